@@ -18,6 +18,7 @@ import (
 
 //go:embed kubernetes-*/pmem-csi-*.yaml
 //go:embed kustomize/webhook/webhook.yaml
+//go:embed kustomize/webhook/validating-webhook.yaml
 //go:embed kustomize/scheduler/scheduler-service.yaml
 //go:embed kustomize/webhook/webhook-service.yaml
 var assets embed.FS
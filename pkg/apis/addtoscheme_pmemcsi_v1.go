@@ -0,0 +1,16 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package apis
+
+import (
+	v1 "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1"
+)
+
+func init() {
+	// Register the types with the Scheme so the components can map objects to GroupVersionKinds and back
+	AddToSchemes = append(AddToSchemes, v1.SchemeBuilder.AddToScheme)
+}
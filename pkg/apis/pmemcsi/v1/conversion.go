@@ -0,0 +1,257 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package v1
+
+import (
+	"fmt"
+
+	"github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+var _ conversion.Convertible = &PmemCSIDeployment{}
+
+// ConvertTo converts to the hub version, v1beta1.
+func (d *PmemCSIDeployment) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.PmemCSIDeployment)
+	if !ok {
+		return fmt.Errorf("unsupported conversion to %T", dstRaw)
+	}
+	dst.ObjectMeta = *d.ObjectMeta.DeepCopy()
+	dst.Spec = ConvertSpecTo(d.Spec)
+	dst.Status = ConvertStatusTo(d.Status)
+	return nil
+}
+
+// ConvertFrom converts from the hub version, v1beta1.
+func (d *PmemCSIDeployment) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.PmemCSIDeployment)
+	if !ok {
+		return fmt.Errorf("unsupported conversion from %T", srcRaw)
+	}
+	d.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	d.Spec = ConvertSpecFrom(src.Spec)
+	d.Status = ConvertStatusFrom(src.Status)
+	return nil
+}
+
+// ConvertSpecTo converts a v1 spec into the corresponding v1beta1 spec.
+func ConvertSpecTo(in DeploymentSpec) v1beta1.DeploymentSpec {
+	in = *in.DeepCopy()
+	out := v1beta1.DeploymentSpec{
+		Image:      in.Image,
+		PullPolicy: in.ImagePullPolicy,
+		LogLevel:   in.LogLevel,
+		LogFormat:  v1beta1.LogFormat(in.LogFormat),
+		DeviceMode: v1beta1.DeviceMode(in.DeviceMode),
+		Labels:     in.Labels,
+		KubeletDir: in.KubeletDir,
+
+		ControllerReplicas:        in.Controller.Replicas,
+		ControllerTLSSecret:       in.Controller.TLSSecret,
+		ControllerDriverResources: in.Controller.Resources,
+		MutatePods:                v1beta1.MutatePods(in.Controller.MutatePods.Mode),
+		MutatePodsResource:        in.Controller.MutatePods.Resource,
+		MutatePodsContainer:       in.Controller.MutatePods.Container,
+		MutatePodsInitContainer:   in.Controller.MutatePods.InitContainer,
+		ValidateVolumes:           v1beta1.ValidateVolumes(in.Controller.ValidateVolumes),
+		SchedulerNodePort:         in.Controller.SchedulerNodePort,
+
+		NodeSelector:           in.Node.NodeSelector,
+		PMEMPercentage:         in.Node.PMEMPercentage,
+		InstanceName:           in.Node.InstanceName,
+		MaxUnavailable:         in.Node.MaxUnavailable,
+		NodeUpgradeStrategy:    v1beta1.NodeUpgradeStrategy(in.Node.UpgradeStrategy),
+		NodeDriverResources:    in.Node.Resources,
+		ProvisionerImage:       in.Node.Provisioner.Image,
+		ProvisionerResources:   in.Node.Provisioner.Resources,
+		NodeRegistrarImage:     in.Node.Registrar.Image,
+		NodeRegistrarResources: in.Node.Registrar.Resources,
+		LivenessProbeImage:     in.Node.LivenessProbe.Image,
+		LivenessProbeResources: in.Node.LivenessProbe.Resources,
+		NodeExtraContainers:    in.Node.ExtraContainers,
+	}
+	for _, pool := range in.Node.Pools {
+		out.NodePools = append(out.NodePools, v1beta1.NodePool{
+			Name:                pool.Name,
+			NodeSelector:        pool.NodeSelector,
+			DeviceMode:          v1beta1.DeviceMode(pool.DeviceMode),
+			PMEMPercentage:      pool.PMEMPercentage,
+			NodeDriverResources: pool.Resources,
+		})
+	}
+	out.PmemSetup = (*v1beta1.PmemSetup)(in.Node.PmemSetup)
+	out.PodTemplateOverrides = v1beta1.PodTemplateOverrides{
+		Controller: (*v1beta1.PodOverrides)(in.PodTemplateOverrides.Controller),
+		Node:       (*v1beta1.PodOverrides)(in.PodTemplateOverrides.Node),
+		NodeSetup:  (*v1beta1.PodOverrides)(in.PodTemplateOverrides.NodeSetup),
+	}
+	return out
+}
+
+// ConvertSpecFrom converts a v1beta1 spec into the corresponding v1 spec.
+func ConvertSpecFrom(in v1beta1.DeploymentSpec) DeploymentSpec {
+	in = *in.DeepCopy()
+	out := DeploymentSpec{
+		Image:           in.Image,
+		ImagePullPolicy: in.PullPolicy,
+		LogLevel:        in.LogLevel,
+		LogFormat:       LogFormat(in.LogFormat),
+		DeviceMode:      DeviceMode(in.DeviceMode),
+		Labels:          in.Labels,
+		KubeletDir:      in.KubeletDir,
+		Controller: ControllerSpec{
+			Replicas:  in.ControllerReplicas,
+			TLSSecret: in.ControllerTLSSecret,
+			Resources: in.ControllerDriverResources,
+			MutatePods: MutatePodsSpec{
+				Mode:          WebhookMode(in.MutatePods),
+				Resource:      in.MutatePodsResource,
+				Container:     in.MutatePodsContainer,
+				InitContainer: in.MutatePodsInitContainer,
+			},
+			ValidateVolumes:   WebhookMode(in.ValidateVolumes),
+			SchedulerNodePort: in.SchedulerNodePort,
+		},
+		Node: NodeSpec{
+			NodeSelector:    in.NodeSelector,
+			PMEMPercentage:  in.PMEMPercentage,
+			InstanceName:    in.InstanceName,
+			MaxUnavailable:  in.MaxUnavailable,
+			UpgradeStrategy: NodeUpgradeStrategy(in.NodeUpgradeStrategy),
+			Resources:       in.NodeDriverResources,
+			Provisioner: SidecarSpec{
+				Image:     in.ProvisionerImage,
+				Resources: in.ProvisionerResources,
+			},
+			Registrar: SidecarSpec{
+				Image:     in.NodeRegistrarImage,
+				Resources: in.NodeRegistrarResources,
+			},
+			LivenessProbe: SidecarSpec{
+				Image:     in.LivenessProbeImage,
+				Resources: in.LivenessProbeResources,
+			},
+			ExtraContainers: in.NodeExtraContainers,
+		},
+	}
+	for _, pool := range in.NodePools {
+		out.Node.Pools = append(out.Node.Pools, NodePool{
+			Name:           pool.Name,
+			NodeSelector:   pool.NodeSelector,
+			DeviceMode:     DeviceMode(pool.DeviceMode),
+			PMEMPercentage: pool.PMEMPercentage,
+			Resources:      pool.NodeDriverResources,
+		})
+	}
+	out.Node.PmemSetup = (*PmemSetup)(in.PmemSetup)
+	out.PodTemplateOverrides = PodTemplateOverrides{
+		Controller: (*PodOverrides)(in.PodTemplateOverrides.Controller),
+		Node:       (*PodOverrides)(in.PodTemplateOverrides.Node),
+		NodeSetup:  (*PodOverrides)(in.PodTemplateOverrides.NodeSetup),
+	}
+	return out
+}
+
+// ConvertStatusTo converts a v1 status into the corresponding v1beta1 status.
+func ConvertStatusTo(in DeploymentStatus) v1beta1.DeploymentStatus {
+	out := v1beta1.DeploymentStatus{
+		Phase:       v1beta1.DeploymentPhase(in.Phase),
+		Reason:      in.Reason,
+		LastUpdated: in.LastUpdated,
+	}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, v1beta1.DeploymentCondition{
+			Type:           v1beta1.DeploymentConditionType(c.Type),
+			Status:         c.Status,
+			Reason:         c.Reason,
+			LastUpdateTime: c.LastUpdateTime,
+		})
+	}
+	for _, c := range in.Components {
+		out.Components = append(out.Components, v1beta1.DriverStatus(c))
+	}
+	for _, n := range in.Nodes {
+		out.Nodes = append(out.Nodes, v1beta1.NodeStatus{
+			NodeName:      n.NodeName,
+			Pool:          n.Pool,
+			DeviceMode:    v1beta1.DeviceMode(n.DeviceMode),
+			PodPhase:      n.PodPhase,
+			Ready:         n.Ready,
+			Capacity:      (*v1beta1.NodeCapacity)(n.Capacity.DeepCopy()),
+			LastHeartbeat: n.LastHeartbeat,
+			Reason:        n.Reason,
+		})
+	}
+	for _, n := range in.PmemSetup {
+		setup := v1beta1.NodeSetupStatus{
+			NodeName: n.NodeName,
+			DryRun:   n.DryRun,
+			Actions:  n.Actions,
+		}
+		for _, c := range n.Conditions {
+			setup.Conditions = append(setup.Conditions, v1beta1.NodeSetupCondition{
+				Type:           v1beta1.NodeSetupConditionType(c.Type),
+				Status:         c.Status,
+				Reason:         c.Reason,
+				LastUpdateTime: c.LastUpdateTime,
+			})
+		}
+		out.PmemSetup = append(out.PmemSetup, setup)
+	}
+	return out
+}
+
+// ConvertStatusFrom converts a v1beta1 status into the corresponding v1 status.
+func ConvertStatusFrom(in v1beta1.DeploymentStatus) DeploymentStatus {
+	out := DeploymentStatus{
+		Phase:       DeploymentPhase(in.Phase),
+		Reason:      in.Reason,
+		LastUpdated: in.LastUpdated,
+	}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, DeploymentCondition{
+			Type:           DeploymentConditionType(c.Type),
+			Status:         c.Status,
+			Reason:         c.Reason,
+			LastUpdateTime: c.LastUpdateTime,
+		})
+	}
+	for _, c := range in.Components {
+		out.Components = append(out.Components, DriverStatus(c))
+	}
+	for _, n := range in.Nodes {
+		out.Nodes = append(out.Nodes, NodeStatus{
+			NodeName:      n.NodeName,
+			Pool:          n.Pool,
+			DeviceMode:    DeviceMode(n.DeviceMode),
+			PodPhase:      n.PodPhase,
+			Ready:         n.Ready,
+			Capacity:      (*NodeCapacity)(n.Capacity.DeepCopy()),
+			LastHeartbeat: n.LastHeartbeat,
+			Reason:        n.Reason,
+		})
+	}
+	for _, n := range in.PmemSetup {
+		setup := NodeSetupStatus{
+			NodeName: n.NodeName,
+			DryRun:   n.DryRun,
+			Actions:  n.Actions,
+		}
+		for _, c := range n.Conditions {
+			setup.Conditions = append(setup.Conditions, NodeSetupCondition{
+				Type:           NodeSetupConditionType(c.Type),
+				Status:         c.Status,
+				Reason:         c.Reason,
+				LastUpdateTime: c.LastUpdateTime,
+			})
+		}
+		out.PmemSetup = append(out.PmemSetup, setup)
+	}
+	return out
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// DeviceMode type decleration for allowed driver device managers
+// +kubebuilder:validation:Enum=lvm;direct
+type DeviceMode string
+
+const (
+	// DeviceModeLVM represents 'lvm' device manager
+	DeviceModeLVM DeviceMode = "lvm"
+	// DeviceModeDirect represents 'direct' device manager
+	DeviceModeDirect DeviceMode = "direct"
+)
+
+// +kubebuilder:validation:Enum=text;json
+type LogFormat string
+
+const (
+	// LogFormatText selects logging via the traditional glog (aka klog) plain text format.
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON selects logging via the zap JSON format.
+	LogFormatJSON LogFormat = "json"
+)
+
+// WebhookMode defines how a webhook gets configured.
+// +kubebuilder:validation:Enum=Always;Try;Never
+type WebhookMode string
+
+const (
+	// WebhookAlways enables the webhook so that a failure is considered fatal.
+	WebhookAlways WebhookMode = "Always"
+	// WebhookTry enables the webhook so that objects can be created even
+	// when the webhook fails.
+	WebhookTry WebhookMode = "Try"
+	// WebhookNever disables the webhook.
+	WebhookNever WebhookMode = "Never"
+)
+
+// NodeUpgradeStrategy defines how changes of the node driver get rolled out.
+// +kubebuilder:validation:Enum=RollingUpdate;Orchestrated
+type NodeUpgradeStrategy string
+
+const (
+	// NodeUpgradeRollingUpdate leaves rolling out changes to the
+	// DaemonSet controller.
+	NodeUpgradeRollingUpdate NodeUpgradeStrategy = "RollingUpdate"
+	// NodeUpgradeOrchestrated lets the operator replace node driver
+	// pods in batches.
+	NodeUpgradeOrchestrated NodeUpgradeStrategy = "Orchestrated"
+)
+
+// +k8s:deepcopy-gen=true
+// DeploymentSpec defines the desired state of Deployment.
+// Unset fields select the same defaults as in v1beta1.
+type DeploymentSpec struct {
+	// Image is the PMEM-CSI driver container image.
+	Image string `json:"image,omitempty"`
+	// ImagePullPolicy is used for all containers, one of Always, Never, IfNotPresent.
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// LogLevel number for the log verbosity
+	LogLevel uint16 `json:"logLevel,omitempty"`
+	// LogFormat of all PMEM-CSI containers.
+	LogFormat LogFormat `json:"logFormat,omitempty"`
+	// DeviceMode to use to manage PMEM devices.
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// Labels contains additional labels for all objects created by the operator.
+	Labels map[string]string `json:"labels,omitempty"`
+	// KubeletDir kubelet's root directory path
+	KubeletDir string `json:"kubeletDir,omitempty"`
+
+	// Controller configures the central controller.
+	Controller ControllerSpec `json:"controller,omitempty"`
+	// Node configures the driver on the nodes.
+	Node NodeSpec `json:"node,omitempty"`
+	// PodTemplateOverrides contains additional pod settings per component.
+	PodTemplateOverrides PodTemplateOverrides `json:"podTemplateOverrides,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// ControllerSpec defines the central controller and its webhooks.
+type ControllerSpec struct {
+	// Replicas determines how many copies of the controller Pod run concurrently.
+	// Zero (= unset) selects the builtin default, which is currently 1.
+	// +kubebuilder:validation:Minimum=0
+	Replicas int `json:"replicas,omitempty"`
+	// TLSSecret is the name of a secret which contains ca.crt, tls.crt and tls.key data
+	// for the scheduler extender and the webhooks. The controller is started if (and only if)
+	// this secret is specified. The special string "-openshift-" enables the usage of
+	// https://docs.openshift.com/container-platform/4.6/security/certificates/service-serving-certificate.html
+	// to create certificates. The special string "-generated-" lets the operator
+	// create and rotate the certificates.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+	// Resources of the driver container.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// MutatePods configures the mutating pod webhook. The default is "Try".
+	MutatePods MutatePodsSpec `json:"mutatePods,omitempty"`
+	// ValidateVolumes configures the validating webhook for storage classes,
+	// PVCs and inline volumes. The default is "Never".
+	ValidateVolumes WebhookMode `json:"validateVolumes,omitempty"`
+	// SchedulerNodePort, if non-zero, ensures that the "scheduler" service
+	// is created as a NodeService with that fixed port number. Otherwise
+	// that service is created as a cluster service.
+	SchedulerNodePort int32 `json:"schedulerNodePort,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// MutatePodsSpec configures the mutating pod webhook.
+type MutatePodsSpec struct {
+	// Mode of the webhook.
+	Mode WebhookMode `json:"mode,omitempty"`
+	// Resource is the extended resource that the webhook adds to
+	// pods. The default is "<driver name>/scheduler".
+	Resource string `json:"resource,omitempty"`
+	// Container is the name of the container which gets the extended
+	// resource. The default is the first container.
+	Container string `json:"container,omitempty"`
+	// InitContainer selects among the init containers of a pod instead of
+	// the normal containers.
+	InitContainer bool `json:"initContainer,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeSpec defines the node driver.
+type NodeSpec struct {
+	// NodeSelector node labels to use for selection of driver node
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// PMEMPercentage represents the percentage of space to be used by the driver in each PMEM region
+	// on every node. Unset (= zero) selects the default of 100%.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// InstanceName gets added to the names of the PMEM namespaces
+	// and volume groups that the driver uses in LVM mode. It must be
+	// set when several deployments run on the same nodes, so that
+	// each of them owns a different part of the PMEM. Empty
+	// selects the traditional names. Changing it later makes
+	// existing volumes unavailable.
+	// +kubebuilder:validation:MaxLength=54
+	InstanceName string `json:"instanceName,omitempty"`
+	// MaxUnavailable limits how many nodes may be without a running
+	// driver during a rolling update, either as integer or percentage.
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// UpgradeStrategy determines how changes of the node driver get
+	// rolled out. The default is "RollingUpdate".
+	UpgradeStrategy NodeUpgradeStrategy `json:"upgradeStrategy,omitempty"`
+	// Resources of the driver container.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Provisioner is the external-provisioner sidecar.
+	Provisioner SidecarSpec `json:"provisioner,omitempty"`
+	// Registrar is the node-driver-registrar sidecar.
+	Registrar SidecarSpec `json:"registrar,omitempty"`
+	// LivenessProbe is the livenessprobe sidecar. It is only added
+	// when an image is set.
+	LivenessProbe SidecarSpec `json:"livenessProbe,omitempty"`
+	// ExtraContainers get added to the node driver pods after the sidecars.
+	ExtraContainers []corev1.Container `json:"extraContainers,omitempty"`
+	// Pools splits the nodes into groups which get different
+	// settings for the node driver.
+	Pools []NodePool `json:"pools,omitempty"`
+	// PmemSetup enables preparing PMEM on nodes before the node
+	// driver runs on them.
+	PmemSetup *PmemSetup `json:"pmemSetup,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PmemSetup describes how PMEM gets prepared for LVM mode on nodes.
+type PmemSetup struct {
+	// NodeSelector selects the nodes which get prepared. The default
+	// are nodes with the "<driver name>/convert-raw-namespaces=force" label.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// ConvertRawNamespaces converts all raw namespaces into fsdax
+	// namespaces for LVM. This destroys the data stored in them!
+	ConvertRawNamespaces bool `json:"convertRawNamespaces,omitempty"`
+	// CreateNamespaces creates fsdax namespaces for LVM in the
+	// free space of each region.
+	CreateNamespaces bool `json:"createNamespaces,omitempty"`
+	// ReservePercentage is the percentage of each region that
+	// CreateNamespaces leaves unused.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	ReservePercentage uint16 `json:"reservePercentage,omitempty"`
+	// DryRun only determines what would be done and reports that in
+	// the status without modifying the nodes.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// SidecarSpec defines one of the sidecar containers.
+type SidecarSpec struct {
+	// Image of the sidecar. The default depends on the Kubernetes version.
+	Image string `json:"image,omitempty"`
+	// Resources of the sidecar container.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PodTemplateOverrides contains additional settings for the pods of
+// the different components.
+type PodTemplateOverrides struct {
+	// Controller applies to the pods of the central controller.
+	Controller *PodOverrides `json:"controller,omitempty"`
+	// Node applies to the pods of the node driver, including
+	// those of node pools and those which remove volumes during a
+	// forced deletion.
+	Node *PodOverrides `json:"node,omitempty"`
+	// NodeSetup applies to the pods which prepare PMEM on nodes.
+	NodeSetup *PodOverrides `json:"nodeSetup,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PodOverrides get merged into a generated pod template with a
+// strategic merge patch: annotations and the security context get
+// merged, lists without merge key like tolerations replace the
+// default ones.
+type PodOverrides struct {
+	// Annotations get added to the pods.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Tolerations replace the default tolerations of the pods.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity of the pods.
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// PriorityClassName replaces the default priority class.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// TopologySpreadConstraints of the pods.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// SecurityContext of the pods.
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+	// Env gets added to all containers of the pods.
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodePool defines settings for the node driver that apply only to
+// nodes in the pool. Unset fields are inherited from the NodeSpec.
+type NodePool struct {
+	// Name is used for the DaemonSet of the pool and must be unique
+	// among all pools of the deployment.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+	// NodeSelector contains node labels which get added to the NodeSelector
+	// of the NodeSpec to select the nodes of the pool.
+	// +kubebuilder:validation:MinProperties=1
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// DeviceMode to use on nodes in the pool.
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PMEMPercentage to use on nodes in the pool.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// Resources of the driver container on nodes in the pool.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// DeploymentConditionType type for representing a deployment status condition
+type DeploymentConditionType string
+
+const (
+	// DriverDeployed means that the all the sub-resources required for the deployment CR
+	// got created
+	DriverDeployed DeploymentConditionType = "DriverDeployed"
+	// NodeDriverUpgraded means that all node driver pods run the
+	// current version of the node driver.
+	NodeDriverUpgraded DeploymentConditionType = "NodeDriverUpgraded"
+	// ConflictDetected is true when the deployment conflicts with
+	// some other deployment, for example because both use the same
+	// PMEM on a node. The reason lists the conflicts. Only set after
+	// a conflict was found once.
+	ConflictDetected DeploymentConditionType = "ConflictDetected"
+)
+
+// +k8s:deepcopy-gen=true
+type DeploymentCondition struct {
+	// Type of condition.
+	Type DeploymentConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// Message human readable text that explain why this condition is in this state
+	Reason string `json:"reason,omitempty"`
+	// Last time the condition was probed.
+	// +nullable
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+type DriverStatus struct {
+	// DriverComponent represents type of the driver: controller or node
+	DriverComponent string `json:"component"`
+	// Status represents the state of the component; one of `Ready` or `NotReady`.
+	Status string `json:"status"`
+	// Reason represents the human readable text that explains why the
+	// driver is in this state.
+	Reason string `json:"reason"`
+	// LastUpdated time of the driver status
+	// +nullable
+	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// DeploymentPhase represents the status phase of a driver deployment
+type DeploymentPhase string
+
+const (
+	// DeploymentPhaseNew indicates a new deployment
+	DeploymentPhaseNew DeploymentPhase = ""
+	// DeploymentPhaseRunning indicates that the deployment was successful
+	DeploymentPhaseRunning DeploymentPhase = "Running"
+	// DeploymentPhaseFailed indicates that the deployment was failed
+	DeploymentPhaseFailed DeploymentPhase = "Failed"
+	// DeploymentPhaseUpgrading indicates that the operator is replacing
+	// node driver pods.
+	DeploymentPhaseUpgrading DeploymentPhase = "Upgrading"
+	// DeploymentPhaseDeleting indicates that the deployment is
+	// waiting for persistent volumes or for the node cleanup before
+	// it can be removed.
+	DeploymentPhaseDeleting DeploymentPhase = "Deleting"
+)
+
+// +k8s:deepcopy-gen=true
+// NodeStatus summarizes the state of the driver on one node.
+type NodeStatus struct {
+	// NodeName is the name of the node.
+	NodeName string `json:"nodeName"`
+	// Pool is the node pool that the node belongs to, empty if the
+	// deployment has no pools.
+	Pool string `json:"pool,omitempty"`
+	// DeviceMode used by the driver on the node.
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PodPhase of the node driver pod.
+	PodPhase corev1.PodPhase `json:"podPhase,omitempty"`
+	// Ready is true if all containers of the node driver pod are ready.
+	Ready bool `json:"ready"`
+	// Capacity as reported by the driver. Not set as long as the
+	// driver could not be reached.
+	Capacity *NodeCapacity `json:"capacity,omitempty"`
+	// LastHeartbeat is the last time when the driver reported its capacity.
+	// +nullable
+	LastHeartbeat metav1.Time `json:"lastHeartbeat,omitempty"`
+	// Reason explains why the driver is not ready or could not be reached.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NodeSetupConditionType is the type of a condition in a NodeSetupStatus.
+type NodeSetupConditionType string
+
+const (
+	// RawNamespacesConverted means that no raw namespaces are left.
+	RawNamespacesConverted NodeSetupConditionType = "RawNamespacesConverted"
+	// NamespacesCreated means that namespaces for LVM exist in all regions.
+	NamespacesCreated NodeSetupConditionType = "NamespacesCreated"
+)
+
+// +k8s:deepcopy-gen=true
+// NodeSetupCondition reports the outcome of one PMEM setup step on a node.
+type NodeSetupCondition struct {
+	// Type of condition.
+	Type NodeSetupConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// Reason explains why the condition is in this state.
+	Reason string `json:"reason,omitempty"`
+	// Last time the condition was probed.
+	// +nullable
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeSetupStatus is the result of PMEM setup on one node.
+type NodeSetupStatus struct {
+	// NodeName is the name of the node.
+	NodeName string `json:"nodeName,omitempty"`
+	// DryRun is true if nothing was modified.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Actions lists the modifications that were done or, in a dry
+	// run, would be done.
+	Actions []string `json:"actions,omitempty"`
+	// Conditions contains one entry per setup step.
+	Conditions []NodeSetupCondition `json:"conditions,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeCapacity contains the PMEM usage on a node.
+type NodeCapacity struct {
+	// Managed is the amount of PMEM that is managed by the driver.
+	Managed resource.Quantity `json:"managed"`
+	// Available is the amount of PMEM that can be used for new volumes.
+	Available resource.Quantity `json:"available"`
+	// MaxVolumeSize is the size of the largest volume that can be created.
+	MaxVolumeSize resource.Quantity `json:"maxVolumeSize"`
+	// Volumes is the number of volumes on the node.
+	Volumes int64 `json:"volumes"`
+}
+
+// +k8s:deepcopy-gen=true
+
+// DeploymentStatus defines the observed state of Deployment
+type DeploymentStatus struct {
+	// Phase indicates the state of the deployment
+	Phase  DeploymentPhase `json:"phase,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+	// Conditions
+	Conditions []DeploymentCondition `json:"conditions,omitempty"`
+	Components []DriverStatus        `json:"driverComponents,omitempty"`
+	// Nodes contains one entry per node driver pod, sorted by node name.
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+	// PmemSetup contains one entry per node which was selected for
+	// PMEM setup, sorted by node name.
+	PmemSetup []NodeSetupStatus `json:"pmemSetup,omitempty"`
+	// LastUpdated time of the deployment status
+	// +nullable
+	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PmemCSIDeployment is the Schema for the deployments API
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=pmemcsideployments,scope=Cluster,shortName=pcd,singular=pmemcsideployment
+// +kubebuilder:printcolumn:name="DeviceMode",type=string,JSONPath=`.spec.deviceMode`
+// +kubebuilder:printcolumn:name="NodeSelector",type=string,JSONPath=`.spec.node.nodeSelector`
+// +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PmemCSIDeployment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DeploymentSpec   `json:"spec,omitempty"`
+	Status DeploymentStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PmemCSIDeploymentList contains a list of PmemCSIDeployment objects
+type PmemCSIDeploymentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PmemCSIDeployment `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PmemCSIDeployment{}, &PmemCSIDeploymentList{})
+}
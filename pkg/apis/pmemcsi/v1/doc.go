@@ -0,0 +1,11 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package v1 contains API Schema definitions for the pmem-csi v1 API group.
+// Objects get stored as v1beta1. The operator converts between the two
+// versions with a conversion webhook.
+// +groupName=pmem-csi.intel.com
+package v1
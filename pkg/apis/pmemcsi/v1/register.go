@@ -0,0 +1,22 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// NOTE: Boilerplate only.  Ignore this file.
+
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// SchemeGroupVersion is group version used to register these objects
+	SchemeGroupVersion = schema.GroupVersion{Group: "pmem-csi.intel.com", Version: "v1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: SchemeGroupVersion}
+)
@@ -0,0 +1,12 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package v1beta1
+
+// Hub marks v1beta1 as the version that other versions get converted
+// to and from. It is also the version that gets stored and that the
+// operator works with.
+func (*PmemCSIDeployment) Hub() {}
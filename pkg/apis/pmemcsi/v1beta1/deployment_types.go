@@ -15,6 +15,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // DeviceMode type decleration for allowed driver device managers
@@ -74,12 +75,47 @@ const (
 	MutatePodsNever MutatePods = "Never"
 )
 
+type ValidateVolumes string
+
+const (
+	// ValidateVolumesAlways enables the validating webhook so that a failure is considered fatal.
+	ValidateVolumesAlways ValidateVolumes = "Always"
+
+	// ValidateVolumesTry enables the validating webhook so that objects can be created even
+	// when the webhook fails.
+	ValidateVolumesTry ValidateVolumes = "Try"
+
+	// ValidateVolumesNever disables the validating webhook.
+	ValidateVolumesNever ValidateVolumes = "Never"
+)
+
+// NodeUpgradeStrategy defines how changes of the node driver get rolled out.
+// +kubebuilder:validation:Enum=RollingUpdate;Orchestrated
+type NodeUpgradeStrategy string
+
+const (
+	// NodeUpgradeRollingUpdate leaves rolling out changes to the
+	// DaemonSet controller.
+	NodeUpgradeRollingUpdate NodeUpgradeStrategy = "RollingUpdate"
+
+	// NodeUpgradeOrchestrated lets the operator replace node driver
+	// pods in batches. The next batch is only started once the
+	// new pods are ready and the driver is registered again on
+	// their nodes.
+	NodeUpgradeOrchestrated NodeUpgradeStrategy = "Orchestrated"
+)
+
 const (
 	// ControllerTLSSecretOpenshift is a special string which
 	// enables the usage of
 	// https://docs.openshift.com/container-platform/4.6/security/certificates/service-serving-certificate.html
 	// to create certificates.
 	ControllerTLSSecretOpenshift = "-openshift-"
+
+	// ControllerTLSSecretGenerated is a special string which lets
+	// the operator generate a CA and the serving certificate for
+	// the controller. Both get renewed before they expire.
+	ControllerTLSSecretGenerated = "-generated-"
 )
 
 // +k8s:deepcopy-gen=true
@@ -99,6 +135,16 @@ type DeploymentSpec struct {
 	ProvisionerResources *corev1.ResourceRequirements `json:"provisionerResources,omitempty"`
 	// NodeRegistrarResources Compute resources required by node registrar sidecar container
 	NodeRegistrarResources *corev1.ResourceRequirements `json:"nodeRegistrarResources,omitempty"`
+	// LivenessProbeImage CSI livenessprobe sidecar image. The node driver already has
+	// its own liveness probe, therefore this sidecar is only added when an image is set.
+	// Kubelet then also checks the driver through the CSI Probe call.
+	LivenessProbeImage string `json:"livenessProbeImage,omitempty"`
+	// LivenessProbeResources Compute resources required by livenessprobe sidecar container
+	LivenessProbeResources *corev1.ResourceRequirements `json:"livenessProbeResources,omitempty"`
+	// NodeExtraContainers get added to the node driver pods after the
+	// sidecars. They can mount the volumes of the pod, for example
+	// "socket-dir" for the CSI socket in "/csi".
+	NodeExtraContainers []corev1.Container `json:"nodeExtraContainers,omitempty"`
 	// NodeDriverResources Compute resources required by driver container running on worker nodes
 	NodeDriverResources *corev1.ResourceRequirements `json:"nodeDriverResources,omitempty"`
 	// ControllerDriverResources Compute resources required by central driver container
@@ -107,7 +153,8 @@ type DeploymentSpec struct {
 	// for the scheduler extender and pod mutation webhook. A controller is started if (and only if)
 	// this secret is specified. The special string "-openshift-" enables the usage of
 	// https://docs.openshift.com/container-platform/4.6/security/certificates/service-serving-certificate.html
-	// to create certificates.
+	// to create certificates. The special string "-generated-" lets the operator
+	// create and rotate the certificates.
 	ControllerTLSSecret string `json:"controllerTLSSecret,omitempty"`
 	// ControllerReplicas determines how many copys of the controller Pod run concurrently.
 	// Zero (= unset) selects the builtin default, which is currently 1.
@@ -118,6 +165,22 @@ type DeploymentSpec struct {
 	// The default is "Try".
 	// +kubebuilder:validation:Enum=Always;Try;Never
 	MutatePods MutatePods `json:"mutatePods,omitempty"`
+	// MutatePodsResource is the extended resource that the mutating pod webhook
+	// adds to pods. The default is "<driver name>/scheduler".
+	MutatePodsResource string `json:"mutatePodsResource,omitempty"`
+	// MutatePodsContainer is the name of the container which gets the extended
+	// resource. The default is the first container.
+	MutatePodsContainer string `json:"mutatePodsContainer,omitempty"`
+	// MutatePodsInitContainer selects among the init containers of a pod instead of
+	// the normal containers. Pods without init containers are handled as if this
+	// was not set.
+	MutatePodsInitContainer bool `json:"mutatePodsInitContainer,omitempty"`
+	// ValidateVolumes enables the validating webhook which checks the
+	// PMEM-CSI parameters in storage classes, inline volumes of pods and
+	// PVCs when they get created or updated. Like MutatePods, it
+	// depends on ControllerTLSSecret. The default is "Never".
+	// +kubebuilder:validation:Enum=Always;Try;Never
+	ValidateVolumes ValidateVolumes `json:"validateVolumes,omitempty"`
 	// SchedulerNodePort, if non-zero, ensures that the "scheduler" service
 	// is created as a NodeService with that fixed port number. Otherwise
 	// that service is created as a cluster service. The number must be
@@ -142,6 +205,14 @@ type DeploymentSpec struct {
 	// +kubebuilder:validation:Minimum=0
 	// +kubebuilder:validation:Maximum=100
 	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// InstanceName gets added to the names of the PMEM namespaces
+	// and volume groups that the driver uses in LVM mode. It must be
+	// set when several deployments run on the same nodes, so that
+	// each of them owns a different part of the PMEM. Empty
+	// selects the traditional names. Changing it later makes
+	// existing volumes unavailable.
+	// +kubebuilder:validation:MaxLength=54
+	InstanceName string `json:"instanceName,omitempty"`
 	// Labels contains additional labels for all objects created by the operator.
 	Labels map[string]string `json:"labels,omitempty"`
 	// KubeletDir kubelet's root directory path
@@ -150,6 +221,106 @@ type DeploymentSpec struct {
 	// not having a running driver pod. That limit can be increased with
 	// this setting, either with a higher integer or a percentage.
 	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// NodeUpgradeStrategy determines how changes of the node driver get
+	// rolled out. The default is "RollingUpdate". With "Orchestrated",
+	// MaxUnavailable is the size of the batches.
+	NodeUpgradeStrategy NodeUpgradeStrategy `json:"nodeUpgradeStrategy,omitempty"`
+	// NodePools splits the nodes into groups which get different
+	// settings for the node driver. Each pool gets its own DaemonSet.
+	// Pools must not overlap. When pools are defined, the node driver
+	// runs only on nodes which belong to one of the pools.
+	NodePools []NodePool `json:"nodePools,omitempty"`
+	// PmemSetup enables preparing PMEM on nodes before the node
+	// driver runs on them.
+	PmemSetup *PmemSetup `json:"pmemSetup,omitempty"`
+	// PodTemplateOverrides contains additional pod settings per component.
+	PodTemplateOverrides PodTemplateOverrides `json:"podTemplateOverrides,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PmemSetup describes how PMEM gets prepared for LVM mode on nodes.
+// Each selected node gets processed once. Afterwards the node gets
+// the "<driver name>/pmem-setup=done" label and the labels from the
+// NodeSelector of the deployment, so that the node driver starts
+// on it.
+type PmemSetup struct {
+	// NodeSelector selects the nodes which get prepared. The default
+	// are nodes with the "<driver name>/convert-raw-namespaces=force" label.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// ConvertRawNamespaces converts all raw namespaces into fsdax
+	// namespaces for LVM. This destroys the data stored in them!
+	ConvertRawNamespaces bool `json:"convertRawNamespaces,omitempty"`
+	// CreateNamespaces creates fsdax namespaces for LVM in the
+	// free space of each region.
+	CreateNamespaces bool `json:"createNamespaces,omitempty"`
+	// ReservePercentage is the percentage of each region that
+	// CreateNamespaces leaves unused.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	ReservePercentage uint16 `json:"reservePercentage,omitempty"`
+	// DryRun only determines what would be done and reports that in
+	// the status without modifying the nodes.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PodTemplateOverrides contains additional settings for the pods of
+// the different components.
+type PodTemplateOverrides struct {
+	// Controller applies to the pods of the central controller.
+	Controller *PodOverrides `json:"controller,omitempty"`
+	// Node applies to the pods of the node driver, including
+	// those of node pools and those which remove volumes during a
+	// forced deletion.
+	Node *PodOverrides `json:"node,omitempty"`
+	// NodeSetup applies to the pods which prepare PMEM on nodes.
+	NodeSetup *PodOverrides `json:"nodeSetup,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PodOverrides get merged into a generated pod template with a
+// strategic merge patch: annotations and the security context get
+// merged, lists without merge key like tolerations replace the
+// default ones.
+type PodOverrides struct {
+	// Annotations get added to the pods.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Tolerations replace the default tolerations of the pods.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity of the pods.
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// PriorityClassName replaces the default priority class.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// TopologySpreadConstraints of the pods.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// SecurityContext of the pods.
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+	// Env gets added to all containers of the pods.
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodePool defines settings for the node driver that apply only to
+// nodes in the pool. Unset fields are inherited from the DeploymentSpec.
+type NodePool struct {
+	// Name is used for the DaemonSet of the pool and must be unique
+	// among all pools of the deployment.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+	// NodeSelector contains node labels which get added to the NodeSelector
+	// of the deployment to select the nodes of the pool.
+	// +kubebuilder:validation:MinProperties=1
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// DeviceMode to use on nodes in the pool.
+	// +kubebuilder:validation:Enum=lvm;direct
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PMEMPercentage to use on nodes in the pool.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// NodeDriverResources Compute resources required by driver container running on nodes in the pool
+	NodeDriverResources *corev1.ResourceRequirements `json:"nodeDriverResources,omitempty"`
 }
 
 // DeploymentConditionType type for representing a deployment status condition
@@ -159,6 +330,15 @@ const (
 	// DriverDeployed means that the all the sub-resources required for the deployment CR
 	// got created
 	DriverDeployed DeploymentConditionType = "DriverDeployed"
+	// NodeDriverUpgraded means that all node driver pods run the
+	// current version of the node driver. Only used with the
+	// "Orchestrated" node upgrade strategy.
+	NodeDriverUpgraded DeploymentConditionType = "NodeDriverUpgraded"
+	// ConflictDetected is true when the deployment conflicts with
+	// some other deployment, for example because both use the same
+	// PMEM on a node. The reason lists the conflicts. Only set after
+	// a conflict was found once.
+	ConflictDetected DeploymentConditionType = "ConflictDetected"
 )
 
 // +k8s:deepcopy-gen=true
@@ -207,6 +387,86 @@ type DriverStatus struct {
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
 }
 
+// +k8s:deepcopy-gen=true
+// NodeStatus summarizes the state of the driver on one node.
+type NodeStatus struct {
+	// NodeName is the name of the node.
+	NodeName string `json:"nodeName"`
+	// Pool is the node pool that the node belongs to, empty if the
+	// deployment has no pools.
+	Pool string `json:"pool,omitempty"`
+	// DeviceMode used by the driver on the node.
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PodPhase of the node driver pod.
+	PodPhase corev1.PodPhase `json:"podPhase,omitempty"`
+	// Ready is true if all containers of the node driver pod are ready.
+	Ready bool `json:"ready"`
+	// Capacity as reported by the driver. Not set as long as the
+	// driver could not be reached.
+	Capacity *NodeCapacity `json:"capacity,omitempty"`
+	// LastHeartbeat is the last time when the driver reported its capacity.
+	// +nullable
+	LastHeartbeat metav1.Time `json:"lastHeartbeat,omitempty"`
+	// Reason explains why the driver is not ready or could not be reached.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NodeSetupConditionType is the type of a condition in a NodeSetupStatus.
+type NodeSetupConditionType string
+
+const (
+	// RawNamespacesConverted means that no raw namespaces are left.
+	RawNamespacesConverted NodeSetupConditionType = "RawNamespacesConverted"
+	// NamespacesCreated means that namespaces for LVM exist in all regions.
+	NamespacesCreated NodeSetupConditionType = "NamespacesCreated"
+)
+
+// +k8s:deepcopy-gen=true
+// NodeSetupCondition reports the outcome of one PMEM setup step on a node.
+type NodeSetupCondition struct {
+	// Type of condition.
+	Type NodeSetupConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown. Unknown
+	// is used in a dry run.
+	Status corev1.ConditionStatus `json:"status"`
+	// Reason explains why the condition is in this state.
+	Reason string `json:"reason,omitempty"`
+	// Last time the condition was probed.
+	// +nullable
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeSetupStatus is the result of PMEM setup on one node. It gets
+// stored by the setup pod in the "<driver name>/pmem-setup"
+// annotation of the node and copied into the deployment status by
+// the operator.
+type NodeSetupStatus struct {
+	// NodeName is the name of the node.
+	NodeName string `json:"nodeName,omitempty"`
+	// DryRun is true if nothing was modified.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Actions lists the modifications that were done or, in a dry
+	// run, would be done. Modifications which destroy data are
+	// marked as such.
+	Actions []string `json:"actions,omitempty"`
+	// Conditions contains one entry per setup step.
+	Conditions []NodeSetupCondition `json:"conditions,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeCapacity contains the PMEM usage on a node.
+type NodeCapacity struct {
+	// Managed is the amount of PMEM that is managed by the driver.
+	Managed resource.Quantity `json:"managed"`
+	// Available is the amount of PMEM that can be used for new volumes.
+	Available resource.Quantity `json:"available"`
+	// MaxVolumeSize is the size of the largest volume that can be created.
+	MaxVolumeSize resource.Quantity `json:"maxVolumeSize"`
+	// Volumes is the number of volumes on the node.
+	Volumes int64 `json:"volumes"`
+}
+
 // +k8s:deepcopy-gen=true
 
 // DeploymentStatus defines the observed state of Deployment
@@ -220,6 +480,11 @@ type DeploymentStatus struct {
 	// Conditions
 	Conditions []DeploymentCondition `json:"conditions,omitempty"`
 	Components []DriverStatus        `json:"driverComponents,omitempty"`
+	// Nodes contains one entry per node driver pod, sorted by node name.
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+	// PmemSetup contains one entry per node which was selected for
+	// PMEM setup, sorted by node name.
+	PmemSetup []NodeSetupStatus `json:"pmemSetup,omitempty"`
 	// LastUpdated time of the deployment status
 	// +nullable
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
@@ -264,6 +529,9 @@ const (
 	EventReasonRunning = "Running"
 	// EventReasonFailed driver deployment failed, Event.Message holds detailed information
 	EventReasonFailed = "Failed"
+	// EventReasonDeletionBlocked deleting the deployment has to wait
+	// for persistent volumes of the driver, Event.Message lists them
+	EventReasonDeletionBlocked = "DeletionBlocked"
 )
 
 const (
@@ -279,6 +547,10 @@ const (
 
 	DefaultMutatePods = MutatePodsTry
 
+	DefaultValidateVolumes = ValidateVolumesNever
+
+	DefaultNodeUpgradeStrategy = NodeUpgradeRollingUpdate
+
 	// The sidecar versions must be kept in sync with the
 	// deploy/kustomize YAML files! hack/bump-image-versions.sh
 	// can be used to update both.
@@ -312,12 +584,40 @@ const (
 	// DefaultProvisionerRequestMemory default memory resource request used for node registrar container
 	DefaultProvisionerRequestMemory = "128Mi"
 
+	// DefaultLivenessProbeRequestCPU default CPU resource request used for livenessprobe container
+	DefaultLivenessProbeRequestCPU = "12m"
+	// DefaultLivenessProbeRequestMemory default memory resource request used for livenessprobe container
+	DefaultLivenessProbeRequestMemory = "128Mi"
+
 	// DefaultDeviceMode default device manger used for deployment
 	DefaultDeviceMode = DeviceModeLVM
 	// DefaultPMEMPercentage PMEM space to reserve for the driver
 	DefaultPMEMPercentage = 100
 	// DefaultKubeletDir default kubelet's path
 	DefaultKubeletDir = "/var/lib/kubelet"
+
+	// NodePoolLabel is added to the pods of a node pool DaemonSet,
+	// with the name of the pool as value.
+	NodePoolLabel = "pmem-csi.intel.com/node-pool"
+
+	// PmemSetupKey is used with the driver name as prefix for the
+	// node label and annotation which are set by PMEM setup.
+	PmemSetupKey = "pmem-setup"
+	// PmemSetupDone is the value of the PMEM setup node label
+	// after a successful setup.
+	PmemSetupDone = "done"
+
+	// DeploymentFinalizer prevents removal of a deployment while
+	// persistent volumes provisioned by the driver still exist.
+	DeploymentFinalizer = "pmem-csi.intel.com/volumes"
+	// ForceDeleteAnnotation with value "true" on a deployment allows
+	// deleting it despite existing volumes. All volumes on the nodes
+	// get removed before the driver itself.
+	ForceDeleteAnnotation = "pmem-csi.intel.com/force-delete"
+	// CleanupKey is used with the driver name as prefix for the node
+	// annotation which is set after removing all volumes of the
+	// driver during a forced deletion.
+	CleanupKey = "cleanup"
 )
 
 var (
@@ -335,6 +635,13 @@ const (
 	DeploymentPhaseRunning DeploymentPhase = "Running"
 	// DeploymentPhaseFailed indicates that the deployment was failed
 	DeploymentPhaseFailed DeploymentPhase = "Failed"
+	// DeploymentPhaseUpgrading indicates that the operator is replacing
+	// node driver pods.
+	DeploymentPhaseUpgrading DeploymentPhase = "Upgrading"
+	// DeploymentPhaseDeleting indicates that the deployment is
+	// waiting for persistent volumes or for the node cleanup before
+	// it can be removed.
+	DeploymentPhaseDeleting DeploymentPhase = "Deleting"
 )
 
 // A TLS secret must contain three data items.
@@ -345,10 +652,14 @@ const (
 	TLSSecretKey = "tls.key"
 	// TLSSecretCert is the public key to used by the server.
 	TLSSecretCert = "tls.crt"
+	// TLSSecretCAKey is the secret key of the CA. Only a secret
+	// generated by the operator contains it.
+	TLSSecretCAKey = "ca.key"
 )
 
 func (d *PmemCSIDeployment) SetCondition(t DeploymentConditionType, state corev1.ConditionStatus, reason string) {
-	for _, c := range d.Status.Conditions {
+	for i := range d.Status.Conditions {
+		c := &d.Status.Conditions[i]
 		if c.Type == t {
 			c.Status = state
 			c.Reason = reason
@@ -397,6 +708,22 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 		return fmt.Errorf("invalid MutatePods value: %s", d.Spec.MutatePods)
 	}
 
+	switch d.Spec.ValidateVolumes {
+	case "":
+		d.Spec.ValidateVolumes = DefaultValidateVolumes
+	case ValidateVolumesAlways, ValidateVolumesTry, ValidateVolumesNever:
+	default:
+		return fmt.Errorf("invalid ValidateVolumes value: %s", d.Spec.ValidateVolumes)
+	}
+
+	switch d.Spec.NodeUpgradeStrategy {
+	case "":
+		d.Spec.NodeUpgradeStrategy = DefaultNodeUpgradeStrategy
+	case NodeUpgradeRollingUpdate, NodeUpgradeOrchestrated:
+	default:
+		return fmt.Errorf("invalid NodeUpgradeStrategy value: %s", d.Spec.NodeUpgradeStrategy)
+	}
+
 	if d.Spec.Image == "" {
 		// If provided use operatorImage
 		if operatorImage != "" {
@@ -471,9 +798,123 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 		}
 	}
 
+	if d.Spec.LivenessProbeResources == nil {
+		d.Spec.LivenessProbeResources = &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(DefaultLivenessProbeRequestCPU),
+				corev1.ResourceMemory: resource.MustParse(DefaultLivenessProbeRequestMemory),
+			},
+		}
+	}
+
+	if d.Spec.PmemSetup != nil && d.Spec.PmemSetup.ReservePercentage > 100 {
+		return fmt.Errorf("invalid PMEM setup reserve percentage %d", d.Spec.PmemSetup.ReservePercentage)
+	}
+
+	if err := ValidateInstanceName(d.Spec.InstanceName); err != nil {
+		return err
+	}
+
+	return d.validateNodePools()
+}
+
+// validateNodePools checks that the node pools have valid, unique names
+// and that no node can be in more than one pool. Two pools are disjoint
+// if (and only if) their node selectors have a common label with
+// different values.
+func (d *PmemCSIDeployment) validateNodePools() error {
+	names := map[string]bool{}
+	for i, pool := range d.Spec.NodePools {
+		if errs := validation.IsDNS1123Label(pool.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid name %q for node pool #%d: %s", pool.Name, i, strings.Join(errs, ", "))
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate node pool name %q", pool.Name)
+		}
+		names[pool.Name] = true
+		switch pool.DeviceMode {
+		case "", DeviceModeDirect, DeviceModeLVM:
+		default:
+			return fmt.Errorf("invalid device mode %q for node pool %q", pool.DeviceMode, pool.Name)
+		}
+		if pool.PMEMPercentage > 100 {
+			return fmt.Errorf("invalid PMEM percentage %d for node pool %q", pool.PMEMPercentage, pool.Name)
+		}
+		if len(pool.NodeSelector) == 0 {
+			return fmt.Errorf("node pool %q has no node selector", pool.Name)
+		}
+	}
+	for i := range d.Spec.NodePools {
+		for e := i + 1; e < len(d.Spec.NodePools); e++ {
+			a, b := d.NodePoolSpec(d.Spec.NodePools[i]), d.NodePoolSpec(d.Spec.NodePools[e])
+			if SelectorsOverlap(a.NodeSelector, b.NodeSelector) {
+				return fmt.Errorf("node pools %q and %q overlap", a.Name, b.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// MaxInstanceNameLength is the maximum length of an instance name.
+// It gets added to "pmem-csi-" to form namespace names, which can
+// have at most 63 characters.
+const MaxInstanceNameLength = 54
+
+// ValidateInstanceName checks that the name can be used for the
+// names of namespaces and volume groups. Empty is valid.
+func ValidateInstanceName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("invalid instance name %q: %s", name, strings.Join(errs, ", "))
+	}
+	if len(name) > MaxInstanceNameLength {
+		return fmt.Errorf("invalid instance name %q: must be no more than %d characters", name, MaxInstanceNameLength)
+	}
 	return nil
 }
 
+// SelectorsOverlap returns true if some node could match both node
+// selectors. They are disjoint if (and only if) they have a common
+// label with different values.
+func SelectorsOverlap(a, b map[string]string) bool {
+	return !disjoint(a, b)
+}
+
+func disjoint(a, b map[string]string) bool {
+	for key, value := range a {
+		if other, ok := b[key]; ok && other != value {
+			return true
+		}
+	}
+	return false
+}
+
+// NodePoolSpec returns a copy of the pool where all unset fields are
+// filled in from the deployment spec. The node selector of the result
+// is the combination of both node selectors.
+func (d *PmemCSIDeployment) NodePoolSpec(pool NodePool) NodePool {
+	result := *pool.DeepCopy()
+	result.NodeSelector = map[string]string{}
+	for key, value := range d.Spec.NodeSelector {
+		result.NodeSelector[key] = value
+	}
+	for key, value := range pool.NodeSelector {
+		result.NodeSelector[key] = value
+	}
+	if result.DeviceMode == "" {
+		result.DeviceMode = d.Spec.DeviceMode
+	}
+	if result.PMEMPercentage == 0 {
+		result.PMEMPercentage = d.Spec.PMEMPercentage
+	}
+	if result.NodeDriverResources == nil {
+		result.NodeDriverResources = d.Spec.NodeDriverResources.DeepCopy()
+	}
+	return result
+}
+
 // GetHyphenedName returns the name of the deployment with dots replaced by hyphens.
 // Most objects created for the deployment will use hyphens in the name, sometimes
 // with an additional suffix like -controller, but others must use the original
@@ -488,6 +929,33 @@ func (d *PmemCSIDeployment) ControllerTLSSecretOpenshiftName() string {
 	return d.GetHyphenedName() + "-openshift-controller-tls"
 }
 
+// ControllerTLSSecretGeneratedName returns the name of the secret
+// that the operator generates for the controller.
+func (d *PmemCSIDeployment) ControllerTLSSecretGeneratedName() string {
+	return d.GetHyphenedName() + "-generated-controller-tls"
+}
+
+// NodeTLSSecretGeneratedName returns the name of the secret with the
+// client certificate that the operator generates for the node
+// drivers.
+func (d *PmemCSIDeployment) NodeTLSSecretGeneratedName() string {
+	return d.GetHyphenedName() + "-generated-node-tls"
+}
+
+// ControllerTLSSecretName returns the name of the secret that gets
+// mounted into the controller pod, which is not the same as
+// ControllerTLSSecret for the special values.
+func (d *PmemCSIDeployment) ControllerTLSSecretName() string {
+	switch d.Spec.ControllerTLSSecret {
+	case ControllerTLSSecretOpenshift:
+		return d.ControllerTLSSecretOpenshiftName()
+	case ControllerTLSSecretGenerated:
+		return d.ControllerTLSSecretGeneratedName()
+	default:
+		return d.Spec.ControllerTLSSecret
+	}
+}
+
 // RegistrySecretName returns the name of the registry
 // Secret object used by the deployment
 func (d *PmemCSIDeployment) RegistrySecretName() string {
@@ -560,6 +1028,12 @@ func (d *PmemCSIDeployment) MutatingWebhookName() string {
 	return d.GetHyphenedName() + "-hook"
 }
 
+// ValidatingWebhookName returns the name of the
+// ValidatingWebhookConfiguration
+func (d *PmemCSIDeployment) ValidatingWebhookName() string {
+	return d.GetHyphenedName() + "-validate-hook"
+}
+
 // NodeServiceAccountName returns the name of the service account
 // used by the DaemonSet with the external-provisioner
 func (d *PmemCSIDeployment) ProvisionerServiceAccountName() string {
@@ -602,6 +1076,12 @@ func (d *PmemCSIDeployment) NodeDriverName() string {
 	return d.GetHyphenedName() + "-node"
 }
 
+// NodePoolDriverName returns the name of the driver
+// DaemonSet object for a node pool
+func (d *PmemCSIDeployment) NodePoolDriverName(pool string) string {
+	return d.NodeDriverName() + "-" + pool
+}
+
 // ControllerDriverName returns the name of the controller
 // StatefulSet object name used by the deployment
 func (d *PmemCSIDeployment) ControllerDriverName() string {
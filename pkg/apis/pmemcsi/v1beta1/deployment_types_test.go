@@ -10,12 +10,17 @@ import (
 	"os"
 	"testing"
 
+	fuzz "github.com/google/gofuzz"
 	"github.com/intel/pmem-csi/pkg/apis"
+	apiv1 "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -45,6 +50,8 @@ var _ = Describe("Operator", func() {
 			Expect(d.Spec.PullPolicy).Should(BeEquivalentTo(api.DefaultImagePullPolicy), "default image pull policy mismatch")
 			Expect(d.Spec.ProvisionerImage).Should(BeEquivalentTo(api.DefaultProvisionerImage), "default provisioner image mismatch")
 			Expect(d.Spec.NodeRegistrarImage).Should(BeEquivalentTo(api.DefaultRegistrarImage), "default node driver registrar image mismatch")
+			Expect(d.Spec.NodeUpgradeStrategy).Should(BeEquivalentTo(api.DefaultNodeUpgradeStrategy), "default node upgrade strategy mismatch")
+			Expect(d.Spec.LivenessProbeImage).Should(BeEmpty(), "livenessprobe must not be enabled by default")
 
 			Expect(d.Spec.ControllerDriverResources).ShouldNot(BeNil(), "default controller resources not set")
 
@@ -63,6 +70,11 @@ var _ = Describe("Operator", func() {
 			rs = d.Spec.ProvisionerResources.Requests
 			Expect(rs.Cpu().String()).Should(BeEquivalentTo(api.DefaultProvisionerRequestCPU), "provisioner 'cpu' resource request mismatch")
 			Expect(rs.Memory().String()).Should(BeEquivalentTo(api.DefaultProvisionerRequestMemory), "provisioner 'cpu' resource request mismatch")
+
+			Expect(d.Spec.LivenessProbeResources).ShouldNot(BeNil(), "default livenessprobe resources not set")
+			rs = d.Spec.LivenessProbeResources.Requests
+			Expect(rs.Cpu().String()).Should(BeEquivalentTo(api.DefaultLivenessProbeRequestCPU), "livenessprobe 'cpu' resource request mismatch")
+			Expect(rs.Memory().String()).Should(BeEquivalentTo(api.DefaultLivenessProbeRequestMemory), "livenessprobe 'memory' resource request mismatch")
 		})
 
 		It("shall be able to set values", func() {
@@ -132,6 +144,39 @@ spec:
 			Expect(rs.Memory().Cmp(resource.MustParse("150Mi"))).Should(BeZero(), "provisioner 'memory' resource requests mismatch")
 		})
 
+		It("shall validate node pools", func() {
+			pools := func(pools ...api.NodePool) api.PmemCSIDeployment {
+				return api.PmemCSIDeployment{
+					Spec: api.DeploymentSpec{
+						NodePools: pools,
+					},
+				}
+			}
+			lvm := api.NodePool{Name: "lvm", NodeSelector: map[string]string{"pmem-mode": "lvm"}}
+			direct := api.NodePool{Name: "direct", NodeSelector: map[string]string{"pmem-mode": "direct"}, DeviceMode: api.DeviceModeDirect}
+			small := api.NodePool{Name: "small", NodeSelector: map[string]string{"pmem-size": "small"}}
+
+			d := pools(lvm, direct)
+			Expect(d.EnsureDefaults("")).ShouldNot(HaveOccurred(), "disjoint pools")
+			spec := d.NodePoolSpec(d.Spec.NodePools[1])
+			Expect(spec.NodeSelector).Should(Equal(map[string]string{"storage": "pmem", "pmem-mode": "direct"}), "pool node selector")
+			Expect(spec.DeviceMode).Should(Equal(api.DeviceModeDirect), "pool device mode")
+			Expect(spec.PMEMPercentage).Should(BeEquivalentTo(api.DefaultPMEMPercentage), "pool PMEM percentage")
+			Expect(spec.NodeDriverResources).Should(Equal(d.Spec.NodeDriverResources), "pool node driver resources")
+
+			d = pools(lvm, small)
+			Expect(d.EnsureDefaults("")).Should(MatchError(`node pools "lvm" and "small" overlap`), "overlapping pools")
+
+			d = pools(lvm, lvm)
+			Expect(d.EnsureDefaults("")).Should(MatchError(`duplicate node pool name "lvm"`), "duplicate pools")
+
+			d = pools(api.NodePool{Name: "no_pool", NodeSelector: small.NodeSelector})
+			Expect(d.EnsureDefaults("")).Should(HaveOccurred(), "invalid name")
+
+			d = pools(api.NodePool{Name: "empty"})
+			Expect(d.EnsureDefaults("")).Should(HaveOccurred(), "empty node selector")
+		})
+
 		It("should have valid json schema", func() {
 
 			crdFile := os.Getenv("REPO_ROOT") + "/deploy/crd/pmem-csi.intel.com_pmemcsideployments.yaml"
@@ -167,6 +212,14 @@ spec:
 				"provisionerResources":      "object",
 				"nodeRegistrarResources":    "object",
 				"kubeletDir":                "string",
+				"instanceName":              "string",
+				"nodePools":                 "array",
+				"nodeUpgradeStrategy":       "string",
+				"pmemSetup":                 "object",
+				"livenessProbeImage":        "string",
+				"livenessProbeResources":    "object",
+				"nodeExtraContainers":       "array",
+				"podTemplateOverrides":      "object",
 			}
 
 			for key := range spec.Properties {
@@ -180,7 +233,9 @@ spec:
 			}
 
 			statusProperties := map[string]string{
-				"phase": "string",
+				"phase":     "string",
+				"nodes":     "array",
+				"pmemSetup": "array",
 			}
 			for prop, tipe := range statusProperties {
 				jsonProp, ok := status.Properties[prop]
@@ -189,4 +244,72 @@ spec:
 			}
 		})
 	})
+
+	Context("conversion", func() {
+		// Random objects with few nil pointers, so that all
+		// fields get covered.
+		fuzzer := fuzz.New().NilChance(0.1).NumElements(0, 3)
+		const numFuzz = 1000
+
+		It("shall round-trip v1beta1 -> v1 -> v1beta1", func() {
+			for i := 0; i < numFuzz; i++ {
+				in := &api.PmemCSIDeployment{}
+				fuzzer.Fuzz(in)
+				// Set by the conversion webhook.
+				in.TypeMeta = metav1.TypeMeta{}
+				v1 := &apiv1.PmemCSIDeployment{}
+				Expect(v1.ConvertFrom(in)).Should(Succeed(), "convert from v1beta1")
+				out := &api.PmemCSIDeployment{}
+				Expect(v1.ConvertTo(out)).Should(Succeed(), "convert to v1beta1")
+				Expect(equality.Semantic.DeepEqual(in, out)).Should(BeTrue(), "round-trip:\n%s", diff.ObjectReflectDiff(in, out))
+			}
+		})
+
+		It("shall round-trip v1 -> v1beta1 -> v1", func() {
+			for i := 0; i < numFuzz; i++ {
+				in := &apiv1.PmemCSIDeployment{}
+				fuzzer.Fuzz(in)
+				in.TypeMeta = metav1.TypeMeta{}
+				hub := &api.PmemCSIDeployment{}
+				Expect(in.ConvertTo(hub)).Should(Succeed(), "convert to v1beta1")
+				out := &apiv1.PmemCSIDeployment{}
+				Expect(out.ConvertFrom(hub)).Should(Succeed(), "convert from v1beta1")
+				Expect(equality.Semantic.DeepEqual(in, out)).Should(BeTrue(), "round-trip:\n%s", diff.ObjectReflectDiff(in, out))
+			}
+		})
+
+		It("shall map renamed fields", func() {
+			yaml := `kind: PmemCSIDeployment
+apiVersion: pmem-csi.intel.com/v1
+metadata:
+  name: test-deployment
+spec:
+  deviceMode: direct
+  controller:
+    replicas: 2
+    tlsSecret: controller-secret
+    mutatePods:
+      mode: Always
+  node:
+    nodeSelector:
+      storage: pmem
+    provisioner:
+      image: test-provisioner:v0.0.0
+`
+			decode := scheme.Codecs.UniversalDeserializer().Decode
+			obj, _, err := decode([]byte(yaml), nil, nil)
+			Expect(err).Should(BeNil(), "Failed to parse deployment")
+			v1 := obj.(*apiv1.PmemCSIDeployment)
+			d := &api.PmemCSIDeployment{}
+			Expect(v1.ConvertTo(d)).Should(Succeed(), "convert to v1beta1")
+
+			Expect(d.Name).Should(Equal("test-deployment"), "name")
+			Expect(d.Spec.DeviceMode).Should(Equal(api.DeviceModeDirect), "device mode")
+			Expect(d.Spec.ControllerReplicas).Should(Equal(2), "controller replicas")
+			Expect(d.Spec.ControllerTLSSecret).Should(Equal("controller-secret"), "controller TLS secret")
+			Expect(d.Spec.MutatePods).Should(Equal(api.MutatePodsAlways), "mutate pods")
+			Expect(d.Spec.NodeSelector).Should(Equal(map[string]string{"storage": "pmem"}), "node selector")
+			Expect(d.Spec.ProvisionerImage).Should(Equal("test-provisioner:v0.0.0"), "provisioner image")
+		})
+	})
 })
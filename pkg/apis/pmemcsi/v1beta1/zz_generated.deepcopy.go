@@ -40,6 +40,18 @@ func (in *DeploymentSpec) DeepCopyInto(out *DeploymentSpec) {
 		*out = new(v1.ResourceRequirements)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.LivenessProbeResources != nil {
+		in, out := &in.LivenessProbeResources, &out.LivenessProbeResources
+		*out = new(v1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodeExtraContainers != nil {
+		in, out := &in.NodeExtraContainers, &out.NodeExtraContainers
+		*out = make([]v1.Container, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.NodeDriverResources != nil {
 		in, out := &in.NodeDriverResources, &out.NodeDriverResources
 		*out = new(v1.ResourceRequirements)
@@ -69,6 +81,19 @@ func (in *DeploymentSpec) DeepCopyInto(out *DeploymentSpec) {
 		*out = new(intstr.IntOrString)
 		**out = **in
 	}
+	if in.NodePools != nil {
+		in, out := &in.NodePools, &out.NodePools
+		*out = make([]NodePool, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PmemSetup != nil {
+		in, out := &in.PmemSetup, &out.PmemSetup
+		*out = new(PmemSetup)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodTemplateOverrides.DeepCopyInto(&out.PodTemplateOverrides)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeploymentSpec.
@@ -98,6 +123,20 @@ func (in *DeploymentStatus) DeepCopyInto(out *DeploymentStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]NodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PmemSetup != nil {
+		in, out := &in.PmemSetup, &out.PmemSetup
+		*out = make([]NodeSetupStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	in.LastUpdated.DeepCopyInto(&out.LastUpdated)
 }
 
@@ -127,6 +166,115 @@ func (in *DriverStatus) DeepCopy() *DriverStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeCapacity) DeepCopyInto(out *NodeCapacity) {
+	*out = *in
+	out.Managed = in.Managed.DeepCopy()
+	out.Available = in.Available.DeepCopy()
+	out.MaxVolumeSize = in.MaxVolumeSize.DeepCopy()
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeCapacity.
+func (in *NodeCapacity) DeepCopy() *NodeCapacity {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeCapacity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodePool) DeepCopyInto(out *NodePool) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.NodeDriverResources != nil {
+		in, out := &in.NodeDriverResources, &out.NodeDriverResources
+		*out = new(v1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodePool.
+func (in *NodePool) DeepCopy() *NodePool {
+	if in == nil {
+		return nil
+	}
+	out := new(NodePool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeSetupCondition) DeepCopyInto(out *NodeSetupCondition) {
+	*out = *in
+	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeSetupCondition.
+func (in *NodeSetupCondition) DeepCopy() *NodeSetupCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeSetupCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeSetupStatus) DeepCopyInto(out *NodeSetupStatus) {
+	*out = *in
+	if in.Actions != nil {
+		in, out := &in.Actions, &out.Actions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]NodeSetupCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeSetupStatus.
+func (in *NodeSetupStatus) DeepCopy() *NodeSetupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeSetupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeStatus) DeepCopyInto(out *NodeStatus) {
+	*out = *in
+	if in.Capacity != nil {
+		in, out := &in.Capacity, &out.Capacity
+		*out = new(NodeCapacity)
+		(*in).DeepCopyInto(*out)
+	}
+	in.LastHeartbeat.DeepCopyInto(&out.LastHeartbeat)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeStatus.
+func (in *NodeStatus) DeepCopy() *NodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PmemCSIDeployment) DeepCopyInto(out *PmemCSIDeployment) {
 	*out = *in
@@ -185,3 +333,108 @@ func (in *PmemCSIDeploymentList) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PmemSetup) DeepCopyInto(out *PmemSetup) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PmemSetup.
+func (in *PmemSetup) DeepCopy() *PmemSetup {
+	if in == nil {
+		return nil
+	}
+	out := new(PmemSetup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodOverrides) DeepCopyInto(out *PodOverrides) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]v1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(v1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TopologySpreadConstraints != nil {
+		in, out := &in.TopologySpreadConstraints, &out.TopologySpreadConstraints
+		*out = make([]v1.TopologySpreadConstraint, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(v1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]v1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodOverrides.
+func (in *PodOverrides) DeepCopy() *PodOverrides {
+	if in == nil {
+		return nil
+	}
+	out := new(PodOverrides)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodTemplateOverrides) DeepCopyInto(out *PodTemplateOverrides) {
+	*out = *in
+	if in.Controller != nil {
+		in, out := &in.Controller, &out.Controller
+		*out = new(PodOverrides)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Node != nil {
+		in, out := &in.Node, &out.Node
+		*out = new(PodOverrides)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodeSetup != nil {
+		in, out := &in.NodeSetup, &out.NodeSetup
+		*out = new(PodOverrides)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodTemplateOverrides.
+func (in *PodTemplateOverrides) DeepCopy() *PodTemplateOverrides {
+	if in == nil {
+		return nil
+	}
+	out := new(PodTemplateOverrides)
+	in.DeepCopyInto(out)
+	return out
+}
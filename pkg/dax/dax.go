@@ -0,0 +1,84 @@
+/*
+Copyright 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package dax checks whether a mounted filesystem really provides
+// DAX. The kernel may silently ignore the dax mount option, for
+// example when the device does not support it.
+package dax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoDAX is returned by Check when DAX is not available.
+var ErrNoDAX = errors.New("DAX not available")
+
+// ErrReadOnly is returned by Check when the filesystem is read-only
+// and therefore cannot be checked.
+var ErrReadOnly = errors.New("read-only filesystem")
+
+// probeSize is the size of the file that gets mapped.
+const probeSize = 4096
+
+// Check creates a temporary file in the directory and maps it with
+// MAP_SYNC, which is only supported for files with DAX semantic. The
+// file has no name if the filesystem supports O_TMPFILE, otherwise
+// it gets removed right after creating it, so it does not show up
+// in the directory while the check runs. ErrNoDAX is returned if
+// the mapping is not supported, ErrReadOnly if no file can be
+// created because the filesystem is read-only, and other errors
+// when the check itself failed.
+func Check(dir string) error {
+	file, err := createProbeFile(dir)
+	if err != nil {
+		if errors.Is(err, unix.EROFS) {
+			return fmt.Errorf("%w: create probe file: %v", ErrReadOnly, err)
+		}
+		return fmt.Errorf("create probe file: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(probeSize); err != nil {
+		return fmt.Errorf("resize probe file: %v", err)
+	}
+
+	data, err := unix.Mmap(int(file.Fd()), 0, probeSize, unix.PROT_READ, unix.MAP_SHARED_VALIDATE|unix.MAP_SYNC)
+	if err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return fmt.Errorf("%w: mmap with MAP_SYNC: %v", ErrNoDAX, err)
+		}
+		return fmt.Errorf("mmap probe file: %v", err)
+	}
+	if err := unix.Munmap(data); err != nil {
+		return fmt.Errorf("munmap probe file: %v", err)
+	}
+	return nil
+}
+
+// createProbeFile returns an open file without a name in the
+// directory.
+func createProbeFile(dir string) (*os.File, error) {
+	file, err := os.OpenFile(dir, os.O_RDWR|unix.O_TMPFILE, 0600)
+	if err == nil {
+		return file, nil
+	}
+	if !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.EISDIR) {
+		return nil, err
+	}
+	// O_TMPFILE is not supported by the filesystem or kernel.
+	file, err = os.CreateTemp(dir, ".pmem-csi-dax-check-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("remove probe file: %v", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dax
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheck(t *testing.T) {
+	// This is assumed to be backed by tmpfs or some other
+	// filesystem without DAX support.
+	tmp := t.TempDir()
+	err := Check(tmp)
+	if !errors.Is(err, ErrNoDAX) {
+		t.Fatalf("expected ErrNoDAX, got: %v", err)
+	}
+	t.Logf("got expected error: %v", err)
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("read directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("probe file not removed: %v", entries)
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmp := t.TempDir()
+	if err := unix.Mount("tmpfs", tmp, "tmpfs", unix.MS_RDONLY, ""); err != nil {
+		t.Skipf("mount read-only tmpfs: %v", err)
+	}
+	defer unix.Unmount(tmp, 0)
+
+	err := Check(tmp)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+	t.Logf("got expected error: %v", err)
+}
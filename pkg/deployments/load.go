@@ -12,15 +12,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
 	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/intel/pmem-csi/pkg/version"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -122,6 +127,10 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 				replicas = 1
 			}
 			outerSpec["replicas"] = replicas
+			if err := patchPodOverrides(obj, deployment.Spec.PodTemplateOverrides.Controller); err != nil {
+				// TODO: avoid panic
+				panic(fmt.Errorf("controller pod template overrides: %v", err))
+			}
 		case "DaemonSet":
 			switch obj.GetName() {
 			case deployment.NodeSetupName():
@@ -129,6 +138,14 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					// TODO: avoid panic
 					panic(fmt.Errorf("set node resources: %v", err))
 				}
+				if deployment.Spec.PmemSetup != nil {
+					patchPmemSetup(obj, deployment)
+				}
+				patchInstance(obj, deployment)
+				if err := patchPodOverrides(obj, deployment.Spec.PodTemplateOverrides.NodeSetup); err != nil {
+					// TODO: avoid panic
+					panic(fmt.Errorf("node setup pod template overrides: %v", err))
+				}
 			case deployment.NodeDriverName():
 				resources := map[string]*corev1.ResourceRequirements{
 					"pmem-driver":          deployment.Spec.NodeDriverResources,
@@ -139,10 +156,27 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					// TODO: avoid panic
 					panic(fmt.Errorf("set node resources: %v", err))
 				}
+				if err := addNodeSidecars(obj, deployment); err != nil {
+					// TODO: avoid panic
+					panic(fmt.Errorf("add node sidecars: %v", err))
+				}
+				if deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretGenerated {
+					if err := patchCapacityReports(obj, deployment, namespace); err != nil {
+						// TODO: avoid panic
+						panic(fmt.Errorf("capacity reports: %v", err))
+					}
+				}
+				patchInstance(obj, deployment)
 				outerSpec := obj.Object["spec"].(map[string]interface{})
-				updateStrategy := outerSpec["updateStrategy"].(map[string]interface{})
-				rollingUpdate := updateStrategy["rollingUpdate"].(map[string]interface{})
-				rollingUpdate["maxUnavailable"] = deployment.Spec.MaxUnavailable
+				if deployment.Spec.NodeUpgradeStrategy == api.NodeUpgradeOrchestrated {
+					outerSpec["updateStrategy"] = map[string]interface{}{
+						"type": "OnDelete",
+					}
+				} else {
+					updateStrategy := outerSpec["updateStrategy"].(map[string]interface{})
+					rollingUpdate := updateStrategy["rollingUpdate"].(map[string]interface{})
+					rollingUpdate["maxUnavailable"] = deployment.Spec.MaxUnavailable
+				}
 				template := outerSpec["template"].(map[string]interface{})
 				spec := template["spec"].(map[string]interface{})
 				if deployment.Spec.NodeSelector != nil {
@@ -152,6 +186,10 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					}
 					spec["nodeSelector"] = selector
 				}
+				if err := patchPodOverrides(obj, deployment.Spec.PodTemplateOverrides.Node); err != nil {
+					// TODO: avoid panic
+					panic(fmt.Errorf("node pod template overrides: %v", err))
+				}
 			}
 		case "MutatingWebhookConfiguration":
 			webhooks := obj.Object["webhooks"].([]interface{})
@@ -172,6 +210,24 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					"service.beta.openshift.io/inject-cabundle": "true",
 				}
 			}
+		case "ValidatingWebhookConfiguration":
+			webhooks := obj.Object["webhooks"].([]interface{})
+			failurePolicy := "Ignore"
+			if deployment.Spec.ValidateVolumes == api.ValidateVolumesAlways {
+				failurePolicy = "Fail"
+			}
+			webhook := webhooks[0].(map[string]interface{})
+			webhook["failurePolicy"] = failurePolicy
+			clientConfig := webhook["clientConfig"].(map[string]interface{})
+			if controllerCABundle != nil {
+				clientConfig["caBundle"] = base64.StdEncoding.EncodeToString(controllerCABundle)
+			}
+			if deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretOpenshift {
+				meta := obj.Object["metadata"].(map[string]interface{})
+				meta["annotations"] = map[string]string{
+					"service.beta.openshift.io/inject-cabundle": "true",
+				}
+			}
 		case "Service":
 			switch obj.GetName() {
 			case deployment.SchedulerServiceName():
@@ -202,18 +258,38 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 		return nil, err
 	}
 
+	if len(deployment.Spec.NodePools) > 0 {
+		objects, err = replaceNodeDriver(objects, kubernetes, namespace, deployment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	scheduler, err := loadYAML("kustomize/scheduler/scheduler-service.yaml", patchYAML, enabled, patchUnstructured)
 	if err != nil {
 		return nil, err
 	}
 	objects = append(objects, scheduler...)
 
-	if deployment.Spec.ControllerTLSSecret != "" && deployment.Spec.MutatePods != api.MutatePodsNever {
+	mutate := deployment.Spec.ControllerTLSSecret != "" && deployment.Spec.MutatePods != api.MutatePodsNever
+	validate := deployment.Spec.ControllerTLSSecret != "" &&
+		deployment.Spec.ValidateVolumes != "" &&
+		deployment.Spec.ValidateVolumes != api.ValidateVolumesNever
+	if mutate {
 		webhook, err := loadYAML("kustomize/webhook/webhook.yaml", patchYAML, enabled, patchUnstructured)
 		if err != nil {
 			return nil, err
 		}
 		objects = append(objects, webhook...)
+	}
+	if validate {
+		webhook, err := loadYAML("kustomize/webhook/validating-webhook.yaml", patchYAML, enabled, patchUnstructured)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, webhook...)
+	}
+	if mutate || validate {
 		service, err := loadYAML("kustomize/webhook/webhook-service.yaml", patchYAML, enabled, patchUnstructured)
 		if err != nil {
 			return nil, err
@@ -224,13 +300,311 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 	return objects, nil
 }
 
+// replaceNodeDriver replaces the node driver DaemonSet with one DaemonSet
+// per node pool. Each of those is based on the reference file for the
+// device mode of the pool and customized with the pool settings.
+func replaceNodeDriver(objects []unstructured.Unstructured, kubernetes version.Version,
+	namespace string, deployment api.PmemCSIDeployment) ([]unstructured.Unstructured, error) {
+	var result []unstructured.Unstructured
+	for _, obj := range objects {
+		if obj.GetKind() != "DaemonSet" || obj.GetName() != deployment.NodeDriverName() {
+			result = append(result, obj)
+		}
+	}
+
+	for _, pool := range deployment.Spec.NodePools {
+		pool := deployment.NodePoolSpec(pool)
+		poolDeployment := *deployment.DeepCopy()
+		poolDeployment.Spec.NodePools = nil
+		poolDeployment.Spec.DeviceMode = pool.DeviceMode
+		poolDeployment.Spec.NodeSelector = pool.NodeSelector
+		poolDeployment.Spec.PMEMPercentage = pool.PMEMPercentage
+		poolDeployment.Spec.NodeDriverResources = pool.NodeDriverResources
+		poolObjects, err := LoadAndCustomizeObjects(kubernetes, pool.DeviceMode, namespace, poolDeployment, nil)
+		if err != nil {
+			return nil, fmt.Errorf("node pool %q: %v", pool.Name, err)
+		}
+		for _, obj := range poolObjects {
+			if obj.GetKind() != "DaemonSet" || obj.GetName() != deployment.NodeDriverName() {
+				continue
+			}
+			obj.SetName(deployment.NodePoolDriverName(pool.Name))
+			outerSpec := obj.Object["spec"].(map[string]interface{})
+			selector := outerSpec["selector"].(map[string]interface{})
+			selector["matchLabels"].(map[string]interface{})[api.NodePoolLabel] = pool.Name
+			template := outerSpec["template"].(map[string]interface{})
+			metadata := template["metadata"].(map[string]interface{})
+			metadata["labels"].(map[string]interface{})[api.NodePoolLabel] = pool.Name
+			result = append(result, obj)
+		}
+	}
+	return result, nil
+}
+
+// addNodeSidecars appends the optional livenessprobe sidecar and the
+// extra containers to the node driver pod in the same order as the
+// operator.
+func addNodeSidecars(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) error {
+	readOnly := true
+	sidecar := func(name, image string, resources *corev1.ResourceRequirements, args ...string) corev1.Container {
+		return corev1.Container{
+			Name:            name,
+			Image:           image,
+			ImagePullPolicy: deployment.Spec.PullPolicy,
+			Args: append([]string{
+				fmt.Sprintf("-v=%d", deployment.Spec.LogLevel),
+				"--csi-address=/csi/csi.sock",
+			}, args...),
+			SecurityContext: &corev1.SecurityContext{
+				ReadOnlyRootFilesystem: &readOnly,
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{
+					Name:      "socket-dir",
+					MountPath: "/csi",
+				},
+			},
+			Resources: *resources,
+		}
+	}
+
+	var containers []corev1.Container
+	const healthPort = 10012
+	if deployment.Spec.LivenessProbeImage != "" {
+		c := sidecar("liveness-probe", deployment.Spec.LivenessProbeImage, deployment.Spec.LivenessProbeResources,
+			fmt.Sprintf("--health-port=%d", healthPort))
+		c.Ports = []corev1.ContainerPort{{Name: "healthz", ContainerPort: healthPort}}
+		containers = append(containers, c)
+	}
+	containers = append(containers, deployment.Spec.NodeExtraContainers...)
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	list := spec["containers"].([]interface{})
+	if deployment.Spec.LivenessProbeImage != "" {
+		probe, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Scheme: "HTTP",
+					Path:   "/healthz",
+					Port:   intstr.FromInt(healthPort),
+				},
+			},
+			SuccessThreshold: 1,
+			TimeoutSeconds:   5,
+			PeriodSeconds:    10,
+			FailureThreshold: 6,
+		})
+		if err != nil {
+			return err
+		}
+		for _, container := range list {
+			container := container.(map[string]interface{})
+			if container["name"].(string) == "pmem-driver" {
+				container["livenessProbe"] = probe
+			}
+		}
+	}
+	for i := range containers {
+		container, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&containers[i])
+		if err != nil {
+			return err
+		}
+		list = append(list, container)
+	}
+	spec["containers"] = list
+	return nil
+}
+
+// patchPodOverrides merges the overrides into the pod template of a
+// Deployment or DaemonSet the same way as the operator.
+func patchPodOverrides(obj *unstructured.Unstructured, overrides *api.PodOverrides) error {
+	if overrides == nil {
+		return nil
+	}
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	data, err := json.Marshal(outerSpec["template"])
+	if err != nil {
+		return err
+	}
+	data, err = k8sutil.MergePodOverrides(data, overrides)
+	if err != nil {
+		return err
+	}
+	// Decoding with the apimachinery json package keeps integers
+	// as int64, like the rest of the unstructured objects.
+	var template map[string]interface{}
+	if err := utiljson.Unmarshal(data, &template); err != nil {
+		return err
+	}
+	outerSpec["template"] = template
+	return nil
+}
+
+// addControllerArgs inserts optional parameters of the controller in
+// the same order as the operator, i.e. before the metrics parameters.
+func addControllerArgs(command []interface{}, deployment api.PmemCSIDeployment) []interface{} {
+	var args []interface{}
+	if deployment.Spec.ControllerTLSSecret != "" {
+		if deployment.Spec.MutatePodsResource != "" {
+			args = append(args, "-mutatePodsResource="+deployment.Spec.MutatePodsResource)
+		}
+		if deployment.Spec.MutatePodsContainer != "" {
+			args = append(args, "-mutatePodsContainer="+deployment.Spec.MutatePodsContainer)
+		}
+		if deployment.Spec.MutatePodsInitContainer {
+			args = append(args, "-mutatePodsInitContainer")
+		}
+		if deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretGenerated {
+			args = append(args, "-capacityReports")
+		}
+	}
+	if deployment.Spec.ControllerReplicas > 1 {
+		args = append(args, "-leaderElection")
+	}
+	if len(args) == 0 {
+		return command
+	}
+
+	i := 0
+	for ; i < len(command); i++ {
+		if strings.HasPrefix(command[i].(string), "-metricsListen=") {
+			break
+		}
+	}
+	result := append([]interface{}{}, command[:i]...)
+	result = append(result, args...)
+	return append(result, command[i:]...)
+}
+
+// patchPmemSetup turns the node setup pod into one which runs the
+// configured PMEM setup on the selected nodes until it is done there.
+func patchPmemSetup(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	setup := deployment.Spec.PmemSetup
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+
+	selector := map[string]string{}
+	for key, value := range spec["nodeSelector"].(map[string]interface{}) {
+		selector[key] = value.(string)
+	}
+	if len(setup.NodeSelector) > 0 {
+		selector = setup.NodeSelector
+	}
+	delete(spec, "nodeSelector")
+	var keys []string
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var expressions []interface{}
+	for _, key := range keys {
+		expressions = append(expressions, map[string]interface{}{
+			"key":      key,
+			"operator": "In",
+			"values":   []interface{}{selector[key]},
+		})
+	}
+	expressions = append(expressions, map[string]interface{}{
+		"key":      deployment.GetName() + "/" + api.PmemSetupKey,
+		"operator": "NotIn",
+		"values":   []interface{}{api.PmemSetupDone},
+	})
+	spec["affinity"] = map[string]interface{}{
+		"nodeAffinity": map[string]interface{}{
+			"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{
+				"nodeSelectorTerms": []interface{}{
+					map[string]interface{}{
+						"matchExpressions": expressions,
+					},
+				},
+			},
+		},
+	}
+
+	containers := spec["containers"].([]interface{})
+	container := containers[0].(map[string]interface{})
+	var command []interface{}
+	for _, arg := range container["command"].([]interface{}) {
+		if strings.HasPrefix(arg.(string), "-mode=") {
+			command = append(command, "-mode=pmem-setup", "-drivername="+deployment.GetName())
+			continue
+		}
+		command = append(command, arg)
+	}
+	command = append(command,
+		fmt.Sprintf("-convertRawNamespaces=%t", setup.ConvertRawNamespaces),
+		fmt.Sprintf("-createNamespaces=%t", setup.CreateNamespaces),
+		fmt.Sprintf("-reservePercentage=%d", setup.ReservePercentage),
+		fmt.Sprintf("-dryRun=%t", setup.DryRun),
+	)
+	container["command"] = command
+}
+
+// patchCapacityReports lets the node driver push its capacity to the
+// controller with the generated client certificate, like the
+// operator does when it generates certificates.
+func patchCapacityReports(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, namespace string) error {
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	containers := spec["containers"].([]interface{})
+	container := containers[0].(map[string]interface{})
+	container["command"] = append(container["command"].([]interface{}),
+		"-caFile=/certs/"+api.TLSSecretCA,
+		"-certFile=/certs/"+api.TLSSecretCert,
+		"-keyFile=/certs/"+api.TLSSecretKey,
+		fmt.Sprintf("-capacityReportURL=https://%s.%s.svc/capacity", deployment.SchedulerServiceName(), namespace),
+	)
+
+	mount, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.VolumeMount{
+		Name:      "node-cert",
+		MountPath: "/certs",
+	})
+	if err != nil {
+		return err
+	}
+	container["volumeMounts"] = append(container["volumeMounts"].([]interface{}), mount)
+	mode := corev1.SecretVolumeSourceDefaultMode
+	volume, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.Volume{
+		Name: "node-cert",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  deployment.NodeTLSSecretGeneratedName(),
+				DefaultMode: &mode,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	spec["volumes"] = append(spec["volumes"].([]interface{}), volume)
+	return nil
+}
+
+// patchInstance adds the instance name to the command of the first
+// container, if one is set.
+func patchInstance(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	if deployment.Spec.InstanceName == "" {
+		return
+	}
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	containers := spec["containers"].([]interface{})
+	container := containers[0].(map[string]interface{})
+	container["command"] = append(container["command"].([]interface{}), "-instance="+deployment.Spec.InstanceName)
+}
+
 func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, resources map[string]*corev1.ResourceRequirements) error {
 	outerSpec := obj.Object["spec"].(map[string]interface{})
 	template := outerSpec["template"].(map[string]interface{})
 	spec := template["spec"].(map[string]interface{})
 	metadata := template["metadata"].(map[string]interface{})
 
-	isController := strings.Contains(obj.GetName(), "controller")
+	isController := obj.GetKind() == "Deployment"
 	stripTLS := isController && deployment.Spec.ControllerTLSSecret == ""
 	openshiftTLS := isController && deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretOpenshift
 
@@ -309,6 +683,19 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 			container["command"] = command
 		}
 
+		if isController && container["name"].(string) == "pmem-driver" {
+			command := container["command"].([]interface{})
+			if deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretGenerated {
+				// The generated CA also verifies node drivers.
+				for i := range command {
+					if command[i].(string) == "-caFile=" {
+						command[i] = "-caFile=/certs/" + api.TLSSecretCA
+					}
+				}
+			}
+			container["command"] = addControllerArgs(command, deployment)
+		}
+
 		// Override driver name in env var.
 		env := container["env"]
 		if env != nil {
@@ -349,11 +736,7 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 			volume := volume.(map[string]interface{})
 			volumeName := volume["name"].(string)
 			if volumeName == "webhook-cert" {
-				name := deployment.Spec.ControllerTLSSecret
-				if name == api.ControllerTLSSecretOpenshift {
-					name = deployment.ControllerTLSSecretOpenshiftName()
-				}
-				volume["secret"].(map[string]interface{})["secretName"] = name
+				volume["secret"].(map[string]interface{})["secretName"] = deployment.ControllerTLSSecretName()
 			}
 		}
 	}
@@ -53,6 +53,9 @@ device](https://github.com/qemu/qemu/blob/master/docs/nvdimm.txt) such
 that the guest kernel provides a /dev/pmem0 (the FS partition above)
 which can be mounted with -odax. For full dax semantic, the QEMU
 device configuration must use the 'pmem' and 'share' flags.
+
+The layout of an existing file can be determined with ReadLayout
+and the file can be grown with Resize.
 */
 package imagefile
 
@@ -159,9 +162,16 @@ package imagefile
 // 	// checksum must be calculated at the end
 // 	sb->checksum = nd_sb_checksum((struct nd_gen_sb*)sb);
 // }
+//
+// u64 nsdax_checksum(void *p)
+// {
+// 	return nd_sb_checksum((struct nd_gen_sb*)p);
+// }
 import "C"
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -170,6 +180,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -180,7 +191,12 @@ type FsType string
 
 const (
 	Ext4 FsType = "ext4"
+	Ext2 FsType = "ext2"
 	Xfs  FsType = "xfs"
+
+	// Raw is a partition without filesystem, for example for
+	// applications which use the device directly inside the guest.
+	Raw FsType = "raw"
 )
 
 type Bytes int64
@@ -224,11 +240,53 @@ const (
 // The result will be sparse, i.e. empty parts are not actually
 // written yet, but they will be allocated, so there is no risk
 // later on that attempting to write fails due to lack of space.
+//
+// With Raw as filesystem, the partition is left empty.
 func Create(filename string, size Bytes, fs FsType) error {
 	if size != 0 && size <= HeaderSize {
 		return fmt.Errorf("invalid image file size %d, must be larger than HeaderSize=%d", size, HeaderSize)
 	}
+	return create(filename, size, fs, "")
+}
+
+// CreateFromImage writes an image file with a partition that
+// contains a copy of an existing filesystem image. The partition
+// has the same size as the source, which therefore must be a
+// multiple of BlockSize. The filesystem type is detected
+// automatically. Sources without a known filesystem are treated
+// like Raw partitions, i.e. they are copied without further checks.
+//
+// Holes in the source are preserved. The result is otherwise the
+// same as with Create.
+func CreateFromImage(filename, srcImage string) error {
+	src, err := os.Open(srcImage)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	srcSize := Bytes(fi.Size())
+	if srcSize == 0 || srcSize%BlockSize != 0 {
+		return fmt.Errorf("invalid size %d of %q, must be a non-zero multiple of BlockSize=%d", srcSize, srcImage, BlockSize)
+	}
+	superblock := make([]byte, superblockSize)
+	if _, err := src.ReadAt(superblock, 0); err != nil {
+		return fmt.Errorf("read filesystem superblock from %q: %w", srcImage, err)
+	}
+	fs, _ := detectFilesystem(superblock)
+	if fs == "" {
+		fs = Raw
+	}
+	return create(filename, HeaderSize+srcSize, fs, srcImage)
+}
 
+// create implements Create and CreateFromImage. If a source is
+// given, then it gets copied into the partition, otherwise mkfs
+// creates the filesystem.
+func create(filename string, size Bytes, fs FsType, source string) error {
 	dir, err := os.Open(filepath.Dir(filename))
 	if err != nil {
 		return err
@@ -264,37 +322,18 @@ func Create(filename string, size Bytes, fs FsType) error {
 	}
 	defer os.RemoveAll(tmp)
 	mbr1 := filepath.Join(tmp, "mbr1")
-	fsimage := filepath.Join(tmp, "fsimage")
 
 	// This is for the full image file.
 	if err := writeMBR(mbr1, fs, HeaderSize, size); err != nil {
 		return err
 	}
 
-	// Create a file of the desired size, then let mkfs write into it.
-	fsFile, err := os.Create(fsimage)
-	if err != nil {
-		return err
-	}
-	defer fsFile.Close()
-	if err := fsFile.Truncate(int64(fsSize)); err != nil {
-		return err
-	}
-	args := []string{fmt.Sprintf("mkfs.%s", fs)}
-	// Required for dax semantic.
-	switch fs {
-	case Ext4:
-		args = append(args, "-b", fmt.Sprintf("%d", BlockSize))
-	case Xfs:
-		args = append(args,
-			"-b", fmt.Sprintf("size=%d", BlockSize),
-			"-m", "reflink=0",
-		)
-	}
-	args = append(args, fsimage)
-	cmd := exec.Command(args[0], args[1:]...)
-	if _, err := cmd.Output(); err != nil {
-		return fmt.Errorf("mkfs.%s for fs of size %d: %w", fs, fsSize, err)
+	fsimage := source
+	if fsimage == "" && fs != Raw {
+		fsimage = filepath.Join(tmp, "fsimage")
+		if err := mkfs(fsimage, fs, fsSize); err != nil {
+			return err
+		}
 	}
 
 	// Now copy to the actual file.
@@ -307,8 +346,10 @@ func Create(filename string, size Bytes, fs FsType) error {
 	if _, err := file.Write(nsdax(uint(HeaderSize), uint(DaxAlignment))); err != nil {
 		return err
 	}
-	if err := dd(fsimage, filename, true, HeaderSize); err != nil {
-		return err
+	if fsimage != "" {
+		if err := dd(fsimage, filename, true, HeaderSize); err != nil {
+			return err
+		}
 	}
 
 	// Some (but not all) kernels seem to expect the entire file to align at
@@ -337,6 +378,35 @@ func Create(filename string, size Bytes, fs FsType) error {
 	return nil
 }
 
+// mkfs creates a file of the desired size, then lets mkfs write into it.
+func mkfs(fsimage string, fs FsType, fsSize Bytes) error {
+	fsFile, err := os.Create(fsimage)
+	if err != nil {
+		return err
+	}
+	defer fsFile.Close()
+	if err := fsFile.Truncate(int64(fsSize)); err != nil {
+		return err
+	}
+	args := []string{fmt.Sprintf("mkfs.%s", fs)}
+	// Required for dax semantic.
+	switch fs {
+	case Ext4, Ext2:
+		args = append(args, "-b", fmt.Sprintf("%d", BlockSize))
+	case Xfs:
+		args = append(args,
+			"-b", fmt.Sprintf("size=%d", BlockSize),
+			"-m", "reflink=0",
+		)
+	}
+	args = append(args, fsimage)
+	cmd := exec.Command(args[0], args[1:]...)
+	if _, err := cmd.Output(); err != nil {
+		return fmt.Errorf("mkfs.%s for fs of size %d: %w", fs, fsSize, err)
+	}
+	return nil
+}
+
 func allocateFile(file *os.File, size Bytes) (Bytes, error) {
 	if size != 0 {
 		if err := file.Truncate(int64(size)); err != nil {
@@ -396,6 +466,33 @@ func nsdax(dataOffset uint, alignment uint) []byte {
 	return C.GoBytes(p, C.sizeof_struct_nd_pfn_sb)
 }
 
+// parseNsdax is the reverse of nsdax. It extracts all fields and
+// calculates the checksum, but does not validate anything.
+func parseNsdax(data []byte) (DAXMetadata, error) {
+	var sb C.struct_nd_pfn_sb
+	if len(data) < C.sizeof_struct_nd_pfn_sb {
+		return DAXMetadata{}, fmt.Errorf("DAX metadata truncated: %d instead of %d bytes", len(data), C.sizeof_struct_nd_pfn_sb)
+	}
+	p := C.CBytes(data[0:C.sizeof_struct_nd_pfn_sb])
+	defer C.free(p)
+
+	le := binary.LittleEndian
+	signature := data[unsafe.Offsetof(sb.signature) : unsafe.Offsetof(sb.signature)+C.PFN_SIG_LEN]
+	return DAXMetadata{
+		Signature:        string(bytes.TrimRight(signature, "\x00")),
+		VersionMajor:     le.Uint16(data[unsafe.Offsetof(sb.version_major):]),
+		VersionMinor:     le.Uint16(data[unsafe.Offsetof(sb.version_minor):]),
+		DataOffset:       Bytes(le.Uint64(data[unsafe.Offsetof(sb.dataoff):])),
+		NPFNs:            le.Uint64(data[unsafe.Offsetof(sb.npfns):]),
+		Mode:             le.Uint32(data[unsafe.Offsetof(sb.mode):]),
+		StartPad:         le.Uint32(data[unsafe.Offsetof(sb.start_pad):]),
+		EndTrunc:         le.Uint32(data[unsafe.Offsetof(sb.end_trunc):]),
+		Alignment:        Bytes(le.Uint32(data[unsafe.Offsetof(sb.align):])),
+		Checksum:         le.Uint64(data[unsafe.Offsetof(sb.checksum):]),
+		ExpectedChecksum: uint64(C.nsdax_checksum(p)),
+	}, nil
+}
+
 // writeMBR writes a master boot record at the start of the given image file.
 func writeMBR(to string, fs FsType, partitionStart Bytes, partitionEnd Bytes) error {
 	// Doesn't have to be a block device, but must exist and be large enough.
@@ -414,12 +511,22 @@ func writeMBR(to string, fs FsType, partitionStart Bytes, partitionEnd Bytes) er
 	// - subtract one from the end because it looks like start and end of the partition
 	//   are both inclusive; at least for end == size of file we get an error
 	//   (Error: The location .... is outside of the device ...).
-	cmd := exec.Command("parted", "--script", "--align", "none", to, "--",
+	//
+	// The filesystem type is optional for parted. It is only used to
+	// pick the partition type, which is the same for all
+	// filesystems that we support.
+	args := []string{"--script", "--align", "none", to, "--",
 		"mklabel", "msdos",
-		"mkpart", "primary", string(fs),
+		"mkpart", "primary",
+	}
+	if fs != Raw {
+		args = append(args, string(fs))
+	}
+	args = append(args,
 		fmt.Sprintf("%dB", partitionStart),
 		fmt.Sprintf("%dB", partitionEnd-1),
 	)
+	cmd := exec.Command("parted", args...)
 	if _, err := cmd.Output(); err != nil {
 		return fmt.Errorf("write MBR with parted to %q: %w", to, err)
 	}
@@ -10,6 +10,7 @@ package imagefile
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestNsdax(t *testing.T) {
@@ -162,3 +164,270 @@ func TestExtents(t *testing.T) {
 	assert.Less(t, delta.Seconds(), 10.0, "time for copying file")
 	verify(copy.Name())
 }
+
+// writeLayout creates a minimal image file with an MBR, DAX metadata
+// and an optional superblock at the start of the partition.
+func writeLayout(t *testing.T, partitionStart, partitionSize, dataOffset Bytes, superblock []byte) string {
+	file, err := ioutil.TempFile("", "layout")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	t.Cleanup(func() { rmTmpfile(file) })
+
+	mbr := make([]byte, sectorSize)
+	entry := mbr[mbrPartitionOffset:]
+	entry[4] = 0x83 // Linux
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(partitionStart/sectorSize))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(partitionSize/sectorSize))
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	if _, err := file.WriteAt(mbr, 0); err != nil {
+		t.Fatalf("write MBR: %v", err)
+	}
+	if _, err := file.WriteAt(nsdax(uint(dataOffset), uint(DaxAlignment)), int64(daxHeaderOffset)); err != nil {
+		t.Fatalf("write DAX metadata: %v", err)
+	}
+	if _, err := file.WriteAt(superblock, int64(partitionStart)); err != nil {
+		t.Fatalf("write superblock: %v", err)
+	}
+	if err := file.Truncate(int64(partitionStart + partitionSize)); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	return file.Name()
+}
+
+func TestLayout(t *testing.T) {
+	xfsSuperblock := make([]byte, superblockSize)
+	copy(xfsSuperblock, "XFSB")
+	binary.BigEndian.PutUint32(xfsSuperblock[4:8], uint32(BlockSize))
+	binary.BigEndian.PutUint64(xfsSuperblock[8:16], uint64(10*MiB/BlockSize))
+
+	ext4Superblock := make([]byte, superblockSize)
+	ext := ext4Superblock[1024:]
+	binary.LittleEndian.PutUint32(ext[0x4:0x8], uint32(12*MiB/BlockSize))
+	binary.LittleEndian.PutUint32(ext[0x18:0x1c], 2) // 1024 << 2 = 4096
+	binary.LittleEndian.PutUint16(ext[0x38:0x3a], 0xEF53)
+
+	testcases := map[string]struct {
+		dataOffset Bytes
+		superblock []byte
+		layout     Layout
+		err        string
+	}{
+		"xfs": {
+			dataOffset: HeaderSize,
+			superblock: xfsSuperblock,
+			layout:     Layout{PartitionStart: HeaderSize, PartitionSize: 16 * MiB, DataOffset: HeaderSize, Alignment: DaxAlignment, FsType: Xfs, FsSize: 10 * MiB},
+		},
+		"ext4": {
+			dataOffset: HeaderSize,
+			superblock: ext4Superblock,
+			layout:     Layout{PartitionStart: HeaderSize, PartitionSize: 16 * MiB, DataOffset: HeaderSize, Alignment: DaxAlignment, FsType: Ext4, FsSize: 12 * MiB},
+		},
+		"raw": {
+			dataOffset: HeaderSize,
+			superblock: make([]byte, superblockSize),
+			layout:     Layout{PartitionStart: HeaderSize, PartitionSize: 16 * MiB, DataOffset: HeaderSize, Alignment: DaxAlignment},
+		},
+		"mismatch": {
+			dataOffset: 2 * HeaderSize,
+			superblock: xfsSuperblock,
+			err:        fmt.Sprintf("DAX data offset %d does not match partition offset %d", 2*HeaderSize, HeaderSize),
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			filename := writeLayout(t, HeaderSize, 16*MiB, tc.dataOffset, tc.superblock)
+			layout, err := ReadLayout(filename)
+			if tc.err != "" {
+				assert.EqualError(t, err, fmt.Sprintf("%q: %s", filename, tc.err))
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.layout, *layout)
+			}
+		})
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		filename := writeLayout(t, HeaderSize, 16*MiB, HeaderSize, xfsSuperblock)
+		file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer file.Close()
+		if _, err := file.WriteAt([]byte{1}, int64(daxHeaderOffset+100)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_, err = ReadLayout(filename)
+		assert.EqualError(t, err, fmt.Sprintf("%q: DAX metadata: invalid checksum", filename))
+	})
+
+	t.Run("grow", func(t *testing.T) {
+		filename := writeLayout(t, HeaderSize, 16*MiB, HeaderSize, xfsSuperblock)
+		file, err := os.OpenFile(filename, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer file.Close()
+		if err := file.Truncate(int64(HeaderSize + 32*MiB)); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		if err := writePartitionSize(file, 32*MiB); err != nil {
+			t.Fatalf("grow partition: %v", err)
+		}
+		layout, err := ReadLayout(filename)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 32*MiB, layout.PartitionSize, "partition size")
+		}
+
+		err = Resize(filename, 16*MiB)
+		assert.EqualError(t, err, fmt.Sprintf("%q: shrinking from %d to %d bytes is not supported", filename, HeaderSize+32*MiB, 16*MiB))
+	})
+}
+
+func TestCanGrow(t *testing.T) {
+	xfsSuperblock := func(size Bytes) []byte {
+		superblock := make([]byte, superblockSize)
+		copy(superblock, "XFSB")
+		binary.BigEndian.PutUint32(superblock[4:8], uint32(BlockSize))
+		binary.BigEndian.PutUint64(superblock[8:16], uint64(size/BlockSize))
+		return superblock
+	}
+
+	testcases := map[string]struct {
+		fsSize Bytes
+		free   Bytes
+		grow   bool
+	}{
+		"full": {
+			fsSize: 16 * MiB,
+		},
+		"little-free-space": {
+			fsSize: 16 * MiB,
+			free:   DaxAlignment - BlockSize,
+		},
+		"expanded-volume": {
+			fsSize: 16 * MiB,
+			free:   DaxAlignment,
+			grow:   true,
+		},
+		"small-filesystem": {
+			fsSize: 16*MiB - DaxAlignment,
+			grow:   true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			filename := writeLayout(t, HeaderSize, 16*MiB, HeaderSize, xfsSuperblock(tc.fsSize))
+			defer func(f func(int, *unix.Statfs_t) error) {
+				fstatfs = f
+			}(fstatfs)
+			fstatfs = func(fd int, stat *unix.Statfs_t) error {
+				stat.Bsize = int64(BlockSize)
+				stat.Bfree = uint64(tc.free / BlockSize)
+				return nil
+			}
+			grow, err := CanGrow(filename)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.grow, grow)
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	xfsSuperblock := make([]byte, superblockSize)
+	copy(xfsSuperblock, "XFSB")
+	binary.BigEndian.PutUint32(xfsSuperblock[4:8], uint32(BlockSize))
+	binary.BigEndian.PutUint64(xfsSuperblock[8:16], uint64(16*MiB/BlockSize))
+
+	write := func(offset Bytes, data []byte) func(t *testing.T, file *os.File) {
+		return func(t *testing.T, file *os.File) {
+			if _, err := file.WriteAt(data, int64(offset)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+	}
+
+	testcases := map[string]struct {
+		modify func(t *testing.T, file *os.File)
+		err    string
+	}{
+		"okay": {},
+		"no-mbr": {
+			modify: write(510, []byte{0, 0}),
+			err:    "no MBR",
+		},
+		"unused": {
+			modify: write(mbrPartitionOffset+4, []byte{0}),
+			err:    "first partition is unused",
+		},
+		"signature": {
+			modify: write(daxHeaderOffset, []byte("X")),
+			err:    "DAX metadata: invalid signature, DAX metadata: invalid checksum",
+		},
+		"alignment": {
+			modify: func(t *testing.T, file *os.File) {
+				write(daxHeaderOffset, nsdax(uint(HeaderSize), 3*uint(MiB)))(t, file)
+			},
+			err: "DAX alignment 3145728 is not a power of two",
+		},
+		"size": {
+			modify: func(t *testing.T, file *os.File) {
+				if err := file.Truncate(int64(HeaderSize + 17*MiB)); err != nil {
+					t.Fatalf("truncate: %v", err)
+				}
+			},
+			err: fmt.Sprintf("file size %d is not aligned to %d", HeaderSize+17*MiB, DaxAlignment),
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			filename := writeLayout(t, HeaderSize, 16*MiB, HeaderSize, xfsSuperblock)
+			if tc.modify != nil {
+				file, err := os.OpenFile(filename, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				defer file.Close()
+				tc.modify(t, file)
+			}
+
+			d, err := Inspect(filename)
+			if !assert.NoError(t, err, "inspect") {
+				return
+			}
+			err = Verify(filename)
+			if tc.err != "" {
+				assert.EqualError(t, err, fmt.Sprintf("%q: %s", filename, tc.err))
+				return
+			}
+			assert.NoError(t, err, "verify")
+			assert.Equal(t, Description{
+				Size: HeaderSize + 16*MiB,
+				MBR:  true,
+				Partitions: [4]Partition{
+					{Type: 0x83, Start: HeaderSize, Size: 16 * MiB},
+				},
+				DAX: DAXMetadata{
+					Signature:        pfnSignature,
+					VersionMinor:     2,
+					DataOffset:       HeaderSize,
+					Mode:             1, // PFN_MODE_RAM
+					Alignment:        DaxAlignment,
+					Checksum:         d.DAX.ExpectedChecksum,
+					ExpectedChecksum: d.DAX.ExpectedChecksum,
+				},
+				FsType: Xfs,
+				FsSize: 16 * MiB,
+			}, *d)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+/*
+
+Copyright (c) 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+
+*/
+
+package imagefile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Description contains everything that Inspect found in an image
+// file, regardless whether it is valid.
+type Description struct {
+	// Size is the size of the file.
+	Size Bytes
+
+	// MBR is true if the file has the signature of a master boot
+	// record. The partitions are only set if it does.
+	MBR bool
+	// Partitions are the four primary partitions. Unused entries
+	// have type zero.
+	Partitions [4]Partition
+
+	// DAX is the content of the DAX metadata.
+	DAX DAXMetadata
+
+	// FsType is the filesystem in the first partition, empty if
+	// unknown. Ext4 is also used for ext2 and ext3.
+	FsType FsType
+	// FsSize is the size of that filesystem.
+	FsSize Bytes
+}
+
+// Partition is an entry in the MBR partition table.
+type Partition struct {
+	Bootable bool
+	Type     byte
+	Start    Bytes
+	Size     Bytes
+}
+
+// DAXMetadata contains the fields from struct nd_pfn_sb which are
+// used by PMEM-CSI.
+type DAXMetadata struct {
+	Signature    string
+	VersionMajor uint16
+	VersionMinor uint16
+	DataOffset   Bytes
+	NPFNs        uint64
+	Mode         uint32
+	StartPad     uint32
+	EndTrunc     uint32
+	Alignment    Bytes
+
+	// Checksum is the stored checksum, ExpectedChecksum the one
+	// calculated for the current content.
+	Checksum         uint64
+	ExpectedChecksum uint64
+}
+
+// pfnSignature is PFN_SIG without the trailing null byte.
+const pfnSignature = "NVDIMM_PFN_INFO"
+
+// Inspect reads the MBR, the DAX metadata and the filesystem
+// superblock of an image file. It only fails when the file cannot
+// be read. Use Verify to check the result.
+func Inspect(filename string) (*Description, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return inspect(file)
+}
+
+func inspect(file *os.File) (*Description, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	d := &Description{
+		Size: Bytes(fi.Size()),
+	}
+	if d.Size < daxHeaderOffset+daxHeaderSize {
+		return nil, fmt.Errorf("%q: file too small for image file: %d bytes", file.Name(), d.Size)
+	}
+
+	mbr := make([]byte, sectorSize)
+	if _, err := file.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("read MBR from %q: %w", file.Name(), err)
+	}
+	d.MBR = mbr[510] == 0x55 && mbr[511] == 0xAA
+	if d.MBR {
+		for i := range d.Partitions {
+			entry := mbr[mbrPartitionOffset+i*16 : mbrPartitionOffset+(i+1)*16]
+			d.Partitions[i] = Partition{
+				Bootable: entry[0] == 0x80,
+				Type:     entry[4],
+				Start:    Bytes(binary.LittleEndian.Uint32(entry[8:12])) * sectorSize,
+				Size:     Bytes(binary.LittleEndian.Uint32(entry[12:16])) * sectorSize,
+			}
+		}
+	}
+
+	sb := make([]byte, daxHeaderSize)
+	if _, err := file.ReadAt(sb, int64(daxHeaderOffset)); err != nil {
+		return nil, fmt.Errorf("read DAX metadata from %q: %w", file.Name(), err)
+	}
+	d.DAX, err = parseNsdax(sb)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", file.Name(), err)
+	}
+
+	partition := d.Partitions[0]
+	if partition.Type != 0 && partition.Start+superblockSize <= d.Size {
+		superblock := make([]byte, superblockSize)
+		if _, err := file.ReadAt(superblock, int64(partition.Start)); err != nil {
+			return nil, fmt.Errorf("read filesystem superblock from %q: %w", file.Name(), err)
+		}
+		d.FsType, d.FsSize = detectFilesystem(superblock)
+	}
+
+	return d, nil
+}
+
+// Verify inspects an image file and checks that the guest kernel
+// and PMEM-CSI can use it.
+func Verify(filename string) error {
+	d, err := Inspect(filename)
+	if err != nil {
+		return err
+	}
+	if err := d.Verify(); err != nil {
+		return fmt.Errorf("%q: %w", filename, err)
+	}
+	return nil
+}
+
+// Verify checks the partition table, the checksum of the DAX
+// metadata and the alignment constraints. All problems are
+// reported in a single error.
+func (d *Description) Verify() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	partition := d.Partitions[0]
+	switch {
+	case !d.MBR:
+		problem("no MBR")
+	case partition.Type == 0:
+		problem("first partition is unused")
+	default:
+		if partition.Start < daxHeaderOffset+daxHeaderSize {
+			problem("partition at offset %d overlaps with DAX metadata", partition.Start)
+		}
+		if end := partition.Start + partition.Size; end > d.Size {
+			problem("partition ends at %d, beyond the end of the file at %d", end, d.Size)
+		}
+		if d.DAX.DataOffset != partition.Start {
+			problem("DAX data offset %d does not match partition offset %d", d.DAX.DataOffset, partition.Start)
+		}
+	}
+
+	if d.DAX.Signature != pfnSignature {
+		problem("DAX metadata: invalid signature")
+	}
+	if d.DAX.Checksum != d.DAX.ExpectedChecksum {
+		problem("DAX metadata: invalid checksum")
+	}
+	align := d.DAX.Alignment
+	switch {
+	case align == 0 || align&(align-1) != 0:
+		problem("DAX alignment %d is not a power of two", align)
+	default:
+		if d.DAX.DataOffset%align != 0 {
+			problem("DAX data offset %d is not aligned to %d", d.DAX.DataOffset, align)
+		}
+		if d.Size%align != 0 {
+			problem("file size %d is not aligned to %d", d.Size, align)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Layout returns the layout of a valid image file.
+func (d *Description) Layout() *Layout {
+	return &Layout{
+		PartitionStart: d.Partitions[0].Start,
+		PartitionSize:  d.Partitions[0].Size,
+		DataOffset:     d.DAX.DataOffset,
+		Alignment:      d.DAX.Alignment,
+		FsType:         d.FsType,
+		FsSize:         d.FsSize,
+	}
+}
@@ -0,0 +1,315 @@
+/*
+
+Copyright (c) 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+
+*/
+
+package imagefile
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/intel/pmem-csi/pkg/volumepathhandler"
+)
+
+const (
+	// Size of the MBR and of the sectors that it counts in.
+	sectorSize = Bytes(512)
+
+	// Offset of the first partition entry in the MBR.
+	mbrPartitionOffset = 446
+
+	// Size of struct nd_pfn_sb.
+	daxHeaderSize = 4 * KiB
+
+	// Number of bytes at the start of a partition which are
+	// needed to detect the filesystem inside it.
+	superblockSize = 2 * KiB
+)
+
+// Layout describes an existing image file.
+type Layout struct {
+	// PartitionStart is the offset of the partition in the file.
+	PartitionStart Bytes
+	// PartitionSize is the size of the partition.
+	PartitionSize Bytes
+
+	// DataOffset is the offset of the data as seen by the NVDIMM
+	// driver. It must be the same as PartitionStart.
+	DataOffset Bytes
+	// Alignment is the base alignment of the DAX mapping.
+	Alignment Bytes
+
+	// FsType is the filesystem inside the partition, empty if
+	// unknown. Ext4 is also used for ext2 and ext3.
+	FsType FsType
+	// FsSize is the size of that filesystem.
+	FsSize Bytes
+}
+
+// ReadLayout determines the layout of an existing image file by
+// parsing the MBR, the DAX metadata and the filesystem superblock.
+// An error is returned when Verify finds problems.
+func ReadLayout(filename string) (*Layout, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readLayout(file)
+}
+
+func readLayout(file *os.File) (*Layout, error) {
+	d, err := inspect(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Verify(); err != nil {
+		return nil, fmt.Errorf("%q: %w", file.Name(), err)
+	}
+	return d.Layout(), nil
+}
+
+// detectFilesystem checks for the magic numbers of the supported
+// filesystems and returns the type and size of the one that is
+// found.
+func detectFilesystem(superblock []byte) (FsType, Bytes) {
+	// XFS: struct xfs_dsb at offset 0, big endian.
+	if string(superblock[0:4]) == "XFSB" {
+		blockSize := Bytes(binary.BigEndian.Uint32(superblock[4:8]))
+		blocks := Bytes(binary.BigEndian.Uint64(superblock[8:16]))
+		return Xfs, blocks * blockSize
+	}
+
+	// ext2/3/4: struct ext4_super_block at offset 1024, little endian.
+	ext := superblock[1024:]
+	if binary.LittleEndian.Uint16(ext[0x38:0x3a]) == 0xEF53 {
+		blockSize := Bytes(1024) << binary.LittleEndian.Uint32(ext[0x18:0x1c])
+		blocks := Bytes(binary.LittleEndian.Uint32(ext[0x4:0x8]))
+		const incompat64Bit = 0x80
+		if binary.LittleEndian.Uint32(ext[0x60:0x64])&incompat64Bit != 0 {
+			blocks |= Bytes(binary.LittleEndian.Uint32(ext[0x150:0x154])) << 32
+		}
+		return Ext4, blocks * blockSize
+	}
+
+	return "", 0
+}
+
+// CanGrow checks whether Resize with size zero would change the image
+// file. That is the case when the filesystem which contains the file
+// has enough free space for growing the partition, for example after
+// expanding the volume, or when the filesystem inside the partition is
+// smaller than the partition, for example because an earlier Resize
+// was interrupted.
+func CanGrow(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	layout, err := readLayout(file)
+	if err != nil {
+		return false, err
+	}
+	if layout.PartitionSize-layout.FsSize >= DaxAlignment {
+		return true, nil
+	}
+	maxSize, err := maxFileSize(file)
+	if err != nil {
+		return false, err
+	}
+	return maxSize > layout.PartitionStart+layout.PartitionSize, nil
+}
+
+// Resize grows an existing image file to a certain total size. If
+// size is zero, then the image file will be made as large as
+// possible. Shrinking is not supported.
+//
+// The partition, the DAX metadata and the filesystem inside the
+// partition all get updated. Growing the filesystem is done online
+// through a loop device, which needs root privileges. The image file
+// must not be in use while resizing it.
+//
+// Resize is idempotent: a filesystem which is smaller than its
+// partition gets grown even if the file itself does not change.
+func Resize(filename string, size Bytes) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	layout, err := readLayout(file)
+	if err != nil {
+		return err
+	}
+	switch layout.FsType {
+	case Ext4, Xfs:
+	default:
+		return fmt.Errorf("%q: cannot resize partition without known filesystem", filename)
+	}
+	end := layout.PartitionStart + layout.PartitionSize
+	if size != 0 && size < end {
+		return fmt.Errorf("%q: shrinking from %d to %d bytes is not supported", filename, end, size)
+	}
+
+	newEnd := end
+	switch {
+	case size == 0:
+		newEnd, err = growFile(file, end)
+	case size > end:
+		newEnd, err = allocateFile(file, size)
+	}
+	if err != nil {
+		return err
+	}
+
+	if newEnd > end {
+		layout.PartitionSize = newEnd - layout.PartitionStart
+		if err := writePartitionSize(file, layout.PartitionSize); err != nil {
+			return err
+		}
+		// The DAX metadata does not depend on the size (npfns
+		// is zero, so the kernel calculates it), but it gets
+		// written again to ensure that it is complete.
+		if _, err := file.WriteAt(nsdax(uint(layout.DataOffset), uint(layout.Alignment)), int64(daxHeaderOffset)); err != nil {
+			return err
+		}
+		// Same padding as in Create.
+		paddedSize := (newEnd + DaxAlignment - 1) / DaxAlignment * DaxAlignment
+		if err := file.Truncate(int64(paddedSize)); err != nil {
+			return fmt.Errorf("resize %q to %d: %w", filename, paddedSize, err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("syncing %q: %w", filename, err)
+		}
+	}
+
+	// Filesystems may leave some space at the end of the partition
+	// unused, so only try to grow them when there is a substantial
+	// difference.
+	if layout.PartitionSize-layout.FsSize < DaxAlignment {
+		return nil
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing %q: %w", filename, err)
+	}
+	return growFilesystem(filename, layout)
+}
+
+// growFile increases the size of the file in DaxAlignment steps as
+// much as possible. The allocated size gets returned. It is the same
+// as the current end if the file cannot grow.
+func growFile(file *os.File, end Bytes) (Bytes, error) {
+	maxSize, err := maxFileSize(file)
+	if err != nil {
+		return 0, err
+	}
+	for size := maxSize; size > end; size -= DaxAlignment {
+		err := unix.Fallocate(int(file.Fd()), 0, 0, int64(size))
+		if err == nil {
+			return size, nil
+		}
+		if !errors.Is(err, syscall.ENOSPC) {
+			return 0, fmt.Errorf("fallocate %q size %d: %w", file.Name(), size, err)
+		}
+	}
+	return end, nil
+}
+
+// fstatfs can be replaced in tests.
+var fstatfs = unix.Fstatfs
+
+// maxFileSize returns how large the file could become with the free
+// space in its filesystem, rounded down to DaxAlignment.
+func maxFileSize(file *os.File) (Bytes, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var stat unix.Statfs_t
+	if err := fstatfs(int(file.Fd()), &stat); err != nil {
+		return 0, fmt.Errorf("unexpected error while checking the volume statistics for %q: %v", file.Name(), err)
+	}
+	return (Bytes(fi.Size()) + Bytes(int64(stat.Bfree)*stat.Bsize)) / DaxAlignment * DaxAlignment, nil
+}
+
+// writePartitionSize updates the first partition in the MBR. The
+// CHS address of the last sector is left unchanged because Linux
+// ignores it.
+func writePartitionSize(file *os.File, size Bytes) error {
+	sectors := size / sectorSize
+	if sectors > math.MaxUint32 {
+		return fmt.Errorf("%q: partition size %d too large for MBR", file.Name(), size)
+	}
+	buffer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buffer, uint32(sectors))
+	if _, err := file.WriteAt(buffer, mbrPartitionOffset+12); err != nil {
+		return fmt.Errorf("update MBR in %q: %w", file.Name(), err)
+	}
+	return nil
+}
+
+// growFilesystem makes the filesystem as large as the partition.
+func growFilesystem(filename string, layout *Layout) (finalErr error) {
+	ctx := context.Background()
+	handler := volumepathhandler.VolumePathHandler{}
+	// An existing loop device would be reused by
+	// AttachFileDeviceWithOptions, without the size limit.
+	if loopDev, err := handler.GetLoopDevice(ctx, filename); err == nil {
+		return fmt.Errorf("%q: in use by loop device %s", filename, loopDev)
+	}
+	loopDev, err := handler.AttachFileDeviceWithOptions(ctx, filename, volumepathhandler.LoopOptions{
+		Offset:    int64(layout.PartitionStart),
+		SizeLimit: int64(layout.PartitionSize),
+	})
+	if err != nil {
+		return fmt.Errorf("create loop device for %q: %w", filename, err)
+	}
+	defer func() {
+		if err := handler.DetachFileDevice(ctx, filename); err != nil && finalErr == nil {
+			finalErr = fmt.Errorf("remove loop device %s: %w", loopDev, err)
+		}
+	}()
+
+	mountPoint, err := ioutil.TempDir("", "pmem-csi-imagefile")
+	if err != nil {
+		return fmt.Errorf("temp dir: %w", err)
+	}
+	// Not RemoveAll: that would wipe the filesystem if unmounting failed.
+	defer os.Remove(mountPoint)
+	if err := unix.Mount(loopDev, mountPoint, string(layout.FsType), 0, ""); err != nil {
+		return fmt.Errorf("mount %s: %w", loopDev, err)
+	}
+	defer func() {
+		if err := unix.Unmount(mountPoint, 0); err != nil && finalErr == nil {
+			finalErr = fmt.Errorf("unmount %s: %w", mountPoint, err)
+		}
+	}()
+
+	var cmd *exec.Cmd
+	switch layout.FsType {
+	case Ext4:
+		cmd = exec.Command("resize2fs", loopDev)
+	case Xfs:
+		cmd = exec.Command("xfs_growfs", "-d", mountPoint)
+	}
+	if _, err := cmd.Output(); err != nil {
+		return fmt.Errorf("%s for %q: %w", cmd.Args[0], filename, err)
+	}
+	return nil
+}
@@ -46,7 +46,7 @@ func ImageFile(t TInterface) {
 		return resource.NewQuantity(int64(size), resource.BinarySI).String()
 	}
 
-	// Try with ext4 and XFS.
+	// Try with all filesystems and without.
 	run := func(fs imagefile.FsType) {
 		t.Outer(string(fs), func(t TInterface) {
 			// Try with a variety of sizes because the image file is
@@ -70,6 +70,75 @@ func ImageFile(t TInterface) {
 	}
 	run(imagefile.Ext4)
 	run(imagefile.Xfs)
+	run(imagefile.Ext2)
+	run(imagefile.Raw)
+
+	t.Outer("from image", func(t TInterface) {
+		t.Inner(string(imagefile.Ext4), func(t TInterface) {
+			testImageFileFromImage(t, imagefile.Ext4)
+		})
+		t.Inner(string(imagefile.Raw), func(t TInterface) {
+			testImageFileFromImage(t, imagefile.Raw)
+		})
+	})
+}
+
+func testImageFileFromImage(t TInterface, fs imagefile.FsType) {
+	if _, err := exec.LookPath("parted"); err != nil {
+		t.Skipf("parted not found: %v", err)
+	}
+
+	const srcSize = 64 * imagefile.MiB
+	const data = "hello world"
+	src, err := ioutil.TempFile("", "source")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	defer rmTmpfile(src)
+	if err := src.Truncate(int64(srcSize)); err != nil {
+		t.Fatalf("resize source: %v", err)
+	}
+	switch fs {
+	case imagefile.Ext4:
+		if _, err := exec.Command("mkfs.ext4", "-b", fmt.Sprintf("%d", imagefile.BlockSize), src.Name()).Output(); err != nil {
+			logStderr(t, err)
+			t.Fatalf("mkfs.ext4: %v", err)
+		}
+	default:
+		if _, err := src.WriteAt([]byte(data), int64(imagefile.MiB)); err != nil {
+			t.Fatalf("write source: %v", err)
+		}
+	}
+
+	file, err := ioutil.TempFile("", "image")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	defer rmTmpfile(file)
+	if err := imagefile.CreateFromImage(file.Name(), src.Name()); err != nil {
+		logStderr(t, err)
+		t.Fatalf("failed to create image file: %v", err)
+	}
+
+	assert.NoError(t, imagefile.Verify(file.Name()), "verify image file")
+	layout, err := imagefile.ReadLayout(file.Name())
+	if err != nil {
+		t.Fatalf("failed to read layout: %v", err)
+	}
+	assert.Equal(t, imagefile.HeaderSize, layout.PartitionStart, "partition start")
+	assert.Equal(t, srcSize, layout.PartitionSize, "partition size")
+	switch fs {
+	case imagefile.Ext4:
+		assert.Equal(t, fs, layout.FsType, "filesystem")
+		assert.Equal(t, srcSize, layout.FsSize, "filesystem size")
+	default:
+		assert.Empty(t, layout.FsType, "filesystem")
+		buffer := make([]byte, len(data))
+		if _, err := file.ReadAt(buffer, int64(imagefile.HeaderSize+imagefile.MiB)); err != nil {
+			t.Fatalf("read image file: %v", err)
+		}
+		assert.Equal(t, data, string(buffer), "copied data")
+	}
 }
 
 func testImageFile(t TInterface, fs imagefile.FsType, size imagefile.Bytes, expectedError string) {
@@ -101,6 +170,57 @@ func testImageFile(t TInterface, fs imagefile.FsType, size imagefile.Bytes, expe
 	}
 	assert.GreaterOrEqual(t, fi.Size(), int64(size), "nominal image size")
 
+	assert.NoError(t, imagefile.Verify(file.Name()), "verify image file")
+	layout, err := imagefile.ReadLayout(file.Name())
+	if err != nil {
+		t.Fatalf("failed to read layout: %v", err)
+	}
+	assert.Equal(t, imagefile.HeaderSize, layout.PartitionStart, "partition start")
+	assert.Equal(t, size-imagefile.HeaderSize, layout.PartitionSize, "partition size")
+	assert.Equal(t, layout.PartitionStart, layout.DataOffset, "DAX data offset")
+	switch fs {
+	case imagefile.Ext2:
+		// Not distinguished from ext4.
+		assert.Equal(t, imagefile.Ext4, layout.FsType, "filesystem")
+	case imagefile.Raw:
+		assert.Empty(t, layout.FsType, "filesystem")
+		assert.Zero(t, layout.FsSize, "filesystem size")
+		data := make([]byte, imagefile.MiB)
+		if _, err := file.ReadAt(data, int64(layout.PartitionStart)); err != nil {
+			t.Fatalf("read partition: %v", err)
+		}
+		assert.Equal(t, make([]byte, imagefile.MiB), data, "partition content")
+
+		// Without a filesystem, the size of the partition
+		// cannot be changed and there is nothing to mount.
+		err := imagefile.Resize(file.Name(), size+64*imagefile.MiB)
+		assert.EqualError(t, err, fmt.Sprintf("%q: cannot resize partition without known filesystem", file.Name()), "resize")
+		return
+	default:
+		assert.Equal(t, fs, layout.FsType, "filesystem")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Log("for testing resizing, run as root")
+	} else {
+		newSize := size + 64*imagefile.MiB
+		if err := imagefile.Resize(file.Name(), newSize); err != nil {
+			logStderr(t, err)
+			t.Fatalf("failed to resize image file: %v", err)
+		}
+		assert.NoError(t, imagefile.Verify(file.Name()), "verify image file after resizing")
+		layout, err := imagefile.ReadLayout(file.Name())
+		if err != nil {
+			t.Fatalf("failed to read layout after resizing: %v", err)
+		}
+		assert.Equal(t, newSize-imagefile.HeaderSize, layout.PartitionSize, "partition size after resizing")
+		assert.Greater(t, int64(layout.FsSize), int64(size-imagefile.HeaderSize), "filesystem size after resizing")
+		fi, err = file.Stat()
+		if err != nil {
+			t.Fatalf("failed to stat image file: %v", err)
+		}
+	}
+
 	if os.Getenv("REPO_ROOT") == "" || os.Getenv("CLUSTER") == "" {
 		t.Log("for testing the image under QEMU, download files for a cluster and set REPO_ROOT and CLUSTER")
 		return
@@ -139,7 +259,7 @@ func testImageFile(t TInterface, fs imagefile.FsType, size imagefile.Bytes, expe
 		t.Fatalf("check-imagefile.sh failed: %v", err)
 	}
 	fsReadableForm := fs // %T output from stat
-	if fs == imagefile.Ext4 {
+	if fs == imagefile.Ext4 || fs == imagefile.Ext2 {
 		// We don't bother with checking what is actually mounted,
 		// this is close enough.
 		fsReadableForm = "ext2/ext3"
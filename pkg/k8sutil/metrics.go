@@ -0,0 +1,125 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package k8sutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrWrongPod is returned by NodeMetrics for a pod which does not
+// belong to the expected driver instance.
+var ErrWrongPod = errors.New("wrong driver pod")
+
+// MetricSample is one sample of a metric.
+type MetricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricValues contains all samples of each metric, indexed by
+// metric name.
+type MetricValues map[string][]MetricSample
+
+// Get returns the value of the first sample of the metric which has
+// all of the given labels.
+func (m MetricValues) Get(name string, labels map[string]string) (float64, bool) {
+	for _, sample := range m[name] {
+		matches := true
+		for key, value := range labels {
+			if sample.Labels[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return sample.Value, true
+		}
+	}
+	return 0, false
+}
+
+// NodeMetrics retrieves the samples of all "pmem_" gauges from the
+// metrics endpoint of a PMEM-CSI node driver. The driver name is
+// checked to allow more than one driver instance per node.
+func NodeMetrics(client *http.Client, url, driverName string) (MetricValues, error) {
+	// TODO (?): negotiate encoding (https://pkg.go.dev/github.com/prometheus/common/expfmt#Negotiate)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %s", resp.Status)
+	}
+	decoder := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	var metrics dto.MetricFamily
+	values := MetricValues{}
+
+	for {
+		err := decoder.Decode(&metrics)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("decode response: %v", err)
+		}
+		if !strings.HasPrefix(metrics.GetName(), "pmem_") {
+			continue
+		}
+		for _, metric := range metrics.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "driver_name" &&
+					label.GetValue() != driverName {
+					return nil, ErrWrongPod
+				}
+				labels[label.GetName()] = label.GetValue()
+			}
+			// "driver_name" was not present yet in PMEM-CSI 0.8.0, so
+			// we cannot fail when it is missing.
+			gauge := metric.GetGauge()
+			if gauge == nil {
+				continue
+			}
+			values[metrics.GetName()] = append(values[metrics.GetName()], MetricSample{
+				Labels: labels,
+				Value:  gauge.GetValue(),
+			})
+		}
+	}
+
+	// If we get here without finding what we look for, we must be talking
+	// to the wrong pod and should keep looking.
+	if _, ok := values.Get("pmem_amount_max_volume_size", nil); !ok {
+		return nil, ErrWrongPod
+	}
+	return values, nil
+}
+
+// MetricsURL returns the URL of the metrics endpoint of the driver
+// container in a node pod, or an empty string if there is none.
+func MetricsURL(pod *corev1.Pod) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == "pmem-driver" {
+			for _, containerPort := range container.Ports {
+				if containerPort.Name == "metrics" {
+					return fmt.Sprintf("http://%s:%d/metrics", pod.Status.PodIP, containerPort.ContainerPort)
+				}
+			}
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package k8sutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeMetrics(t *testing.T) {
+	testcases := map[string]struct {
+		metrics     string
+		expectErr   error
+		expectValue map[string]float64
+	}{
+		"one-node": {
+			metrics: `# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name="pmem-csi.intel.com",node="worker1"} 1024
+# TYPE pmem_volumes gauge
+pmem_volumes{driver_name="pmem-csi.intel.com",node="worker1"} 3
+`,
+			expectValue: map[string]float64{
+				"worker1/pmem_amount_max_volume_size": 1024,
+				"worker1/pmem_volumes":                3,
+			},
+		},
+		"two-nodes": {
+			metrics: `# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name="pmem-csi.intel.com",node="worker1"} 1024
+pmem_amount_max_volume_size{driver_name="pmem-csi.intel.com",node="worker2"} 2048
+`,
+			expectValue: map[string]float64{
+				"worker1/pmem_amount_max_volume_size": 1024,
+				"worker2/pmem_amount_max_volume_size": 2048,
+			},
+		},
+		"other-metrics": {
+			metrics: `# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name="pmem-csi.intel.com",node="worker1"} 1024
+# TYPE pmem_fsck_total counter
+pmem_fsck_total{driver_name="pmem-csi.intel.com",node="worker1",result="ok"} 1
+# TYPE csi_sidecar_operations_seconds gauge
+csi_sidecar_operations_seconds{driver_name="other"} 1
+`,
+			expectValue: map[string]float64{
+				"worker1/pmem_amount_max_volume_size": 1024,
+			},
+		},
+		"wrong-driver": {
+			metrics: `# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name="other",node="worker1"} 1024
+`,
+			expectErr: ErrWrongPod,
+		},
+		"no-capacity": {
+			metrics: `# TYPE pmem_volumes gauge
+pmem_volumes{driver_name="pmem-csi.intel.com",node="worker1"} 3
+`,
+			expectErr: ErrWrongPod,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				fmt.Fprint(w, tc.metrics)
+			}))
+			defer server.Close()
+
+			values, err := NodeMetrics(server.Client(), server.URL, "pmem-csi.intel.com")
+			if tc.expectErr != nil {
+				assert.Equal(t, tc.expectErr, err)
+				return
+			}
+			require.NoError(t, err, "NodeMetrics")
+			actual := map[string]float64{}
+			for name, samples := range values {
+				for _, sample := range samples {
+					actual[sample.Labels["node"]+"/"+name] = sample.Value
+				}
+			}
+			assert.Equal(t, tc.expectValue, actual, "samples")
+			value, ok := values.Get("pmem_amount_max_volume_size", map[string]string{"node": "worker1"})
+			assert.True(t, ok, "worker1 found")
+			assert.Equal(t, float64(1024), value, "worker1 value")
+			_, ok = values.Get("pmem_amount_max_volume_size", map[string]string{"node": "no-such-node"})
+			assert.False(t, ok, "unknown node found")
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"fmt"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// MergePodOverrides applies the overrides to a pod template in JSON
+// format with a strategic merge patch. Env is added to all
+// containers and init containers. The template is returned
+// unmodified when there are no overrides.
+func MergePodOverrides(template []byte, overrides *api.PodOverrides) ([]byte, error) {
+	if overrides == nil {
+		return template, nil
+	}
+
+	var pod corev1.PodTemplateSpec
+	if err := json.Unmarshal(template, &pod); err != nil {
+		return nil, fmt.Errorf("decode pod template: %v", err)
+	}
+
+	spec := map[string]interface{}{}
+	if overrides.Tolerations != nil {
+		spec["tolerations"] = overrides.Tolerations
+	}
+	if overrides.Affinity != nil {
+		spec["affinity"] = overrides.Affinity
+	}
+	if overrides.PriorityClassName != "" {
+		spec["priorityClassName"] = overrides.PriorityClassName
+	}
+	if overrides.TopologySpreadConstraints != nil {
+		spec["topologySpreadConstraints"] = overrides.TopologySpreadConstraints
+	}
+	if overrides.SecurityContext != nil {
+		spec["securityContext"] = overrides.SecurityContext
+	}
+	if len(overrides.Env) > 0 {
+		env := func(containers []corev1.Container) []interface{} {
+			var patch []interface{}
+			for _, container := range containers {
+				patch = append(patch, map[string]interface{}{
+					"name": container.Name,
+					"env":  overrides.Env,
+				})
+			}
+			return patch
+		}
+		if len(pod.Spec.Containers) > 0 {
+			spec["containers"] = env(pod.Spec.Containers)
+		}
+		if len(pod.Spec.InitContainers) > 0 {
+			spec["initContainers"] = env(pod.Spec.InitContainers)
+		}
+	}
+	patch := map[string]interface{}{
+		"spec": spec,
+	}
+	if len(overrides.Annotations) > 0 {
+		patch["metadata"] = map[string]interface{}{
+			"annotations": overrides.Annotations,
+		}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("encode patch: %v", err)
+	}
+	merged, err := strategicpatch.StrategicMergePatch(template, data, corev1.PodTemplateSpec{})
+	if err != nil {
+		return nil, fmt.Errorf("apply patch: %v", err)
+	}
+	return merged, nil
+}
+
+// ApplyPodOverrides is like MergePodOverrides for a pod template
+// object, which gets modified in place.
+func ApplyPodOverrides(template *corev1.PodTemplateSpec, overrides *api.PodOverrides) error {
+	if overrides == nil {
+		return nil
+	}
+	data, err := json.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("encode pod template: %v", err)
+	}
+	merged, err := MergePodOverrides(data, overrides)
+	if err != nil {
+		return err
+	}
+	var result corev1.PodTemplateSpec
+	if err := json.Unmarshal(merged, &result); err != nil {
+		return fmt.Errorf("decode pod template: %v", err)
+	}
+	*template = result
+	return nil
+}
@@ -7,13 +7,41 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcommon
 
 import (
+	"strings"
+
 	"github.com/intel/pmem-csi/pkg/ndctl"
 )
 
-func VgName(bus ndctl.Bus, region ndctl.Region) string {
+// namespaceName is the special alt name that a namespace must have
+// to be managed by PMEM-CSI in LVM mode.
+const namespaceName = "pmem-csi"
+
+// NamespaceName returns the alt name of the namespaces which are used
+// for volume groups by a driver instance. The default instance (empty
+// name) uses "pmem-csi", other instances add their name to that.
+func NamespaceName(instance string) string {
+	if instance == "" {
+		return namespaceName
+	}
+	return namespaceName + "-" + instance
+}
+
+// IsNamespaceName returns true for the alt names that are used for
+// volume groups by any driver instance.
+func IsNamespaceName(name string) bool {
+	return name == namespaceName || strings.HasPrefix(name, namespaceName+"-")
+}
+
+// VgName returns the name of the volume group for the region which is
+// used by a driver instance.
+func VgName(instance string, bus ndctl.Bus, region ndctl.Region) string {
 	// Hard-coded string to indicate all namespaces are in "FSDAX" mode.
 	nsmode := "fsdax"
 	// This is present to avoid API break: names used to indicate nsmode
 	// before the sector-mode support was dropped.
-	return bus.DeviceName() + region.DeviceName() + nsmode
+	name := bus.DeviceName() + region.DeviceName() + nsmode
+	if instance != "" {
+		name = instance + "-" + name
+	}
+	return name
 }
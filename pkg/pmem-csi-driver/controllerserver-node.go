@@ -27,25 +27,44 @@ import (
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/capabilities"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
 	"k8s.io/utils/keymutex"
+	"k8s.io/utils/mount"
 )
 
 type nodeVolume struct {
 	ID     string            `json:"id"`
 	Size   int64             `json:"size"`
 	Params map[string]string `json:"parameters"`
+
+	// Publishers are the target paths where the node server has
+	// published the staged volume.
+	Publishers []string `json:"publishers,omitempty"`
 }
 
 type nodeControllerServer struct {
 	*DefaultControllerServer
 	nodeID      string
+	instance    string
 	dm          pmdmanager.PmemDeviceManager
 	sm          pmemstate.StateManager
 	pmemVolumes map[string]*nodeVolume // map of reqID:nodeVolume
 	mutex       sync.Mutex             // lock for pmemVolumes
+
+	// capacityChanged, if set, gets called after creating or deleting a volume.
+	capacityChanged func()
+
+	// sharedDirectory is where the backing volumes of
+	// subdirectory volumes get mounted.
+	sharedDirectory string
+	// sharedMutex serializes creating and deleting subdirectory
+	// volumes and their backing volumes.
+	sharedMutex sync.Mutex
+	mounter     mount.Interface
+	sharedFS    sharedFS
 }
 
 var _ csi.ControllerServer = &nodeControllerServer{}
@@ -53,21 +72,18 @@ var _ grpcserver.Service = &nodeControllerServer{}
 
 var nodeVolumeMutex = keymutex.NewHashed(-1)
 
-func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
+func NewNodeControllerServer(ctx context.Context, nodeID, instance string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
 	ctx, logger := pmemlog.WithName(ctx, "NewNodeControllerServer")
 
-	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-	}
-
 	ncs := &nodeControllerServer{
-		DefaultControllerServer: NewDefaultControllerServer(serverCaps),
+		DefaultControllerServer: NewDefaultControllerServer(capabilities.Controller),
 		nodeID:                  nodeID,
+		instance:                instance,
 		dm:                      dm,
 		sm:                      sm,
 		pmemVolumes:             map[string]*nodeVolume{},
+		mounter:                 mount.New(""),
+		sharedFS:                xfsSharedFS{},
 	}
 
 	// Restore provisioned volumes from state.
@@ -78,6 +94,7 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 			logger.Error(err, "Failed to get volumes")
 		}
 		cleanupList := []string{}
+		subdirectories := []*nodeVolume{}
 		ids, err := sm.GetAll()
 		if err != nil {
 			logger.Error(err, "Failed to load state")
@@ -95,10 +112,15 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 				logger.Error(err, "Failed to parse volume parameters for volume", "volume-id", id)
 				continue
 			}
+			if v.GetSharedVolume() != "" {
+				// Checked below once all backing volumes are known.
+				subdirectories = append(subdirectories, vol)
+				continue
+			}
 
 			found := false
 			if v.GetDeviceMode() != dm.GetMode() {
-				dm, err := pmdmanager.New(ctx, v.GetDeviceMode(), 0)
+				dm, err := pmdmanager.New(ctx, v.GetDeviceMode(), 0, instance)
 				if err != nil {
 					logger.Error(err, "Failed to initialize device manager for state volume", "volume-id", id, "device-mode", v.GetDeviceMode())
 					continue
@@ -129,6 +151,14 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 			}
 		}
 
+		for _, vol := range subdirectories {
+			if ncs.getVolumeByName(sharedVolumeName(vol.Params[parameters.SharedVolume])) != nil {
+				ncs.pmemVolumes[vol.ID] = vol
+			} else {
+				cleanupList = append(cleanupList, vol.ID)
+			}
+		}
+
 		for _, id := range cleanupList {
 			if err := sm.Delete(id); err != nil {
 				logger.Error(err, "Failed to remove stale volume from state", "volume-id", id)
@@ -216,6 +246,15 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	// getVolumeByName.
 	p.Name = &volumeName
 
+	if err := validateAccessModes(volumeCapabilities); err != nil {
+		statusErr = status.Error(codes.InvalidArgument, err.Error())
+		return
+	}
+	if err := validateFilesystemParameters(p, volumeCapabilities); err != nil {
+		statusErr = status.Error(codes.InvalidArgument, err.Error())
+		return
+	}
+
 	asked := capacity.GetRequiredBytes()
 	if vol := cs.getVolumeByName(volumeName); vol != nil {
 		// Check if the size of existing volume can cover the new request
@@ -246,6 +285,12 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		return
 	}
 
+	if p.GetSharedVolume() != "" {
+		actual = asked
+		statusErr = cs.createSubdirectoryVolume(ctx, p, volumeID, asked)
+		return
+	}
+
 	// Set which device manager was used to create the volume
 	mode := cs.dm.GetMode()
 	p.DeviceMode = &mode
@@ -274,6 +319,7 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		}()
 	}
 	actualSize, err := cs.dm.CreateDevice(ctx, volumeID, uint64(asked), p.GetUsage())
+	cs.notifyCapacityChanged()
 	if err != nil {
 		code := codes.Internal
 		if errors.Is(err, pmemerr.NotEnoughSpace) {
@@ -336,32 +382,66 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", volumeID, err)
 	}
 
-	dm := cs.dm
-	if dm.GetMode() != p.GetDeviceMode() {
-		dm, err = pmdmanager.New(ctx, p.GetDeviceMode(), 0)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
-		}
+	if p.GetSharedVolume() != "" {
+		err = cs.deleteSubdirectoryVolume(ctx, vol, p)
+	} else {
+		err = cs.deleteDevice(ctx, vol, p)
 	}
+	if err != nil {
+		// This is already a status error.
+		return nil, err
+	}
+
+	logger.V(4).Info("Volume deleted")
+	return &csi.DeleteVolumeResponse{}, nil
+}
 
-	if err := dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter()); err != nil {
+// deleteDevice removes the PMEM device of a volume and then the volume
+// itself. It returns a status error.
+func (cs *nodeControllerServer) deleteDevice(ctx context.Context, vol *nodeVolume, p parameters.Volume) error {
+	dm, err := cs.getDeviceManager(ctx, vol.ID, p)
+	if err != nil {
+		return err
+	}
+
+	err = dm.DeleteDevice(ctx, vol.ID, p.GetEraseAfter())
+	cs.notifyCapacityChanged()
+	if err != nil {
 		if errors.Is(err, pmemerr.DeviceInUse) {
-			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
+			return status.Errorf(codes.FailedPrecondition, err.Error())
 		}
-		return nil, status.Errorf(codes.Internal, "Failed to delete volume: %s", err.Error())
+		return status.Errorf(codes.Internal, "Failed to delete volume: %s", err.Error())
 	}
+	cs.forgetVolume(ctx, vol.ID)
+	return nil
+}
+
+// forgetVolume removes a volume from the persistent state and the
+// list of volumes.
+func (cs *nodeControllerServer) forgetVolume(ctx context.Context, volumeID string) {
 	if cs.sm != nil {
-		if err := cs.sm.Delete(req.VolumeId); err != nil {
-			logger.Error(err, "Failed to remove volume from state")
+		if err := cs.sm.Delete(volumeID); err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to remove volume from state", "volume-id", volumeID)
 		}
 	}
 
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
-	delete(cs.pmemVolumes, req.VolumeId)
+	delete(cs.pmemVolumes, volumeID)
+}
 
-	logger.V(4).Info("Volume deleted")
-	return &csi.DeleteVolumeResponse{}, nil
+// getDeviceManager returns the device manager which was used for
+// the volume. It returns a status error.
+func (cs *nodeControllerServer) getDeviceManager(ctx context.Context, volumeID string, p parameters.Volume) (pmdmanager.PmemDeviceManager, error) {
+	dm := cs.dm
+	if dm.GetMode() != p.GetDeviceMode() {
+		var err error
+		dm, err = pmdmanager.New(ctx, p.GetDeviceMode(), 0, cs.instance)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
+		}
+	}
+	return dm, nil
 }
 
 func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -378,13 +458,11 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 	if vol == nil {
 		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
 	}
-	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			return &csi.ValidateVolumeCapabilitiesResponse{
-				Confirmed: nil,
-				Message:   "Driver does not support '" + cap.AccessMode.Mode.String() + "' mode",
-			}, nil
-		}
+	if err := validateAccessModes(req.VolumeCapabilities); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Confirmed: nil,
+			Message:   err.Error(),
+		}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -405,6 +483,11 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 	// Copy from map into array for pagination.
 	vols := make([]*nodeVolume, 0, len(cs.pmemVolumes))
 	for _, vol := range cs.pmemVolumes {
+		// Backing volumes of subdirectory volumes were not
+		// created by the CO and thus are not listed.
+		if isSharedVolumeName(vol.Params[parameters.Name]) {
+			continue
+		}
 		vols = append(vols, vol)
 	}
 
@@ -486,6 +569,12 @@ func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCap
 	}, nil
 }
 
+func (cs *nodeControllerServer) notifyCapacityChanged() {
+	if cs.capacityChanged != nil {
+		cs.capacityChanged()
+	}
+}
+
 func (cs *nodeControllerServer) getVolumeByID(volumeID string) *nodeVolume {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
@@ -506,6 +595,63 @@ func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
 	return nil
 }
 
+// addPublisher records that the volume is published at the target
+// path and persists that. It is idempotent.
+func (cs *nodeControllerServer) addPublisher(volumeID, targetPath string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	vol, ok := cs.pmemVolumes[volumeID]
+	if !ok {
+		return fmt.Errorf("unknown volume %q", volumeID)
+	}
+	for _, publisher := range vol.Publishers {
+		if publisher == targetPath {
+			return nil
+		}
+	}
+	vol.Publishers = append(vol.Publishers, targetPath)
+	return cs.storePublishers(vol)
+}
+
+// removePublisher is the reverse of addPublisher. Unknown volumes
+// and target paths are ignored.
+func (cs *nodeControllerServer) removePublisher(volumeID, targetPath string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	vol, ok := cs.pmemVolumes[volumeID]
+	if !ok {
+		return nil
+	}
+	for i, publisher := range vol.Publishers {
+		if publisher == targetPath {
+			vol.Publishers = append(vol.Publishers[:i:i], vol.Publishers[i+1:]...)
+			return cs.storePublishers(vol)
+		}
+	}
+	return nil
+}
+
+// getPublishers returns a copy of the target paths of a volume.
+func (cs *nodeControllerServer) getPublishers(volumeID string) []string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if vol, ok := cs.pmemVolumes[volumeID]; ok {
+		return append([]string(nil), vol.Publishers...)
+	}
+	return nil
+}
+
+// storePublishers must be called with the mutex locked.
+func (cs *nodeControllerServer) storePublishers(vol *nodeVolume) error {
+	if cs.sm == nil {
+		return nil
+	}
+	if err := cs.sm.Create(vol.ID, vol); err != nil {
+		return fmt.Errorf("store state: %v", err)
+	}
+	return nil
+}
+
 func (cs *nodeControllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -538,3 +684,70 @@ func generateVolumeID(name string) string {
 	id := name[0:use] + "-" + hash
 	return id
 }
+
+// supportedAccessModes lists the access modes that PMEM-CSI supports.
+// A volume can only be used on the node where it was created, so
+// MULTI_NODE_READER_ONLY means that several pods on that node can
+// read it.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    true,
+}
+
+// validateAccessModes checks that all access modes are supported.
+func validateAccessModes(volumeCapabilities []*csi.VolumeCapability) error {
+	for _, capability := range volumeCapabilities {
+		mode := capability.GetAccessMode().GetMode()
+		if !supportedAccessModes[mode] {
+			return fmt.Errorf("Driver does not support '%s' mode", mode)
+		}
+	}
+	return nil
+}
+
+// isReadOnlyMode returns true for access modes which only allow
+// reading.
+func isReadOnlyMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// validateFilesystemParameters checks the filesystem parameters against
+// the filesystems that may get created for the volume.
+func validateFilesystemParameters(p parameters.Volume, volumeCapabilities []*csi.VolumeCapability) error {
+	if p.GetSharedVolume() != "" {
+		return validateSubdirectoryCapabilities(volumeCapabilities)
+	}
+	for _, capability := range volumeCapabilities {
+		mount := capability.GetMount()
+		if mount == nil {
+			continue
+		}
+		fsType := mount.GetFsType()
+		if fsType == "" {
+			fsType = defaultFilesystem
+		}
+		if fsType == noFilesystem {
+			if p.MkfsOptions != nil || p.MountOptions != nil || p.GetKataContainers() ||
+				p.ExtentSize != nil || p.DaxInherit != nil {
+				return fmt.Errorf("parameters %q, %q, %q, %q and %q cannot be used without a filesystem",
+					parameters.MkfsOptions, parameters.MountOptions, parameters.KataContainers,
+					parameters.ExtentSize, parameters.DaxInherit)
+			}
+			continue
+		}
+		if _, _, err := mkfsCommand(fsType, p.GetMkfsOptions()); err != nil {
+			return err
+		}
+		if p.ExtentSize != nil && fsType != "xfs" {
+			return fmt.Errorf("parameter %q is only supported for xfs", parameters.ExtentSize)
+		}
+		if p.GetDaxInherit() && fsType != "xfs" && fsType != "ext4" {
+			return fmt.Errorf("parameter %q is only supported for xfs and ext4", parameters.DaxInherit)
+		}
+	}
+	return nil
+}
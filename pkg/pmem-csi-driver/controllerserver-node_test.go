@@ -0,0 +1,228 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// newFakeControllerServer creates a controller server with the fake
+// device manager and persistent state in a temporary directory.
+func newFakeControllerServer(ctx context.Context, t *testing.T) *nodeControllerServer {
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, "")
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	return NewNodeControllerServer(ctx, "node", "pmem-csi.intel.com", dm, sm)
+}
+
+// restartControllerServer creates a new controller server with the
+// same devices and state, as after a restart of the driver.
+func restartControllerServer(ctx context.Context, cs *nodeControllerServer) *nodeControllerServer {
+	return NewNodeControllerServer(ctx, cs.nodeID, cs.instance, cs.dm, cs.sm)
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: mode,
+		},
+	}
+}
+
+// createTestVolume creates a normal volume and returns its ID.
+func createTestVolume(ctx context.Context, t *testing.T, cs *nodeControllerServer, name string) string {
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume %s", name)
+	return resp.Volume.VolumeId
+}
+
+func TestValidateAccessModes(t *testing.T) {
+	testcases := map[string]struct {
+		modes []csi.VolumeCapability_AccessMode_Mode
+		err   string
+	}{
+		"none": {},
+		"supported": {
+			modes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			},
+		},
+		"multi-node-writer": {
+			modes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+			err: "Driver does not support 'MULTI_NODE_MULTI_WRITER' mode",
+		},
+		"multi-node-single-writer": {
+			modes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+			},
+			err: "Driver does not support 'MULTI_NODE_SINGLE_WRITER' mode",
+		},
+		"unknown": {
+			modes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_UNKNOWN,
+			},
+			err: "Driver does not support 'UNKNOWN' mode",
+		},
+		"mixed": {
+			modes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+			err: "Driver does not support 'MULTI_NODE_MULTI_WRITER' mode",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var capabilities []*csi.VolumeCapability
+			for _, mode := range tc.modes {
+				capabilities = append(capabilities, mountCapability(mode))
+			}
+			err := validateAccessModes(capabilities)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeControllerServer(ctx, t)
+	volumeID := createTestVolume(ctx, t, cs, "vol")
+
+	testcases := map[string]struct {
+		req       *csi.ValidateVolumeCapabilitiesRequest
+		code      codes.Code
+		confirmed bool
+		message   string
+	}{
+		"no-volume-id": {
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			code: codes.InvalidArgument,
+		},
+		"no-capabilities": {
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: volumeID,
+			},
+			code: codes.InvalidArgument,
+		},
+		"unknown-volume": {
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "no-such-volume",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			},
+			code: codes.NotFound,
+		},
+		"supported": {
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+					mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+				},
+			},
+			confirmed: true,
+		},
+		"unsupported": {
+			req: &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+					mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+				},
+			},
+			message: "Driver does not support 'MULTI_NODE_MULTI_WRITER' mode",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			resp, err := cs.ValidateVolumeCapabilities(ctx, tc.req)
+			if tc.code != codes.OK {
+				assert.Equal(t, tc.code, status.Code(err), "error code: %v", err)
+				return
+			}
+			require.NoError(t, err, "ValidateVolumeCapabilities")
+			if tc.confirmed {
+				require.NotNil(t, resp.Confirmed, "confirmed")
+				assert.Equal(t, tc.req.VolumeCapabilities, resp.Confirmed.VolumeCapabilities, "confirmed capabilities")
+			} else {
+				assert.Nil(t, resp.Confirmed, "confirmed")
+			}
+			assert.Equal(t, tc.message, resp.Message, "message")
+		})
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := newFakeControllerServer(ctx, t)
+	volumeID := createTestVolume(ctx, t, cs, "vol")
+	assert.Empty(t, cs.getPublishers(volumeID), "initial publishers")
+
+	require.NoError(t, cs.addPublisher(volumeID, "/target-1"), "add first publisher")
+	require.NoError(t, cs.addPublisher(volumeID, "/target-1"), "add first publisher again")
+	require.NoError(t, cs.addPublisher(volumeID, "/target-2"), "add second publisher")
+	assert.Equal(t, []string{"/target-1", "/target-2"}, cs.getPublishers(volumeID), "publishers")
+	assert.Error(t, cs.addPublisher("no-such-volume", "/target-1"), "add publisher for unknown volume")
+	assert.Empty(t, cs.getPublishers("no-such-volume"), "publishers of unknown volume")
+
+	// The returned slice is a copy.
+	publishers := cs.getPublishers(volumeID)
+	publishers[0] = "/modified"
+	assert.Equal(t, []string{"/target-1", "/target-2"}, cs.getPublishers(volumeID), "publishers after modifying copy")
+
+	// Publishers are persistent.
+	var vol nodeVolume
+	require.NoError(t, cs.sm.Get(volumeID, &vol), "get state")
+	assert.Equal(t, []string{"/target-1", "/target-2"}, vol.Publishers, "persisted publishers")
+	cs = restartControllerServer(ctx, cs)
+	assert.Equal(t, []string{"/target-1", "/target-2"}, cs.getPublishers(volumeID), "publishers after restart")
+
+	require.NoError(t, cs.removePublisher(volumeID, "/target-1"), "remove first publisher")
+	require.NoError(t, cs.removePublisher(volumeID, "/target-1"), "remove first publisher again")
+	require.NoError(t, cs.removePublisher("no-such-volume", "/target-1"), "remove publisher of unknown volume")
+	assert.Equal(t, []string{"/target-2"}, cs.getPublishers(volumeID), "publishers after removal")
+	cs = restartControllerServer(ctx, cs)
+	assert.Equal(t, []string{"/target-2"}, cs.getPublishers(volumeID), "publishers after removal and restart")
+
+	require.NoError(t, cs.removePublisher(volumeID, "/target-2"), "remove second publisher")
+	cs = restartControllerServer(ctx, cs)
+	assert.Empty(t, cs.getPublishers(volumeID), "publishers after removing all")
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/dax"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+var (
+	daxChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_dax_checks_total",
+			Help: "A counter for DAX verifications after mounting a filesystem for AppDirect usage.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(daxChecks)
+}
+
+// mountDAX mounts a filesystem with the dax mount option and then
+// verifies that DAX is really available. What happens when it isn't
+// depends on the DAX policy of the volume. The result is counted and
+// reported as event for the object, which identifies the volume.
+// Nothing is checked when the target is already mounted or when it
+// is read-only. Errors are status errors.
+//
+// With daxInherit, the filesystem gets mounted with dax=inode and
+// the DAX flag is set on the root directory before the check.
+func (ns *nodeServer) mountDAX(ctx context.Context, v parameters.Volume, object *corev1.ObjectReference, fsType, sourcePath, targetPath string, mountOptions []string) error {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to determine if '%s' is a valid mount point: %s", targetPath, err.Error())
+	}
+	if !notMnt {
+		return nil
+	}
+
+	policy := v.GetDaxPolicy()
+	logger := klog.FromContext(ctx).WithName("mountDAX").WithValues("policy", policy)
+	ctx = klog.NewContext(ctx, logger)
+
+	fallback := func(reason string) error {
+		logger.Info("Mounting without DAX", "reason", reason)
+		if err := ns.mount(ctx, sourcePath, targetPath, mountOptions, false); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		daxChecks.WithLabelValues("fallback").Inc()
+		ns.volumeEvent(object, corev1.EventTypeWarning, "DAXFallback", "Mounted without DAX on node %s: %s", ns.cs.nodeID, reason)
+		return nil
+	}
+
+	daxFlag := daxMountFlag
+	if v.GetDaxInherit() {
+		daxFlag = daxInodeMountFlag
+	}
+	if err := ns.mount(ctx, sourcePath, targetPath, append(mountOptions, daxFlag), false); err != nil {
+		if policy != parameters.DaxPolicyFallback {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return fallback(err.Error())
+	}
+	readOnly := false
+	for _, option := range mountOptions {
+		if option == "ro" {
+			readOnly = true
+		}
+	}
+	if v.GetDaxInherit() && !readOnly {
+		// The file created by the check must inherit the flag.
+		if err := configureFilesystem(targetPath, fsType, v); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if readOnly {
+		err = fmt.Errorf("%w: mounted with ro option", dax.ErrReadOnly)
+	} else {
+		err = dax.Check(targetPath)
+	}
+	switch {
+	case err == nil:
+		logger.V(3).Info("DAX is available")
+		daxChecks.WithLabelValues("available").Inc()
+		ns.volumeEvent(object, corev1.EventTypeNormal, "DAXAvailable", "DAX verified on node %s", ns.cs.nodeID)
+		return nil
+	case errors.Is(err, dax.ErrReadOnly):
+		// The check needs to create a file. Not knowing is
+		// not a reason to unmount or fall back.
+		logger.V(3).Info("DAX check skipped", "reason", err.Error())
+		daxChecks.WithLabelValues("skipped").Inc()
+		ns.volumeEvent(object, corev1.EventTypeNormal, "DAXCheckSkipped", "DAX not verified on node %s: %v", ns.cs.nodeID, err)
+		return nil
+	case !errors.Is(err, dax.ErrNoDAX):
+		// We don't know, so keep the mount.
+		logger.Error(err, "DAX verification failed")
+		daxChecks.WithLabelValues("failed").Inc()
+		ns.volumeEvent(object, corev1.EventTypeWarning, "DAXCheckFailed", "DAX verification on node %s failed: %v", ns.cs.nodeID, err)
+		return nil
+	}
+
+	switch policy {
+	case parameters.DaxPolicyWarn:
+		logger.Info("DAX is not available")
+		daxChecks.WithLabelValues("unavailable").Inc()
+		ns.volumeEvent(object, corev1.EventTypeWarning, "DAXUnavailable", "Mounted with dax option on node %s, but DAX is not available: %v", ns.cs.nodeID, err)
+		return nil
+	case parameters.DaxPolicyFallback:
+		if err := ns.mounter.Unmount(targetPath); err != nil {
+			return status.Errorf(codes.Internal, "unmount after failed DAX verification: %v", err)
+		}
+		return fallback(err.Error())
+	default:
+		daxChecks.WithLabelValues("unavailable").Inc()
+		ns.volumeEvent(object, corev1.EventTypeWarning, "DAXUnavailable", "DAX is not available on node %s: %v", ns.cs.nodeID, err)
+		if err := ns.mounter.Unmount(targetPath); err != nil {
+			return status.Errorf(codes.Internal, "unmount after failed DAX verification: %v", err)
+		}
+		return status.Errorf(codes.FailedPrecondition, "DAX verification: %v", err)
+	}
+}
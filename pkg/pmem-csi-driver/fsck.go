@@ -0,0 +1,204 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+type fsckResult string
+
+const (
+	// fsckClean: no problems found.
+	fsckClean fsckResult = "clean"
+	// fsckRepaired: problems were found and fixed.
+	fsckRepaired fsckResult = "repaired"
+	// fsckDamaged: problems were found and remain.
+	fsckDamaged fsckResult = "damaged"
+	// fsckSkipped: the filesystem could not be checked, for
+	// example because the XFS log has to be replayed first.
+	fsckSkipped fsckResult = "skipped"
+	// fsckFailed: the check itself failed.
+	fsckFailed fsckResult = "failed"
+)
+
+var (
+	fsckChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_fsck_total",
+			Help: "A counter for filesystem checks before staging a volume.",
+		},
+		[]string{"fs_type", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fsckChecks)
+}
+
+// fsckCommand returns the command which checks (and, depending on
+// the policy, repairs) the filesystem. The device path must be
+// appended. An empty command is returned for filesystems that cannot
+// be checked.
+func fsckCommand(fsType string, policy parameters.FsckPolicy) (string, []string) {
+	repair := policy == parameters.FsckPolicyRepair
+	switch fsType {
+	case "ext2", "ext4":
+		if repair {
+			return "e2fsck", []string{"-p"}
+		}
+		return "e2fsck", []string{"-n"}
+	case "xfs":
+		if repair {
+			return "xfs_repair", nil
+		}
+		return "xfs_repair", []string{"-n"}
+	default:
+		return "", nil
+	}
+}
+
+// fsckExitResult interprets the exit code of the command returned by
+// fsckCommand.
+func fsckExitResult(fsType string, policy parameters.FsckPolicy, exitCode int) fsckResult {
+	repair := policy == parameters.FsckPolicyRepair
+	switch fsType {
+	case "ext2", "ext4":
+		// See "EXIT CODE" in e2fsck(8). The exit code is the
+		// sum of 1 = errors corrected, 2 = errors corrected,
+		// system should be rebooted (only relevant for the
+		// root filesystem), 4 = errors left uncorrected,
+		// 8 = operational error, 16 = usage error, 32 = canceled
+		// by user and 128 = shared library error.
+		switch {
+		case exitCode < 0 || exitCode&^(1|2|4) != 0:
+			return fsckFailed
+		case exitCode&4 != 0:
+			return fsckDamaged
+		case exitCode&(1|2) != 0:
+			if repair {
+				return fsckRepaired
+			}
+			return fsckDamaged
+		default:
+			return fsckClean
+		}
+	case "xfs":
+		// See "EXIT STATUS" in xfs_repair(8). With -n, 1 means
+		// that corruption was detected, otherwise that repairing
+		// failed. 2 is returned when the log is dirty.
+		switch exitCode {
+		case 0:
+			return fsckClean
+		case 1:
+			return fsckDamaged
+		case 2:
+			return fsckSkipped
+		}
+	}
+	return fsckFailed
+}
+
+// checkFilesystem runs a filesystem check according to the fsck
+// policy of the volume. The result is counted, reported as event for
+// the PV and stored as volume condition. An error is returned if the
+// filesystem is damaged and should have been repaired.
+func (ns *nodeServer) checkFilesystem(ctx context.Context, volumeID string, v parameters.Volume, devicePath, fsType string) error {
+	policy := v.GetFsckPolicy()
+	if policy == parameters.FsckPolicyNever {
+		return nil
+	}
+	logger := klog.FromContext(ctx).WithName("checkFilesystem").WithValues("fs-type", fsType, "policy", policy)
+	ctx = klog.NewContext(ctx, logger)
+
+	cmdName, args := fsckCommand(fsType, policy)
+	if cmdName == "" {
+		logger.V(3).Info("Filesystem check not supported")
+		return nil
+	}
+	cmd := exec.Command(cmdName, append(args, devicePath)...)
+	_, err := pmemexec.Run(ctx, cmd)
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+	}
+	result := fsckExitResult(fsType, policy, exitCode)
+	logger.V(2).Info("Checked filesystem", "result", result, "exit-code", exitCode)
+	fsckChecks.WithLabelValues(fsType, string(result)).Inc()
+
+	condition := &csi.VolumeCondition{}
+	eventType := corev1.EventTypeNormal
+	reason := ""
+	switch result {
+	case fsckClean:
+		condition.Message = "Filesystem check found no problems."
+	case fsckRepaired:
+		condition.Message = "Filesystem errors were repaired."
+		reason = "FilesystemRepaired"
+	case fsckDamaged:
+		condition.Abnormal = true
+		condition.Message = "Filesystem is damaged."
+		if policy == parameters.FsckPolicyRepair {
+			condition.Message = "Filesystem is damaged and could not be repaired automatically."
+		}
+		eventType = corev1.EventTypeWarning
+		reason = "FilesystemDamaged"
+	case fsckSkipped:
+		condition.Message = "Filesystem could not be checked because its log must be replayed first."
+		reason = "FilesystemCheckSkipped"
+	case fsckFailed:
+		condition.Message = fmt.Sprintf("Filesystem check failed: %v", err)
+		eventType = corev1.EventTypeWarning
+		reason = "FilesystemCheckFailed"
+	}
+	ns.setVolumeCondition(volumeID, condition)
+	if reason != "" {
+		ns.volumeEvent(volumeObject(v, nil), eventType, reason, "%s on node %s: %s", fsType, ns.cs.nodeID, condition.Message)
+	}
+
+	if result == fsckDamaged && policy == parameters.FsckPolicyRepair {
+		return status.Errorf(codes.FailedPrecondition, "%s: refusing to mount volume %s", condition.Message, volumeID)
+	}
+	return nil
+}
+
+// setVolumeCondition stores the condition for NodeGetVolumeStats.
+func (ns *nodeServer) setVolumeCondition(volumeID string, condition *csi.VolumeCondition) {
+	ns.conditionsMutex.Lock()
+	defer ns.conditionsMutex.Unlock()
+	if condition == nil {
+		delete(ns.volumeConditions, volumeID)
+		return
+	}
+	ns.volumeConditions[volumeID] = condition
+}
+
+// getVolumeCondition returns the stored condition or a normal one
+// if the volume has not been checked.
+func (ns *nodeServer) getVolumeCondition(volumeID string) *csi.VolumeCondition {
+	ns.conditionsMutex.Lock()
+	defer ns.conditionsMutex.Unlock()
+	if condition, ok := ns.volumeConditions[volumeID]; ok {
+		return condition
+	}
+	return &csi.VolumeCondition{}
+}
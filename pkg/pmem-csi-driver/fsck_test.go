@@ -0,0 +1,101 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestFsck(t *testing.T) {
+	testcases := []struct {
+		fsType  string
+		policy  parameters.FsckPolicy
+		cmd     string
+		args    []string
+		results map[int]fsckResult
+	}{
+		{
+			fsType: "ext4",
+			policy: parameters.FsckPolicyCheck,
+			cmd:    "e2fsck",
+			args:   []string{"-n"},
+			results: map[int]fsckResult{
+				0:  fsckClean,
+				1:  fsckDamaged,
+				4:  fsckDamaged,
+				5:  fsckDamaged,
+				6:  fsckDamaged,
+				8:  fsckFailed,
+				12: fsckFailed,
+				32: fsckFailed,
+			},
+		},
+		{
+			fsType: "ext2",
+			policy: parameters.FsckPolicyRepair,
+			cmd:    "e2fsck",
+			args:   []string{"-p"},
+			results: map[int]fsckResult{
+				0:  fsckClean,
+				1:  fsckRepaired,
+				2:  fsckRepaired,
+				3:  fsckRepaired,
+				4:  fsckDamaged,
+				5:  fsckDamaged,
+				6:  fsckDamaged,
+				8:  fsckFailed,
+				12: fsckFailed,
+				-1: fsckFailed,
+			},
+		},
+		{
+			fsType: "xfs",
+			policy: parameters.FsckPolicyCheck,
+			cmd:    "xfs_repair",
+			args:   []string{"-n"},
+			results: map[int]fsckResult{
+				0: fsckClean,
+				1: fsckDamaged,
+				2: fsckSkipped,
+			},
+		},
+		{
+			fsType: "xfs",
+			policy: parameters.FsckPolicyRepair,
+			cmd:    "xfs_repair",
+			results: map[int]fsckResult{
+				0: fsckClean,
+				1: fsckDamaged,
+				4: fsckFailed,
+			},
+		},
+		{
+			fsType: "btrfs",
+			policy: parameters.FsckPolicyRepair,
+			results: map[int]fsckResult{
+				0: fsckFailed,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", tc.fsType, tc.policy), func(t *testing.T) {
+			cmd, args := fsckCommand(tc.fsType, tc.policy)
+			assert.Equal(t, tc.cmd, cmd, "command")
+			assert.Equal(t, tc.args, args, "arguments")
+			for exitCode, result := range tc.results {
+				assert.Equal(t, result, fsckExitResult(tc.fsType, tc.policy, exitCode), "exit code %d", exitCode)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ package pmemcsidriver
 import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/capabilities"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
@@ -22,25 +23,20 @@ type identityServer struct {
 var _ grpcserver.Service = &identityServer{}
 
 func NewIdentityServer(name, version string) *identityServer {
-	return &identityServer{
-		name:    name,
-		version: version,
-		pluginCaps: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
-				},
-			},
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
-					},
+	var pluginCaps []*csi.PluginCapability
+	for _, t := range capabilities.Plugin {
+		pluginCaps = append(pluginCaps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: t,
 				},
 			},
-		},
+		})
+	}
+	return &identityServer{
+		name:       name,
+		version:    version,
+		pluginCaps: pluginCaps,
 	}
 }
 
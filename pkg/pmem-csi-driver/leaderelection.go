@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Same defaults as in the CSI sidecars.
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 5 * time.Second
+)
+
+var (
+	leaderInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_controller_leader",
+			Help: "A metric with a constant '1' value labeled by the identity of the current leader among the controller replicas.",
+		},
+		[]string{"identity"},
+	)
+
+	isLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pmem_controller_is_leader",
+			Help: "1 if this controller replica is the leader which runs the stateful parts of the controller, 0 otherwise.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(leaderInfo, isLeader)
+}
+
+// runAsLeader calls run once this replica is the leader, or
+// immediately when leader election is disabled. run must not block. Parts of
+// the controller which must not be active in more than one replica
+// at a time have to be started this way. When leadership is lost,
+// the entire controller gets shut down by cancelling the context.
+func (csid *csiDriver) runAsLeader(ctx context.Context, cancel func(), client kubernetes.Interface, run func(ctx context.Context)) error {
+	l := klog.FromContext(ctx).WithName("leader-election")
+
+	if !csid.cfg.leaderElection {
+		isLeader.Set(1)
+		run(ctx)
+		return nil
+	}
+
+	namespace := csid.cfg.leaderElectionNamespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		return errors.New("leader election namespace not set and POD_NAMESPACE env variable is not set")
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("determine identity for leader election: %v", err)
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      strings.ReplaceAll(csid.cfg.DriverName, ".", "-") + "-controller",
+			Namespace: namespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lock.LeaseMeta.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				l.Info("became leader")
+				isLeader.Set(1)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				isLeader.Set(0)
+				if ctx.Err() == nil {
+					l.Info("lost leadership, shutting down")
+					cancel()
+				}
+			},
+			OnNewLeader: func(leader string) {
+				l.V(3).Info("new leader", "identity", leader)
+				leaderInfo.Reset()
+				leaderInfo.WithLabelValues(leader).Set(1)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create leader elector: %v", err)
+	}
+
+	l.Info("starting", "lease", klog.KRef(namespace, lock.LeaseMeta.Name), "identity", identity)
+	isLeader.Set(0)
+	go func() {
+		defer cancel()
+		defer l.Info("stopped")
+		elector.Run(ctx)
+	}()
+	return nil
+}
@@ -12,12 +12,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"github.com/intel/pmem-csi/pkg/logger"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+	"github.com/intel/pmem-csi/pkg/scheduler"
 )
 
 var (
@@ -50,12 +53,33 @@ func init() {
 	/* Controller mode options */
 	flag.StringVar(&config.schedulerListen, "schedulerListen", "", "controller: HTTPS listen address (like :8000) for scheduler extender and mutating webhook, disabled by default (needs caFile, certFile, keyFile)")
 	flag.StringVar(&config.insecureSchedulerListen, "insecureSchedulerListen", "", "controller: HTTP listen address (like :8001) for scheduler extender and mutating webhook, disabled by default (does not use TLS config)")
+	flag.StringVar(&config.podMutation.ResourceName, "mutatePodsResource", "", "controller: extended resource that the mutating pod webhook adds to pods, defaults to <drivername>/scheduler")
+	flag.StringVar(&config.podMutation.ContainerName, "mutatePodsContainer", "", "controller: name of the container which gets the extended resource, defaults to the first container")
+	flag.BoolVar(&config.podMutation.InitContainer, "mutatePodsInitContainer", false, "controller: add the extended resource to an init container instead of a normal container, if the pod has init containers")
+	flag.BoolVar(&config.capacityReports, "capacityReports", false, "controller: accept capacity reports pushed by node drivers under /capacity on the scheduler listen address, only from clients with a certificate for "+scheduler.CapacityReporterName+" which is signed by the CA from caFile")
+	flag.DurationVar(&config.capacityMaxAge, "capacityMaxAge", 3*time.Minute, "controller: capacity reports older than this are ignored, zero disables expiration")
+	flag.BoolVar(&config.capacityMetricsFallback, "capacityMetricsFallback", true, "controller: retrieve capacity from the metrics endpoint of node driver pods when no current report is available")
+	flag.DurationVar(&config.recreateGracePeriod, "recreateGracePeriod", 10*time.Minute, "controller: recreate PVCs which opted into it via the "+annRecreateOnNodeLoss+" annotation when the node of their volume has had no PMEM-CSI driver for this long, zero disables the check")
+	flag.BoolVar(&config.leaderElection, "leaderElection", false, "controller: use leader election so that only one of several replicas runs those parts which keep state, webhooks are served by all replicas")
+	flag.StringVar(&config.leaderElectionNamespace, "leaderElectionNamespace", "", "controller: namespace for the leader election lease, defaults to the POD_NAMESPACE env variable")
 	flag.Var(&config.nodeSelector, "nodeSelector", "controller: reschedule PVCs with a selected node where PMEM-CSI is not meant to run because the node does not have these labels (represented as JSON map)")
 
 	/* Node mode options */
 	flag.Var(&config.DeviceManager, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm' or 'direct' (= 'ndctl')")
 	flag.StringVar(&config.StateBasePath, "statePath", "", "node: directory path where to persist the state of the driver, defaults to /var/lib/<drivername>")
 	flag.UintVar(&config.PmemPercentage, "pmemPercentage", 100, "node: percentage of space to be used by the driver in each PMEM region")
+	flag.StringVar(&config.Instance, "instance", "", "node, pmem-setup, cleanup, force-convert-raw-namespaces: name of the driver instance which gets added to the names of namespaces and volume groups in LVM mode, empty for the traditional names used by a single driver")
+	flag.StringVar(&config.capacityReportURL, "capacityReportURL", "", "node: HTTPS URL (like https://pmem-csi-intel-com-scheduler.pmem-csi.svc/capacity) where the controller accepts capacity reports, disabled by default (needs caFile, certFile, keyFile)")
+	flag.DurationVar(&config.capacityReportInterval, "capacityReportInterval", time.Minute, "node: send a capacity report at least this often, in addition to reports after each capacity change")
+
+	/* pmem-setup mode options */
+	flag.BoolVar(&config.pmemSetup.ConvertRawNamespaces, "convertRawNamespaces", false, "pmem-setup: convert raw namespaces into fsdax namespaces for LVM, destroys their data")
+	flag.BoolVar(&config.pmemSetup.CreateNamespaces, "createNamespaces", false, "pmem-setup: create fsdax namespaces for LVM in the free space of each region")
+	flag.UintVar(&config.pmemSetup.ReservePercentage, "reservePercentage", 0, "pmem-setup: percentage of each region which is not used when creating namespaces")
+	flag.BoolVar(&config.pmemSetup.DryRun, "dryRun", false, "pmem-setup: only report what would be done, without modifying PMEM or node labels")
+
+	/* cleanup mode options */
+	flag.StringVar(&config.cleanupToken, "cleanupToken", "", "cleanup: value of the <drivername>/cleanup node annotation which gets set after removing all volumes")
 
 	klog.InitFlags(nil)
 }
@@ -80,6 +104,22 @@ func Main() int {
 		pmemcommon.ExitError("scheduler listening", errors.New("only supported in the controller"))
 		return 1
 	}
+	if config.capacityReports && (config.Mode != Webhooks || config.schedulerListen == "" || config.CAFile == "") {
+		pmemcommon.ExitError("capacity reports", errors.New("only supported in the controller with schedulerListen and caFile"))
+		return 1
+	}
+	if config.leaderElection && config.Mode != Webhooks {
+		pmemcommon.ExitError("leader election", errors.New("only supported in the controller"))
+		return 1
+	}
+	if config.capacityReportURL != "" && config.Mode != Node {
+		pmemcommon.ExitError("capacity reporting", errors.New("only supported on the node"))
+		return 1
+	}
+	if config.capacityReportURL != "" && !strings.HasPrefix(config.capacityReportURL, "https://") {
+		pmemcommon.ExitError("capacity reporting", errors.New("URL must use HTTPS"))
+		return 1
+	}
 
 	config.Version = version
 	driver, err := GetCSIDriver(config)
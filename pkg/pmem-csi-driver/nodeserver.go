@@ -13,12 +13,17 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/keymutex"
 	"k8s.io/utils/mount"
@@ -28,6 +33,7 @@ import (
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"github.com/intel/pmem-csi/pkg/imagefile"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/capabilities"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	"github.com/intel/pmem-csi/pkg/volumepathhandler"
@@ -41,6 +47,11 @@ const (
 	volumeProvisionerIdentity = "storage.kubernetes.io/csiProvisionerIdentity"
 	defaultFilesystem         = "ext4"
 
+	// noFilesystem as fsType skips formatting. The fsdax device
+	// itself gets published instead of a mounted filesystem, which
+	// then is only usable in privileged containers.
+	noFilesystem = "none"
+
 	// kataContainersImageFilename is the image file that Kata Containers
 	// needs to make available inside the VM.
 	kataContainersImageFilename = "kata-containers-pmem-csi-vm.img"
@@ -51,6 +62,10 @@ const (
 	// Given that "-o dax" is part of the kernel API, it's unlikely that
 	// support for it really gets removed, therefore we continue to use it.
 	daxMountFlag = "dax"
+
+	// daxInodeMountFlag enables DAX only for files with the DAX
+	// flag. Supported since Linux 5.8 (XFS) and 5.10 (ext4).
+	daxInodeMountFlag = "dax=inode"
 )
 
 type nodeServer struct {
@@ -61,26 +76,38 @@ type nodeServer struct {
 
 	// A directory for additional mount points.
 	mountDirectory string
+
+	// recorder, if set, is used for events about volumes.
+	recorder record.EventRecorder
+
+	// volumeConditions contains the result of the last
+	// filesystem check for staged volumes.
+	volumeConditions map[string]*csi.VolumeCondition
+	conditionsMutex  sync.Mutex
 }
 
 var _ csi.NodeServer = &nodeServer{}
 var _ grpcserver.Service = &nodeServer{}
 var volumeMutex = keymutex.NewHashed(-1)
 
-func NewNodeServer(cs *nodeControllerServer, mountDirectory string) *nodeServer {
-	return &nodeServer{
-		nodeCaps: []*csi.NodeServiceCapability{
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-					},
+func NewNodeServer(cs *nodeControllerServer, mountDirectory string, recorder record.EventRecorder) *nodeServer {
+	var nodeCaps []*csi.NodeServiceCapability
+	for _, t := range capabilities.Node {
+		nodeCaps = append(nodeCaps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: t,
 				},
 			},
-		},
-		cs:             cs,
-		mounter:        mount.New(""),
-		mountDirectory: mountDirectory,
+		})
+	}
+	return &nodeServer{
+		nodeCaps:         nodeCaps,
+		cs:               cs,
+		mounter:          mount.New(""),
+		mountDirectory:   mountDirectory,
+		recorder:         recorder,
+		volumeConditions: map[string]*csi.VolumeCondition{},
 	}
 }
 
@@ -106,10 +133,69 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 }
 
 func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	vol := ns.cs.getVolumeByID(volumeID)
+	if vol == nil {
+		// For ephemeral volumes we use volumeID as volume name.
+		vol = ns.cs.getVolumeByName(volumeID)
+	}
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "no volume found with volume id %q", volumeID)
+	}
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %q does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "stat volume path: %v", err)
+	}
+
+	var usage []*csi.VolumeUsage
+	if info.IsDir() {
+		var stat unix.Statfs_t
+		if err := unix.Statfs(volumePath, &stat); err != nil {
+			return nil, status.Errorf(codes.Internal, "statfs %q: %v", volumePath, err)
+		}
+		usage = []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(stat.Blocks) * stat.Bsize,
+				Available: int64(stat.Bavail) * stat.Bsize,
+				Used:      int64(stat.Blocks-stat.Bfree) * stat.Bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(stat.Files),
+				Available: int64(stat.Ffree),
+				Used:      int64(stat.Files - stat.Ffree),
+			},
+		}
+	} else {
+		// Raw block volume or device without filesystem.
+		usage = []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: vol.Size,
+			},
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: ns.getVolumeCondition(vol.ID),
+	}, nil
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, finalErr error) {
 	volumeID := req.GetVolumeId()
 	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
 	ctx = klog.NewContext(ctx, logger)
@@ -124,6 +210,10 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := validateAccessModes([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	accessMode := req.GetVolumeCapability().GetAccessMode().GetMode()
 
 	// Serialize by VolumeId
 	volumeMutex.LockKey(volumeID)
@@ -132,6 +222,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}()
 
 	var ephemeral bool
+	var mountDAX bool
 	var device *pmdmanager.PmemDeviceInfo
 	var err error
 
@@ -146,11 +237,22 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		"target-path", targetPath,
 		"source-path", srcPath,
 		"read-only", readOnly,
+		"access-mode", accessMode,
 		"mount-flags", mountFlags,
 		"fs-type", fsType,
 		"volume-context", volumeContext,
 	)
 
+	// Staged volumes may get published more than once. Each
+	// target path is recorded, see NodeUnstageVolume.
+	defer func() {
+		if finalErr == nil && !ephemeral {
+			if err := ns.cs.addPublisher(volumeID, targetPath); err != nil {
+				finalErr = status.Errorf(codes.Internal, "record publisher: %v", err)
+			}
+		}
+	}()
+
 	// Kubernetes v1.16+ would request ephemeral volumes via VolumeContext
 	val, ok := req.GetVolumeContext()[parameters.Ephemeral]
 	if ok {
@@ -185,8 +287,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, err
 		}
 		srcPath = device.Path
-		if v.GetUsage() == parameters.UsageAppDirect {
-			mountFlags = append(mountFlags, daxMountFlag)
+		if fsType != noFilesystem {
+			mountFlags = append(mountFlags, v.GetMountOptions()...)
+			mountDAX = v.GetUsage() == parameters.UsageAppDirect
 		}
 	} else {
 		// Validate parameters.
@@ -196,21 +299,39 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		volumeParameters = v
 
-		dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
-		if err != nil {
-			return nil, err
-		}
+		if v.GetSharedVolume() != "" {
+			// Subdirectory volumes have no device of their own.
+			if req.GetVolumeCapability().GetMount() == nil || fsType == noFilesystem {
+				return nil, status.Error(codes.InvalidArgument, "subdirectory volumes must be mounted with a filesystem")
+			}
+		} else {
+			dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+			if err != nil {
+				return nil, err
+			}
 
-		if device, err = dm.GetDevice(ctx, volumeID); err != nil {
-			if errors.Is(err, pmemerr.DeviceNotFound) {
-				return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
+			if device, err = dm.GetDevice(ctx, volumeID); err != nil {
+				if errors.Is(err, pmemerr.DeviceNotFound) {
+					return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
+				}
+				return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
 			}
-			return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
 		}
 		mountFlags = append(mountFlags, "bind")
+
+		if accessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+			// Target paths which are no longer mounted do not count.
+			for _, publisher := range ns.getActivePublishers(ctx, volumeID) {
+				if publisher != targetPath {
+					return nil, status.Errorf(codes.FailedPrecondition, "volume with access mode %s is already published at %q", accessMode, publisher)
+				}
+			}
+		}
 	}
 
-	if readOnly {
+	// Read-only access modes are enforced even when the CO does
+	// not ask for a read-only mount.
+	if readOnly || isReadOnlyMode(accessMode) {
 		mountFlags = append(mountFlags, "ro")
 	}
 
@@ -221,6 +342,21 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		// For block volumes, source path is the actual Device path
 		srcPath = device.Path
 	case *csi.VolumeCapability_Mount:
+		if fsType == noFilesystem {
+			// Bind-mount the device like a raw block volume.
+			// In contrast to a raw block volume, kubelet does
+			// not add the device to the device cgroup of the
+			// container, so only privileged containers can
+			// open it. We cannot check that here because we
+			// do not see the pod spec.
+			rawBlock = true
+			if ephemeral {
+				mountFlags = append(mountFlags, "bind")
+			} else {
+				srcPath = device.Path
+			}
+			break
+		}
 		if !ephemeral && len(srcPath) == 0 {
 			return nil, status.Error(codes.FailedPrecondition, "Staging target path missing in request")
 		}
@@ -282,12 +418,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		hostMount = filepath.Join(ns.mountDirectory, req.GetVolumeId())
 	}
-	if err := ns.mount(ctx, srcPath, hostMount, mountFlags, rawBlock); err != nil {
+	if mountDAX {
+		if err := ns.mountDAX(ctx, volumeParameters, volumeObject(volumeParameters, volumeContext), fsType, srcPath, hostMount, mountFlags); err != nil {
+			return nil, err
+		}
+	} else if err := ns.mount(ctx, srcPath, hostMount, mountFlags, rawBlock); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if ephemeral && fsType == "xfs" {
-		if err := xfs.ConfigureFS(hostMount); err != nil {
+	if ephemeral && !rawBlock {
+		if err := configureFilesystem(hostMount, fsType, volumeParameters); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
@@ -319,7 +459,29 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	// the mounted filesystem allows. Create() is not idempotent, so we have to check for the
 	// file before overwriting something that was already created earlier.
 	imageFile := filepath.Join(hostMount, kataContainersImageFilename)
-	if _, err := os.Stat(imageFile); err != nil {
+	handler := volumepathhandler.VolumePathHandler{}
+	if _, err := os.Stat(imageFile); err == nil {
+		// An existing image file gets grown to fill the volume
+		// if the volume has become larger or an earlier resize
+		// was interrupted. This is only safe while the file is
+		// not in use.
+		grow, err := imagefile.CanGrow(imageFile)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "check Kata Container image file size: "+err.Error())
+		}
+		if grow {
+			_, err := handler.GetLoopDevice(ctx, imageFile)
+			switch {
+			case err != nil && err.Error() == volumepathhandler.ErrDeviceNotFound:
+				logger.V(3).Info("Growing Kata Container image file", "image-file", imageFile)
+				if err := imagefile.Resize(imageFile, 0 /* as large as possible */); err != nil {
+					return nil, status.Error(codes.Internal, "resize Kata Container image file: "+err.Error())
+				}
+			case err != nil:
+				return nil, status.Error(codes.Internal, "check for loop device: "+err.Error())
+			}
+		}
+	} else {
 		if !os.IsNotExist(err) {
 			return nil, status.Error(codes.Internal, "unexpected error while checking for image file: "+err.Error())
 		}
@@ -339,21 +501,43 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
-	// If this offset ever changes, then we have to make future versions of PMEM-CSI more
-	// flexible and dynamically determine the offset. For now we assume that the
-	// file was created by the current version and thus use the fixed offset.
-	offset := int64(imagefile.HeaderSize)
-	handler := volumepathhandler.VolumePathHandler{}
-	loopDev, err := handler.AttachFileDeviceWithOffset(ctx, imageFile, offset)
+	// The file might have been created by a different version of
+	// PMEM-CSI, so the offset of the partition must be determined
+	// dynamically. This also verifies the file, because a corrupted
+	// file would not work inside the VM.
+	layout, err := imagefile.ReadLayout(imageFile)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "invalid Kata Container image file: "+err.Error())
+	}
+	// Direct I/O avoids caching the data twice, once for the
+	// loop device and once for the image file.
+	loopDev, err := handler.AttachFileDeviceWithOptions(ctx, imageFile, volumepathhandler.LoopOptions{
+		Offset:   int64(layout.PartitionStart),
+		DirectIO: true,
+	})
 	if err != nil {
 		return nil, status.Error(codes.Internal, "create loop device: "+err.Error())
 	}
 
-	// TODO: Try to mount with dax first, fall back to mount without it if not supported.
+	// Loop devices do not support DAX, so mounting with dax and
+	// verifying it like for other volumes would always fail. DAX
+	// inside the VM depends on the filesystem which contains the
+	// image file and that was verified when mounting it.
 	if err := ns.mount(ctx, loopDev, targetPath, []string{}, false); err != nil {
+		if err := handler.DetachFileDevice(ctx, imageFile); err != nil {
+			klog.FromContext(ctx).Error(err, "remove loop device after failed mount", "device", loopDev)
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// Now that the device is in use, the kernel can detach it
+	// automatically once it no longer is. This avoids leaking it
+	// when the target path gets unmounted by someone else than
+	// NodeUnpublishVolume.
+	if err := handler.SetAutoClear(ctx, loopDev); err != nil {
+		return nil, status.Error(codes.Internal, "configure loop device: "+err.Error())
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -449,6 +633,10 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	logger.V(5).Info("Target path removed with harmless error or no error", "error", err)
 
+	if err := ns.cs.removePublisher(vol.ID, targetPath); err != nil {
+		return nil, status.Error(codes.Internal, "remove publisher: "+err.Error())
+	}
+
 	if p.GetPersistency() == parameters.PersistencyEphemeral {
 		if _, err := ns.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID}); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to delete ephemeral volume %s: %s", volumeID, err.Error()))
@@ -525,6 +713,10 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		// Default to ext4 filesystem
 		requestedFsType = defaultFilesystem
 	}
+	if requestedFsType == noFilesystem {
+		// Same as for block devices, NodePublishVolume uses the device directly.
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
 
 	v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
 	if err != nil {
@@ -538,11 +730,32 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}()
 
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
+	// With a read-only access mode, the volume must not get
+	// modified: it gets mounted read-only, not repaired and not
+	// configured.
+	readOnly := isReadOnlyMode(req.GetVolumeCapability().GetAccessMode().GetMode())
+	if readOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
 	logger.V(3).Info("Staging volume",
 		"fs-type", requestedFsType,
 		"mount-options", mountOptions,
+		"read-only", readOnly,
 	)
 
+	if v.GetSharedVolume() != "" {
+		// The directory inside the shared volume gets bind-mounted.
+		dir, err := ns.cs.getSubdirectory(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		mountOptions = append(mountOptions, "bind")
+		if err := ns.mount(ctx, dir, stagingtargetPath, mountOptions, false /* raw block */); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
 	if err != nil {
 		return nil, err
@@ -570,22 +783,44 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		} else {
 			return nil, status.Error(codes.AlreadyExists, "File system with different type exists")
 		}
+
+		// Checking a mounted filesystem is not possible. It
+		// was checked before mounting it.
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingtargetPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, "validate staging target path: "+err.Error())
+		}
+		if notMnt || err != nil {
+			fsckVolume := v
+			if readOnly && v.GetFsckPolicy() == parameters.FsckPolicyRepair {
+				check := parameters.FsckPolicyCheck
+				fsckVolume.FsckPolicy = &check
+			}
+			if err := ns.checkFilesystem(ctx, volumeID, fsckVolume, device.Path, existingFsType); err != nil {
+				return nil, err
+			}
+		}
 	} else {
-		if err = ns.provisionDevice(ctx, device, requestedFsType); err != nil {
+		if readOnly {
+			// Creating the filesystem would modify the volume.
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q has no filesystem and cannot be formatted with a read-only access mode", volumeID)
+		}
+		if err = provisionDevice(ctx, device, requestedFsType, v.GetMkfsOptions()); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
+	mountOptions = append(mountOptions, v.GetMountOptions()...)
 	if v.GetUsage() == parameters.UsageAppDirect {
-		mountOptions = append(mountOptions, daxMountFlag)
-	}
-
-	if err = ns.mount(ctx, device.Path, stagingtargetPath, mountOptions, false /* raw block */); err != nil {
+		if err := ns.mountDAX(ctx, v, volumeObject(v, nil), requestedFsType, device.Path, stagingtargetPath, mountOptions); err != nil {
+			return nil, err
+		}
+	} else if err = ns.mount(ctx, device.Path, stagingtargetPath, mountOptions, false /* raw block */); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if requestedFsType == "xfs" {
-		if err := xfs.ConfigureFS(stagingtargetPath); err != nil {
+	if !readOnly {
+		if err := configureFilesystem(stagingtargetPath, requestedFsType, v); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
@@ -614,18 +849,25 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}()
 
 	logger.V(3).Info("Unstage volume")
-	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
-	if err != nil {
-		return nil, err
+	if publishers := ns.getActivePublishers(ctx, volumeID); len(publishers) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume is still published at %s", strings.Join(publishers, ", "))
 	}
-	// by spec, we have to return OK if asked volume is not mounted on asked path,
-	// so we look up the current device by volumeID and see is that device
-	// mounted on staging target path
-	if _, err := dm.GetDevice(ctx, volumeID); err != nil {
-		if errors.Is(err, pmemerr.DeviceNotFound) {
-			return nil, status.Errorf(codes.NotFound, "no device found with volume id '%s': %s", volumeID, err.Error())
+	// Subdirectory volumes have no device, the bind mount of
+	// the directory is found like a normal mount below.
+	if !ns.cs.isSubdirectoryVolume(volumeID) {
+		dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		// by spec, we have to return OK if asked volume is not mounted on asked path,
+		// so we look up the current device by volumeID and see is that device
+		// mounted on staging target path
+		if _, err := dm.GetDevice(ctx, volumeID); err != nil {
+			if errors.Is(err, pmemerr.DeviceNotFound) {
+				return nil, status.Errorf(codes.NotFound, "no device found with volume id '%s': %s", volumeID, err.Error())
+			}
+			return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %s", volumeID, err.Error())
 		}
-		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %s", volumeID, err.Error())
 	}
 
 	// Find out device name for mounted path
@@ -641,6 +883,7 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if err := ns.mounter.Unmount(stagingtargetPath); err != nil {
 		return nil, err
 	}
+	ns.setVolumeCondition(volumeID, nil)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -649,6 +892,27 @@ func (ns *nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeReq
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// getActivePublishers returns the target paths where a volume is
+// still published. Target paths that are no longer mounted, for
+// example after a reboot, get removed.
+func (ns *nodeServer) getActivePublishers(ctx context.Context, volumeID string) []string {
+	logger := klog.FromContext(ctx)
+	var active []string
+	for _, publisher := range ns.cs.getPublishers(volumeID) {
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(publisher)
+		if err == nil && !notMnt || err != nil && !os.IsNotExist(err) {
+			// Mounted or unknown, better keep it.
+			active = append(active, publisher)
+			continue
+		}
+		logger.V(3).Info("Removing stale publisher", "target-path", publisher)
+		if err := ns.cs.removePublisher(volumeID, publisher); err != nil {
+			logger.Error(err, "Removing stale publisher failed", "target-path", publisher)
+		}
+	}
+	return active
+}
+
 // createEphemeralDevice creates new pmem device for given req.
 // On failure it returns one of status errors.
 func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePublishVolumeRequest, p parameters.Volume) (*pmdmanager.PmemDeviceInfo, error) {
@@ -676,7 +940,7 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 	}
 
 	// Create filesystem
-	if err := ns.provisionDevice(ctx, device, req.GetVolumeCapability().GetMount().GetFsType()); err != nil {
+	if err := provisionDevice(ctx, device, req.GetVolumeCapability().GetMount().GetFsType(), p.GetMkfsOptions()); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: failed to create filesystem: %v", err))
 	}
 
@@ -685,13 +949,16 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 
 // provisionDevice initializes the device with requested filesystem.
 // It can be called multiple times for the same device (idempotent).
-func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string) error {
+func provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string, mkfsOptions []string) error {
 	ctx, logger := pmemlog.WithName(ctx, "provisionDevice")
 
 	if fsType == "" {
 		// Empty FsType means "unspecified" and we pick default, currently hard-coded to ext4
 		fsType = defaultFilesystem
 	}
+	if fsType == noFilesystem {
+		return nil
+	}
 
 	// Check does devicepath already contain a filesystem?
 	existingFsType, err := determineFilesystemType(ctx, device.Path)
@@ -706,28 +973,106 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 		}
 		return status.Error(codes.AlreadyExists, "File system with different type exists")
 	}
-	cmd := ""
-	var args []string
+	cmd, args, err := mkfsCommand(fsType, mkfsOptions)
+	if err != nil {
+		return err
+	}
+	args = append(args, device.Path)
+
+	output, err := pmemexec.RunCommand(ctx, cmd, args...)
+	if err != nil {
+		return fmt.Errorf("mkfs failed: output:[%s] err:[%v]", output, err)
+	}
+
+	return nil
+}
+
+// mkfsFlags lists for each supported filesystem the flags which may
+// be passed to mkfs via the mkfsOptions parameter. Flags which
+// PMEM-CSI sets itself or which could break DAX are not included.
+var mkfsFlags = map[string][]string{
+	"ext2": {"-E", "-i", "-I", "-L", "-m", "-N", "-O", "-T"},
+	"ext4": {"-E", "-i", "-I", "-J", "-L", "-m", "-N", "-O", "-T"},
+	"xfs":  {"-i", "-L", "-l", "-m", "-n"},
+}
+
+// mkfsCommand returns the mkfs command and its arguments, except for
+// the device path which must be appended. The additional options
+// must be pairs of flag and value.
+func mkfsCommand(fsType string, mkfsOptions []string) (string, []string, error) {
+	allowed, ok := mkfsFlags[fsType]
+	if !ok {
+		return "", nil, fmt.Errorf("Unsupported filesystem '%s'. Supported filesystems types: 'xfs', 'ext4', 'ext2', '%s'", fsType, noFilesystem)
+	}
+	if len(mkfsOptions)%2 != 0 {
+		return "", nil, fmt.Errorf("mkfs options must be pairs of flag and value: %v", mkfsOptions)
+	}
+	for i := 0; i < len(mkfsOptions); i += 2 {
+		flag, value := mkfsOptions[i], mkfsOptions[i+1]
+		supported := false
+		for _, f := range allowed {
+			if f == flag {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return "", nil, fmt.Errorf("mkfs option %s not supported for %s, supported are: %s", flag, fsType, strings.Join(allowed, " "))
+		}
+		if fsType == "xfs" && flag == "-m" && strings.Contains(value, "reflink") {
+			return "", nil, fmt.Errorf("mkfs option %s %s: reflink is incompatible with DAX", flag, value)
+		}
+	}
+
+	// Some flags are also used by PMEM-CSI. The values provided
+	// by the user get merged into ours because the mkfs commands
+	// either use only the last value or reject repeated flags.
+	merge := func(flag, value string) (string, []string) {
+		var remaining []string
+		for i := 0; i < len(mkfsOptions); i += 2 {
+			if mkfsOptions[i] == flag {
+				value += "," + mkfsOptions[i+1]
+				continue
+			}
+			remaining = append(remaining, mkfsOptions[i], mkfsOptions[i+1])
+		}
+		return value, remaining
+	}
+
 	// hard-code block size to 4k to avoid smaller values and trouble to dax mount option
 	switch fsType {
-	case "ext4":
-		cmd = "mkfs.ext4"
-		args = []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-F", device.Path}
-	case "xfs":
-		cmd = "mkfs.xfs"
+	case "ext2", "ext4":
+		extended, remaining := merge("-E", "stride=512,stripe_width=512")
+		args := []string{"-b", "4096", "-E", extended}
+		args = append(args, remaining...)
+		return "mkfs." + fsType, append(args, "-F"), nil
+	default:
 		// reflink=0: reflink and DAX are mutually exclusive
 		// (http://man7.org/linux/man-pages/man8/mkfs.xfs.8.html).
 		// su=2m,sw=1: use 2MB-aligned and -sized block allocations
-		args = []string{"-b", "size=4096", "-m", "reflink=0", "-d", "su=2m,sw=1", "-f", device.Path}
-	default:
-		return fmt.Errorf("Unsupported filesystem '%s'. Supported filesystems types: 'xfs', 'ext4'", fsType)
+		metadata, remaining := merge("-m", "reflink=0")
+		args := []string{"-b", "size=4096", "-m", metadata, "-d", "su=2m,sw=1"}
+		args = append(args, remaining...)
+		return "mkfs.xfs", append(args, "-f"), nil
 	}
+}
 
-	output, err := pmemexec.RunCommand(ctx, cmd, args...)
-	if err != nil {
-		return fmt.Errorf("mkfs failed: output:[%s] err:[%v]", output, err)
+// configureFilesystem sets the extent size hint (XFS only) and, for
+// daxInherit, the DAX flag on the root directory of a mounted
+// filesystem. New files and directories inherit both. It is
+// idempotent.
+func configureFilesystem(path, fsType string, v parameters.Volume) error {
+	if fsType == "" {
+		fsType = defaultFilesystem
+	}
+	switch fsType {
+	case "xfs":
+		return xfs.ConfigureDirectory(path, v.GetExtentSize(), v.GetDaxInherit())
+	case "ext4":
+		if v.GetDaxInherit() {
+			return xfs.SetExt4DAX(path)
+		}
 	}
-
 	return nil
 }
 
@@ -773,6 +1118,38 @@ func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string,
 	return nil
 }
 
+// volumeObject returns the object that events about a volume get
+// attached to: the pod for ephemeral inline volumes (detected via
+// the pod info in the volume context), otherwise the PV, which has the
+// same name as the volume. Nil if neither is known.
+func volumeObject(v parameters.Volume, volumeContext map[string]string) *corev1.ObjectReference {
+	if podName := volumeContext[parameters.PodInfoPrefix+"pod.name"]; podName != "" {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       podName,
+			Namespace:  volumeContext[parameters.PodInfoPrefix+"pod.namespace"],
+			UID:        types.UID(volumeContext[parameters.PodInfoPrefix+"pod.uid"]),
+		}
+	}
+	if v.GetName() != "" {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+			Name:       v.GetName(),
+		}
+	}
+	return nil
+}
+
+// volumeEvent records an event for the object, if possible.
+func (ns *nodeServer) volumeEvent(object *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if object == nil || ns.recorder == nil {
+		return
+	}
+	ns.recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
 // getDeviceManagerForVolume checks the stored volume parametes for the
 // given id and returns the device manager which creates that volume.
 // NOT_FOUND is returned when the volume does not exist.
@@ -790,7 +1167,7 @@ func (ns *nodeServer) getDeviceManagerForVolume(ctx context.Context, id string)
 
 	dm := ns.cs.dm
 	if v.GetDeviceMode() != dm.GetMode() {
-		dm, err = pmdmanager.New(ctx, v.GetDeviceMode(), 0)
+		dm, err = pmdmanager.New(ctx, v.GetDeviceMode(), 0, ns.cs.instance)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize device manager for volume %q, volume mode %q: %v", id, v.GetDeviceMode(), err)
 		}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+)
+
+func TestMkfsCommand(t *testing.T) {
+	testcases := map[string]struct {
+		fsType      string
+		mkfsOptions []string
+		cmd         string
+		args        []string
+		err         string
+	}{
+		"ext4": {
+			fsType: "ext4",
+			cmd:    "mkfs.ext4",
+			args:   []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-F"},
+		},
+		"ext4-options": {
+			fsType:      "ext4",
+			mkfsOptions: []string{"-O", "^has_journal", "-E", "lazy_itable_init=0"},
+			cmd:         "mkfs.ext4",
+			args:        []string{"-b", "4096", "-E", "stride=512,stripe_width=512,lazy_itable_init=0", "-O", "^has_journal", "-F"},
+		},
+		"ext2": {
+			fsType:      "ext2",
+			mkfsOptions: []string{"-i", "65536"},
+			cmd:         "mkfs.ext2",
+			args:        []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-i", "65536", "-F"},
+		},
+		"ext2-journal": {
+			fsType:      "ext2",
+			mkfsOptions: []string{"-J", "size=64"},
+			err:         "mkfs option -J not supported for ext2, supported are: -E -i -I -L -m -N -O -T",
+		},
+		"xfs": {
+			fsType: "xfs",
+			cmd:    "mkfs.xfs",
+			args:   []string{"-b", "size=4096", "-m", "reflink=0", "-d", "su=2m,sw=1", "-f"},
+		},
+		"xfs-options": {
+			fsType:      "xfs",
+			mkfsOptions: []string{"-i", "maxpct=5", "-m", "crc=1"},
+			cmd:         "mkfs.xfs",
+			args:        []string{"-b", "size=4096", "-m", "reflink=0,crc=1", "-d", "su=2m,sw=1", "-i", "maxpct=5", "-f"},
+		},
+		"xfs-reflink": {
+			fsType:      "xfs",
+			mkfsOptions: []string{"-m", "reflink=1"},
+			err:         "mkfs option -m reflink=1: reflink is incompatible with DAX",
+		},
+		"xfs-data": {
+			fsType:      "xfs",
+			mkfsOptions: []string{"-d", "su=4k"},
+			err:         "mkfs option -d not supported for xfs, supported are: -i -L -l -m -n",
+		},
+		"odd": {
+			fsType:      "xfs",
+			mkfsOptions: []string{"-i"},
+			err:         "mkfs options must be pairs of flag and value: [-i]",
+		},
+		"btrfs": {
+			fsType: "btrfs",
+			err:    "Unsupported filesystem 'btrfs'. Supported filesystems types: 'xfs', 'ext4', 'ext2', 'none'",
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			cmd, args, err := mkfsCommand(tc.fsType, tc.mkfsOptions)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.cmd, cmd, "command")
+				assert.Equal(t, tc.args, args, "arguments")
+			}
+		})
+	}
+}
+
+// newFakeNodeServer creates a node server which uses the fake device
+// manager and a fake mounter.
+func newFakeNodeServer(ctx context.Context, t *testing.T) (*nodeServer, *mount.FakeMounter) {
+	cs := newFakeControllerServer(ctx, t)
+	ns := NewNodeServer(cs, t.TempDir(), nil)
+	mounter := mount.NewFakeMounter(nil)
+	ns.mounter = mounter
+	return ns, mounter
+}
+
+// fakePublish simulates a mounted target path.
+func fakePublish(t *testing.T, mounter *mount.FakeMounter, stagingPath, targetPath string, options ...string) {
+	require.NoError(t, os.MkdirAll(targetPath, 0750), "create target path")
+	require.NoError(t, mounter.Mount(stagingPath, targetPath, "ext4", options), "mount %s", targetPath)
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ns, mounter := newFakeNodeServer(ctx, t)
+	volumeID := createTestVolume(ctx, t, ns.cs, "vol")
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+	targetPath := filepath.Join(t.TempDir(), "target")
+	req := &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+	}
+
+	fakePublish(t, mounter, stagingPath, targetPath)
+	require.NoError(t, ns.cs.addPublisher(volumeID, targetPath), "add publisher")
+	_, err := ns.NodeUnstageVolume(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "unstage while published: %v", err)
+	assert.Equal(t, []string{targetPath}, ns.cs.getPublishers(volumeID), "publishers while published")
+
+	// A target path which is no longer mounted does not block
+	// unstaging and gets removed.
+	require.NoError(t, mounter.Unmount(targetPath), "unmount target path")
+	_, err = ns.NodeUnstageVolume(ctx, req)
+	require.NoError(t, err, "unstage after unpublishing")
+	assert.Empty(t, ns.cs.getPublishers(volumeID), "publishers after unstaging")
+}
+
+func TestNodePublishVolumeSingleWriter(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ns, mounter := newFakeNodeServer(ctx, t)
+	volumeID := createTestVolume(ctx, t, ns.cs, "vol")
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+	targetPath1 := filepath.Join(t.TempDir(), "target-1")
+	targetPath2 := filepath.Join(t.TempDir(), "target-2")
+	publish := func(targetPath string) error {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+		})
+		return err
+	}
+
+	fakePublish(t, mounter, stagingPath, targetPath1)
+	require.NoError(t, ns.cs.addPublisher(volumeID, targetPath1), "add publisher")
+	err := publish(targetPath2)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "publish second time: %v", err)
+	assert.Equal(t, []string{targetPath1}, ns.cs.getPublishers(volumeID), "publishers after rejection")
+
+	// Once the first target path is unmounted, publishing
+	// elsewhere is allowed. The second target is already mounted,
+	// so NodePublishVolume does not need to mount it.
+	require.NoError(t, mounter.Unmount(targetPath1), "unmount first target path")
+	fakePublish(t, mounter, stagingPath, targetPath2, "bind")
+	require.NoError(t, publish(targetPath2), "publish after unmounting first target path")
+	assert.Equal(t, []string{targetPath2}, ns.cs.getPublishers(volumeID), "publishers after publishing")
+}
@@ -13,11 +13,14 @@ import (
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type Persistency string
 type Origin int
 type Usage string
+type FsckPolicy string
+type DaxPolicy string
 
 // Beware of API and backwards-compatibility breaking when changing these string constants!
 const (
@@ -33,6 +36,43 @@ const (
 	UsageAppDirect Usage = "AppDirect"
 	UsageFileIO    Usage = "FileIO"
 
+	// Customization of the filesystem.
+	MkfsOptions  = "mkfsOptions"
+	MountOptions = "mountOptions"
+
+	// FsckPolicyModel determines whether an existing filesystem
+	// gets checked before mounting it.
+	FsckPolicyModel             = "fsckPolicy"
+	FsckPolicyNever  FsckPolicy = "never"
+	FsckPolicyCheck  FsckPolicy = "check"
+	FsckPolicyRepair FsckPolicy = "repair"
+
+	// DaxPolicyModel determines what happens when a filesystem
+	// mounted for AppDirect usage does not provide DAX.
+	DaxPolicyModel              = "daxPolicy"
+	DaxPolicyFail     DaxPolicy = "fail"
+	DaxPolicyWarn     DaxPolicy = "warn"
+	DaxPolicyFallback DaxPolicy = "fallback"
+
+	// ExtentSize is the extent size hint for XFS, DaxInherit
+	// enables DAX per directory instead of for the entire
+	// filesystem.
+	ExtentSize        = "extentSize"
+	DefaultExtentSize = 2 * 1024 * 1024
+	MaxExtentSize     = 1024 * 1024 * 1024
+	DaxInherit        = "daxInherit"
+
+	// SharedVolume turns a volume into a directory with a project
+	// quota inside a shared XFS filesystem, the backing volume with
+	// that name. SharedVolumeSize is the size of the backing volume
+	// when it needs to be created.
+	SharedVolume     = "sharedVolume"
+	SharedVolumeSize = "sharedVolumeSize"
+
+	// ProjectID is the XFS project of a subdirectory volume. It
+	// is chosen by PMEM-CSI and only stored internally.
+	ProjectID = "projectID"
+
 	// Kubernetes v1.16+ adds this key to NodePublishRequest.VolumeContext
 	// while provisioning ephemeral volume.
 	Ephemeral = "csi.storage.k8s.io/ephemeral"
@@ -66,6 +106,14 @@ var valid = map[Origin][]string{
 		KataContainers,
 		UsageModel,
 		PersistencyModel,
+		MkfsOptions,
+		MountOptions,
+		DaxPolicyModel,
+		FsckPolicyModel,
+		ExtentSize,
+		DaxInherit,
+		SharedVolume,
+		SharedVolumeSize,
 	},
 
 	// Parameters from Kubernetes and users.
@@ -73,6 +121,11 @@ var valid = map[Origin][]string{
 		EraseAfter,
 		KataContainers,
 		UsageModel,
+		MkfsOptions,
+		MountOptions,
+		DaxPolicyModel,
+		ExtentSize,
+		DaxInherit,
 		PodInfoPrefix,
 		Size,
 	},
@@ -87,6 +140,14 @@ var valid = map[Origin][]string{
 		KataContainers,
 		PersistencyModel,
 		UsageModel,
+		MkfsOptions,
+		MountOptions,
+		DaxPolicyModel,
+		FsckPolicyModel,
+		ExtentSize,
+		DaxInherit,
+		SharedVolume,
+		SharedVolumeSize,
 
 		Name,
 		PodInfoPrefix,
@@ -99,10 +160,19 @@ var valid = map[Origin][]string{
 		EraseAfter,
 		KataContainers,
 		UsageModel,
+		MkfsOptions,
+		MountOptions,
+		DaxPolicyModel,
+		FsckPolicyModel,
+		ExtentSize,
+		DaxInherit,
 		Name,
 		PersistencyModel,
 		Size,
 		DeviceMode,
+		SharedVolume,
+		SharedVolumeSize,
+		ProjectID,
 	},
 }
 
@@ -118,6 +188,16 @@ type Volume struct {
 	Size           *int64
 	DeviceMode     *api.DeviceMode
 	Usage          *Usage
+	MkfsOptions    *string
+	MountOptions   *string
+	FsckPolicy     *FsckPolicy
+	DaxPolicy      *DaxPolicy
+	ExtentSize     *int64
+	DaxInherit     *bool
+
+	SharedVolume     *string
+	SharedVolumeSize *int64
+	ProjectID        *uint32
 }
 
 // VolumeContext represents the same settings as a string map.
@@ -208,6 +288,67 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as DeviceMode: %v", key, value, err)
 			}
 			result.DeviceMode = &mode
+		case MkfsOptions:
+			if err := validateMkfsOptions(value); err != nil {
+				return result, fmt.Errorf("parameter %q: %v", key, err)
+			}
+			result.MkfsOptions = &value
+		case MountOptions:
+			if err := validateMountOptions(value); err != nil {
+				return result, fmt.Errorf("parameter %q: %v", key, err)
+			}
+			result.MountOptions = &value
+		case FsckPolicyModel:
+			f := FsckPolicy(value)
+			switch f {
+			case FsckPolicyNever, FsckPolicyCheck, FsckPolicyRepair:
+				result.FsckPolicy = &f
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+		case DaxPolicyModel:
+			d := DaxPolicy(value)
+			switch d {
+			case DaxPolicyFail, DaxPolicyWarn, DaxPolicyFallback:
+				result.DaxPolicy = &d
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+		case ExtentSize:
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as int64: %v", key, value, err)
+			}
+			s := quantity.Value()
+			if s <= 0 || s%4096 != 0 || s > MaxExtentSize {
+				return result, fmt.Errorf("parameter %q: %q must be a multiple of 4Ki and at most 1Gi", key, value)
+			}
+			result.ExtentSize = &s
+		case DaxInherit:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.DaxInherit = &b
+		case SharedVolume:
+			if errs := validation.IsDNS1123Label(value); len(errs) > 0 {
+				return result, fmt.Errorf("parameter %q: invalid name %q: %s", key, value, strings.Join(errs, ", "))
+			}
+			result.SharedVolume = &value
+		case SharedVolumeSize:
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as int64: %v", key, value, err)
+			}
+			s := quantity.Value()
+			result.SharedVolumeSize = &s
+		case ProjectID:
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as uint32: %v", key, value, err)
+			}
+			projectID := uint32(id)
+			result.ProjectID = &projectID
 		case ProvisionerID:
 		default:
 			if !strings.HasPrefix(key, PodInfoPrefix) {
@@ -225,6 +366,27 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 		return result, fmt.Errorf("Kata Container support and usage %q are mutually exclusive", result.GetUsage())
 	}
 
+	if result.GetDaxInherit() && result.GetUsage() != UsageAppDirect {
+		return result, fmt.Errorf("parameter %q and usage %q are mutually exclusive", DaxInherit, result.GetUsage())
+	}
+
+	if result.SharedVolume == nil {
+		if result.SharedVolumeSize != nil || result.ProjectID != nil {
+			return result, fmt.Errorf("parameters %q and %q require %q", SharedVolumeSize, ProjectID, SharedVolume)
+		}
+	} else {
+		if origin == CreateVolumeOrigin && result.SharedVolumeSize == nil {
+			return result, fmt.Errorf("required parameter %q not specified", SharedVolumeSize)
+		}
+		// The filesystem is shared and thus cannot be
+		// configured per volume.
+		if result.GetKataContainers() || result.MkfsOptions != nil || result.MountOptions != nil ||
+			result.FsckPolicy != nil || result.DaxPolicy != nil || result.DaxInherit != nil {
+			return result, fmt.Errorf("parameters %q, %q, %q, %q, %q and %q cannot be used together with %q",
+				KataContainers, MkfsOptions, MountOptions, FsckPolicyModel, DaxPolicyModel, DaxInherit, SharedVolume)
+		}
+	}
+
 	return result, nil
 }
 
@@ -262,6 +424,33 @@ func (v Volume) ToContext() VolumeContext {
 	if v.Usage != nil {
 		result[UsageModel] = string(*v.Usage)
 	}
+	if v.MkfsOptions != nil {
+		result[MkfsOptions] = *v.MkfsOptions
+	}
+	if v.MountOptions != nil {
+		result[MountOptions] = *v.MountOptions
+	}
+	if v.FsckPolicy != nil {
+		result[FsckPolicyModel] = string(*v.FsckPolicy)
+	}
+	if v.DaxPolicy != nil {
+		result[DaxPolicyModel] = string(*v.DaxPolicy)
+	}
+	if v.ExtentSize != nil {
+		result[ExtentSize] = fmt.Sprintf("%d", *v.ExtentSize)
+	}
+	if v.DaxInherit != nil {
+		result[DaxInherit] = fmt.Sprintf("%v", *v.DaxInherit)
+	}
+	if v.SharedVolume != nil {
+		result[SharedVolume] = *v.SharedVolume
+	}
+	if v.SharedVolumeSize != nil {
+		result[SharedVolumeSize] = fmt.Sprintf("%d", *v.SharedVolumeSize)
+	}
+	if v.ProjectID != nil {
+		result[ProjectID] = fmt.Sprintf("%d", *v.ProjectID)
+	}
 
 	return result
 }
@@ -315,3 +504,130 @@ func (v Volume) GetUsage() Usage {
 	}
 	return UsageAppDirect
 }
+
+func (v Volume) GetFsckPolicy() FsckPolicy {
+	if v.FsckPolicy != nil {
+		return *v.FsckPolicy
+	}
+	return FsckPolicyNever
+}
+
+func (v Volume) GetDaxPolicy() DaxPolicy {
+	if v.DaxPolicy != nil {
+		return *v.DaxPolicy
+	}
+	return DaxPolicyWarn
+}
+
+// GetExtentSize returns the extent size hint for XFS.
+func (v Volume) GetExtentSize() int64 {
+	if v.ExtentSize != nil {
+		return *v.ExtentSize
+	}
+	return DefaultExtentSize
+}
+
+// GetDaxInherit returns true if DAX is enabled through a flag on the
+// root directory, which gets inherited by new files and directories,
+// instead of a mount option.
+func (v Volume) GetDaxInherit() bool {
+	if v.DaxInherit != nil {
+		return *v.DaxInherit
+	}
+	return false
+}
+
+// GetSharedVolume returns the name of the backing volume of a
+// subdirectory volume, empty for normal volumes.
+func (v Volume) GetSharedVolume() string {
+	if v.SharedVolume != nil {
+		return *v.SharedVolume
+	}
+	return ""
+}
+
+func (v Volume) GetSharedVolumeSize() int64 {
+	if v.SharedVolumeSize != nil {
+		return *v.SharedVolumeSize
+	}
+	return 0
+}
+
+func (v Volume) GetProjectID() uint32 {
+	if v.ProjectID != nil {
+		return *v.ProjectID
+	}
+	return 0
+}
+
+// GetMkfsOptions returns the additional command line arguments for
+// mkfs. Which of those are supported depends on the filesystem.
+func (v Volume) GetMkfsOptions() []string {
+	if v.MkfsOptions != nil {
+		return strings.Fields(*v.MkfsOptions)
+	}
+	return nil
+}
+
+// GetMountOptions returns the additional mount options for the
+// filesystem.
+func (v Volume) GetMountOptions() []string {
+	if v.MountOptions != nil && *v.MountOptions != "" {
+		return strings.Split(*v.MountOptions, ",")
+	}
+	return nil
+}
+
+// validateMkfsOptions checks that the mkfs options are pairs of
+// flag and value. The value must not refer to some other device or
+// file. Whether the flags are supported is checked once the
+// filesystem is known.
+func validateMkfsOptions(value string) error {
+	args := strings.Fields(value)
+	if len(args)%2 != 0 {
+		return fmt.Errorf("expected pairs of flag and value, got %q", value)
+	}
+	for i := 0; i < len(args); i += 2 {
+		flag, arg := args[i], args[i+1]
+		if len(flag) != 2 || flag[0] != '-' {
+			return fmt.Errorf("%q is not a single-letter flag", flag)
+		}
+		if strings.HasPrefix(arg, "-") || strings.Contains(arg, "/") {
+			return fmt.Errorf("invalid value for %s: %q", flag, arg)
+		}
+	}
+	return nil
+}
+
+// invalidMountOptions are options which would change how PMEM-CSI
+// mounts the volume.
+var invalidMountOptions = []string{
+	"bind",
+	"rbind",
+	"move",
+	"remount",
+	"loop",
+}
+
+// validateMountOptions checks a comma-separated list of mount
+// options. DAX is controlled via the usage parameter and cannot be
+// set explicitly.
+func validateMountOptions(value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, option := range strings.Split(value, ",") {
+		if option == "" || strings.ContainsAny(option, " /") {
+			return fmt.Errorf("invalid mount option %q", option)
+		}
+		if option == "dax" || strings.HasPrefix(option, "dax=") {
+			return fmt.Errorf("mount option %q conflicts with parameter %q", option, UsageModel)
+		}
+		for _, invalid := range invalidMountOptions {
+			if option == invalid {
+				return fmt.Errorf("mount option %q not supported", option)
+			}
+		}
+	}
+	return nil
+}
@@ -23,6 +23,13 @@ func TestParameters(t *testing.T) {
 	gigNum := int64(1 * 1024 * 1024 * 1024)
 	appDirect := UsageAppDirect
 	fileIO := UsageFileIO
+	mkfsOptions := "-O ^has_journal -i 65536"
+	mountOptions := "noatime,nodiratime"
+	repair := FsckPolicyRepair
+	fallback := DaxPolicyFallback
+	hugePage := int64(1024 * 1024 * 1024)
+	shared := "tenants"
+	projectID := uint32(42)
 
 	tests := []struct {
 		name       string
@@ -128,6 +135,238 @@ func TestParameters(t *testing.T) {
 			err: "parameter \"size\": failed to parse \"foo\" as int64: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
 		},
 
+		// Filesystem options.
+		{
+			name:   "valid-filesystem-options",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MkfsOptions:  "-O ^has_journal -i 65536",
+				MountOptions: "noatime,nodiratime",
+			},
+			parameters: Volume{
+				MkfsOptions:  &mkfsOptions,
+				MountOptions: &mountOptions,
+			},
+		},
+		{
+			name:   "valid-node-filesystem-options",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				MkfsOptions:  "-O ^has_journal -i 65536",
+				MountOptions: "noatime,nodiratime",
+			},
+			parameters: Volume{
+				MkfsOptions:  &mkfsOptions,
+				MountOptions: &mountOptions,
+			},
+		},
+		{
+			name:   "invalid-mkfs-options-pairs",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MkfsOptions: "-O ^has_journal -i",
+			},
+			err: "parameter \"mkfsOptions\": expected pairs of flag and value, got \"-O ^has_journal -i\"",
+		},
+		{
+			name:   "invalid-mkfs-options-flag",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MkfsOptions: "--foo bar",
+			},
+			err: "parameter \"mkfsOptions\": \"--foo\" is not a single-letter flag",
+		},
+		{
+			name:   "invalid-mkfs-options-device",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MkfsOptions: "-J device=/dev/pmem0",
+			},
+			err: "parameter \"mkfsOptions\": invalid value for -J: \"device=/dev/pmem0\"",
+		},
+		{
+			name:   "invalid-mount-options-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MountOptions: "noatime,dax=never",
+			},
+			err: "parameter \"mountOptions\": mount option \"dax=never\" conflicts with parameter \"usage\"",
+		},
+		{
+			name:   "invalid-mount-options-bind",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MountOptions: "remount",
+			},
+			err: "parameter \"mountOptions\": mount option \"remount\" not supported",
+		},
+		{
+			name:   "invalid-mount-options-empty",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				MountOptions: "noatime,,ro",
+			},
+			err: "parameter \"mountOptions\": invalid mount option \"\"",
+		},
+
+		// Filesystem check.
+		{
+			name:   "valid-fsck-policy",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				FsckPolicyModel: "repair",
+			},
+			parameters: Volume{
+				FsckPolicy: &repair,
+			},
+		},
+		{
+			name:   "invalid-fsck-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				FsckPolicyModel: "always",
+			},
+			err: "parameter \"fsckPolicy\": unknown value: always",
+		},
+		{
+			name:   "invalid-fsck-policy-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				FsckPolicyModel: "check",
+				Size:            gig,
+			},
+			err: "parameter \"fsckPolicy\" invalid in this context",
+		},
+
+		// DAX verification.
+		{
+			name:   "valid-dax-policy",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				DaxPolicyModel: "fallback",
+				Size:           gig,
+			},
+			parameters: Volume{
+				DaxPolicy: &fallback,
+				Size:      &gigNum,
+			},
+		},
+		{
+			name:   "invalid-dax-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DaxPolicyModel: "ignore",
+			},
+			err: "parameter \"daxPolicy\": unknown value: ignore",
+		},
+
+		// Extent size and DAX flags.
+		{
+			name:   "valid-extent-size",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				ExtentSize: "1Gi",
+				DaxInherit: "true",
+			},
+			parameters: Volume{
+				ExtentSize: &hugePage,
+				DaxInherit: &yes,
+			},
+		},
+		{
+			name:   "invalid-extent-size",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ExtentSize: "1000",
+			},
+			err: "parameter \"extentSize\": \"1000\" must be a multiple of 4Ki and at most 1Gi",
+		},
+		{
+			name:   "too-large-extent-size",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ExtentSize: "2Gi",
+			},
+			err: "parameter \"extentSize\": \"2Gi\" must be a multiple of 4Ki and at most 1Gi",
+		},
+		{
+			name:   "dax-inherit-file-io",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DaxInherit: "true",
+				UsageModel: "FileIO",
+			},
+			err: "parameter \"daxInherit\" and usage \"FileIO\" are mutually exclusive",
+		},
+
+		// Subdirectory volumes.
+		{
+			name:   "valid-shared-volume",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolume:     shared,
+				SharedVolumeSize: gig,
+			},
+			parameters: Volume{
+				SharedVolume:     &shared,
+				SharedVolumeSize: &gigNum,
+			},
+		},
+		{
+			name:   "valid-shared-volume-node",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolume: shared,
+				ProjectID:    "42",
+			},
+			parameters: Volume{
+				SharedVolume: &shared,
+				ProjectID:    &projectID,
+			},
+		},
+		{
+			name:   "invalid-shared-volume-name",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolume:     "../foo",
+				SharedVolumeSize: gig,
+			},
+			err: "parameter \"sharedVolume\": invalid name \"../foo\": a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')",
+		},
+		{
+			name:   "missing-shared-volume-size",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolume: shared,
+			},
+			err: "required parameter \"sharedVolumeSize\" not specified",
+		},
+		{
+			name:   "missing-shared-volume",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolumeSize: gig,
+			},
+			err: "parameters \"sharedVolumeSize\" and \"projectID\" require \"sharedVolume\"",
+		},
+		{
+			name:   "shared-volume-mount-options",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				SharedVolume: shared,
+				MountOptions: mountOptions,
+			},
+			err: "parameters \"kataContainers\", \"mkfsOptions\", \"mountOptions\", \"fsckPolicy\", \"daxPolicy\" and \"daxInherit\" cannot be used together with \"sharedVolume\"",
+		},
+		{
+			name:   "invalid-project-id-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				ProjectID: "1",
+			},
+			err: "parameter \"projectID\" invalid in this context",
+		},
+
 		// Legacy state files.
 		{
 			name:   "model-none",
@@ -146,7 +385,7 @@ func TestParameters(t *testing.T) {
 			result := VolumeContext{}
 			for key, value := range tt.stringmap {
 				switch key {
-				case Size:
+				case Size, SharedVolumeSize, ExtentSize:
 					quantity := resource.MustParse(value)
 					value = fmt.Sprintf("%d", quantity.Value())
 				case PersistencyModel:
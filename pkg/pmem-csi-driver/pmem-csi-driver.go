@@ -34,7 +34,12 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -47,7 +52,7 @@ type DriverMode string
 
 func (mode *DriverMode) Set(value string) error {
 	switch value {
-	case string(Node), string(Webhooks), string(ForceConvertRawNamespaces):
+	case string(Node), string(Webhooks), string(ForceConvertRawNamespaces), string(PmemSetup), string(Cleanup):
 		*mode = DriverMode(value)
 	default:
 		// The flag package will add the value to the final output, no need to do it here.
@@ -69,6 +74,10 @@ const (
 	Webhooks DriverMode = "webhooks"
 	// Convert each raw namespace into fsdax.
 	ForceConvertRawNamespaces = "force-convert-raw-namespaces"
+	// Prepare PMEM as configured by the PmemSetup options.
+	PmemSetup DriverMode = "pmem-setup"
+	// Remove all volumes and the driver state on the node.
+	Cleanup DriverMode = "cleanup"
 )
 
 var (
@@ -117,6 +126,9 @@ type Config struct {
 	Version string
 	// PmemPercentage percentage of space to be used by the driver in each PMEM region
 	PmemPercentage uint
+	// Instance is added to the names of namespaces and volume groups
+	// in LVM mode, empty for the traditional names
+	Instance string
 
 	// KubeAPIQPS is the average rate of requests to the Kubernetes API server,
 	// enforced locally in client-go.
@@ -129,10 +141,31 @@ type Config struct {
 	// parameters for Kubernetes scheduler extender
 	schedulerListen         string
 	insecureSchedulerListen string
+	podMutation             scheduler.PodMutation
+
+	// parameters for capacity reporting from node to controller
+	capacityReports         bool
+	capacityMaxAge          time.Duration
+	capacityMetricsFallback bool
+	capacityReportURL       string
+	capacityReportInterval  time.Duration
 
 	// parameters for rescheduler and raw namespace conversion
 	nodeSelector types.NodeSelector
 
+	// parameters for PMEM setup
+	pmemSetup pmdmanager.SetupOptions
+
+	// parameter for node cleanup
+	cleanupToken string
+
+	// parameter for recreating PVCs after their node lost the driver
+	recreateGracePeriod time.Duration
+
+	// parameters for leader election among controller replicas
+	leaderElection          bool
+	leaderElectionNamespace string
+
 	// parameters for Prometheus metrics
 	metricsListen string
 	metricsPath   string
@@ -153,7 +186,14 @@ func GetCSIDriver(cfg Config) (*csiDriver, error) {
 	if cfg.Mode == Node && cfg.NodeID == "" {
 		return nil, errors.New("node ID configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.StateBasePath == "" {
+	if cfg.Mode == PmemSetup && cfg.pmemSetup.ReservePercentage > 100 {
+		return nil, errors.New("reserve percentage must not be larger than 100")
+	}
+	if err := api.ValidateInstanceName(cfg.Instance); err != nil {
+		return nil, err
+	}
+	cfg.pmemSetup.Instance = cfg.Instance
+	if (cfg.Mode == Node || cfg.Mode == Cleanup) && cfg.StateBasePath == "" {
 		cfg.StateBasePath = "/var/lib/" + cfg.DriverName
 	}
 
@@ -210,6 +250,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		scInformer := globalFactory.Storage().V1().StorageClasses().Informer()
 		pvInformer := globalFactory.Core().V1().PersistentVolumes().Informer()
 		csiNodeLister := globalFactory.Storage().V1().CSINodes().Lister()
+		pvLister := globalFactory.Core().V1().PersistentVolumes().Lister()
 
 		var pcp *pmemCSIProvisioner
 		if csid.cfg.nodeSelector != nil {
@@ -248,17 +289,10 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		}
 
 		if csid.cfg.schedulerListen != "" || csid.cfg.insecureSchedulerListen != "" {
-			// Factory for the driver's namespace.
-			namespace := os.Getenv("POD_NAMESPACE")
-			if namespace == "" {
-				return errors.New("POD_NAMESPACE env variable is not set")
+			c, reports, err := csid.getCapacity(ctx, client)
+			if err != nil {
+				return err
 			}
-			localFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod,
-				informers.WithNamespace(namespace),
-			)
-			podLister := localFactory.Core().V1().Pods().Lister()
-			c := scheduler.CapacityViaMetrics(namespace, csid.cfg.DriverName, podLister)
-			localFactory.Start(ctx.Done())
 
 			sched, err := scheduler.NewScheduler(
 				csid.cfg.DriverName,
@@ -266,12 +300,22 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 				client,
 				pvcLister,
 				scLister,
+				csid.cfg.podMutation,
 			)
 			if err != nil {
 				return fmt.Errorf("create scheduler: %v", err)
 			}
 			if csid.cfg.schedulerListen != "" {
-				if _, err := csid.startHTTPSServer(ctx, cancel, csid.cfg.schedulerListen, sched, true /* TLS */); err != nil {
+				handler := http.Handler(sched)
+				if reports != nil {
+					// Only offered via TLS because node drivers
+					// must authenticate with a client certificate.
+					mux := http.NewServeMux()
+					mux.Handle("/", sched)
+					mux.Handle("/capacity", reports)
+					handler = mux
+				}
+				if _, err := csid.startHTTPSServer(ctx, cancel, csid.cfg.schedulerListen, handler, true /* TLS */); err != nil {
 					return err
 				}
 			}
@@ -285,8 +329,29 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		if pcp != nil {
 			pcp.startRescheduler(ctx, cancel)
 		}
+
+		// Everything that keeps state must only be active in
+		// one replica. Serving the webhooks is stateless and
+		// done by all replicas.
+		var statefulTasks []func(ctx context.Context)
+		if csid.cfg.recreateGracePeriod > 0 {
+			evBroadcaster := record.NewBroadcaster()
+			evBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+			defer evBroadcaster.Shutdown()
+			recorder := evBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: csid.cfg.DriverName})
+			recreator := newPVCRecreator(csid.cfg.DriverName, csid.cfg.recreateGracePeriod,
+				client, pvcLister, pvLister, scLister, csiNodeLister, recorder)
+			statefulTasks = append(statefulTasks, recreator.run)
+		}
+		if err := csid.runAsLeader(ctx, cancel, client, func(ctx context.Context) {
+			for _, task := range statefulTasks {
+				go task(ctx)
+			}
+		}); err != nil {
+			return err
+		}
 	case Node:
-		dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
+		dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage, csid.cfg.Instance)
 		if err != nil {
 			return err
 		}
@@ -305,8 +370,21 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 
 		// Create GRPC servers
 		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
-		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm)
-		ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount")
+		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, csid.cfg.Instance, dm, sm)
+		cs.sharedDirectory = filepath.Clean(csid.cfg.StateBasePath) + "/shared"
+
+		// Events about volumes are optional, the driver also
+		// works without access to the apiserver.
+		var recorder record.EventRecorder
+		if client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst); err != nil {
+			logger.Info("Events about volumes are disabled", "error", err)
+		} else {
+			evBroadcaster := record.NewBroadcaster()
+			evBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+			defer evBroadcaster.Shutdown()
+			recorder = evBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: csid.cfg.DriverName, Host: csid.cfg.NodeID})
+		}
+		ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount", recorder)
 
 		services := []grpcserver.Service{ids, ns, cs}
 		if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, services...); err != nil {
@@ -316,6 +394,26 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		// Also collect metrics data via the device manager.
 		pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
 
+		// Push capacity changes to the controller, if enabled.
+		if csid.cfg.capacityReportURL != "" {
+			tlsConfig := func() (*tls.Config, error) {
+				return pmemgrpc.LoadClientTLS(csid.cfg.CAFile, csid.cfg.CertFile, csid.cfg.KeyFile, "")
+			}
+			nodeCapacity := func(ctx context.Context) (scheduler.CapacityReport, error) {
+				capacity, err := dm.GetCapacity(ctx)
+				return scheduler.CapacityReport{
+					MaxVolumeSize: int64(capacity.MaxVolumeSize),
+					Available:     int64(capacity.Available),
+					Managed:       int64(capacity.Managed),
+					Total:         int64(capacity.Total),
+				}, err
+			}
+			reporter := scheduler.NewCapacityReporter(csid.cfg.capacityReportURL, tlsConfig, csid.cfg.capacityReportInterval,
+				csid.cfg.DriverName, csid.cfg.NodeID, nodeCapacity)
+			cs.capacityChanged = reporter.Trigger
+			go reporter.Run(ctx)
+		}
+
 		capacity, err := dm.GetCapacity(ctx)
 		if err != nil {
 			return fmt.Errorf("get initial capacity: %v", err)
@@ -327,7 +425,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 			return fmt.Errorf("connect to apiserver: %v", err)
 		}
 
-		if err := pmdmanager.ForceConvertRawNamespaces(ctx, client, csid.cfg.DriverName, csid.cfg.nodeSelector, csid.cfg.NodeID); err != nil {
+		if err := pmdmanager.ForceConvertRawNamespaces(ctx, client, csid.cfg.DriverName, csid.cfg.Instance, csid.cfg.nodeSelector, csid.cfg.NodeID); err != nil {
 			return err
 		}
 
@@ -342,6 +440,32 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		// isn't supported for DaemonSets
 		// (https://github.com/kubernetes/kubernetes/issues/24725).
 		logger.Info("Raw namespace conversion is done, waiting for termination signal.")
+	case PmemSetup:
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+
+		if err := pmdmanager.PmemSetup(ctx, client, csid.cfg.DriverName, csid.cfg.nodeSelector, csid.cfg.NodeID, csid.cfg.pmemSetup); err != nil {
+			return err
+		}
+
+		// Same as for ForceConvertRawNamespaces: wait for
+		// Kubernetes to remove the pod. After a dry run, that
+		// only happens when the PMEM setup gets reconfigured.
+		logger.Info("PMEM setup is done, waiting for termination signal.", "dry-run", csid.cfg.pmemSetup.DryRun)
+	case Cleanup:
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+
+		if err := pmdmanager.Cleanup(ctx, client, csid.cfg.DriverName, csid.cfg.NodeID, csid.cfg.DeviceManager, csid.cfg.Instance, csid.cfg.StateBasePath, csid.cfg.cleanupToken); err != nil {
+			return err
+		}
+
+		// The operator removes the pod once all nodes are done.
+		logger.Info("Node cleanup is done, waiting for termination signal.")
 	default:
 		return fmt.Errorf("Unsupported device mode '%v", csid.cfg.Mode)
 	}
@@ -378,6 +502,46 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 	return nil
 }
 
+// getCapacity returns the source of capacity information for the
+// scheduler extender: either scraping the metrics endpoints of the
+// node driver pods, reports pushed by the node drivers, or both. When
+// reports are enabled, it also returns the HTTP handler which receives
+// them. With leader election, the replicas share the reports.
+func (csid *csiDriver) getCapacity(ctx context.Context, client kubernetes.Interface) (scheduler.Capacity, http.Handler, error) {
+	var fallback scheduler.Capacity
+	if !csid.cfg.capacityReports || csid.cfg.capacityMetricsFallback {
+		// Factory for the driver's namespace.
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			return nil, nil, errors.New("POD_NAMESPACE env variable is not set")
+		}
+		localFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod,
+			informers.WithNamespace(namespace),
+		)
+		podLister := localFactory.Core().V1().Pods().Lister()
+		fallback = scheduler.CapacityViaMetrics(namespace, csid.cfg.DriverName, podLister)
+		localFactory.Start(ctx.Done())
+	}
+	if !csid.cfg.capacityReports {
+		return fallback, nil, nil
+	}
+
+	cache := scheduler.NewCapacityCache(csid.cfg.DriverName, csid.cfg.capacityMaxAge, fallback)
+	if csid.cfg.leaderElection {
+		// Several replicas serve the scheduler extender, but
+		// each report reaches only one of them.
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			return nil, nil, errors.New("POD_NAMESPACE env variable is not set")
+		}
+		if err := cache.ShareViaLeases(ctx, client, namespace); err != nil {
+			return nil, nil, fmt.Errorf("share capacity reports: %v", err)
+		}
+	}
+	klog.FromContext(ctx).Info("Capacity reports enabled.", "endpoint", fmt.Sprintf("https://%s/capacity", csid.cfg.schedulerListen))
+	return cache, cache, nil
+}
+
 // startMetrics starts the HTTPS server for the Prometheus endpoint, if one is configured.
 // Error handling is the same as for startScheduler.
 func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string, error) {
@@ -428,7 +592,9 @@ func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), list
 
 		var err error
 		if useTLS {
-			err = server.ServeTLS(listener, csid.cfg.CertFile, csid.cfg.KeyFile)
+			// The certificates come from the TLS config, which
+			// reloads them when they get updated.
+			err = server.ServeTLS(listener, "", "")
 		} else {
 			err = server.Serve(listener)
 		}
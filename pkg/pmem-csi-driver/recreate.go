@@ -0,0 +1,454 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+const (
+	// annRecreateOnNodeLoss enables recreation of a PVC when the
+	// node of its volume no longer has a PMEM-CSI driver. It can be
+	// set to "true" in a storage class or PVC. "false" in a PVC
+	// overrides the storage class.
+	annRecreateOnNodeLoss = "pmem-csi.intel.com/recreate-on-node-loss"
+
+	// annPendingClaim is set on the old PV before deleting its PVC.
+	// It contains the PVC which still needs to be created, so that
+	// the recreation can be completed after a restart of the
+	// controller.
+	annPendingClaim = "pmem-csi.intel.com/pending-claim"
+
+	// recreateCheckInterval determines how often all PVCs get checked.
+	recreateCheckInterval = 30 * time.Second
+)
+
+var (
+	pvcRecreations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_pvc_recreations_total",
+			Help: "A counter for actions taken for PVCs whose node lost the PMEM-CSI driver.",
+		},
+		[]string{"action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pvcRecreations)
+}
+
+// pvcRecreator detects bound PVCs whose volume is on a node which
+// no longer has a PMEM-CSI driver, for example because the node was
+// removed or its PMEM failed. For PVCs which opted into it, it
+// deletes the PVC after a grace period and creates it anew, which
+// then leads to provisioning of a new, empty volume elsewhere. This
+// is meant for workloads which use PMEM as cache. The old PV remains
+// and has to be removed by the admin.
+type pvcRecreator struct {
+	driverName    string
+	topologyKey   string
+	gracePeriod   time.Duration
+	client        kubernetes.Interface
+	pvcLister     corelistersv1.PersistentVolumeClaimLister
+	pvLister      corelistersv1.PersistentVolumeLister
+	scLister      storagelistersv1.StorageClassLister
+	csiNodeLister storagelistersv1.CSINodeLister
+	recorder      record.EventRecorder
+	now           func() time.Time
+
+	// lostSince records when the node of a PVC was first found
+	// without driver.
+	lostSince map[types.UID]time.Time
+	// pending contains PVCs which were deleted and still need to
+	// be created, indexed by namespace/name.
+	pending map[string]pendingPVC
+}
+
+type pendingPVC struct {
+	oldUID     types.UID
+	volumeName string
+	nodeName   string
+	claim      *v1.PersistentVolumeClaim
+}
+
+// persistedPVC is the content of the annPendingClaim annotation.
+type persistedPVC struct {
+	OldUID types.UID                 `json:"oldUID"`
+	Node   string                    `json:"node"`
+	Claim  *v1.PersistentVolumeClaim `json:"claim"`
+}
+
+func newPVCRecreator(driverName string,
+	gracePeriod time.Duration,
+	client kubernetes.Interface,
+	pvcLister corelistersv1.PersistentVolumeClaimLister,
+	pvLister corelistersv1.PersistentVolumeLister,
+	scLister storagelistersv1.StorageClassLister,
+	csiNodeLister storagelistersv1.CSINodeLister,
+	recorder record.EventRecorder) *pvcRecreator {
+	return &pvcRecreator{
+		driverName:    driverName,
+		topologyKey:   driverName + "/node",
+		gracePeriod:   gracePeriod,
+		client:        client,
+		pvcLister:     pvcLister,
+		pvLister:      pvLister,
+		scLister:      scLister,
+		csiNodeLister: csiNodeLister,
+		recorder:      recorder,
+		now:           time.Now,
+		lostSince:     map[types.UID]time.Time{},
+		pending:       map[string]pendingPVC{},
+	}
+}
+
+// run checks all PVCs periodically until the context is done.
+func (r *pvcRecreator) run(ctx context.Context) {
+	l := klog.FromContext(ctx).WithName("pvc-recreator")
+	ctx = klog.NewContext(ctx, l)
+
+	l.Info("starting", "grace-period", r.gracePeriod)
+	defer l.Info("stopped")
+	r.restore(ctx)
+	wait.UntilWithContext(ctx, r.check, recreateCheckInterval)
+}
+
+// restore fills the pending PVCs from the annotations of the old
+// PVs. Those were deleted by a previous instance of the controller
+// which did not get to create them again.
+func (r *pvcRecreator) restore(ctx context.Context) {
+	l := klog.FromContext(ctx)
+
+	pvs, err := r.pvLister.List(labels.Everything())
+	if err != nil {
+		l.Error(err, "list PVs")
+		return
+	}
+	for _, pv := range pvs {
+		value, ok := pv.Annotations[annPendingClaim]
+		if !ok {
+			continue
+		}
+		var persisted persistedPVC
+		if err := json.Unmarshal([]byte(value), &persisted); err != nil || persisted.Claim == nil {
+			l.Error(err, "invalid annotation", "pv", pmemlog.KObj(pv), "annotation", annPendingClaim)
+			continue
+		}
+		claim := persisted.Claim
+		l.V(3).Info("restored pending PVC", "pvc", pmemlog.KObj(claim), "pv", pmemlog.KObj(pv))
+		r.pending[claim.Namespace+"/"+claim.Name] = pendingPVC{
+			oldUID:     persisted.OldUID,
+			volumeName: pv.Name,
+			nodeName:   persisted.Node,
+			claim:      claim,
+		}
+	}
+}
+
+func (r *pvcRecreator) check(ctx context.Context) {
+	l := klog.FromContext(ctx)
+
+	for key, p := range r.pending {
+		if r.create(ctx, p) && r.forget(ctx, p) {
+			delete(r.pending, key)
+		}
+	}
+
+	pvcs, err := r.pvcLister.List(labels.Everything())
+	if err != nil {
+		l.Error(err, "list PVCs")
+		return
+	}
+	seen := map[types.UID]bool{}
+	for _, pvc := range pvcs {
+		seen[pvc.UID] = true
+		if err := r.checkPVC(ctx, pvc); err != nil {
+			l.Error(err, "check PVC", "pvc", pmemlog.KObj(pvc))
+		}
+	}
+	for uid := range r.lostSince {
+		if !seen[uid] {
+			delete(r.lostSince, uid)
+		}
+	}
+}
+
+func (r *pvcRecreator) checkPVC(ctx context.Context, pvc *v1.PersistentVolumeClaim) error {
+	l := klog.FromContext(ctx).WithValues("pvc", pmemlog.KObj(pvc))
+
+	if pvc.Status.Phase != v1.ClaimBound ||
+		pvc.Spec.VolumeName == "" ||
+		pvc.DeletionTimestamp != nil {
+		return nil
+	}
+	pv, err := r.pvLister.Get(pvc.Spec.VolumeName)
+	switch {
+	case apierrs.IsNotFound(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("retrieve PV %s: %v", pvc.Spec.VolumeName, err)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != r.driverName {
+		return nil
+	}
+	nodeName := r.volumeNode(pv)
+	if nodeName == "" {
+		return nil
+	}
+	if !r.optedIn(ctx, pvc) {
+		return nil
+	}
+
+	driverIsRunning := false
+	csiNode, err := r.csiNodeLister.Get(nodeName)
+	switch {
+	case err == nil:
+		driverIsRunning = hasDriver(csiNode, r.driverName)
+	case apierrs.IsNotFound(err):
+		driverIsRunning = false
+	default:
+		return fmt.Errorf("retrieve CSINode %s: %v", nodeName, err)
+	}
+
+	since, known := r.lostSince[pvc.UID]
+	if driverIsRunning {
+		if known {
+			l.V(3).Info("driver is back", "node", nodeName)
+			r.recorder.Eventf(pvc, v1.EventTypeNormal, "NodeRecovered",
+				"node %s of volume %s has a PMEM-CSI driver again, PVC will not be recreated", nodeName, pv.Name)
+			pvcRecreations.WithLabelValues("recovered").Inc()
+			delete(r.lostSince, pvc.UID)
+		}
+		return nil
+	}
+	now := r.now()
+	if !known {
+		l.V(3).Info("driver is gone", "node", nodeName)
+		r.recorder.Eventf(pvc, v1.EventTypeWarning, "NodeLost",
+			"node %s of volume %s has no PMEM-CSI driver, PVC will be recreated after %v unless the driver comes back", nodeName, pv.Name, r.gracePeriod)
+		pvcRecreations.WithLabelValues("node_lost").Inc()
+		r.lostSince[pvc.UID] = now
+		return nil
+	}
+	if now.Sub(since) < r.gracePeriod {
+		return nil
+	}
+
+	p := pendingPVC{
+		oldUID:     pvc.UID,
+		volumeName: pv.Name,
+		nodeName:   nodeName,
+		claim:      newClaim(pvc),
+	}
+	// The new PVC must be known before deleting the old one,
+	// otherwise it would get lost when the controller restarts
+	// in between.
+	if err := r.persist(ctx, p); err != nil {
+		r.recorder.Eventf(pvc, v1.EventTypeWarning, "RecreateFailed", "%v", err)
+		pvcRecreations.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	l.Info("deleting PVC", "node", nodeName, "pv", pmemlog.KObj(pv))
+	r.recorder.Eventf(pvc, v1.EventTypeNormal, "Recreating",
+		"deleting PVC because node %s of volume %s has no PMEM-CSI driver since %v", nodeName, pv.Name, now.Sub(since).Round(time.Second))
+	uid := pvc.UID
+	err = r.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+	if err != nil && !apierrs.IsNotFound(err) {
+		r.recorder.Eventf(pvc, v1.EventTypeWarning, "RecreateFailed", "delete PVC: %v", err)
+		pvcRecreations.WithLabelValues("failed").Inc()
+		// Not much harm done when the annotation remains: the
+		// PVC still exists and will not be created again.
+		r.forget(ctx, p)
+		return fmt.Errorf("delete PVC: %v", err)
+	}
+	pvcRecreations.WithLabelValues("deleted").Inc()
+	delete(r.lostSince, pvc.UID)
+
+	// Deletion usually is not immediate because of the PVC
+	// protection finalizer, so creation most likely has to be
+	// retried during the next check.
+	if !r.create(ctx, p) || !r.forget(ctx, p) {
+		r.pending[pvc.Namespace+"/"+pvc.Name] = p
+	}
+	return nil
+}
+
+// persist stores the pending PVC in an annotation of the old PV.
+func (r *pvcRecreator) persist(ctx context.Context, p pendingPVC) error {
+	value, err := json.Marshal(persistedPVC{
+		OldUID: p.oldUID,
+		Node:   p.nodeName,
+		Claim:  p.claim,
+	})
+	if err != nil {
+		return fmt.Errorf("encode pending PVC: %v", err)
+	}
+	return r.annotatePV(ctx, p.volumeName, string(value))
+}
+
+// forget removes the annotation for a pending PVC from the old PV and
+// returns true if that worked.
+func (r *pvcRecreator) forget(ctx context.Context, p pendingPVC) bool {
+	if err := r.annotatePV(ctx, p.volumeName, nil); err != nil {
+		klog.FromContext(ctx).Error(err, "remove pending PVC", "pvc", pmemlog.KObj(p.claim))
+		return false
+	}
+	return true
+}
+
+// annotatePV sets or (for nil) removes the annPendingClaim annotation.
+// A PV which was already deleted by the admin is not an error.
+func (r *pvcRecreator) annotatePV(ctx context.Context, pvName string, value interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				annPendingClaim: value,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := r.client.CoreV1().PersistentVolumes().Patch(ctx, pvName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil &&
+		!apierrs.IsNotFound(err) {
+		return fmt.Errorf("annotate PV %s: %v", pvName, err)
+	}
+	return nil
+}
+
+// create tries to create the new PVC and returns true if nothing more needs to be done.
+func (r *pvcRecreator) create(ctx context.Context, p pendingPVC) bool {
+	l := klog.FromContext(ctx).WithValues("pvc", pmemlog.KObj(p.claim))
+
+	old, err := r.pvcLister.PersistentVolumeClaims(p.claim.Namespace).Get(p.claim.Name)
+	switch {
+	case err == nil && old.UID == p.oldUID:
+		l.V(5).Info("old PVC still exists")
+		return false
+	case err == nil:
+		// Someone else, for example the StatefulSet controller, was faster.
+		l.V(3).Info("PVC was recreated by someone else")
+		return true
+	case !apierrs.IsNotFound(err):
+		l.Error(err, "check for old PVC")
+		return false
+	}
+
+	claim, err := r.client.CoreV1().PersistentVolumeClaims(p.claim.Namespace).Create(ctx, p.claim, metav1.CreateOptions{})
+	switch {
+	case apierrs.IsAlreadyExists(err):
+		// Lister was not up-to-date, try again later.
+		return false
+	case err != nil:
+		l.Error(err, "create PVC")
+		pvcRecreations.WithLabelValues("failed").Inc()
+		return false
+	}
+	l.Info("created PVC")
+	r.recorder.Eventf(claim, v1.EventTypeNormal, "Recreated",
+		"replaces PVC with UID %s because node %s of volume %s has no PMEM-CSI driver, that volume must be removed manually", p.oldUID, p.nodeName, p.volumeName)
+	pvcRecreations.WithLabelValues("created").Inc()
+	return true
+}
+
+// optedIn checks the annotation of the PVC first, then the one of the storage class.
+func (r *pvcRecreator) optedIn(ctx context.Context, pvc *v1.PersistentVolumeClaim) bool {
+	l := klog.FromContext(ctx)
+
+	if value, ok := pvc.Annotations[annRecreateOnNodeLoss]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			l.V(3).Info("invalid annotation", "annotation", annRecreateOnNodeLoss, "value", value)
+			return false
+		}
+		return enabled
+	}
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false
+	}
+	sc, err := r.scLister.Get(*pvc.Spec.StorageClassName)
+	if err != nil {
+		return false
+	}
+	enabled, _ := strconv.ParseBool(sc.Annotations[annRecreateOnNodeLoss])
+	return enabled
+}
+
+// volumeNode returns the node that a PMEM-CSI volume is on according
+// to its node affinity, an empty string if unknown.
+func (r *pvcRecreator) volumeNode(pv *v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == r.topologyKey &&
+				expr.Operator == v1.NodeSelectorOpIn &&
+				len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// newClaim returns a PVC which is identical to the old one except
+// for the information about the volume that it was bound to.
+func newClaim(pvc *v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pvc.Name,
+			Namespace:       pvc.Namespace,
+			OwnerReferences: pvc.OwnerReferences,
+		},
+		Spec: *pvc.Spec.DeepCopy(),
+	}
+	claim.Spec.VolumeName = ""
+	if pvc.Labels != nil {
+		claim.Labels = map[string]string{}
+		for key, value := range pvc.Labels {
+			claim.Labels[key] = value
+		}
+	}
+	for key, value := range pvc.Annotations {
+		switch key {
+		case annSelectedNode,
+			"pv.kubernetes.io/bind-completed",
+			"pv.kubernetes.io/bound-by-controller",
+			"volume.beta.kubernetes.io/storage-provisioner",
+			"volume.kubernetes.io/storage-provisioner":
+			continue
+		}
+		if claim.Annotations == nil {
+			claim.Annotations = map[string]string{}
+		}
+		claim.Annotations[key] = value
+	}
+	return claim
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type recreateEnv struct {
+	client    *fake.Clientset
+	pvcs      cache.Indexer
+	pvs       cache.Indexer
+	scs       cache.Indexer
+	csiNodes  cache.Indexer
+	recorder  *record.FakeRecorder
+	recreator *pvcRecreator
+	now       time.Time
+}
+
+const (
+	recreateClass = "recreate"
+	normalClass   = "normal"
+	gracePeriod   = 5 * time.Minute
+)
+
+func newRecreateEnv(t *testing.T, pvc *v1.PersistentVolumeClaim, haveDriver bool) *recreateEnv {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv",
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver: driverName,
+				},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      driverName + "/node",
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{nodeName},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	classes := []*storagev1.StorageClass{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: recreateClass,
+				Annotations: map[string]string{
+					annRecreateOnNodeLoss: "true",
+				},
+			},
+			Provisioner: driverName,
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: normalClass,
+			},
+			Provisioner: driverName,
+		},
+	}
+
+	env := &recreateEnv{
+		client:   fake.NewSimpleClientset(pvc, pv),
+		pvcs:     cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		pvs:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		scs:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		csiNodes: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		recorder: record.NewFakeRecorder(100),
+		now:      time.Now(),
+	}
+	require.NoError(t, env.pvcs.Add(pvc))
+	require.NoError(t, env.pvs.Add(pv))
+	for _, sc := range classes {
+		require.NoError(t, env.scs.Add(sc))
+	}
+	env.setDriver(t, haveDriver)
+	env.newRecreator()
+	return env
+}
+
+// newRecreator creates a new recreator instance, as after a restart
+// of the controller.
+func (env *recreateEnv) newRecreator() {
+	env.recreator = newPVCRecreator(driverName, gracePeriod, env.client,
+		corelistersv1.NewPersistentVolumeClaimLister(env.pvcs),
+		corelistersv1.NewPersistentVolumeLister(env.pvs),
+		storagelistersv1.NewStorageClassLister(env.scs),
+		storagelistersv1.NewCSINodeLister(env.csiNodes),
+		env.recorder,
+	)
+	env.recreator.now = func() time.Time { return env.now }
+}
+
+// syncPV copies the PV from the client into the lister.
+func (env *recreateEnv) syncPV(t *testing.T) *v1.PersistentVolume {
+	pv, err := env.client.CoreV1().PersistentVolumes().Get(context.Background(), "pv", metav1.GetOptions{})
+	require.NoError(t, err, "get PV")
+	require.NoError(t, env.pvs.Update(pv))
+	return pv
+}
+
+func (env *recreateEnv) setDriver(t *testing.T, haveDriver bool) {
+	csiNode := &storagev1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: nodeName,
+		},
+	}
+	if haveDriver {
+		csiNode.Spec.Drivers = []storagev1.CSINodeDriver{{Name: driverName}}
+	}
+	require.NoError(t, env.csiNodes.Update(csiNode))
+}
+
+func (env *recreateEnv) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-env.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func (env *recreateEnv) getPVC(t *testing.T, name string) *v1.PersistentVolumeClaim {
+	pvc, err := env.client.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return pvc
+}
+
+func makeBoundPVC(className string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pvc",
+			Namespace:   "default",
+			UID:         types.UID("pvc-uid"),
+			Annotations: map[string]string{},
+			Labels:      map[string]string{"app": "cache"},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &className,
+			VolumeName:       "pv",
+		},
+		Status: v1.PersistentVolumeClaimStatus{
+			Phase: v1.ClaimBound,
+		},
+	}
+	pvc.Annotations[annSelectedNode] = nodeName
+	pvc.Annotations["pv.kubernetes.io/bind-completed"] = "yes"
+	for key, value := range annotations {
+		pvc.Annotations[key] = value
+	}
+	return pvc
+}
+
+func hasEvent(events []string, reason string) bool {
+	for _, event := range events {
+		if strings.Contains(event, " "+reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPVCRecreator(t *testing.T) {
+	testcases := map[string]struct {
+		pvc        *v1.PersistentVolumeClaim
+		haveDriver bool
+
+		expectRecreate bool
+	}{
+		"driver-running": {
+			pvc:        makeBoundPVC(recreateClass, nil),
+			haveDriver: true,
+		},
+		"not-opted-in": {
+			pvc: makeBoundPVC(normalClass, nil),
+		},
+		"opted-out": {
+			pvc: makeBoundPVC(recreateClass, map[string]string{annRecreateOnNodeLoss: "false"}),
+		},
+		"opted-in-class": {
+			pvc:            makeBoundPVC(recreateClass, nil),
+			expectRecreate: true,
+		},
+		"opted-in-pvc": {
+			pvc:            makeBoundPVC(normalClass, map[string]string{annRecreateOnNodeLoss: "true"}),
+			expectRecreate: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			env := newRecreateEnv(t, tc.pvc, tc.haveDriver)
+
+			env.recreator.check(ctx)
+			events := env.events()
+			assert.Equal(t, tc.expectRecreate, hasEvent(events, "NodeLost"), "NodeLost event in %v", events)
+
+			// Nothing happens during the grace period.
+			env.now = env.now.Add(gracePeriod - time.Second)
+			env.recreator.check(ctx)
+			assert.Empty(t, env.events(), "events during grace period")
+			require.NotNil(t, env.getPVC(t, "pvc"), "PVC during grace period")
+
+			env.now = env.now.Add(time.Second)
+			env.recreator.check(ctx)
+			events = env.events()
+			if !tc.expectRecreate {
+				assert.Empty(t, events, "events after grace period")
+				require.NotNil(t, env.getPVC(t, "pvc"), "PVC after grace period")
+				return
+			}
+			assert.True(t, hasEvent(events, "Recreating"), "Recreating event in %v", events)
+			// The fake client deletes immediately, but the
+			// lister still has the old PVC.
+			assert.Nil(t, env.getPVC(t, "pvc"), "PVC after grace period")
+			assert.Contains(t, env.syncPV(t).Annotations, annPendingClaim, "PV annotations while pending")
+
+			// Once the informer catches up, the PVC gets created anew.
+			require.NoError(t, env.pvcs.Delete(tc.pvc))
+			env.recreator.check(ctx)
+			events = env.events()
+			assert.True(t, hasEvent(events, "Recreated"), "Recreated event in %v", events)
+			pvc := env.getPVC(t, "pvc")
+			require.NotNil(t, pvc, "new PVC")
+			assert.Empty(t, pvc.Spec.VolumeName, "volume name")
+			assert.NotContains(t, pvc.Annotations, annSelectedNode, "annotations")
+			assert.NotContains(t, pvc.Annotations, "pv.kubernetes.io/bind-completed", "annotations")
+			assert.Equal(t, tc.pvc.Labels, pvc.Labels, "labels")
+			assert.Equal(t, tc.pvc.Spec.StorageClassName, pvc.Spec.StorageClassName, "storage class")
+			assert.Empty(t, env.recreator.pending, "pending PVCs")
+			assert.NotContains(t, env.syncPV(t).Annotations, annPendingClaim, "PV annotations after recreation")
+		})
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		oldPVC := makeBoundPVC(recreateClass, nil)
+		env := newRecreateEnv(t, oldPVC, false)
+
+		env.recreator.check(ctx)
+		env.now = env.now.Add(gracePeriod)
+		env.recreator.check(ctx)
+		assert.True(t, hasEvent(env.events(), "Recreating"), "Recreating event")
+		assert.Nil(t, env.getPVC(t, "pvc"), "PVC after grace period")
+		require.Len(t, env.recreator.pending, 1, "pending PVCs")
+
+		// The controller restarts before the old PVC is gone.
+		env.syncPV(t)
+		env.newRecreator()
+		env.recreator.restore(ctx)
+		require.Len(t, env.recreator.pending, 1, "restored pending PVCs")
+
+		require.NoError(t, env.pvcs.Delete(oldPVC))
+		env.recreator.check(ctx)
+		events := env.events()
+		assert.True(t, hasEvent(events, "Recreated"), "Recreated event in %v", events)
+		pvc := env.getPVC(t, "pvc")
+		require.NotNil(t, pvc, "new PVC")
+		assert.Empty(t, pvc.Spec.VolumeName, "volume name")
+		assert.Equal(t, oldPVC.Labels, pvc.Labels, "labels")
+		assert.Empty(t, env.recreator.pending, "pending PVCs")
+		assert.NotContains(t, env.syncPV(t).Annotations, annPendingClaim, "PV annotations after recreation")
+	})
+
+	t.Run("driver-recovers", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		env := newRecreateEnv(t, makeBoundPVC(recreateClass, nil), false)
+
+		env.recreator.check(ctx)
+		assert.True(t, hasEvent(env.events(), "NodeLost"), "NodeLost event")
+
+		env.setDriver(t, true)
+		env.recreator.check(ctx)
+		assert.True(t, hasEvent(env.events(), "NodeRecovered"), "NodeRecovered event")
+
+		// Losing the driver again restarts the grace period.
+		env.now = env.now.Add(gracePeriod)
+		env.setDriver(t, false)
+		env.recreator.check(ctx)
+		assert.True(t, hasEvent(env.events(), "NodeLost"), "NodeLost event")
+		require.NotNil(t, env.getPVC(t, "pvc"), "PVC")
+	})
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	"github.com/intel/pmem-csi/pkg/xfs"
+)
+
+// Subdirectory volumes are directories inside a shared XFS
+// filesystem, the backing volume. Each directory has its own project
+// ID and a project quota which limits it to the size of the volume.
+// The backing volume is a normal volume which gets created together
+// with the first subdirectory volume and deleted together with the
+// last one.
+
+// sharedVolumePrefix gets added to the name of a shared volume to get
+// the name of its backing volume. PVs are named differently, so there
+// are no conflicts with normal volumes.
+const sharedVolumePrefix = "pmem-csi-shared-"
+
+func sharedVolumeName(name string) string {
+	return sharedVolumePrefix + name
+}
+
+// isSharedVolumeName returns true for the names of backing volumes.
+func isSharedVolumeName(name string) bool {
+	return strings.HasPrefix(name, sharedVolumePrefix)
+}
+
+// sharedFS contains the operations on backing volumes which need
+// XFS and root privileges. Tests replace it.
+type sharedFS interface {
+	// mount creates an XFS filesystem on the device unless it
+	// already has one and mounts it with the given options.
+	mount(ctx context.Context, device *pmdmanager.PmemDeviceInfo, mountPoint string, options []string) error
+	// setupDirectory assigns the project ID to a directory and
+	// sets its extent size hint, unless that is zero.
+	setupDirectory(dir string, projectID uint32, extentSize int64) error
+	// setProjectQuota limits the size of a project, zero removes
+	// the limit.
+	setProjectQuota(device string, projectID uint32, limit int64) error
+}
+
+type xfsSharedFS struct{}
+
+var _ sharedFS = xfsSharedFS{}
+
+func (xfsSharedFS) mount(ctx context.Context, device *pmdmanager.PmemDeviceInfo, mountPoint string, options []string) error {
+	if err := provisionDevice(ctx, device, "xfs", nil); err != nil {
+		return err
+	}
+	if _, err := pmemexec.RunCommand(ctx, "mount", "-c", "-o", strings.Join(options, ","), device.Path, mountPoint); err != nil {
+		return err
+	}
+	return xfs.ConfigureFS(mountPoint)
+}
+
+func (xfsSharedFS) setupDirectory(dir string, projectID uint32, extentSize int64) error {
+	if err := xfs.SetProjectID(dir, projectID); err != nil {
+		return err
+	}
+	if extentSize != 0 {
+		return xfs.ConfigureDirectory(dir, extentSize, false)
+	}
+	return nil
+}
+
+func (xfsSharedFS) setProjectQuota(device string, projectID uint32, limit int64) error {
+	return xfs.SetProjectQuota(device, projectID, limit)
+}
+
+// validateSubdirectoryCapabilities checks that subdirectory volumes
+// are only requested with XFS as filesystem.
+func validateSubdirectoryCapabilities(volumeCapabilities []*csi.VolumeCapability) error {
+	for _, capability := range volumeCapabilities {
+		mount := capability.GetMount()
+		if mount == nil {
+			return fmt.Errorf("parameter %q: raw block volumes are not supported", parameters.SharedVolume)
+		}
+		switch mount.GetFsType() {
+		case "", "xfs":
+		default:
+			return fmt.Errorf("parameter %q: filesystem type %q not supported, must be xfs", parameters.SharedVolume, mount.GetFsType())
+		}
+	}
+	return nil
+}
+
+// createSubdirectoryVolume creates the backing volume if needed and
+// then a directory with a project quota inside it. It returns a
+// status error.
+func (cs *nodeControllerServer) createSubdirectoryVolume(ctx context.Context, p parameters.Volume, volumeID string, size int64) (statusErr error) {
+	logger := klog.FromContext(ctx)
+	shared := p.GetSharedVolume()
+	if size <= 0 {
+		return status.Errorf(codes.InvalidArgument, "subdirectory volume in %q: size required", shared)
+	}
+
+	cs.sharedMutex.Lock()
+	defer cs.sharedMutex.Unlock()
+
+	backing := cs.getVolumeByName(sharedVolumeName(shared))
+	if backing == nil {
+		var backingParams parameters.Volume
+		backingParams.Usage = p.Usage
+		if _, _, err := cs.createVolumeInternal(ctx, backingParams, sharedVolumeName(shared),
+			[]*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+				},
+				// Shared by all pods on the node.
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+				},
+			}},
+			&csi.CapacityRange{RequiredBytes: p.GetSharedVolumeSize()},
+		); err != nil {
+			return err
+		}
+		backing = cs.getVolumeByName(sharedVolumeName(shared))
+		if backing == nil {
+			return status.Errorf(codes.Internal, "shared volume %q not found after creating it", shared)
+		}
+	}
+	mountPoint, device, err := cs.mountSharedVolume(ctx, backing)
+	if err != nil {
+		return err
+	}
+
+	// Quotas must not exceed the backing volume, otherwise volumes
+	// could run out of space before reaching their size.
+	var used int64
+	projectID := uint32(1)
+	for _, vol := range cs.getSubdirectoryVolumes(shared) {
+		used += vol.Size
+		if other, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params); err == nil && other.GetProjectID() >= projectID {
+			projectID = other.GetProjectID() + 1
+		}
+	}
+	if used+size > backing.Size {
+		return status.Errorf(codes.ResourceExhausted, "shared volume %q: %d of %d bytes used, %d bytes requested", shared, used, backing.Size, size)
+	}
+
+	p.ProjectID = &projectID
+	vol := &nodeVolume{
+		ID:     volumeID,
+		Size:   size,
+		Params: p.ToContext(),
+	}
+	if cs.sm != nil {
+		// Same as for normal volumes: persist before creating.
+		if err := cs.sm.Create(volumeID, vol); err != nil {
+			return status.Error(codes.Internal, "store state: "+err.Error())
+		}
+		defer func() {
+			if statusErr != nil {
+				if err := cs.sm.Delete(volumeID); err != nil {
+					logger.Error(err, "Removing volume from persistent state failed")
+				}
+			}
+		}()
+	}
+
+	dir := filepath.Join(mountPoint, volumeID)
+	if err := os.Mkdir(dir, os.FileMode(0755)); err != nil && !os.IsExist(err) {
+		return status.Error(codes.Internal, "create volume directory: "+err.Error())
+	}
+	var extentSize int64
+	if p.ExtentSize != nil {
+		extentSize = p.GetExtentSize()
+	}
+	if err := cs.sharedFS.setupDirectory(dir, projectID, extentSize); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := cs.sharedFS.setProjectQuota(device.Path, projectID, size); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.pmemVolumes[volumeID] = vol
+	logger.V(5).Info("Created new subdirectory volume", "volume", *vol)
+
+	return nil
+}
+
+// deleteSubdirectoryVolume removes the directory and its quota. The
+// backing volume gets deleted together with the last subdirectory
+// volume. The volume itself is only forgotten once everything else
+// is done, so a failed call can be repeated. It returns a status
+// error.
+func (cs *nodeControllerServer) deleteSubdirectoryVolume(ctx context.Context, vol *nodeVolume, p parameters.Volume) error {
+	logger := klog.FromContext(ctx)
+	shared := p.GetSharedVolume()
+
+	cs.sharedMutex.Lock()
+	defer cs.sharedMutex.Unlock()
+
+	backing := cs.getVolumeByName(sharedVolumeName(shared))
+	if backing != nil {
+		mountPoint, device, err := cs.mountSharedVolume(ctx, backing)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(mountPoint, vol.ID)); err != nil {
+			return status.Error(codes.Internal, "remove volume directory: "+err.Error())
+		}
+		if err := cs.sharedFS.setProjectQuota(device.Path, p.GetProjectID(), 0); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if len(cs.getSubdirectoryVolumes(shared)) == 1 {
+			logger.V(3).Info("Deleting unused shared volume", "shared-volume", shared, "mountpoint", mountPoint)
+			if err := cs.mounter.Unmount(mountPoint); err != nil {
+				return status.Errorf(codes.Internal, "unmount shared volume %q: %v", shared, err)
+			}
+			if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+				return status.Errorf(codes.Internal, "remove mount point of shared volume %q: %v", shared, err)
+			}
+			backingParams, err := parameters.Parse(parameters.NodeVolumeOrigin, backing.Params)
+			if err != nil {
+				return status.Errorf(codes.Internal, "previously stored volume parameters for shared volume %q: %v", shared, err)
+			}
+			if err := cs.deleteDevice(ctx, backing, backingParams); err != nil {
+				return err
+			}
+		}
+	}
+
+	cs.forgetVolume(ctx, vol.ID)
+	return nil
+}
+
+// getSubdirectory returns the directory of a subdirectory volume
+// after ensuring that the backing volume is mounted. It returns a
+// status error.
+func (cs *nodeControllerServer) getSubdirectory(ctx context.Context, volumeID string) (string, error) {
+	vol := cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return "", status.Errorf(codes.NotFound, "unknown volume: "+volumeID)
+	}
+	shared := vol.Params[parameters.SharedVolume]
+
+	cs.sharedMutex.Lock()
+	defer cs.sharedMutex.Unlock()
+
+	backing := cs.getVolumeByName(sharedVolumeName(shared))
+	if backing == nil {
+		return "", status.Errorf(codes.Internal, "shared volume %q for volume %q not found", shared, volumeID)
+	}
+	mountPoint, _, err := cs.mountSharedVolume(ctx, backing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mountPoint, volumeID), nil
+}
+
+// isSubdirectoryVolume returns true for known subdirectory volumes.
+func (cs *nodeControllerServer) isSubdirectoryVolume(volumeID string) bool {
+	vol := cs.getVolumeByID(volumeID)
+	return vol != nil && vol.Params[parameters.SharedVolume] != ""
+}
+
+// getSubdirectoryVolumes returns all volumes inside a shared volume.
+func (cs *nodeControllerServer) getSubdirectoryVolumes(shared string) []*nodeVolume {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	var vols []*nodeVolume
+	for _, vol := range cs.pmemVolumes {
+		if vol.Params[parameters.SharedVolume] == shared {
+			vols = append(vols, vol)
+		}
+	}
+	return vols
+}
+
+// mountSharedVolume formats and mounts a backing volume with project
+// quotas enabled, unless that was done before. It must be called
+// with sharedMutex locked and returns a status error.
+func (cs *nodeControllerServer) mountSharedVolume(ctx context.Context, backing *nodeVolume) (string, *pmdmanager.PmemDeviceInfo, error) {
+	logger := klog.FromContext(ctx)
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, backing.Params)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", backing.ID, err)
+	}
+	dm, err := cs.getDeviceManager(ctx, backing.ID, p)
+	if err != nil {
+		return "", nil, err
+	}
+	device, err := dm.GetDevice(ctx, backing.ID)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Internal, "failed to get device details for shared volume %q: %v", p.GetName(), err)
+	}
+
+	mountPoint := filepath.Join(cs.sharedDirectory, backing.ID)
+	notMnt, err := cs.mounter.IsLikelyNotMountPoint(mountPoint)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, status.Errorf(codes.Internal, "validate mount point of shared volume: %v", err)
+	}
+	if err == nil && !notMnt {
+		return mountPoint, device, nil
+	}
+
+	if err := os.MkdirAll(mountPoint, os.FileMode(0755)); err != nil {
+		return "", nil, status.Error(codes.Internal, "create mount point for shared volume: "+err.Error())
+	}
+	// Quota enforcement can only be enabled when mounting.
+	options := []string{"prjquota"}
+	if p.GetUsage() == parameters.UsageAppDirect {
+		options = append(options, daxMountFlag)
+	}
+	logger.V(3).Info("Mounting shared volume", "device", device.Path, "mountpoint", mountPoint, "mount-options", options)
+	if err := cs.sharedFS.mount(ctx, device, mountPoint, options); err != nil {
+		return "", nil, status.Errorf(codes.Internal, "mount shared volume %q: %v", p.GetName(), err)
+	}
+	return mountPoint, device, nil
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+const (
+	sharedName = "shared"
+	sharedSize = 10 * 1024 * 1024 * 1024
+	gib        = 1024 * 1024 * 1024
+)
+
+// fakeSharedFS records project IDs and quotas instead of setting
+// them in an XFS filesystem.
+type fakeSharedFS struct {
+	mounter    *mount.FakeMounter
+	mounts     int
+	projectIDs map[string]uint32
+	quotas     map[uint32]int64
+
+	// quotaErr, if set, gets returned by setProjectQuota.
+	quotaErr error
+}
+
+var _ sharedFS = &fakeSharedFS{}
+
+func (f *fakeSharedFS) mount(ctx context.Context, device *pmdmanager.PmemDeviceInfo, mountPoint string, options []string) error {
+	f.mounts++
+	return f.mounter.Mount(device.Path, mountPoint, "xfs", options)
+}
+
+func (f *fakeSharedFS) setupDirectory(dir string, projectID uint32, extentSize int64) error {
+	f.projectIDs[filepath.Base(dir)] = projectID
+	return nil
+}
+
+func (f *fakeSharedFS) setProjectQuota(device string, projectID uint32, limit int64) error {
+	if f.quotaErr != nil {
+		return f.quotaErr
+	}
+	if limit == 0 {
+		delete(f.quotas, projectID)
+	} else {
+		f.quotas[projectID] = limit
+	}
+	return nil
+}
+
+type subdirectoryEnv struct {
+	dm        pmdmanager.PmemDeviceManager
+	sm        pmemstate.StateManager
+	fs        *fakeSharedFS
+	sharedDir string
+	cs        *nodeControllerServer
+}
+
+func newSubdirectoryEnv(ctx context.Context, t *testing.T) *subdirectoryEnv {
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, "")
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	env := &subdirectoryEnv{
+		dm: dm,
+		sm: sm,
+		fs: &fakeSharedFS{
+			mounter:    mount.NewFakeMounter(nil),
+			projectIDs: map[string]uint32{},
+			quotas:     map[uint32]int64{},
+		},
+		sharedDir: t.TempDir(),
+	}
+	env.restart(ctx)
+	return env
+}
+
+// restart creates a new controller server, as after a restart of
+// the driver.
+func (env *subdirectoryEnv) restart(ctx context.Context) {
+	env.cs = NewNodeControllerServer(ctx, "node", "pmem-csi.intel.com", env.dm, env.sm)
+	env.cs.sharedDirectory = env.sharedDir
+	env.cs.mounter = env.fs.mounter
+	env.cs.sharedFS = env.fs
+}
+
+func (env *subdirectoryEnv) createVolume(ctx context.Context, name string, size int64) (*csi.CreateVolumeResponse, error) {
+	return env.cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		Parameters: map[string]string{
+			parameters.SharedVolume:     sharedName,
+			parameters.SharedVolumeSize: "10Gi",
+		},
+	})
+}
+
+func (env *subdirectoryEnv) deleteVolume(ctx context.Context, volumeID string) error {
+	_, err := env.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	return err
+}
+
+// projectID returns the project ID that is stored for a volume.
+func (env *subdirectoryEnv) projectID(t *testing.T, volumeID string) uint32 {
+	vol := env.cs.getVolumeByID(volumeID)
+	require.NotNil(t, vol, "volume %s", volumeID)
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	require.NoError(t, err, "parse parameters")
+	return p.GetProjectID()
+}
+
+// stateIDs returns the IDs of all volumes in the persistent state.
+func (env *subdirectoryEnv) stateIDs(t *testing.T) []string {
+	ids, err := env.sm.GetAll()
+	require.NoError(t, err, "get state")
+	sort.Strings(ids)
+	return ids
+}
+
+// listVolumes returns the IDs of all volumes reported by ListVolumes.
+func (env *subdirectoryEnv) listVolumes(ctx context.Context, t *testing.T) []string {
+	resp, err := env.cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "ListVolumes")
+	var ids []string
+	for _, entry := range resp.Entries {
+		ids = append(ids, entry.Volume.VolumeId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (env *subdirectoryEnv) devices(ctx context.Context, t *testing.T) int {
+	devices, err := env.dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	return len(devices)
+}
+
+func sortedIDs(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSubdirectoryVolumes(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		env := newSubdirectoryEnv(ctx, t)
+
+		vol1, err := env.createVolume(ctx, "vol-1", 1*gib)
+		require.NoError(t, err, "create vol-1")
+		id1 := vol1.Volume.VolumeId
+		assert.Equal(t, int64(1*gib), vol1.Volume.CapacityBytes, "size of vol-1")
+		assert.Equal(t, 1, env.devices(ctx, t), "backing volume created")
+		assert.Equal(t, 1, env.fs.mounts, "backing volume mounted")
+		backing := env.cs.getVolumeByName(sharedVolumeName(sharedName))
+		require.NotNil(t, backing, "backing volume")
+		assert.Equal(t, int64(sharedSize), backing.Size, "size of backing volume")
+		mountPoint := filepath.Join(env.sharedDir, backing.ID)
+		assert.DirExists(t, filepath.Join(mountPoint, id1), "directory of vol-1")
+		assert.Equal(t, uint32(1), env.projectID(t, id1), "project ID of vol-1")
+		assert.Equal(t, map[string]uint32{id1: 1}, env.fs.projectIDs, "directory project IDs")
+		assert.Equal(t, map[uint32]int64{1: 1 * gib}, env.fs.quotas, "quotas")
+
+		// Repeating the call returns the same volume.
+		again, err := env.createVolume(ctx, "vol-1", 1*gib)
+		require.NoError(t, err, "create vol-1 again")
+		assert.Equal(t, id1, again.Volume.VolumeId, "volume ID of vol-1")
+		assert.Equal(t, map[uint32]int64{1: 1 * gib}, env.fs.quotas, "quotas after repeating")
+
+		vol2, err := env.createVolume(ctx, "vol-2", 2*gib)
+		require.NoError(t, err, "create vol-2")
+		id2 := vol2.Volume.VolumeId
+		assert.Equal(t, uint32(2), env.projectID(t, id2), "project ID of vol-2")
+		assert.Equal(t, 1, env.devices(ctx, t), "backing volume reused")
+		assert.Equal(t, 1, env.fs.mounts, "backing volume mounted once")
+		assert.Equal(t, map[uint32]int64{1: 1 * gib, 2: 2 * gib}, env.fs.quotas, "quotas")
+
+		// The backing volume has 10Gi, 3Gi are used.
+		_, err = env.createVolume(ctx, "vol-3", 8*gib)
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err), "create vol-3 with too large size: %v", err)
+		assert.Nil(t, env.cs.getVolumeByName("vol-3"), "vol-3 after failure")
+		assert.Equal(t, sortedIDs(backing.ID, id1, id2), env.stateIDs(t), "state after failure")
+
+		// Backing volumes are internal.
+		assert.Equal(t, sortedIDs(id1, id2), env.listVolumes(ctx, t), "ListVolumes")
+
+		// Project IDs are not reused while higher ones are in use.
+		require.NoError(t, env.deleteVolume(ctx, id1), "delete vol-1")
+		vol3, err := env.createVolume(ctx, "vol-3", 7*gib)
+		require.NoError(t, err, "create vol-3")
+		assert.Equal(t, uint32(3), env.projectID(t, vol3.Volume.VolumeId), "project ID of vol-3")
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		env := newSubdirectoryEnv(ctx, t)
+
+		env.fs.quotaErr = errors.New("fake quota error")
+		_, err := env.createVolume(ctx, "vol-1", 1*gib)
+		assert.Equal(t, codes.Internal, status.Code(err), "create vol-1 with quota error: %v", err)
+		assert.Nil(t, env.cs.getVolumeByName("vol-1"), "vol-1 after failure")
+		backing := env.cs.getVolumeByName(sharedVolumeName(sharedName))
+		require.NotNil(t, backing, "backing volume")
+		assert.Equal(t, []string{backing.ID}, env.stateIDs(t), "state after failure")
+
+		env.fs.quotaErr = nil
+		vol1, err := env.createVolume(ctx, "vol-1", 1*gib)
+		require.NoError(t, err, "create vol-1 again")
+		id1 := vol1.Volume.VolumeId
+		assert.Equal(t, uint32(1), env.projectID(t, id1), "project ID of vol-1")
+		assert.Equal(t, map[uint32]int64{1: 1 * gib}, env.fs.quotas, "quotas")
+		assert.Equal(t, sortedIDs(backing.ID, id1), env.stateIDs(t), "state")
+
+		// A failed deletion keeps the volume, so it can be repeated.
+		env.fs.quotaErr = errors.New("fake quota error")
+		err = env.deleteVolume(ctx, id1)
+		assert.Equal(t, codes.Internal, status.Code(err), "delete vol-1 with quota error: %v", err)
+		assert.NotNil(t, env.cs.getVolumeByID(id1), "vol-1 after failure")
+		assert.Equal(t, sortedIDs(backing.ID, id1), env.stateIDs(t), "state after failure")
+
+		env.fs.quotaErr = nil
+		require.NoError(t, env.deleteVolume(ctx, id1), "delete vol-1 again")
+		assert.Nil(t, env.cs.getVolumeByID(id1), "vol-1 after deletion")
+		assert.Empty(t, env.stateIDs(t), "state after deletion")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		env := newSubdirectoryEnv(ctx, t)
+
+		vol1, err := env.createVolume(ctx, "vol-1", 1*gib)
+		require.NoError(t, err, "create vol-1")
+		id1 := vol1.Volume.VolumeId
+		vol2, err := env.createVolume(ctx, "vol-2", 2*gib)
+		require.NoError(t, err, "create vol-2")
+		id2 := vol2.Volume.VolumeId
+		backing := env.cs.getVolumeByName(sharedVolumeName(sharedName))
+		require.NotNil(t, backing, "backing volume")
+		mountPoint := filepath.Join(env.sharedDir, backing.ID)
+
+		require.NoError(t, env.deleteVolume(ctx, id1), "delete vol-1")
+		assert.NoDirExists(t, filepath.Join(mountPoint, id1), "directory of vol-1")
+		assert.Equal(t, map[uint32]int64{2: 2 * gib}, env.fs.quotas, "quotas after deleting vol-1")
+		assert.Equal(t, 1, env.devices(ctx, t), "backing volume after deleting vol-1")
+		assert.Equal(t, sortedIDs(backing.ID, id2), env.stateIDs(t), "state after deleting vol-1")
+
+		// The last volume takes the backing volume with it.
+		require.NoError(t, env.deleteVolume(ctx, id2), "delete vol-2")
+		assert.Empty(t, env.fs.quotas, "quotas after deleting vol-2")
+		assert.Equal(t, 0, env.devices(ctx, t), "backing volume after deleting vol-2")
+		assert.Nil(t, env.cs.getVolumeByName(sharedVolumeName(sharedName)), "backing volume after deleting vol-2")
+		assert.Empty(t, env.fs.mounter.MountPoints, "mounts after deleting vol-2")
+		assert.NoDirExists(t, mountPoint, "mount point after deleting vol-2")
+		assert.Empty(t, env.stateIDs(t), "state after deleting vol-2")
+
+		// Deleting again is a no-op.
+		require.NoError(t, env.deleteVolume(ctx, id2), "delete vol-2 again")
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		env := newSubdirectoryEnv(ctx, t)
+
+		vol1, err := env.createVolume(ctx, "vol-1", 1*gib)
+		require.NoError(t, err, "create vol-1")
+		id1 := vol1.Volume.VolumeId
+		backing := env.cs.getVolumeByName(sharedVolumeName(sharedName))
+		require.NotNil(t, backing, "backing volume")
+
+		// A subdirectory volume whose backing volume is gone.
+		stale := &nodeVolume{
+			ID:   "stale",
+			Size: 1 * gib,
+			Params: map[string]string{
+				parameters.Name:         "stale",
+				parameters.SharedVolume: "other",
+				parameters.ProjectID:    "1",
+			},
+		}
+		require.NoError(t, env.sm.Create(stale.ID, stale), "store stale volume")
+
+		env.restart(ctx)
+		assert.NotNil(t, env.cs.getVolumeByID(id1), "vol-1 after restart")
+		assert.NotNil(t, env.cs.getVolumeByName(sharedVolumeName(sharedName)), "backing volume after restart")
+		assert.Nil(t, env.cs.getVolumeByID(stale.ID), "stale volume after restart")
+		assert.Equal(t, sortedIDs(backing.ID, id1), env.stateIDs(t), "state after restart")
+		assert.Equal(t, []string{id1}, env.listVolumes(ctx, t), "ListVolumes after restart")
+
+		// The next volume gets a new project ID and the
+		// backing volume, which is still mounted, is reused.
+		vol2, err := env.createVolume(ctx, "vol-2", 2*gib)
+		require.NoError(t, err, "create vol-2")
+		assert.Equal(t, uint32(2), env.projectID(t, vol2.Volume.VolumeId), "project ID of vol-2")
+		assert.Equal(t, 1, env.devices(ctx, t), "backing volume reused")
+		assert.Equal(t, 1, env.fs.mounts, "backing volume mounted once")
+
+		// Without its backing volume, a subdirectory volume
+		// gets dropped.
+		require.NoError(t, env.dm.DeleteDevice(ctx, backing.ID, false), "delete backing device")
+		env.restart(ctx)
+		assert.Nil(t, env.cs.getVolumeByID(id1), "vol-1 without backing volume")
+		assert.Empty(t, env.stateIDs(t), "state without backing volume")
+	})
+}
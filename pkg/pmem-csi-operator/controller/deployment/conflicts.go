@@ -0,0 +1,206 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// checkConflicts compares the deployment against all other
+// deployments and records the result in the ConflictDetected
+// condition. The condition is only added once a conflict was found,
+// afterwards it gets updated. The other deployments get updated too
+// because a change of this deployment may have caused or resolved
+// conflicts with them.
+func (r *ReconcileDeployment) checkConflicts(ctx context.Context, dep *api.PmemCSIDeployment) error {
+	deployments, err := r.listDeployments(ctx)
+	if err != nil {
+		return err
+	}
+	setConflictCondition(dep, findConflicts(dep, othersThan(deployments, dep.Name)))
+	r.updateConflicts(ctx, deployments, dep.Name)
+	return nil
+}
+
+// refreshConflicts updates the ConflictDetected condition of all
+// deployments. It gets called after a deployment was removed.
+func (r *ReconcileDeployment) refreshConflicts(ctx context.Context) {
+	deployments, err := r.listDeployments(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "refresh conflicts")
+		return
+	}
+	r.updateConflicts(ctx, deployments, "")
+}
+
+// updateConflicts patches the status of those deployments whose
+// ConflictDetected condition has changed, except for the one which
+// is currently getting reconciled. Failures are only logged because
+// they must not block the reconciliation of that deployment.
+func (r *ReconcileDeployment) updateConflicts(ctx context.Context, deployments []*api.PmemCSIDeployment, skip string) {
+	l := klog.FromContext(ctx).WithName("updateConflicts")
+	for _, dep := range deployments {
+		if dep.Name == skip || dep.DeletionTimestamp != nil {
+			continue
+		}
+		org := dep.DeepCopy()
+		if !setConflictCondition(dep, findConflicts(dep, othersThan(deployments, dep.Name))) {
+			continue
+		}
+		l.V(3).Info("conflicts changed", "deployment", dep.Name)
+		if err := r.patchDeploymentStatus(dep, client.MergeFrom(org)); err != nil {
+			l.Error(err, "update status", "deployment", dep.Name)
+		}
+	}
+}
+
+// listDeployments returns all deployments which can be deployed,
+// with their defaults set.
+func (r *ReconcileDeployment) listDeployments(ctx context.Context) ([]*api.PmemCSIDeployment, error) {
+	list := &api.PmemCSIDeploymentList{}
+	if err := r.client.List(ctx, list); err != nil {
+		return nil, fmt.Errorf("list deployments: %v", err)
+	}
+	var deployments []*api.PmemCSIDeployment
+	for i := range list.Items {
+		dep := list.Items[i].DeepCopy()
+		if err := dep.EnsureDefaults(r.containerImage); err != nil {
+			// Such a deployment does not get deployed.
+			continue
+		}
+		deployments = append(deployments, dep)
+	}
+	return deployments, nil
+}
+
+// othersThan returns all deployments except the one with the name.
+func othersThan(deployments []*api.PmemCSIDeployment, name string) []*api.PmemCSIDeployment {
+	var others []*api.PmemCSIDeployment
+	for _, dep := range deployments {
+		if dep.Name != name {
+			others = append(others, dep)
+		}
+	}
+	return others
+}
+
+// setConflictCondition sets or updates the ConflictDetected
+// condition and returns true if its status or reason changed.
+func setConflictCondition(dep *api.PmemCSIDeployment, conflicts []string) bool {
+	var old *api.DeploymentCondition
+	for i := range dep.Status.Conditions {
+		if dep.Status.Conditions[i].Type == api.ConflictDetected {
+			old = dep.Status.Conditions[i].DeepCopy()
+			break
+		}
+	}
+	status, reason := corev1.ConditionTrue, strings.Join(conflicts, " ")
+	if len(conflicts) == 0 {
+		if old == nil {
+			return false
+		}
+		status, reason = corev1.ConditionFalse, "No conflicts with other deployments."
+	}
+	if old != nil && old.Status == status && old.Reason == reason {
+		return false
+	}
+	dep.SetCondition(api.ConflictDetected, status, reason)
+	return true
+}
+
+// findConflicts returns descriptions of all conflicts between the
+// deployment and the other deployments. All deployments must have
+// their defaults set.
+func findConflicts(dep *api.PmemCSIDeployment, others []*api.PmemCSIDeployment) []string {
+	var conflicts []string
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].Name < others[j].Name
+	})
+	for _, other := range others {
+		// Objects get named after the hyphened name. Two
+		// deployments with the same hyphened name would overwrite
+		// each other's objects.
+		if dep.GetHyphenedName() == other.GetHyphenedName() {
+			conflicts = append(conflicts, fmt.Sprintf("Deployment %q uses the same object names.", other.Name))
+		}
+
+		for _, dir := range hostDirs(dep) {
+			for _, otherDir := range hostDirs(other) {
+				if nestedDirs(dir, otherDir) {
+					conflicts = append(conflicts, fmt.Sprintf("Deployment %q uses host directory %s, which overlaps with %s.", other.Name, otherDir, dir))
+				}
+			}
+		}
+
+		for _, driver := range nodeDrivers(dep) {
+			for _, otherDriver := range nodeDrivers(other) {
+				if !api.SelectorsOverlap(driver.NodeSelector, otherDriver.NodeSelector) {
+					continue
+				}
+				switch {
+				case driver.DeviceMode == api.DeviceModeDirect && otherDriver.DeviceMode == api.DeviceModeDirect:
+					// Volumes in direct mode are namespaces
+					// which cannot be associated with a
+					// driver instance.
+					conflicts = append(conflicts, fmt.Sprintf("Deployment %q may also run in direct mode on nodes with labels %v.", other.Name, driver.NodeSelector))
+				case driver.DeviceMode == api.DeviceModeLVM && otherDriver.DeviceMode == api.DeviceModeLVM &&
+					dep.Spec.InstanceName == other.Spec.InstanceName:
+					// Both would use the same namespaces
+					// and volume groups.
+					conflicts = append(conflicts, fmt.Sprintf("Deployment %q may also run on nodes with labels %v and uses the same instance name %q.", other.Name, driver.NodeSelector, dep.Spec.InstanceName))
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// hostDirs returns the directories on the nodes which are owned by
+// the driver.
+func hostDirs(dep *api.PmemCSIDeployment) []string {
+	return []string{
+		"/var/lib/" + dep.GetName(),
+		filepath.Join(dep.Spec.KubeletDir, "plugins", dep.GetName()),
+	}
+}
+
+// nestedDirs returns true if the directories are the same or one
+// contains the other.
+func nestedDirs(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	return a == b ||
+		strings.HasPrefix(a, b+"/") ||
+		strings.HasPrefix(b, a+"/")
+}
+
+// nodeDrivers returns the node selector and device mode of each node
+// driver DaemonSet.
+func nodeDrivers(dep *api.PmemCSIDeployment) []api.NodePool {
+	if len(dep.Spec.NodePools) == 0 {
+		return []api.NodePool{
+			{
+				NodeSelector: dep.Spec.NodeSelector,
+				DeviceMode:   dep.Spec.DeviceMode,
+			},
+		}
+	}
+	var drivers []api.NodePool
+	for _, pool := range dep.Spec.NodePools {
+		drivers = append(drivers, dep.NodePoolSpec(pool))
+	}
+	return drivers
+}
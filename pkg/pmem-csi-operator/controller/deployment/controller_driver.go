@@ -8,11 +8,16 @@ package deployment
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/metrics"
 	"github.com/intel/pmem-csi/pkg/types"
@@ -38,6 +43,7 @@ const (
 	controllerMetricsPort  = 10010
 	nodeMetricsPort        = 10010
 	provisionerMetricsPort = 10011
+	livenessProbePort      = 10012
 	schedulerPort          = 8000
 	insecureSchedulerPort  = 8001
 )
@@ -67,6 +73,7 @@ var currentObjects = []client.Object{
 	&corev1.ServiceAccount{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "ServiceAccount")},
 	&appsv1.Deployment{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "Deployment")},
 	&admissionregistrationv1.MutatingWebhookConfiguration{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "MutatingWebhookConfiguration")},
+	&admissionregistrationv1.ValidatingWebhookConfiguration{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "ValidatingWebhookConfiguration")},
 }
 
 func cloneObject(from client.Object) (client.Object, error) {
@@ -95,6 +102,8 @@ func cloneObject(from client.Object) (client.Object, error) {
 		return t.DeepCopyObject().(*appsv1.StatefulSet), nil
 	case *admissionregistrationv1.MutatingWebhookConfiguration:
 		return t.DeepCopyObject().(*admissionregistrationv1.MutatingWebhookConfiguration), nil
+	case *admissionregistrationv1.ValidatingWebhookConfiguration:
+		return t.DeepCopyObject().(*admissionregistrationv1.ValidatingWebhookConfiguration), nil
 	default:
 		return nil, fmt.Errorf("cannot clone client.Object of type %T", from)
 	}
@@ -102,7 +111,7 @@ func cloneObject(from client.Object) (client.Object, error) {
 
 func isNamespaced(kind string) bool {
 	switch kind {
-	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "MutatingWebhookConfiguration":
+	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration":
 		return false
 	default:
 		return true
@@ -155,6 +164,25 @@ type pmemCSIDeployment struct {
 	k8sVersion version.Version
 
 	controllerCABundle []byte
+
+	// controllerCA and controllerCAKey are the current generated
+	// CA, nil if not generated.
+	controllerCA    *x509.Certificate
+	controllerCAKey crypto.Signer
+
+	// controllerTLSRenewal is the time when the generated
+	// controller or node certificates need to be renewed, zero if
+	// not generated.
+	controllerTLSRenewal time.Time
+
+	// nodePoolStatus is the most recent status of the DaemonSet
+	// of each node pool, used to determine the overall status
+	// of the node driver.
+	nodePoolStatus map[string]appsv1.DaemonSetStatus
+
+	// upgrading is true while upgradeNodes still needs to
+	// replace node driver pods.
+	upgrading bool
 }
 
 func (d *pmemCSIDeployment) withStorageCapacity() bool {
@@ -174,8 +202,19 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 	l.V(3).Info("start", "deployment", d.Name, "phase", d.Status.Phase)
 	var allObjects []apiruntime.Object
 	redeployAll := func() error {
-		for name, handler := range subObjectHandlers {
-			if handler.enabled != nil && !handler.enabled(d) {
+		handlers := d.objectHandlers()
+		// The webhook configurations need the CA bundle from the
+		// generated secret, so that has to be updated first.
+		if controllerTLSGenerated(d) {
+			o, err := d.redeploy(ctx, r, handlers[controllerTLSSecretHandler])
+			if err != nil {
+				return fmt.Errorf("failed to update %s: %v", controllerTLSSecretHandler, err)
+			}
+			allObjects = append(allObjects, o)
+		}
+		for name, handler := range handlers {
+			if handler.enabled != nil && !handler.enabled(d) ||
+				name == controllerTLSSecretHandler {
 				continue
 			}
 			o, err := d.redeploy(ctx, r, handler)
@@ -187,6 +226,15 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 		return nil
 	}
 
+	if err := d.checkVersionSkew(ctx, r); err != nil {
+		d.SetCondition(api.DriverDeployed, corev1.ConditionFalse, err.Error())
+		return err
+	}
+
+	if err := r.checkConflicts(ctx, d.PmemCSIDeployment); err != nil {
+		return err
+	}
+
 	if err := redeployAll(); err != nil {
 		d.SetCondition(api.DriverDeployed, corev1.ConditionFalse, err.Error())
 		return err
@@ -201,6 +249,14 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 		return fmt.Errorf("Delete obsolete objects failed with error: %v", err)
 	}
 
+	if d.Spec.NodeUpgradeStrategy == api.NodeUpgradeOrchestrated {
+		upgrading, err := d.upgradeNodes(ctx, r)
+		if err != nil {
+			return err
+		}
+		d.upgrading = upgrading
+	}
+
 	return nil
 }
 
@@ -236,6 +292,10 @@ type redeployObject struct {
 	object     func(*pmemCSIDeployment) client.Object
 	modify     func(*pmemCSIDeployment, client.Object) error
 	postUpdate func(*pmemCSIDeployment, client.Object) error
+	// dependents are the names of handlers whose objects depend
+	// on this one. They get redeployed after handling an event
+	// for this object.
+	dependents []string
 }
 
 // redeploy creates or patches one sub-object so that it matches
@@ -357,9 +417,132 @@ func mutatingWebhookEnabled(d *pmemCSIDeployment) bool {
 	return d.Spec.ControllerTLSSecret != "" && d.Spec.MutatePods != api.MutatePodsNever
 }
 
+func validatingWebhookEnabled(d *pmemCSIDeployment) bool {
+	return d.Spec.ControllerTLSSecret != "" && d.Spec.ValidateVolumes != api.ValidateVolumesNever
+}
+
+func webhooksEnabled(d *pmemCSIDeployment) bool {
+	return mutatingWebhookEnabled(d) || validatingWebhookEnabled(d)
+}
+
+func nodePoolsEnabled(d *pmemCSIDeployment) bool {
+	return len(d.Spec.NodePools) > 0
+}
+
+// objectHandlers returns the static sub-object handlers plus one
+// handler for the DaemonSet of each node pool.
+func (d *pmemCSIDeployment) objectHandlers() map[string]redeployObject {
+	if !nodePoolsEnabled(d) {
+		return subObjectHandlers
+	}
+	handlers := make(map[string]redeployObject, len(subObjectHandlers)+len(d.Spec.NodePools))
+	for name, handler := range subObjectHandlers {
+		handlers[name] = handler
+	}
+	for _, pool := range d.Spec.NodePools {
+		handlers["node driver for pool "+pool.Name] = nodePoolHandler(pool.Name)
+	}
+	return handlers
+}
+
+// nodePoolHandler is like the "node driver" handler, just for the
+// DaemonSet of one node pool.
+func nodePoolHandler(name string) redeployObject {
+	return redeployObject{
+		objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &appsv1.DaemonSet{
+				TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+				ObjectMeta: d.getObjectMeta(d.NodePoolDriverName(name), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			for _, pool := range d.Spec.NodePools {
+				if pool.Name == name {
+					pool := d.NodePoolSpec(pool)
+					ds := o.(*appsv1.DaemonSet)
+					d.getNodeDaemonSet(ds, &pool)
+					return k8sutil.ApplyPodOverrides(&ds.Spec.Template, d.Spec.PodTemplateOverrides.Node)
+				}
+			}
+			return fmt.Errorf("node pool %q not found", name)
+		},
+		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
+			if d.nodePoolStatus == nil {
+				d.nodePoolStatus = map[string]appsv1.DaemonSetStatus{}
+			}
+			d.nodePoolStatus[name] = o.(*appsv1.DaemonSet).Status
+			var available, ready int32
+			for _, status := range d.nodePoolStatus {
+				available += status.NumberAvailable
+				ready += status.NumberReady
+			}
+			d.setNodeDriverStatus(available, ready)
+			return nil
+		},
+	}
+}
+
+// setNodeDriverStatus updates the node driver status based on the
+// number of available and ready pods in all node DaemonSets.
+func (d *pmemCSIDeployment) setNodeDriverStatus(available, ready int32) {
+	status := "NotReady"
+	reason := ""
+	if available == 0 {
+		reason = "Node daemon set has not started yet."
+	} else if ready == available {
+		status = "Ready"
+		reason = fmt.Sprintf("All %d node driver pod(s) running successfully", available)
+	} else {
+		reason = fmt.Sprintf("%d out of %d driver pods are ready", ready, available)
+	}
+	d.SetDriverStatus(api.NodeDriver, status, reason)
+}
+
+// controllerTLSSecretHandler and nodeTLSSecretHandler are the names
+// of the handlers for the generated TLS secrets.
+const (
+	controllerTLSSecretHandler = "controller TLS secret"
+	nodeTLSSecretHandler       = "node TLS secret"
+)
+
 var subObjectHandlers = map[string]redeployObject{
+	controllerTLSSecretHandler: {
+		objType: reflect.TypeOf(&corev1.Secret{}),
+		enabled: controllerTLSGenerated,
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.Secret{
+				TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.ControllerTLSSecretName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			return d.getControllerTLSSecret(o.(*corev1.Secret), time.Now())
+		},
+		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
+			d.controllerCABundle = o.(*corev1.Secret).Data[api.TLSSecretCA]
+			return nil
+		},
+		dependents: []string{"mutating webhook configuration", "validating webhook configuration", nodeTLSSecretHandler},
+	},
+	nodeTLSSecretHandler: {
+		objType: reflect.TypeOf(&corev1.Secret{}),
+		enabled: controllerTLSGenerated,
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.Secret{
+				TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.NodeTLSSecretGeneratedName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			return d.getNodeTLSSecret(o.(*corev1.Secret), time.Now())
+		},
+	},
 	"node driver": {
 		objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return !nodePoolsEnabled(d)
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &appsv1.DaemonSet{
 				TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
@@ -367,23 +550,14 @@ var subObjectHandlers = map[string]redeployObject{
 			}
 		},
 		modify: func(d *pmemCSIDeployment, o client.Object) error {
-			d.getNodeDaemonSet(o.(*appsv1.DaemonSet))
-			return nil
+			ds := o.(*appsv1.DaemonSet)
+			d.getNodeDaemonSet(ds, nil)
+			return k8sutil.ApplyPodOverrides(&ds.Spec.Template, d.Spec.PodTemplateOverrides.Node)
 		},
 		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
 			ds := o.(*appsv1.DaemonSet)
 			// Update node driver status is status object
-			status := "NotReady"
-			reason := ""
-			if ds.Status.NumberAvailable == 0 {
-				reason = "Node daemon set has not started yet."
-			} else if ds.Status.NumberReady == ds.Status.NumberAvailable {
-				status = "Ready"
-				reason = fmt.Sprintf("All %d node driver pod(s) running successfully", ds.Status.NumberAvailable)
-			} else {
-				reason = fmt.Sprintf("%d out of %d driver pods are ready", ds.Status.NumberReady, ds.Status.NumberAvailable)
-			}
-			d.SetDriverStatus(api.NodeDriver, status, reason)
+			d.setNodeDriverStatus(ds.Status.NumberAvailable, ds.Status.NumberReady)
 			return nil
 		},
 	},
@@ -396,8 +570,9 @@ var subObjectHandlers = map[string]redeployObject{
 			}
 		},
 		modify: func(d *pmemCSIDeployment, o client.Object) error {
-			d.getControllerDeployment(o.(*appsv1.Deployment))
-			return nil
+			ss := o.(*appsv1.Deployment)
+			d.getControllerDeployment(ss)
+			return k8sutil.ApplyPodOverrides(&ss.Spec.Template, d.Spec.PodTemplateOverrides.Controller)
 		},
 		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
 			ss := o.(*appsv1.Deployment)
@@ -498,7 +673,7 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks service": {
 		objType: reflect.TypeOf(&corev1.Service{}),
-		enabled: mutatingWebhookEnabled,
+		enabled: webhooksEnabled,
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &corev1.Service{
 				TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
@@ -524,6 +699,20 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"validating webhook configuration": {
+		objType: reflect.TypeOf(&admissionregistrationv1.ValidatingWebhookConfiguration{}),
+		enabled: validatingWebhookEnabled,
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &admissionregistrationv1.ValidatingWebhookConfiguration{
+				TypeMeta:   metav1.TypeMeta{Kind: "ValidatingWebhookConfiguration", APIVersion: "admissionregistration.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.ValidatingWebhookName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getValidatingWebhookConfig(o.(*admissionregistrationv1.ValidatingWebhookConfiguration))
+			return nil
+		},
+	},
 	"scheduler service": {
 		objType: reflect.TypeOf(&corev1.Service{}),
 		object: func(d *pmemCSIDeployment) client.Object {
@@ -664,8 +853,9 @@ var subObjectHandlers = map[string]redeployObject{
 			}
 		},
 		modify: func(d *pmemCSIDeployment, o client.Object) error {
-			d.getNodeSetupDaemonSet(o.(*appsv1.DaemonSet))
-			return nil
+			ds := o.(*appsv1.DaemonSet)
+			d.getNodeSetupDaemonSet(ds)
+			return k8sutil.ApplyPodOverrides(&ds.Spec.Template, d.Spec.PodTemplateOverrides.NodeSetup)
 		},
 	},
 }
@@ -678,7 +868,7 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 	l.V(5).Info("start", "object", pmemlog.KObjWithType(metaData), "type", objType)
 
 	objName := metaData.GetName()
-	for name, handler := range subObjectHandlers {
+	for name, handler := range d.objectHandlers() {
 		if handler.enabled != nil && !handler.enabled(d) {
 			continue
 		}
@@ -694,6 +884,15 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 		if _, err := d.redeploy(ctx, r, handler); err != nil {
 			return fmt.Errorf("failed to redeploy %s: %v", name, err)
 		}
+		for _, dependent := range handler.dependents {
+			handler := subObjectHandlers[dependent]
+			if handler.enabled != nil && !handler.enabled(d) {
+				continue
+			}
+			if _, err := d.redeploy(ctx, r, handler); err != nil {
+				return fmt.Errorf("failed to redeploy %s: %v", dependent, err)
+			}
+		}
 		if err := r.patchDeploymentStatus(d.PmemCSIDeployment, client.MergeFrom(org)); err != nil {
 			return fmt.Errorf("failed to update deployment CR status: %v", err)
 		}
@@ -815,6 +1014,13 @@ func (d *pmemCSIDeployment) getWebhooksRole(role *rbacv1.Role) {
 				"get", "watch", "list",
 			},
 		},
+		{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs: []string{
+				"get", "watch", "list", "create", "update",
+			},
+		},
 	}
 }
 
@@ -846,7 +1052,7 @@ func (d *pmemCSIDeployment) getWebhooksClusterRole(cr *rbacv1.ClusterRole) {
 			APIGroups: []string{""},
 			Resources: []string{"persistentvolumeclaims"},
 			Verbs: []string{
-				"get", "list", "watch", "patch", "update",
+				"get", "list", "watch", "patch", "update", "create", "delete",
 			},
 		},
 		{
@@ -984,6 +1190,99 @@ func (d *pmemCSIDeployment) getMutatingWebhookConfig(hook *admissionregistration
 	hook.Webhooks[0].ClientConfig.CABundle = controllerCABundle
 }
 
+func (d *pmemCSIDeployment) getValidatingWebhookConfig(hook *admissionregistrationv1.ValidatingWebhookConfiguration) {
+	servicePort := int32(443) // default webhook service port
+	selector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      "pmem-csi.intel.com/webhook",
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"ignore"},
+			},
+		},
+	}
+	failurePolicy := admissionregistrationv1.Ignore
+	if d.Spec.ValidateVolumes == api.ValidateVolumesAlways {
+		failurePolicy = admissionregistrationv1.Fail
+	}
+	path := "/validate"
+	none := admissionregistrationv1.SideEffectClassNone
+	controllerCABundle := d.controllerCABundle
+	// Preserve defaults when updating.
+	var scopes [2]*admissionregistrationv1.ScopeType
+	var timeoutSeconds *int32
+	var matchPolicy *admissionregistrationv1.MatchPolicyType
+	if len(hook.Webhooks) > 0 {
+		if d.Spec.ControllerTLSSecret == api.ControllerTLSSecretOpenshift {
+			// Same as for the mutating webhook, the CABundle was generated
+			// by OpenShift and must be retrieved before overwriting.
+			controllerCABundle = hook.Webhooks[0].ClientConfig.CABundle
+		}
+		for i := 0; i < len(scopes) && i < len(hook.Webhooks[0].Rules); i++ {
+			scopes[i] = hook.Webhooks[0].Rules[i].Scope
+		}
+		timeoutSeconds = hook.Webhooks[0].TimeoutSeconds
+		matchPolicy = hook.Webhooks[0].MatchPolicy
+	}
+	hook.Webhooks = []admissionregistrationv1.ValidatingWebhook{
+		{
+			Name:              "validate-hook.pmem-csi.intel.com",
+			NamespaceSelector: selector,
+			ObjectSelector:    selector,
+			FailurePolicy:     &failurePolicy,
+			MatchPolicy:       matchPolicy,
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Name:      d.WebhooksServiceName(),
+					Namespace: d.namespace,
+					Path:      &path,
+					Port:      &servicePort,
+				},
+				// CABundle set below.
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{
+				{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{"storage.k8s.io"},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"storageclasses"},
+						Scope:       scopes[0],
+					},
+				},
+				{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods", "persistentvolumeclaims"},
+						Scope:       scopes[1],
+					},
+				},
+			},
+			SideEffects:             &none,
+			AdmissionReviewVersions: []string{"v1"},
+			TimeoutSeconds:          timeoutSeconds,
+		},
+	}
+
+	switch {
+	case d.Spec.ControllerTLSSecret == api.ControllerTLSSecretOpenshift:
+		if hook.Annotations == nil {
+			hook.Annotations = map[string]string{}
+		}
+		hook.Annotations["service.beta.openshift.io/inject-cabundle"] = "true"
+	case len(controllerCABundle) == 0:
+		panic("controller CA bundle empty, should have been loaded")
+	default:
+		if hook.Annotations != nil {
+			delete(hook.Annotations, "service.beta.openshift.io/inject-cabundle")
+		}
+	}
+	// Set or preserve the CABundle.
+	hook.Webhooks[0].ClientConfig.CABundle = controllerCABundle
+}
+
 func (d *pmemCSIDeployment) getSchedulerService(service *corev1.Service) {
 	targetPort := schedulerPort
 	port := 443
@@ -1200,14 +1499,12 @@ func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 		d.getControllerContainer(),
 	}
 	// Allow this pod to run on all nodes.
+	resetPodOverrides(&ss.Spec.Template.Spec)
 	setTolerations(&ss.Spec.Template.Spec)
 	ss.Spec.Template.Spec.Volumes = []corev1.Volume{}
 	if d.Spec.ControllerTLSSecret != "" {
 		mode := corev1.SecretVolumeSourceDefaultMode
-		name := d.Spec.ControllerTLSSecret
-		if name == api.ControllerTLSSecretOpenshift {
-			name = d.ControllerTLSSecretOpenshiftName()
-		}
+		name := d.ControllerTLSSecretName()
 		ss.Spec.Template.Spec.Volumes = append(ss.Spec.Template.Spec.Volumes, corev1.Volume{
 			Name: "webhook-cert",
 			VolumeSource: corev1.VolumeSource{
@@ -1220,7 +1517,10 @@ func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 	}
 }
 
-func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
+// getNodeDaemonSet configures the node driver DaemonSet, either the
+// one for all nodes (pool == nil) or the one for a node pool. The pool
+// must have been completed with NodePoolSpec.
+func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet, pool *api.NodePool) {
 	directoryOrCreate := corev1.HostPathDirectoryOrCreate
 
 	// To make sure that the default values set by the API server
@@ -1242,45 +1542,63 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 	ds.Labels["app.kubernetes.io/component"] = "node"
 	ds.Labels["app.kubernetes.io/instance"] = d.Name
 
-	ds.Spec.Selector = &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			"app.kubernetes.io/name":     "pmem-csi-node",
-			"app.kubernetes.io/instance": d.Name,
-		},
+	selector := map[string]string{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.Name,
 	}
-	ds.Spec.UpdateStrategy.Type = appsv1.RollingUpdateDaemonSetStrategyType
-	if ds.Spec.UpdateStrategy.RollingUpdate == nil {
-		ds.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateDaemonSet{}
+	nodeSelector := d.Spec.NodeSelector
+	if pool != nil {
+		// The pool label keeps the pods of different pools apart.
+		selector[api.NodePoolLabel] = pool.Name
+		nodeSelector = pool.NodeSelector
+	}
+	ds.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: selector,
 	}
-	maxUnavailable := d.Spec.MaxUnavailable
-	if maxUnavailable == nil {
-		// nil is not the default in the DaemonSet, we have to set "1" explicitly
-		// to avoid redundant patching.
-		one := intstr.FromInt(1)
-		maxUnavailable = &one
+	if d.Spec.NodeUpgradeStrategy == api.NodeUpgradeOrchestrated {
+		// Pods get replaced by the operator, see upgradeNodes.
+		ds.Spec.UpdateStrategy.Type = appsv1.OnDeleteDaemonSetStrategyType
+		ds.Spec.UpdateStrategy.RollingUpdate = nil
+	} else {
+		ds.Spec.UpdateStrategy.Type = appsv1.RollingUpdateDaemonSetStrategyType
+		if ds.Spec.UpdateStrategy.RollingUpdate == nil {
+			ds.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateDaemonSet{}
+		}
+		maxUnavailable := d.Spec.MaxUnavailable
+		if maxUnavailable == nil {
+			// nil is not the default in the DaemonSet, we have to set "1" explicitly
+			// to avoid redundant patching.
+			one := intstr.FromInt(1)
+			maxUnavailable = &one
+		}
+		ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable = maxUnavailable
 	}
-	ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable = maxUnavailable
 	ds.Spec.Template.ObjectMeta.Labels = joinMaps(
 		d.Spec.Labels,
-		map[string]string{
-			"app.kubernetes.io/name":      "pmem-csi-node",
+		joinMaps(selector, map[string]string{
 			"app.kubernetes.io/part-of":   "pmem-csi",
 			"app.kubernetes.io/component": "node",
-			"app.kubernetes.io/instance":  d.Name,
 			"pmem-csi.intel.com/webhook":  "ignore",
-		})
+		}))
 	ds.Spec.Template.ObjectMeta.Annotations = map[string]string{
 		"pmem-csi.intel.com/scrape": "containers",
 	}
 	ds.Spec.Template.Spec.PriorityClassName = "system-node-critical"
 	ds.Spec.Template.Spec.ServiceAccountName = d.ProvisionerServiceAccountName()
-	ds.Spec.Template.Spec.NodeSelector = d.Spec.NodeSelector
+	ds.Spec.Template.Spec.NodeSelector = nodeSelector
 	ds.Spec.Template.Spec.Containers = []corev1.Container{
-		d.getNodeDriverContainer(),
+		d.getNodeDriverContainer(pool),
 		d.getNodeRegistrarContainer(),
 		d.getProvisionerContainer(),
 	}
+	if d.Spec.LivenessProbeImage != "" {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, d.getLivenessProbeContainer())
+	}
+	for _, c := range d.Spec.NodeExtraContainers {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, *c.DeepCopy())
+	}
 	// Allow this pod to run on all master nodes.
+	resetPodOverrides(&ds.Spec.Template.Spec)
 	setTolerations(&ds.Spec.Template.Spec)
 	ds.Spec.Template.Spec.Volumes = []corev1.Volume{
 		{
@@ -1347,6 +1665,18 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 			},
 		},
 	}
+	if controllerTLSGenerated(d) {
+		mode := corev1.SecretVolumeSourceDefaultMode
+		ds.Spec.Template.Spec.Volumes = append(ds.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: "node-cert",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  d.NodeTLSSecretGeneratedName(),
+					DefaultMode: &mode,
+				},
+			},
+		})
+	}
 }
 
 func (d *pmemCSIDeployment) getControllerCommand() []string {
@@ -1361,8 +1691,14 @@ func (d *pmemCSIDeployment) getControllerCommand() []string {
 	}
 
 	if d.Spec.ControllerTLSSecret != "" {
+		caFile := ""
+		if controllerTLSGenerated(d) {
+			// Needed for verifying the client
+			// certificates of the node drivers.
+			caFile = "/certs/" + api.TLSSecretCA
+		}
 		args = append(args,
-			"-caFile=",
+			"-caFile="+caFile,
 			"-certFile=/certs/tls.crt",
 			"-keyFile=/certs/tls.key",
 			fmt.Sprintf("-schedulerListen=:%d", schedulerPort),
@@ -1372,16 +1708,35 @@ func (d *pmemCSIDeployment) getControllerCommand() []string {
 				fmt.Sprintf("-insecureSchedulerListen=:%d", insecureSchedulerPort),
 			)
 		}
+		if d.Spec.MutatePodsResource != "" {
+			args = append(args, "-mutatePodsResource="+d.Spec.MutatePodsResource)
+		}
+		if d.Spec.MutatePodsContainer != "" {
+			args = append(args, "-mutatePodsContainer="+d.Spec.MutatePodsContainer)
+		}
+		if d.Spec.MutatePodsInitContainer {
+			args = append(args, "-mutatePodsInitContainer")
+		}
+		if controllerTLSGenerated(d) {
+			args = append(args, "-capacityReports")
+		}
+	}
+	if d.Spec.ControllerReplicas > 1 {
+		args = append(args, "-leaderElection")
 	}
 	args = append(args, fmt.Sprintf("-metricsListen=:%d", controllerMetricsPort))
 
 	return args
 }
 
-func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
-	return []string{
+func (d *pmemCSIDeployment) getNodeDriverCommand(pool *api.NodePool) []string {
+	deviceMode, pmemPercentage := d.Spec.DeviceMode, d.Spec.PMEMPercentage
+	if pool != nil {
+		deviceMode, pmemPercentage = pool.DeviceMode, pool.PMEMPercentage
+	}
+	args := []string{
 		"/usr/local/bin/pmem-csi-driver",
-		fmt.Sprintf("-deviceManager=%s", d.Spec.DeviceMode),
+		fmt.Sprintf("-deviceManager=%s", deviceMode),
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
 		"-logging-format=" + string(d.Spec.LogFormat),
 		"-mode=node",
@@ -1389,9 +1744,29 @@ func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
 		"-nodeid=$(KUBE_NODE_NAME)",
 		"-statePath=/var/lib/$(PMEM_CSI_DRIVER_NAME)",
 		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
-		fmt.Sprintf("-pmemPercentage=%d", d.Spec.PMEMPercentage),
+		fmt.Sprintf("-pmemPercentage=%d", pmemPercentage),
 		fmt.Sprintf("-metricsListen=:%d", nodeMetricsPort),
 	}
+	if controllerTLSGenerated(d) {
+		// Push capacity to the controller instead of
+		// waiting for it to scrape the metrics endpoint.
+		args = append(args,
+			"-caFile=/certs/"+api.TLSSecretCA,
+			"-certFile=/certs/"+api.TLSSecretCert,
+			"-keyFile=/certs/"+api.TLSSecretKey,
+			fmt.Sprintf("-capacityReportURL=https://%s.%s.svc/capacity", d.SchedulerServiceName(), d.namespace),
+		)
+	}
+	return append(args, d.getInstanceArgs()...)
+}
+
+// getInstanceArgs returns the parameter for the instance name, if one
+// is set. Without it, the driver uses the traditional names.
+func (d *pmemCSIDeployment) getInstanceArgs() []string {
+	if d.Spec.InstanceName == "" {
+		return nil
+	}
+	return []string{"-instance=" + d.Spec.InstanceName}
 }
 
 func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
@@ -1443,7 +1818,7 @@ func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
 	return c
 }
 
-func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
+func (d *pmemCSIDeployment) getNodeDriverContainer(pool *api.NodePool) corev1.Container {
 	bidirectional := corev1.MountPropagationBidirectional
 	true := true
 	root := int64(0)
@@ -1451,7 +1826,7 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 		Name:            "pmem-driver",
 		Image:           d.Spec.Image,
 		ImagePullPolicy: d.Spec.PullPolicy,
-		Command:         d.getNodeDriverCommand(),
+		Command:         d.getNodeDriverCommand(pool),
 		Env: []corev1.EnvVar{
 			{
 				Name: "KUBE_NODE_NAME",
@@ -1516,6 +1891,33 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 		LivenessProbe:            getMetricsProbe(6, 10, "/simple"),
 		StartupProbe:             getMetricsProbe(300, 1, "/simple"),
 	}
+	if pool != nil {
+		c.Resources = *pool.NodeDriverResources
+	}
+	if controllerTLSGenerated(d) {
+		c.VolumeMounts = append(c.VolumeMounts,
+			corev1.VolumeMount{
+				Name:      "node-cert",
+				MountPath: "/certs",
+			})
+	}
+	if d.Spec.LivenessProbeImage != "" {
+		// The livenessprobe sidecar checks the driver through
+		// the CSI Probe call.
+		c.LivenessProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Scheme: "HTTP",
+					Path:   "/healthz",
+					Port:   intstr.FromInt(livenessProbePort),
+				},
+			},
+			SuccessThreshold: 1,
+			TimeoutSeconds:   5,
+			PeriodSeconds:    10,
+			FailureThreshold: 6,
+		}
+	}
 
 	return c
 }
@@ -1630,6 +2032,50 @@ func (d *pmemCSIDeployment) getNodeRegistrarContainer() corev1.Container {
 	}
 }
 
+// getLivenessProbeContainer returns the livenessprobe sidecar. The
+// driver has its own liveness probe, so this sidecar only gets added
+// when an image is configured.
+func (d *pmemCSIDeployment) getLivenessProbeContainer() corev1.Container {
+	c := d.getSidecarContainer("liveness-probe", d.Spec.LivenessProbeImage, d.Spec.LivenessProbeResources,
+		fmt.Sprintf("--health-port=%d", livenessProbePort),
+	)
+	c.Ports = []corev1.ContainerPort{
+		{
+			Name:          "healthz",
+			ContainerPort: livenessProbePort,
+			Protocol:      "TCP",
+		},
+	}
+	return c
+}
+
+// getSidecarContainer returns a container which only needs the CSI
+// socket of the driver.
+func (d *pmemCSIDeployment) getSidecarContainer(name, image string, resources *corev1.ResourceRequirements, args ...string) corev1.Container {
+	true := true
+	return corev1.Container{
+		Name:            name,
+		Image:           image,
+		ImagePullPolicy: d.Spec.PullPolicy,
+		Args: append([]string{
+			fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+			"--csi-address=/csi/csi.sock",
+		}, args...),
+		SecurityContext: &corev1.SecurityContext{
+			ReadOnlyRootFilesystem: &true,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "socket-dir",
+				MountPath: "/csi",
+			},
+		},
+		Resources:                *resources,
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+}
+
 func (d *pmemCSIDeployment) getNodeSetupClusterRole(cr *rbacv1.ClusterRole) {
 	cr.Rules = []rbacv1.PolicyRule{
 		{
@@ -1684,13 +2130,51 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 			"app.kubernetes.io/instance":  d.Name,
 			"pmem-csi.intel.com/webhook":  "ignore",
 		})
+	spec.Template.ObjectMeta.Annotations = nil
 	podSpec := &ds.Spec.Template.Spec
 	podSpec.ServiceAccountName = d.NodeSetupServiceAccountName()
+	podSpec.PriorityClassName = ""
 	// Allow this pod to run on all nodes.
+	resetPodOverrides(podSpec)
 	setTolerations(podSpec)
 	podSpec.NodeSelector = map[string]string{
 		d.Name + "/convert-raw-namespaces": "force",
 	}
+	podSpec.Affinity = nil
+	if setup := d.Spec.PmemSetup; setup != nil {
+		// Run on the selected nodes until the setup pod marks
+		// the node as done.
+		selector := setup.NodeSelector
+		if len(selector) == 0 {
+			selector = podSpec.NodeSelector
+		}
+		podSpec.NodeSelector = nil
+		var requirements []corev1.NodeSelectorRequirement
+		for key, value := range selector {
+			requirements = append(requirements, corev1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{value},
+			})
+		}
+		sort.Slice(requirements, func(i, j int) bool {
+			return requirements[i].Key < requirements[j].Key
+		})
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      d.Name + "/" + api.PmemSetupKey,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   []string{api.PmemSetupDone},
+		})
+		podSpec.Affinity = &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: requirements},
+					},
+				},
+			},
+		}
+	}
 	podSpec.Containers = []corev1.Container{
 		d.getNodeSetupContainer(),
 	}
@@ -1766,15 +2250,36 @@ func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 }
 
 func (d *pmemCSIDeployment) getNodeSetupCommand() []string {
+	if d.Spec.PmemSetup != nil {
+		return d.getPmemSetupCommand()
+	}
 	nodeSelector := types.NodeSelector(d.Spec.NodeSelector)
-	return []string{
+	return append([]string{
 		"/usr/local/bin/pmem-csi-driver",
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
 		"-logging-format=" + string(d.Spec.LogFormat),
 		"-mode=force-convert-raw-namespaces",
 		"-nodeSelector=" + nodeSelector.String(),
 		"-nodeid=$(KUBE_NODE_NAME)",
-	}
+	}, d.getInstanceArgs()...)
+}
+
+func (d *pmemCSIDeployment) getPmemSetupCommand() []string {
+	setup := d.Spec.PmemSetup
+	nodeSelector := types.NodeSelector(d.Spec.NodeSelector)
+	return append([]string{
+		"/usr/local/bin/pmem-csi-driver",
+		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+		"-logging-format=" + string(d.Spec.LogFormat),
+		"-mode=pmem-setup",
+		"-drivername=" + d.GetName(),
+		"-nodeSelector=" + nodeSelector.String(),
+		"-nodeid=$(KUBE_NODE_NAME)",
+		fmt.Sprintf("-convertRawNamespaces=%t", setup.ConvertRawNamespaces),
+		fmt.Sprintf("-createNamespaces=%t", setup.CreateNamespaces),
+		fmt.Sprintf("-reservePercentage=%d", setup.ReservePercentage),
+		fmt.Sprintf("-dryRun=%t", setup.DryRun),
+	}, d.getInstanceArgs()...)
 }
 
 func (d *pmemCSIDeployment) getMetricsPorts(port int32) []corev1.ContainerPort {
@@ -1827,6 +2332,16 @@ func joinMaps(left, right map[string]string) map[string]string {
 	return result
 }
 
+// resetPodOverrides removes settings which only get added by
+// PodTemplateOverrides. The empty security context is what the API
+// server stores by default.
+func resetPodOverrides(podSpec *corev1.PodSpec) {
+	podSpec.Tolerations = nil
+	podSpec.Affinity = nil
+	podSpec.TopologySpreadConstraints = nil
+	podSpec.SecurityContext = &corev1.PodSecurityContext{}
+}
+
 func setTolerations(podSpec *corev1.PodSpec) {
 	setToleration(podSpec, "NoSchedule")
 	setToleration(podSpec, "NoExecute")
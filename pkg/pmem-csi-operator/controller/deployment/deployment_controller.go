@@ -23,6 +23,7 @@ import (
 	"github.com/operator-framework/operator-lib/handler"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -31,6 +32,7 @@ import (
 	"k8s.io/kubectl/pkg/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	crhandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -72,9 +74,14 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 			l.V(3).Info("UPDATED", "object", logger.KObjWithType(e.ObjectOld), "generation", e.ObjectNew.GetGeneration())
 			if e.ObjectNew.GetDeletionTimestamp() != nil {
 				// Deployment CR deleted, remove it's reference from cache.
-				// Objects owned by it are automatically garbage collected.
+				// Objects owned by it are automatically garbage collected
+				// once Reconcile removed the finalizer. That needs to be
+				// checked when deletion starts and when the user
+				// might have added the force annotation.
 				r.deleteDeployment(e.ObjectOld.GetName())
-				return false
+				return controllerutil.ContainsFinalizer(e.ObjectNew, api.DeploymentFinalizer) &&
+					(e.ObjectOld.GetDeletionTimestamp() == nil ||
+						e.ObjectOld.GetAnnotations()[api.ForceDeleteAnnotation] != e.ObjectNew.GetAnnotations()[api.ForceDeleteAnnotation])
 			}
 			if e.ObjectOld.GetGeneration() == e.ObjectNew.GetGeneration() {
 				// No changes registered
@@ -105,12 +112,24 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 			// Deployment CR deleted, remove it's reference from cache.
 			// Objects owned by it are automatically garbage collected.
 			r.deleteDeployment(e.Object.GetName())
+			// Conflicts with the deployment are gone.
+			r.refreshConflicts(ctx)
 			// We already handled the event here,
 			// so no more further reconcile required.
 			return false
 		},
 	}
 
+	// Refresh the per-node status periodically.
+	if err := mgr.Add(manager.RunnableFunc(r.runNodeStatus)); err != nil {
+		return fmt.Errorf("add node status refresh: %v", err)
+	}
+
+	// Replace node driver pods during orchestrated upgrades.
+	if err := mgr.Add(manager.RunnableFunc(r.runNodeUpgrades)); err != nil {
+		return fmt.Errorf("add node upgrades: %v", err)
+	}
+
 	// Watch for changes to primary resource Deployment
 	if err := c.Watch(&source.Kind{Type: &api.PmemCSIDeployment{}}, &handler.InstrumentedEnqueueRequestForObject{}, p); err != nil {
 		return fmt.Errorf("watch: %v", err)
@@ -284,11 +303,14 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	l.V(3).Info("reconcile starting", "deployment", deployment.GetName())
 
 	// If the deployment has already been marked for deletion,
-	// then we don't need to do anything for it because the
-	// apiserver is in the process of garbage-collecting all
-	// sub-objects and then will remove it.
+	// then the only remaining work is the finalizer.
 	if deployment.DeletionTimestamp != nil {
-		return reconcile.Result{Requeue: false}, nil
+		return r.finalize(ctx, deployment)
+	}
+
+	if err := r.addFinalizer(ctx, deployment); err != nil {
+		l.Error(err, "failed to add finalizer")
+		return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
 	}
 
 	for f := range r.reconcileHooks {
@@ -339,11 +361,15 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 		return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
 	}
 
-	dep.Status.Phase = api.DeploymentPhaseRunning
-	dep.Status.Reason = "All driver components are deployed successfully"
+	d.setUpgradePhase(d.upgrading)
 	r.evRecorder.Event(dep, corev1.EventTypeNormal, api.EventReasonRunning, "Driver deployment successful")
 
-	return reconcile.Result{}, nil
+	var result reconcile.Result
+	if !d.controllerTLSRenewal.IsZero() {
+		// Come back in time to renew the generated certificates.
+		result.RequeueAfter = time.Until(d.controllerTLSRenewal)
+	}
+	return result, nil
 }
 
 func (r *ReconcileDeployment) Namespace() string {
@@ -448,6 +474,26 @@ func (r *ReconcileDeployment) newDeployment(ctx context.Context, deployment *api
 		// Nothing to do.
 	case api.ControllerTLSSecretOpenshift:
 		// Nothing to load, we just add annotations.
+	case api.ControllerTLSSecretGenerated:
+		// Load the CA bundle if the secret was already
+		// generated. Otherwise it gets created during
+		// reconciling.
+		secret := &corev1.Secret{}
+		objKey := client.ObjectKey{
+			Namespace: d.namespace,
+			Name:      d.ControllerTLSSecretName(),
+		}
+		if err := r.client.Get(ctx, objKey, secret); err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, fmt.Errorf("loading generated controller TLS secret %s from namespace %s: %v", objKey.Name, d.namespace, err)
+			}
+		} else {
+			d.controllerCABundle = secret.Data[api.TLSSecretCA]
+			// The first certificate in the bundle is the
+			// current CA. Needed when only the node TLS
+			// secret gets updated.
+			d.controllerCA, d.controllerCAKey = parseKeyPair(secret.Data[api.TLSSecretCA], secret.Data[api.TLSSecretCAKey])
+		}
 	default:
 		// Load the specified secret.
 		secret := &corev1.Secret{
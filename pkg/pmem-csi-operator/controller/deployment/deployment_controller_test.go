@@ -7,8 +7,15 @@ package deployment_test
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -23,10 +30,14 @@ import (
 	pmemcontroller "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment/testcases"
+	"github.com/intel/pmem-csi/pkg/scheduler"
 	"github.com/intel/pmem-csi/pkg/version"
 	"github.com/intel/pmem-csi/test/e2e/operator/validate"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -58,8 +69,11 @@ type pmemDeployment struct {
 	nodeRegistarCPU, nodeRegistrarMemory                string
 	controllerTLSSecret                                 string
 	mutatePods                                          api.MutatePods
+	validateVolumes                                     api.ValidateVolumes
 	schedulerNodePort                                   int32
 	kubeletDir                                          string
+	nodePools                                           []api.NodePool
+	instanceName                                        string
 
 	objects []runtime.Object
 
@@ -92,7 +106,10 @@ func getDeployment(d *pmemDeployment) *api.PmemCSIDeployment {
 		NodeRegistrarImage:  d.registrarImage,
 		ControllerTLSSecret: d.controllerTLSSecret,
 		MutatePods:          d.mutatePods,
+		ValidateVolumes:     d.validateVolumes,
 		SchedulerNodePort:   d.schedulerNodePort,
+		NodePools:           d.nodePools,
+		InstanceName:        d.instanceName,
 	}
 	spec := &dep.Spec
 	spec.ControllerReplicas = d.controllerReplicas
@@ -392,6 +409,19 @@ func TestDeploymentController(t *testing.T) {
 				mutatePods:          api.MutatePodsAlways,
 				objects:             []runtime.Object{createSecret("controller-secret", testNamespace, dataOkay)},
 			},
+			"controller, try validate": {
+				name:                "test-controller",
+				controllerTLSSecret: "controller-secret",
+				validateVolumes:     api.ValidateVolumesTry,
+				objects:             []runtime.Object{createSecret("controller-secret", testNamespace, dataOkay)},
+			},
+			"controller, always validate, no mutate": {
+				name:                "test-controller",
+				controllerTLSSecret: "controller-secret",
+				mutatePods:          api.MutatePodsNever,
+				validateVolumes:     api.ValidateVolumesAlways,
+				objects:             []runtime.Object{createSecret("controller-secret", testNamespace, dataOkay)},
+			},
 			"controller, port 31000": {
 				name:                "test-controller",
 				controllerTLSSecret: "controller-secret",
@@ -402,6 +432,45 @@ func TestDeploymentController(t *testing.T) {
 				name:                "test-controller",
 				controllerTLSSecret: "-openshift-",
 			},
+			"generated secret": {
+				name:                "test-controller",
+				controllerTLSSecret: api.ControllerTLSSecretGenerated,
+			},
+			"node pools": {
+				name: "test-node-pools",
+				nodePools: []api.NodePool{
+					{
+						Name:         "small",
+						NodeSelector: map[string]string{"pmem-size": "small"},
+						DeviceMode:   api.DeviceModeDirect,
+						NodeDriverResources: &corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("50m"),
+								corev1.ResourceMemory: resource.MustParse("100Mi"),
+							},
+						},
+					},
+					{
+						Name:           "large",
+						NodeSelector:   map[string]string{"pmem-size": "large"},
+						PMEMPercentage: 50,
+					},
+				},
+			},
+			"overlapping node pools": {
+				name: "test-node-pools",
+				nodePools: []api.NodePool{
+					{
+						Name:         "small",
+						NodeSelector: map[string]string{"pmem-size": "small"},
+					},
+					{
+						Name:         "direct",
+						NodeSelector: map[string]string{"pmem-mode": "direct"},
+					},
+				},
+				expectFailure: true,
+			},
 		}
 
 		for name, d := range cases {
@@ -436,7 +505,8 @@ func TestDeploymentController(t *testing.T) {
 			}
 
 			d2 := &pmemDeployment{
-				name: "test-deployment2",
+				name:         "test-deployment2",
+				instanceName: "second",
 			}
 
 			dep1 := getDeployment(d1)
@@ -459,6 +529,680 @@ func TestDeploymentController(t *testing.T) {
 			validateConditions(tc, d2.name, conditions)
 		})
 
+		t.Run("conflicting deployments", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d1 := &pmemDeployment{
+				name: "test-deployment1",
+			}
+
+			d2 := &pmemDeployment{
+				name: "test-deployment2",
+			}
+
+			dep1 := getDeployment(d1)
+			err := tc.c.Create(tc.ctx, dep1)
+			require.NoError(t, err, "failed to create deployment1")
+
+			dep2 := getDeployment(d2)
+			err = tc.c.Create(tc.ctx, dep2)
+			require.NoError(t, err, "failed to create deployment2")
+
+			// Both use the same PMEM in LVM mode on all nodes.
+			tc.testReconcilePhase(d1.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d1.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:   corev1.ConditionTrue,
+				api.ConflictDetected: corev1.ConditionTrue,
+			})
+			tc.testReconcilePhase(d2.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:   corev1.ConditionTrue,
+				api.ConflictDetected: corev1.ConditionTrue,
+			})
+
+			// A different instance name resolves the conflict. The
+			// other deployment gets updated without reconciling it.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d2.name}, dep2)
+			require.NoError(t, err, "get deployment2")
+			dep2.Spec.InstanceName = "second"
+			err = tc.c.Update(tc.ctx, dep2)
+			require.NoError(t, err, "update deployment2")
+			tc.testReconcilePhase(d2.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:   corev1.ConditionTrue,
+				api.ConflictDetected: corev1.ConditionFalse,
+			})
+			validateConditions(tc, d1.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:   corev1.ConditionTrue,
+				api.ConflictDetected: corev1.ConditionFalse,
+			})
+
+			// Going back to the same instance name causes the
+			// conflict again, also for the other deployment.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d2.name}, dep2)
+			require.NoError(t, err, "get deployment2")
+			dep2.Spec.InstanceName = ""
+			err = tc.c.Update(tc.ctx, dep2)
+			require.NoError(t, err, "update deployment2")
+			tc.testReconcilePhase(d2.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d1.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:   corev1.ConditionTrue,
+				api.ConflictDetected: corev1.ConditionTrue,
+			})
+		})
+
+		t.Run("node status", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name:       "test-node-status",
+				deviceMode: "direct",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				fmt.Fprintf(w, `# TYPE pmem_amount_available gauge
+pmem_amount_available{driver_name=%[1]q,node="worker1"} 1073741824
+# TYPE pmem_amount_managed gauge
+pmem_amount_managed{driver_name=%[1]q,node="worker1"} 4294967296
+# TYPE pmem_amount_max_volume_size gauge
+pmem_amount_max_volume_size{driver_name=%[1]q,node="worker1"} 536870912
+# TYPE pmem_volumes gauge
+pmem_volumes{driver_name=%[1]q,node="worker1"} 3
+`, d.name)
+			}))
+			defer server.Close()
+			_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+			require.NoError(t, err, "split server address")
+			portNum, err := strconv.Atoi(port)
+			require.NoError(t, err, "parse server port")
+
+			nodePod := func(node string, phase corev1.PodPhase, ready corev1.ConditionStatus) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      d.name + "-node-" + node,
+						Namespace: testNamespace,
+						Labels: map[string]string{
+							"app.kubernetes.io/name":     "pmem-csi-node",
+							"app.kubernetes.io/instance": d.name,
+						},
+					},
+					Spec: corev1.PodSpec{
+						NodeName: node,
+						Containers: []corev1.Container{{
+							Name:  "pmem-driver",
+							Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: int32(portNum)}},
+						}},
+					},
+					Status: corev1.PodStatus{
+						Phase: phase,
+						PodIP: "127.0.0.1",
+						Conditions: []corev1.PodCondition{{
+							Type:   corev1.PodReady,
+							Status: ready,
+						}},
+						ContainerStatuses: []corev1.ContainerStatus{{
+							Name: "pmem-driver",
+							State: corev1.ContainerState{
+								Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"},
+							},
+						}},
+					},
+				}
+			}
+			for _, pod := range []*corev1.Pod{
+				nodePod("worker2", corev1.PodPending, corev1.ConditionFalse),
+				nodePod("worker1", corev1.PodRunning, corev1.ConditionTrue),
+			} {
+				require.NoError(t, tc.c.Create(tc.ctx, pod), "create pod")
+			}
+
+			tc.rc.(*deployment.ReconcileDeployment).UpdateNodeStatus(tc.ctx)
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			nodes := dep.Status.Nodes
+			require.Len(t, nodes, 2, "node status")
+			require.Equal(t, "worker1", nodes[0].NodeName, "first node")
+			require.True(t, nodes[0].Ready, "worker1 ready")
+			require.Equal(t, api.DeviceModeDirect, nodes[0].DeviceMode, "worker1 device mode")
+			require.NotNil(t, nodes[0].Capacity, "worker1 capacity")
+			require.Equal(t, "4Gi", nodes[0].Capacity.Managed.String(), "worker1 managed")
+			require.Equal(t, "1Gi", nodes[0].Capacity.Available.String(), "worker1 available")
+			require.Equal(t, "512Mi", nodes[0].Capacity.MaxVolumeSize.String(), "worker1 max volume size")
+			require.Equal(t, int64(3), nodes[0].Capacity.Volumes, "worker1 volumes")
+			require.False(t, nodes[0].LastHeartbeat.IsZero(), "worker1 heartbeat")
+			require.Equal(t, "worker2", nodes[1].NodeName, "second node")
+			require.False(t, nodes[1].Ready, "worker2 ready")
+			require.Equal(t, corev1.PodPending, nodes[1].PodPhase, "worker2 phase")
+			require.Nil(t, nodes[1].Capacity, "worker2 capacity")
+			require.Equal(t, "container pmem-driver: ImagePullBackOff", nodes[1].Reason, "worker2 reason")
+		})
+
+		t.Run("pmem setup", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-pmem-setup",
+			}
+			dep := getDeployment(d)
+			dep.Spec.PmemSetup = &api.PmemSetup{
+				NodeSelector:         map[string]string{"pmem": "yes"},
+				ConvertRawNamespaces: true,
+				ReservePercentage:    10,
+				DryRun:               true,
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeSetupName()}, ds)
+			require.NoError(t, err, "get node setup driver")
+			podSpec := ds.Spec.Template.Spec
+			require.Empty(t, podSpec.NodeSelector, "node selector")
+			require.NotNil(t, podSpec.Affinity, "affinity")
+			require.Equal(t, []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: "pmem", Operator: corev1.NodeSelectorOpIn, Values: []string{"yes"}},
+					{Key: d.name + "/" + api.PmemSetupKey, Operator: corev1.NodeSelectorOpNotIn, Values: []string{api.PmemSetupDone}},
+				},
+			}}, podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, "node selector terms")
+			command := podSpec.Containers[0].Command
+			for _, arg := range []string{"-mode=pmem-setup", "-convertRawNamespaces=true", "-createNamespaces=false", "-reservePercentage=10", "-dryRun=true"} {
+				require.Contains(t, command, arg, "node setup command")
+			}
+
+			// Simulate the result of the setup pod on one node.
+			status := api.NodeSetupStatus{
+				DryRun:  true,
+				Actions: []string{"convert raw namespace namespace0.0 of size 1Gi in region region0 to fsdax, DESTROYS ITS DATA"},
+				Conditions: []api.NodeSetupCondition{{
+					Type:   api.RawNamespacesConverted,
+					Status: corev1.ConditionUnknown,
+					Reason: "Dry run: 1 raw namespace(s) would be converted.",
+				}},
+			}
+			value, err := json.Marshal(status)
+			require.NoError(t, err, "encode setup status")
+			for _, node := range []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "worker1", Annotations: map[string]string{d.name + "/" + api.PmemSetupKey: string(value)}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "worker2"}},
+			} {
+				require.NoError(t, tc.c.Create(tc.ctx, node), "create node")
+			}
+
+			tc.rc.(*deployment.ReconcileDeployment).UpdateNodeStatus(tc.ctx)
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Len(t, dep.Status.PmemSetup, 1, "setup status")
+			actual := dep.Status.PmemSetup[0]
+			require.Equal(t, "worker1", actual.NodeName, "node name")
+			require.True(t, actual.DryRun, "dry run")
+			require.Equal(t, status.Actions, actual.Actions, "actions")
+			require.Len(t, actual.Conditions, 1, "conditions")
+			require.Equal(t, corev1.ConditionUnknown, actual.Conditions[0].Status, "condition status")
+		})
+
+		t.Run("sidecars", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-sidecars",
+			}
+			dep := getDeployment(d)
+			dep.Spec.LivenessProbeImage = "livenessprobe-image"
+			dep.Spec.NodeExtraContainers = []corev1.Container{
+				{
+					Name:  "extra",
+					Image: "extra-image",
+				},
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			containers := ds.Spec.Template.Spec.Containers
+			var names []string
+			for _, c := range containers {
+				names = append(names, c.Name)
+			}
+			// The driver does not support expansion, snapshots or volume conditions.
+			require.Equal(t, []string{"pmem-driver", "driver-registrar", "external-provisioner", "liveness-probe", "extra"}, names, "containers")
+			require.Equal(t, "livenessprobe-image", containers[3].Image, "livenessprobe image")
+			require.NotNil(t, containers[0].LivenessProbe, "driver liveness probe")
+			require.NotNil(t, containers[0].LivenessProbe.HTTPGet, "driver liveness probe")
+			require.Equal(t, "/healthz", containers[0].LivenessProbe.HTTPGet.Path, "driver liveness probe")
+
+			// Manual modifications get reverted.
+			ds.Spec.Template.Spec.Containers = containers[0:3]
+			err = tc.c.Update(tc.ctx, ds)
+			require.NoError(t, err, "update node driver")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Len(t, ds.Spec.Template.Spec.Containers, 5, "containers after reconcile")
+		})
+
+		t.Run("pod template overrides", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-overrides",
+			}
+			dep := getDeployment(d)
+			tolerations := []corev1.Toleration{
+				{
+					Key:      "example.com/dedicated",
+					Operator: corev1.TolerationOpEqual,
+					Value:    "pmem",
+					Effect:   corev1.TaintEffectNoSchedule,
+				},
+			}
+			dep.Spec.PodTemplateOverrides.Controller = &api.PodOverrides{
+				Tolerations:       tolerations,
+				PriorityClassName: "high-priority",
+				Env:               []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+			}
+			dep.Spec.PodTemplateOverrides.Node = &api.PodOverrides{
+				Annotations: map[string]string{"example.com/foo": "bar"},
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ss := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.ControllerDriverName()}, ss)
+			require.NoError(t, err, "get controller")
+			spec := ss.Spec.Template.Spec
+			require.Equal(t, tolerations, spec.Tolerations, "controller tolerations")
+			require.Equal(t, "high-priority", spec.PriorityClassName, "controller priority class")
+			require.Contains(t, spec.Containers[0].Env, corev1.EnvVar{Name: "FOO", Value: "bar"}, "controller env")
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Equal(t, map[string]string{
+				"pmem-csi.intel.com/scrape": "containers",
+				"example.com/foo":           "bar",
+			}, ds.Spec.Template.Annotations, "node annotations")
+
+			// Removing the overrides restores the defaults.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.PodTemplateOverrides = api.PodTemplateOverrides{}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.ControllerDriverName()}, ss)
+			require.NoError(t, err, "get controller")
+			spec = ss.Spec.Template.Spec
+			require.Len(t, spec.Tolerations, 2, "default controller tolerations")
+			require.Equal(t, "system-cluster-critical", spec.PriorityClassName, "default controller priority class")
+			require.NotContains(t, spec.Containers[0].Env, corev1.EnvVar{Name: "FOO", Value: "bar"}, "controller env")
+		})
+
+		t.Run("generated TLS secret", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name:                "test-generated-tls",
+				controllerTLSSecret: api.ControllerTLSSecretGenerated,
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			secret := &corev1.Secret{}
+			secretKey := client.ObjectKey{Namespace: testNamespace, Name: dep.ControllerTLSSecretName()}
+			err = tc.c.Get(tc.ctx, secretKey, secret)
+			require.NoError(t, err, "get generated secret")
+			for _, key := range []string{api.TLSSecretCA, api.TLSSecretCert, api.TLSSecretKey} {
+				require.NotEmpty(t, secret.Data[key], "secret data %s", key)
+			}
+			cert := secret.Data[api.TLSSecretCert]
+
+			hook := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.MutatingWebhookName()}, hook)
+			require.NoError(t, err, "get mutating webhook")
+			require.Equal(t, secret.Data[api.TLSSecretCA], hook.Webhooks[0].ClientConfig.CABundle, "CA bundle")
+
+			ss := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.ControllerDriverName()}, ss)
+			require.NoError(t, err, "get controller")
+			var secretName string
+			for _, volume := range ss.Spec.Template.Spec.Volumes {
+				if volume.Secret != nil {
+					secretName = volume.Secret.SecretName
+				}
+			}
+			require.Equal(t, dep.ControllerTLSSecretName(), secretName, "controller secret volume")
+
+			// Node drivers get a client certificate for
+			// pushing capacity reports to the controller.
+			nodeSecret := &corev1.Secret{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeTLSSecretGeneratedName()}, nodeSecret)
+			require.NoError(t, err, "get generated node secret")
+			require.Equal(t, secret.Data[api.TLSSecretCA], nodeSecret.Data[api.TLSSecretCA], "node CA bundle")
+			nodeCert := parseCertificate(t, nodeSecret.Data[api.TLSSecretCert])
+			require.NoError(t, nodeCert.CheckSignatureFrom(parseCertificate(t, secret.Data[api.TLSSecretCA])), "node certificate signed by CA")
+			require.Equal(t, scheduler.CapacityReporterName, nodeCert.Subject.CommonName, "node certificate name")
+			require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nodeCert.ExtKeyUsage, "node certificate usage")
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command,
+				fmt.Sprintf("-capacityReportURL=https://%s.%s.svc/capacity", dep.SchedulerServiceName(), testNamespace),
+				"node driver command")
+			require.Contains(t, ss.Spec.Template.Spec.Containers[0].Command, "-capacityReports", "controller command")
+
+			// Valid certificates are kept.
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, secretKey, secret)
+			require.NoError(t, err, "get generated secret")
+			require.Equal(t, cert, secret.Data[api.TLSSecretCert], "certificate after reconcile")
+
+			// Broken certificates get replaced.
+			secret.Data[api.TLSSecretCert] = []byte("broken")
+			err = tc.c.Update(tc.ctx, secret)
+			require.NoError(t, err, "update secret")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, secretKey, secret)
+			require.NoError(t, err, "get generated secret")
+			require.NotEqual(t, []byte("broken"), secret.Data[api.TLSSecretCert], "certificate was not replaced")
+			require.NotEqual(t, cert, secret.Data[api.TLSSecretCert], "certificate was not replaced")
+		})
+
+		t.Run("deletion without volumes", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-deletion",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Finalizers, api.DeploymentFinalizer, "finalizer")
+
+			err = tc.c.Delete(tc.ctx, dep)
+			require.NoError(t, err, "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment should be removed, got: %v", err)
+		})
+
+		t.Run("deletion with volumes", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-deletion",
+			}
+			dep := getDeployment(d)
+			dep.UID = "test-deletion-uid"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			pv := func(name, driver string) *corev1.PersistentVolume {
+				return &corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: corev1.PersistentVolumeSpec{
+						PersistentVolumeSource: corev1.PersistentVolumeSource{
+							CSI: &corev1.CSIPersistentVolumeSource{
+								Driver:       driver,
+								VolumeHandle: name,
+							},
+						},
+					},
+				}
+			}
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "worker1",
+					Labels: api.DefaultNodeSelector,
+				},
+			}
+			for _, obj := range []client.Object{
+				pv("pv-1", d.name),
+				pv("pv-2", "other-driver"),
+				node,
+				&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker2"}},
+			} {
+				require.NoError(t, tc.c.Create(tc.ctx, obj), "create %s", obj.GetName())
+			}
+
+			err = tc.c.Delete(tc.ctx, dep)
+			require.NoError(t, err, "delete deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseDeleting)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "pv-1", "reason")
+			require.NotContains(t, dep.Status.Reason, "pv-2", "reason")
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "node driver must still exist")
+
+			// Force deletion.
+			dep.Annotations = map[string]string{api.ForceDeleteAnnotation: "true"}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "add force annotation")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseDeleting)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.True(t, errors.IsNotFound(err), "node driver should be removed, got: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName() + "-cleanup"}, ds)
+			require.NoError(t, err, "get node cleanup")
+			require.Len(t, ds.Spec.Template.Spec.Containers, 1, "containers")
+			command := ds.Spec.Template.Spec.Containers[0].Command
+			require.Contains(t, command, "-mode=cleanup", "node cleanup command")
+			require.Contains(t, command, "-cleanupToken=test-deletion-uid", "node cleanup command")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, "worker1", "reason")
+			require.NotContains(t, dep.Status.Reason, "worker2", "reason")
+
+			// Simulate the cleanup pod.
+			node.Annotations = map[string]string{d.name + "/" + api.CleanupKey: "test-deletion-uid"}
+			err = tc.c.Update(tc.ctx, node)
+			require.NoError(t, err, "annotate node")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment should be removed, got: %v", err)
+		})
+
+		t.Run("orchestrated upgrade", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-upgrade",
+			}
+			dep := getDeployment(d)
+			dep.Spec.NodeUpgradeStrategy = api.NodeUpgradeOrchestrated
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed:     corev1.ConditionTrue,
+				api.NodeDriverUpgraded: corev1.ConditionTrue,
+			})
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Equal(t, appsv1.OnDeleteDaemonSetStrategyType, ds.Spec.UpdateStrategy.Type, "update strategy")
+			require.Nil(t, ds.Spec.UpdateStrategy.RollingUpdate, "rolling update")
+
+			// Simulate a new revision of the DaemonSet with
+			// three outdated pods.
+			ds.Status.DesiredNumberScheduled = 3
+			err = tc.c.Status().Update(tc.ctx, ds)
+			require.NoError(t, err, "update node driver status")
+			labels := func(hash string) map[string]string {
+				labels := map[string]string{
+					appsv1.DefaultDaemonSetUniqueLabelKey: hash,
+				}
+				for key, value := range ds.Spec.Selector.MatchLabels {
+					labels[key] = value
+				}
+				return labels
+			}
+			revision := &appsv1.ControllerRevision{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            ds.Name + "-new",
+					Namespace:       testNamespace,
+					Labels:          labels("new"),
+					OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(ds, appsv1.SchemeGroupVersion.WithKind("DaemonSet"))},
+				},
+				Revision: 2,
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, revision), "create controller revision")
+			nodePod := func(node, hash string, ready corev1.ConditionStatus, age time.Duration) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              ds.Name + "-" + node,
+						Namespace:         testNamespace,
+						Labels:            labels(hash),
+						CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+					},
+					Spec: corev1.PodSpec{
+						NodeName: node,
+					},
+					Status: corev1.PodStatus{
+						Phase: corev1.PodRunning,
+						Conditions: []corev1.PodCondition{{
+							Type:   corev1.PodReady,
+							Status: ready,
+						}},
+					},
+				}
+			}
+			nodes := []string{"worker1", "worker2", "worker3"}
+			for _, node := range nodes {
+				csiNode := &storagev1.CSINode{
+					ObjectMeta: metav1.ObjectMeta{Name: node},
+					Spec: storagev1.CSINodeSpec{
+						Drivers: []storagev1.CSINodeDriver{{Name: d.name, NodeID: node}},
+					},
+				}
+				require.NoError(t, tc.c.Create(tc.ctx, csiNode), "create CSINode")
+				require.NoError(t, tc.c.Create(tc.ctx, nodePod(node, "old", corev1.ConditionTrue, time.Hour)), "create pod")
+			}
+
+			upgradeNodes := func(expectedPhase api.DeploymentPhase, expectedCondition corev1.ConditionStatus, expectedPods ...string) string {
+				tc.rc.(*deployment.ReconcileDeployment).UpgradeNodes(tc.ctx)
+				tc.testDeploymentPhase(d.name, expectedPhase)
+				dep := &api.PmemCSIDeployment{}
+				require.NoError(t, tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep), "get deployment")
+				var reason string
+				for _, c := range dep.Status.Conditions {
+					if c.Type == api.NodeDriverUpgraded {
+						require.Equal(t, expectedCondition, c.Status, "NodeDriverUpgraded condition: %s", c.Reason)
+						reason = c.Reason
+					}
+				}
+				pods := &corev1.PodList{}
+				require.NoError(t, tc.c.List(tc.ctx, pods, client.InNamespace(testNamespace)), "list pods")
+				var actualPods []string
+				for _, pod := range pods.Items {
+					actualPods = append(actualPods, pod.Spec.NodeName+"="+pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey])
+				}
+				sort.Strings(actualPods)
+				require.Equal(t, expectedPods, actualPods, "pods")
+				return reason
+			}
+
+			// One pod per batch with the default MaxUnavailable.
+			upgradeNodes(api.DeploymentPhaseUpgrading, corev1.ConditionFalse, "worker2=old", "worker3=old")
+
+			// The replacement pod is not ready for too long.
+			require.NoError(t, tc.c.Create(tc.ctx, nodePod("worker1", "new", corev1.ConditionFalse, time.Hour)), "create pod")
+			reason := upgradeNodes(api.DeploymentPhaseUpgrading, corev1.ConditionFalse, "worker1=new", "worker2=old", "worker3=old")
+			require.Contains(t, reason, "paused", "NodeDriverUpgraded reason")
+
+			// Once it is ready, the upgrade continues.
+			require.NoError(t, tc.c.Update(tc.ctx, nodePod("worker1", "new", corev1.ConditionTrue, time.Minute)), "update pod")
+			upgradeNodes(api.DeploymentPhaseUpgrading, corev1.ConditionFalse, "worker1=new", "worker3=old")
+			require.NoError(t, tc.c.Create(tc.ctx, nodePod("worker2", "new", corev1.ConditionTrue, time.Minute)), "create pod")
+			upgradeNodes(api.DeploymentPhaseUpgrading, corev1.ConditionFalse, "worker1=new", "worker2=new")
+			require.NoError(t, tc.c.Create(tc.ctx, nodePod("worker3", "new", corev1.ConditionTrue, time.Minute)), "create pod")
+			upgradeNodes(api.DeploymentPhaseRunning, corev1.ConditionTrue, "worker1=new", "worker2=new", "worker3=new")
+		})
+
+		t.Run("version skew", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name:  "test-version-skew",
+				image: "intel/pmem-csi-driver:v1.0.0",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			// Simulate the node driver pod.
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      ds.Name + "-worker1",
+					Namespace: testNamespace,
+					Labels:    ds.Spec.Selector.MatchLabels,
+				},
+				Spec: corev1.PodSpec{
+					NodeName: "worker1",
+					Containers: []corev1.Container{{
+						Name:  "pmem-driver",
+						Image: "intel/pmem-csi-driver:v1.0.0",
+					}},
+				},
+			}
+			require.NoError(t, tc.c.Create(tc.ctx, pod), "create pod")
+			setImage := func(image string) {
+				err := tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+				require.NoError(t, err, "get deployment")
+				dep.Spec.Image = image
+				require.NoError(t, tc.c.Update(tc.ctx, dep), "update deployment")
+			}
+
+			// Skipping a minor version is rejected.
+			setImage("intel/pmem-csi-driver:v1.2.0")
+			tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+
+			// The next minor version is fine.
+			setImage("intel/pmem-csi-driver:v1.1.0")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			// The DaemonSet has the new image, but the pod was
+			// not replaced yet.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Equal(t, "intel/pmem-csi-driver:v1.1.0", ds.Spec.Template.Spec.Containers[0].Image, "node driver image")
+			setImage("intel/pmem-csi-driver:v1.2.0")
+			tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Contains(t, dep.Status.Reason, pod.Name, "reason")
+
+			// Once the pod runs the intermediate version, the
+			// upgrade can continue.
+			pod.Spec.Containers[0].Image = "intel/pmem-csi-driver:v1.1.0"
+			require.NoError(t, tc.c.Update(tc.ctx, pod), "update pod")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+		})
+
 		t.Run("modified deployment under reconcile", func(t *testing.T) {
 			tc := setup(t)
 			defer teardown(tc)
@@ -708,3 +1452,12 @@ func (t *testClient) Create(ctx context.Context, obj client.Object, opts ...clie
 	}
 	return t.Client.Create(ctx, obj, opts...)
 }
+
+// parseCertificate returns the first certificate in the PEM data.
+func parseCertificate(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block, "PEM data")
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err, "parse certificate")
+	return cert
+}
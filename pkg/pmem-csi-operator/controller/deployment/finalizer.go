@@ -0,0 +1,281 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// deletionInterval determines how often a blocked or ongoing
+	// deletion gets checked again. Removing persistent volumes or
+	// annotating nodes does not trigger a reconcile.
+	deletionInterval = 30 * time.Second
+)
+
+// forceDelete returns true if the deployment may be removed despite
+// existing volumes.
+func forceDelete(deployment *api.PmemCSIDeployment) bool {
+	return deployment.Annotations[api.ForceDeleteAnnotation] == "true"
+}
+
+// addFinalizer ensures that the operator gets a chance to check for
+// volumes before the deployment gets removed.
+func (r *ReconcileDeployment) addFinalizer(ctx context.Context, deployment *api.PmemCSIDeployment) error {
+	if controllerutil.ContainsFinalizer(deployment, api.DeploymentFinalizer) {
+		return nil
+	}
+	org := deployment.DeepCopy()
+	controllerutil.AddFinalizer(deployment, api.DeploymentFinalizer)
+	if err := r.client.Patch(ctx, deployment, client.MergeFrom(org)); err != nil {
+		return fmt.Errorf("add finalizer: %v", err)
+	}
+	return nil
+}
+
+// finalize handles a deployment which is marked for deletion. The
+// finalizer gets removed once no persistent volumes of the driver
+// exist anymore or, when forced, once all volumes on the nodes were
+// removed by the cleanup pods. Then the apiserver garbage-collects
+// all sub-objects.
+func (r *ReconcileDeployment) finalize(ctx context.Context, deployment *api.PmemCSIDeployment) (reconcile.Result, error) {
+	l := klog.FromContext(ctx).WithName("finalize")
+	ctx = klog.NewContext(ctx, l)
+
+	if !controllerutil.ContainsFinalizer(deployment, api.DeploymentFinalizer) {
+		// The apiserver is in the process of garbage-collecting
+		// all sub-objects and then will remove it.
+		return reconcile.Result{}, nil
+	}
+
+	dep := deployment.DeepCopy()
+	var reason string
+	if forceDelete(deployment) {
+		d, err := r.newDeployment(ctx, dep)
+		if err != nil {
+			return reconcile.Result{RequeueAfter: deletionInterval}, err
+		}
+		pending, err := d.cleanupNodes(ctx, r)
+		if err != nil {
+			return reconcile.Result{RequeueAfter: deletionInterval}, err
+		}
+		if len(pending) > 0 {
+			reason = fmt.Sprintf("Removing all volumes, waiting for node(s): %s", strings.Join(pending, ", "))
+		}
+	} else {
+		volumes, err := r.driverVolumes(ctx, deployment)
+		if err != nil {
+			return reconcile.Result{RequeueAfter: deletionInterval}, err
+		}
+		if len(volumes) > 0 {
+			reason = fmt.Sprintf("Deletion blocked by %d persistent volume(s) of the driver: %s. Delete them or set the %s=true annotation to remove them together with the driver.",
+				len(volumes), strings.Join(volumes, ", "), api.ForceDeleteAnnotation)
+			if reason != deployment.Status.Reason {
+				r.evRecorder.Event(deployment, corev1.EventTypeWarning, api.EventReasonDeletionBlocked, reason)
+			}
+		}
+	}
+
+	if reason != "" {
+		l.V(3).Info("deletion pending", "reason", reason)
+		if dep.Status.Phase != api.DeploymentPhaseDeleting || dep.Status.Reason != reason {
+			dep.Status.Phase = api.DeploymentPhaseDeleting
+			dep.Status.Reason = reason
+			if err := r.patchDeploymentStatus(dep, client.MergeFrom(deployment)); err != nil {
+				l.Error(err, "failed to update status")
+			}
+		}
+		return reconcile.Result{RequeueAfter: deletionInterval}, nil
+	}
+
+	l.Info("removing finalizer")
+	org := deployment.DeepCopy()
+	controllerutil.RemoveFinalizer(deployment, api.DeploymentFinalizer)
+	if err := r.client.Patch(ctx, deployment, client.MergeFrom(org)); err != nil {
+		return reconcile.Result{RequeueAfter: deletionInterval}, fmt.Errorf("remove finalizer: %v", err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// driverVolumes returns the sorted names of all persistent volumes
+// which were provisioned by the driver.
+func (r *ReconcileDeployment) driverVolumes(ctx context.Context, deployment *api.PmemCSIDeployment) ([]string, error) {
+	pvs := &corev1.PersistentVolumeList{}
+	if err := r.client.List(ctx, pvs); err != nil {
+		return nil, fmt.Errorf("list persistent volumes: %v", err)
+	}
+	var names []string
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == deployment.CSIDriverName() {
+			names = append(names, pv.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// cleanupNodes replaces the node driver with cleanup pods which
+// remove all volumes. It returns the sorted names of the nodes where
+// that has not been done yet.
+func (d *pmemCSIDeployment) cleanupNodes(ctx context.Context, r *ReconcileDeployment) ([]string, error) {
+	l := klog.FromContext(ctx)
+
+	// The node driver must be gone before its volumes get removed.
+	for _, name := range d.nodeDaemonSetNames() {
+		ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: d.namespace, Name: name}}
+		if err := r.client.Delete(ctx, ds); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("delete node driver %s: %v", name, err)
+		}
+	}
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/name":     "pmem-csi-node",
+			"app.kubernetes.io/instance": d.Name,
+		}); err != nil {
+		return nil, fmt.Errorf("list node driver pods: %v", err)
+	}
+	if len(pods.Items) > 0 {
+		var nodes []string
+		for _, pod := range pods.Items {
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+		sort.Strings(nodes)
+		return nodes, nil
+	}
+
+	var pools []*api.NodePool
+	if nodePoolsEnabled(d) {
+		for _, pool := range d.Spec.NodePools {
+			pool := d.NodePoolSpec(pool)
+			pools = append(pools, &pool)
+		}
+	} else {
+		pools = append(pools, nil)
+	}
+
+	annotation := d.Name + "/" + api.CleanupKey
+	pending := map[string]bool{}
+	for _, pool := range pools {
+		ds := &appsv1.DaemonSet{
+			TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+			ObjectMeta: d.getObjectMeta(d.nodeCleanupName(pool), false),
+		}
+		if err := r.client.Get(ctx, client.ObjectKeyFromObject(ds), ds); err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, fmt.Errorf("get node cleanup %s: %v", ds.Name, err)
+			}
+			d.getNodeCleanupDaemonSet(ds, pool)
+			if err := k8sutil.ApplyPodOverrides(&ds.Spec.Template, d.Spec.PodTemplateOverrides.Node); err != nil {
+				return nil, fmt.Errorf("node cleanup %s: %v", ds.Name, err)
+			}
+			l.Info("creating node cleanup", "daemonset", ds.Name)
+			if err := r.client.Create(ctx, ds); err != nil {
+				return nil, fmt.Errorf("create node cleanup %s: %v", ds.Name, err)
+			}
+		}
+
+		nodes := &corev1.NodeList{}
+		if err := r.client.List(ctx, nodes, client.MatchingLabels(ds.Spec.Template.Spec.NodeSelector)); err != nil {
+			return nil, fmt.Errorf("list nodes: %v", err)
+		}
+		for _, node := range nodes.Items {
+			if node.Annotations[annotation] != string(d.UID) {
+				pending[node.Name] = true
+			}
+		}
+	}
+
+	var nodes []string
+	for node := range pending {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// nodeCleanupName returns the name of the cleanup DaemonSet for the
+// node driver of all nodes (pool == nil) or of one node pool.
+func (d *pmemCSIDeployment) nodeCleanupName(pool *api.NodePool) string {
+	if pool == nil {
+		return d.NodeDriverName() + "-cleanup"
+	}
+	return d.NodePoolDriverName(pool.Name) + "-cleanup"
+}
+
+// getNodeCleanupDaemonSet configures a DaemonSet which runs on the
+// same nodes as the node driver with the same volumes, just with the
+// driver in cleanup mode.
+func (d *pmemCSIDeployment) getNodeCleanupDaemonSet(ds *appsv1.DaemonSet, pool *api.NodePool) {
+	d.getNodeDaemonSet(ds, pool)
+
+	ds.Labels["app.kubernetes.io/name"] = "pmem-csi-node-cleanup"
+	ds.Labels["app.kubernetes.io/component"] = "node-cleanup"
+	selector := map[string]string{
+		"app.kubernetes.io/name":     "pmem-csi-node-cleanup",
+		"app.kubernetes.io/instance": d.Name,
+	}
+	if pool != nil {
+		selector[api.NodePoolLabel] = pool.Name
+	}
+	ds.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: selector,
+	}
+	ds.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{}
+	ds.Spec.Template.ObjectMeta.Labels = joinMaps(
+		d.Spec.Labels,
+		joinMaps(selector, map[string]string{
+			"app.kubernetes.io/part-of":   "pmem-csi",
+			"app.kubernetes.io/component": "node-cleanup",
+			"pmem-csi.intel.com/webhook":  "ignore",
+		}))
+	ds.Spec.Template.ObjectMeta.Annotations = nil
+	// Needs permission to annotate the node.
+	ds.Spec.Template.Spec.ServiceAccountName = d.NodeSetupServiceAccountName()
+
+	c := d.getNodeDriverContainer(pool)
+	c.Command = d.getNodeCleanupCommand(pool)
+	c.Ports = nil
+	c.LivenessProbe = nil
+	c.StartupProbe = nil
+	ds.Spec.Template.Spec.Containers = []corev1.Container{c}
+}
+
+func (d *pmemCSIDeployment) getNodeCleanupCommand(pool *api.NodePool) []string {
+	deviceMode := d.Spec.DeviceMode
+	if pool != nil {
+		deviceMode = pool.DeviceMode
+	}
+	return append([]string{
+		"/usr/local/bin/pmem-csi-driver",
+		fmt.Sprintf("-deviceManager=%s", deviceMode),
+		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+		"-logging-format=" + string(d.Spec.LogFormat),
+		"-mode=cleanup",
+		"-nodeid=$(KUBE_NODE_NAME)",
+		"-statePath=/var/lib/$(PMEM_CSI_DRIVER_NAME)",
+		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
+		"-cleanupToken=" + string(d.UID),
+	}, d.getInstanceArgs()...)
+}
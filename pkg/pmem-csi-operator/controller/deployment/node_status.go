@@ -0,0 +1,238 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// nodeStatusInterval determines how often the per-node status
+	// of all deployments gets refreshed.
+	nodeStatusInterval = time.Minute
+	// nodeMetricsTimeout limits how long retrieving metrics data
+	// from a single node driver may take.
+	nodeMetricsTimeout = 10 * time.Second
+)
+
+// runNodeStatus refreshes the per-node status periodically until the
+// context is done. It gets started by the manager, which ensures that
+// it only runs in the leader.
+func (r *ReconcileDeployment) runNodeStatus(ctx context.Context) error {
+	wait.UntilWithContext(ctx, r.UpdateNodeStatus, nodeStatusInterval)
+	return nil
+}
+
+// UpdateNodeStatus collects information about the node driver pods of
+// all known deployments and stores it in their status.
+func (r *ReconcileDeployment) UpdateNodeStatus(ctx context.Context) {
+	l := klog.FromContext(ctx).WithName("UpdateNodeStatus")
+
+	r.deploymentsMutex.Lock()
+	var deployments []*api.PmemCSIDeployment
+	for _, dep := range r.deployments {
+		deployments = append(deployments, dep.DeepCopy())
+	}
+	r.deploymentsMutex.Unlock()
+
+	for _, dep := range deployments {
+		if dep.DeletionTimestamp != nil {
+			continue
+		}
+		if err := r.updateNodeStatus(ctx, dep); err != nil {
+			l.Error(err, "update node status", "deployment", dep.Name)
+		}
+	}
+}
+
+func (r *ReconcileDeployment) updateNodeStatus(ctx context.Context, dep *api.PmemCSIDeployment) error {
+	// The most recent status is needed as base for the patch.
+	if err := r.client.Get(ctx, client.ObjectKey{Name: dep.Name}, dep); err != nil {
+		return fmt.Errorf("get deployment: %v", err)
+	}
+	if err := dep.EnsureDefaults(r.containerImage); err != nil {
+		// Reconcile reports this.
+		return nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods,
+		client.InNamespace(r.namespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/name":     "pmem-csi-node",
+			"app.kubernetes.io/instance": dep.Name,
+		}); err != nil {
+		return fmt.Errorf("list node driver pods: %v", err)
+	}
+
+	oldStatus := map[string]api.NodeStatus{}
+	for _, status := range dep.Status.Nodes {
+		oldStatus[status.NodeName] = status
+	}
+
+	var scheduled []*corev1.Pod
+	for i := range pods.Items {
+		if pods.Items[i].Spec.NodeName != "" {
+			scheduled = append(scheduled, &pods.Items[i])
+		}
+	}
+
+	// Retrieving metrics data may be slow, so do it in parallel.
+	nodes := make([]api.NodeStatus, len(scheduled))
+	var wg sync.WaitGroup
+	for i, pod := range scheduled {
+		wg.Add(1)
+		go func(i int, pod *corev1.Pod) {
+			defer wg.Done()
+			nodes[i] = nodeStatus(dep, pod, oldStatus[pod.Spec.NodeName])
+		}(i, pod)
+	}
+	wg.Wait()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeName < nodes[j].NodeName
+	})
+
+	setup, err := r.pmemSetupStatus(ctx, dep)
+	if err != nil {
+		return err
+	}
+
+	org := dep.DeepCopy()
+	dep.Status.Nodes = nodes
+	dep.Status.PmemSetup = setup
+	return r.patchDeploymentStatus(dep, client.MergeFrom(org))
+}
+
+// pmemSetupStatus collects the results of the PMEM setup pods. Those
+// store them in an annotation of their node because they have no
+// permission to update the deployment.
+func (r *ReconcileDeployment) pmemSetupStatus(ctx context.Context, dep *api.PmemCSIDeployment) ([]api.NodeSetupStatus, error) {
+	if dep.Spec.PmemSetup == nil {
+		return nil, nil
+	}
+	l := klog.FromContext(ctx)
+	nodes := &corev1.NodeList{}
+	if err := r.client.List(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("list nodes: %v", err)
+	}
+	annotation := dep.Name + "/" + api.PmemSetupKey
+	var setup []api.NodeSetupStatus
+	for _, node := range nodes.Items {
+		value, ok := node.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		var status api.NodeSetupStatus
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			l.Error(err, "decode PMEM setup status", "node", node.Name, "annotation", annotation)
+			continue
+		}
+		status.NodeName = node.Name
+		setup = append(setup, status)
+	}
+	sort.Slice(setup, func(i, j int) bool {
+		return setup[i].NodeName < setup[j].NodeName
+	})
+	return setup, nil
+}
+
+// nodeStatus determines the status of one node driver pod. Capacity
+// and heartbeat from the previous status are kept when the driver
+// cannot be reached.
+func nodeStatus(dep *api.PmemCSIDeployment, pod *corev1.Pod, old api.NodeStatus) api.NodeStatus {
+	status := api.NodeStatus{
+		NodeName:      pod.Spec.NodeName,
+		Pool:          pod.Labels[api.NodePoolLabel],
+		DeviceMode:    dep.Spec.DeviceMode,
+		PodPhase:      pod.Status.Phase,
+		Ready:         podIsReady(pod),
+		Capacity:      old.Capacity,
+		LastHeartbeat: old.LastHeartbeat,
+	}
+	for _, pool := range dep.Spec.NodePools {
+		if pool.Name == status.Pool {
+			status.DeviceMode = dep.NodePoolSpec(pool).DeviceMode
+		}
+	}
+	if !status.Ready {
+		status.Reason = podNotReadyReason(pod)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return status
+	}
+
+	url := k8sutil.MetricsURL(pod)
+	if url == "" || pod.Status.PodIP == "" {
+		status.Reason = "no metrics endpoint"
+		return status
+	}
+	values, err := k8sutil.NodeMetrics(&http.Client{Timeout: nodeMetricsTimeout}, url, dep.Name)
+	if err != nil {
+		status.Reason = fmt.Sprintf("get metrics: %v", err)
+		return status
+	}
+	// Only samples for this node are relevant. The label is
+	// pmdmanager.NodeLabel, which cannot be imported here
+	// without cgo.
+	labels := map[string]string{"node": pod.Spec.NodeName}
+	value := func(name string) int64 {
+		v, _ := values.Get(name, labels)
+		return int64(v)
+	}
+	status.Capacity = &api.NodeCapacity{
+		Managed:       *resource.NewQuantity(value("pmem_amount_managed"), resource.BinarySI),
+		Available:     *resource.NewQuantity(value("pmem_amount_available"), resource.BinarySI),
+		MaxVolumeSize: *resource.NewQuantity(value("pmem_amount_max_volume_size"), resource.BinarySI),
+		Volumes:       value("pmem_volumes"),
+	}
+	status.LastHeartbeat = metav1.Now()
+	return status
+}
+
+func podIsReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podNotReadyReason returns the reason of the first container that is
+// not ready, or the pod phase if there is no such container.
+func podNotReadyReason(pod *corev1.Pod) string {
+	for _, container := range pod.Status.ContainerStatuses {
+		if container.Ready {
+			continue
+		}
+		switch {
+		case container.State.Waiting != nil:
+			return fmt.Sprintf("container %s: %s", container.Name, container.State.Waiting.Reason)
+		case container.State.Terminated != nil:
+			return fmt.Sprintf("container %s: %s", container.Name, container.State.Terminated.Reason)
+		default:
+			return fmt.Sprintf("container %s: not ready", container.Name)
+		}
+	}
+	return fmt.Sprintf("pod %s", pod.Status.Phase)
+}
@@ -75,6 +75,77 @@ func UpdateTests() []UpdateTest {
 				},
 			}
 		},
+		"livenessProbe": func(d *api.PmemCSIDeployment) {
+			d.Spec.LivenessProbeImage = "no-such-livenessprobe-image"
+			d.Spec.LivenessProbeResources = &corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("51m"),
+					corev1.ResourceMemory: resource.MustParse("51Mi"),
+				},
+			}
+		},
+		"nodeExtraContainers": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeExtraContainers = []corev1.Container{
+				{
+					Name:    "extra",
+					Image:   "no-such-extra-image",
+					Command: []string{"sleep", "infinity"},
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:      "socket-dir",
+							MountPath: "/csi",
+						},
+					},
+				},
+			}
+		},
+		"podTemplateOverrides": func(d *api.PmemCSIDeployment) {
+			// Settings which do not prevent scheduling the pods.
+			overrides := func() *api.PodOverrides {
+				return &api.PodOverrides{
+					Annotations: map[string]string{
+						"example.com/foo": "bar",
+					},
+					Tolerations: []corev1.Toleration{
+						{Operator: corev1.TolerationOpExists},
+					},
+					Affinity: &corev1.Affinity{
+						NodeAffinity: &corev1.NodeAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+								{
+									Weight: 1,
+									Preference: corev1.NodeSelectorTerm{
+										MatchExpressions: []corev1.NodeSelectorRequirement{
+											{
+												Key:      "no-such-label",
+												Operator: corev1.NodeSelectorOpExists,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+					PriorityClassName: "system-cluster-critical",
+					TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+						{
+							MaxSkew:           1,
+							TopologyKey:       "kubernetes.io/hostname",
+							WhenUnsatisfiable: corev1.ScheduleAnyway,
+						},
+					},
+					SecurityContext: &corev1.PodSecurityContext{
+						SupplementalGroups: []int64{1000},
+					},
+					Env: []corev1.EnvVar{
+						{Name: "FOO", Value: "bar"},
+					},
+				}
+			}
+			d.Spec.PodTemplateOverrides.Controller = overrides()
+			d.Spec.PodTemplateOverrides.Node = overrides()
+			d.Spec.PodTemplateOverrides.NodeSetup = overrides()
+		},
 		"logLevel": func(d *api.PmemCSIDeployment) {
 			d.Spec.LogLevel++
 		},
@@ -105,6 +176,30 @@ func UpdateTests() []UpdateTest {
 		"openshift": func(d *api.PmemCSIDeployment) {
 			d.Spec.ControllerTLSSecret = "-openshift-"
 		},
+		"nodeUpgradeStrategy": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeUpgradeStrategy = api.NodeUpgradeOrchestrated
+		},
+		"pmemSetup": func(d *api.PmemCSIDeployment) {
+			d.Spec.PmemSetup = &api.PmemSetup{
+				CreateNamespaces:  true,
+				ReservePercentage: 20,
+			}
+		},
+		"nodePools": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodePools = []api.NodePool{
+				{
+					Name:         "lvm",
+					NodeSelector: map[string]string{"pool": "lvm"},
+					DeviceMode:   api.DeviceModeLVM,
+				},
+				{
+					Name:           "direct",
+					NodeSelector:   map[string]string{"pool": "direct"},
+					DeviceMode:     api.DeviceModeDirect,
+					PMEMPercentage: 100,
+				},
+			}
+		},
 	}
 
 	full := api.PmemCSIDeployment{
@@ -218,5 +313,22 @@ func UpdateTests() []UpdateTest {
 		},
 	})
 
+	// Special case: remove -generated-
+	generatedDep := api.PmemCSIDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pmem-csi-with-generated-tls",
+		},
+		Spec: api.DeploymentSpec{
+			ControllerTLSSecret: api.ControllerTLSSecretGenerated,
+		},
+	}
+	tests = append(tests, UpdateTest{
+		Name:       "remove-generated",
+		Deployment: generatedDep,
+		Mutate: func(d *api.PmemCSIDeployment) {
+			d.Spec.ControllerTLSSecret = ""
+		},
+	})
+
 	return tests
 }
@@ -0,0 +1,277 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/scheduler"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// caValidity is the lifetime of a generated CA.
+	caValidity = 5 * 365 * 24 * time.Hour
+	// certValidity is the lifetime of a generated serving
+	// certificate. It gets limited further by the lifetime of
+	// the CA.
+	certValidity = 365 * 24 * time.Hour
+	// clockSkew is subtracted from the start of the validity
+	// period to allow for slightly different clocks in the
+	// cluster.
+	clockSkew = time.Hour
+)
+
+func controllerTLSGenerated(d *pmemCSIDeployment) bool {
+	return d.Spec.ControllerTLSSecret == api.ControllerTLSSecretGenerated
+}
+
+// renewalTime returns the time when a certificate gets replaced,
+// which is when one third of its lifetime is left.
+func renewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Add(-lifetime / 3)
+}
+
+// getControllerTLSSecret fills the secret with a CA and a serving
+// certificate for the controller. Existing certificates are kept
+// until they need to be renewed. The CA bundle also contains
+// previous CAs until they expire, so webhook calls keep working
+// while the controller still uses the old certificate.
+func (d *pmemCSIDeployment) getControllerTLSSecret(secret *corev1.Secret, now time.Time) error {
+	ca, caKey, renewal, err := fillTLSSecret(secret, "pmem-csi-ca-"+d.Name, "pmem-controller", d.controllerTLSHosts(), now)
+	if err != nil {
+		return err
+	}
+	d.controllerCA, d.controllerCAKey = ca, caKey
+	d.setTLSRenewal(renewal)
+	return nil
+}
+
+// GetWebhookTLSSecret fills the secret with a CA and a serving
+// certificate for the conversion webhook of the operator, the same way
+// as for the controller of a deployment. It returns the time when
+// it needs to be called again.
+func GetWebhookTLSSecret(secret *corev1.Secret, hosts []string, now time.Time) (time.Time, error) {
+	_, _, renewal, err := fillTLSSecret(secret, "pmem-csi-operator-ca", "pmem-csi-operator", hosts, now)
+	return renewal, err
+}
+
+// fillTLSSecret implements getControllerTLSSecret and
+// GetWebhookTLSSecret. It returns the CA and when the secret needs to
+// be renewed.
+func fillTLSSecret(secret *corev1.Secret, caName, certName string, hosts []string, now time.Time) (*x509.Certificate, crypto.Signer, time.Time, error) {
+	ca, caKey := parseKeyPair(secret.Data[api.TLSSecretCA], secret.Data[api.TLSSecretCAKey])
+	if ca == nil || !now.Before(renewalTime(ca)) || !ca.IsCA {
+		var err error
+		ca, caKey, err = newCertificate(nil, nil, now, caValidity, caName, nil, 0)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("create CA: %v", err)
+		}
+	}
+
+	cert, certKey := parseKeyPair(secret.Data[api.TLSSecretCert], secret.Data[api.TLSSecretKey])
+	if cert == nil ||
+		!now.Before(renewalTime(cert)) ||
+		cert.CheckSignatureFrom(ca) != nil ||
+		!reflect.DeepEqual(cert.DNSNames, hosts) {
+		var err error
+		cert, certKey, err = newCertificate(ca, caKey, now, certValidity, certName, hosts, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("create serving certificate: %v", err)
+		}
+	}
+
+	_, caKeyPEM, err := encodeKeyPair(ca, caKey)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	certPEM, certKeyPEM, err := encodeKeyPair(cert, certKey)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		api.TLSSecretCA:    caBundle(ca, secret.Data[api.TLSSecretCA], now),
+		api.TLSSecretCAKey: caKeyPEM,
+		api.TLSSecretCert:  certPEM,
+		api.TLSSecretKey:   certKeyPEM,
+	}
+
+	renewal := renewalTime(cert)
+	if caRenewal := renewalTime(ca); caRenewal.Before(renewal) {
+		renewal = caRenewal
+	}
+	return ca, caKey, renewal, nil
+}
+
+// getNodeTLSSecret fills the secret with a client certificate for the
+// node drivers and the CA bundle for verifying the controller. The
+// certificate gets signed by the CA from getControllerTLSSecret, which
+// must have been called first.
+func (d *pmemCSIDeployment) getNodeTLSSecret(secret *corev1.Secret, now time.Time) error {
+	if d.controllerCA == nil {
+		return fmt.Errorf("controller CA not available yet")
+	}
+	cert, certKey := parseKeyPair(secret.Data[api.TLSSecretCert], secret.Data[api.TLSSecretKey])
+	if cert == nil ||
+		!now.Before(renewalTime(cert)) ||
+		cert.CheckSignatureFrom(d.controllerCA) != nil {
+		var err error
+		cert, certKey, err = newCertificate(d.controllerCA, d.controllerCAKey, now, certValidity, scheduler.CapacityReporterName, nil, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return fmt.Errorf("create client certificate: %v", err)
+		}
+	}
+	certPEM, certKeyPEM, err := encodeKeyPair(cert, certKey)
+	if err != nil {
+		return err
+	}
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		api.TLSSecretCA:   d.controllerCABundle,
+		api.TLSSecretCert: certPEM,
+		api.TLSSecretKey:  certKeyPEM,
+	}
+	d.setTLSRenewal(renewalTime(cert))
+	return nil
+}
+
+// setTLSRenewal moves the time for renewing generated certificates
+// forward if needed.
+func (d *pmemCSIDeployment) setTLSRenewal(renewal time.Time) {
+	if d.controllerTLSRenewal.IsZero() || renewal.Before(d.controllerTLSRenewal) {
+		d.controllerTLSRenewal = renewal
+	}
+}
+
+// controllerTLSHosts returns the names under which the controller
+// gets contacted.
+func (d *pmemCSIDeployment) controllerTLSHosts() []string {
+	var hosts []string
+	for _, service := range []string{d.WebhooksServiceName(), d.SchedulerServiceName()} {
+		hosts = append(hosts,
+			service,
+			service+"."+d.namespace,
+			service+"."+d.namespace+".svc",
+		)
+	}
+	return hosts
+}
+
+// caBundle returns the CA followed by all other CAs in the old
+// bundle which have not expired yet.
+func caBundle(ca *x509.Certificate, oldBundle []byte, now time.Time) []byte {
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	for {
+		var block *pem.Block
+		block, oldBundle = pem.Decode(oldBundle)
+		if block == nil {
+			break
+		}
+		old, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || bytes.Equal(old.Raw, ca.Raw) || !now.Before(old.NotAfter) {
+			continue
+		}
+		bundle = append(bundle, pem.EncodeToMemory(block)...)
+	}
+	return bundle
+}
+
+// parseKeyPair returns the first certificate and the private key
+// or nil if they cannot be parsed or do not match.
+func parseKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil
+	}
+	return cert, key
+}
+
+// encodeKeyPair returns the PEM encoded certificate and key.
+func encodeKeyPair(cert *x509.Certificate, key crypto.Signer) (certPEM, keyPEM []byte, err error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode private key: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// newCertificate creates a new key and a certificate for it. Without
+// a parent, a self-signed CA is created. Otherwise the result is a
+// serving or client certificate for the hosts which is signed by the
+// parent.
+func newCertificate(parent *x509.Certificate, parentKey crypto.Signer, now time.Time, validity time.Duration, commonName string, hosts []string, usage x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		if usage == x509.ExtKeyUsageServerAuth {
+			template.DNSNames = hosts
+			// Used by kube-scheduler when it reaches the scheduler
+			// extender through a node port.
+			template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
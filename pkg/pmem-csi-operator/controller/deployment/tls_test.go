@@ -0,0 +1,140 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// parseBundle returns all certificates in a PEM bundle.
+func parseBundle(t *testing.T, data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err, "parse certificate")
+		certs = append(certs, cert)
+	}
+}
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	certs := parseBundle(t, data)
+	require.Len(t, certs, 1, "certificates")
+	return certs[0]
+}
+
+func TestTLSRotation(t *testing.T) {
+	d := &pmemCSIDeployment{
+		PmemCSIDeployment: &api.PmemCSIDeployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pmem-csi.intel.com",
+			},
+		},
+		namespace: "default",
+	}
+	controllerSecret := &corev1.Secret{}
+	nodeSecret := &corev1.Secret{}
+
+	// update generates the secrets like the reconcile loop does
+	// and checks that the certificates are usable.
+	update := func(t *testing.T, now time.Time) (ca, cert, nodeCert *x509.Certificate, bundle []*x509.Certificate) {
+		d.controllerTLSRenewal = time.Time{}
+		require.NoError(t, d.getControllerTLSSecret(controllerSecret, now), "controller secret")
+		d.controllerCABundle = controllerSecret.Data[api.TLSSecretCA]
+		require.NoError(t, d.getNodeTLSSecret(nodeSecret, now), "node secret")
+		assert.True(t, d.controllerTLSRenewal.After(now), "renewal after %s: %s", now, d.controllerTLSRenewal)
+
+		bundle = parseBundle(t, controllerSecret.Data[api.TLSSecretCA])
+		require.NotEmpty(t, bundle, "CA bundle")
+		ca = bundle[0]
+		assert.True(t, ca.Equal(d.controllerCA), "first CA in bundle is the current CA")
+		cert = parseCert(t, controllerSecret.Data[api.TLSSecretCert])
+		nodeCert = parseCert(t, nodeSecret.Data[api.TLSSecretCert])
+		assert.Equal(t, controllerSecret.Data[api.TLSSecretCA], nodeSecret.Data[api.TLSSecretCA], "node CA bundle")
+
+		roots := x509.NewCertPool()
+		for _, ca := range bundle {
+			roots.AddCert(ca)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			DNSName:     d.SchedulerServiceName() + "." + d.namespace + ".svc",
+			Roots:       roots,
+			CurrentTime: now,
+		})
+		assert.NoError(t, err, "verify controller certificate")
+		_, err = nodeCert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: now,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		assert.NoError(t, err, "verify node certificate")
+		return
+	}
+
+	start := time.Now()
+	ca1, cert1, nodeCert1, bundle := update(t, start)
+	assert.Len(t, bundle, 1, "initial CA bundle")
+
+	// Nothing changes while the certificates are young.
+	oldData := controllerSecret.Data
+	ca, cert, nodeCert, _ := update(t, start.Add(24*time.Hour))
+	assert.Equal(t, oldData, controllerSecret.Data, "controller secret after one day")
+	assert.True(t, ca.Equal(ca1), "CA after one day")
+	assert.True(t, cert.Equal(cert1), "certificate after one day")
+	assert.True(t, nodeCert.Equal(nodeCert1), "node certificate after one day")
+
+	// After 2/3 of the lifetime of the certificates, new ones
+	// get issued by the same CA.
+	now := renewalTime(cert1)
+	ca, cert2, nodeCert2, bundle := update(t, now)
+	assert.True(t, ca.Equal(ca1), "CA after certificate renewal")
+	assert.Len(t, bundle, 1, "CA bundle after certificate renewal")
+	assert.False(t, cert2.Equal(cert1), "certificate not renewed")
+	assert.False(t, nodeCert2.Equal(nodeCert1), "node certificate not renewed")
+	assert.True(t, cert2.NotAfter.After(cert1.NotAfter), "new certificate lives longer")
+
+	// After 2/3 of the lifetime of the CA, a new CA is created.
+	// The old one remains in the bundle because certificates
+	// signed by it are still in use.
+	now = renewalTime(ca1)
+	_, oldCert, _, _ := update(t, now.Add(-time.Minute))
+	ca2, cert3, _, bundle := update(t, now)
+	assert.False(t, ca2.Equal(ca1), "CA not renewed")
+	require.Len(t, bundle, 2, "CA bundle after CA renewal")
+	assert.True(t, bundle[1].Equal(ca1), "old CA in bundle")
+	assert.NoError(t, cert3.CheckSignatureFrom(ca2), "certificate signed by new CA")
+	roots := x509.NewCertPool()
+	for _, ca := range bundle {
+		roots.AddCert(ca)
+	}
+	_, err := oldCert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now,
+	})
+	assert.NoError(t, err, "old certificate accepted by new bundle")
+
+	// Expired CAs get removed from the bundle.
+	now = ca1.NotAfter
+	ca, _, _, bundle = update(t, now)
+	assert.True(t, ca.Equal(ca2), "CA after expiration of old CA")
+	assert.Len(t, bundle, 1, "CA bundle after expiration of old CA")
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/version"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// nodeUpgradeInterval determines how often the progress of an
+	// orchestrated node driver upgrade gets checked.
+	nodeUpgradeInterval = 10 * time.Second
+	// nodeUpgradeTimeout is the time that a replaced node driver
+	// pod has for becoming ready and registering the driver. The
+	// upgrade pauses when that time is exceeded.
+	nodeUpgradeTimeout = 5 * time.Minute
+)
+
+// runNodeUpgrades checks the progress of orchestrated node driver
+// upgrades periodically until the context is done. Like
+// runNodeStatus, it only runs in the leader.
+func (r *ReconcileDeployment) runNodeUpgrades(ctx context.Context) error {
+	wait.UntilWithContext(ctx, r.UpgradeNodes, nodeUpgradeInterval)
+	return nil
+}
+
+// UpgradeNodes advances the node driver upgrade of all deployments
+// which use the "Orchestrated" strategy and updates their status.
+func (r *ReconcileDeployment) UpgradeNodes(ctx context.Context) {
+	l := klog.FromContext(ctx).WithName("UpgradeNodes")
+
+	// Must not run in parallel to Reconcile, which also
+	// calls upgradeNodes.
+	r.reconcileMutex.Lock()
+	defer r.reconcileMutex.Unlock()
+
+	r.deploymentsMutex.Lock()
+	var names []string
+	for name, dep := range r.deployments {
+		if dep.DeletionTimestamp == nil {
+			names = append(names, name)
+		}
+	}
+	r.deploymentsMutex.Unlock()
+
+	for _, name := range names {
+		if err := r.upgradeNodes(ctx, name); err != nil {
+			l.Error(err, "upgrade node driver", "deployment", name)
+		}
+	}
+}
+
+func (r *ReconcileDeployment) upgradeNodes(ctx context.Context, name string) error {
+	dep := &api.PmemCSIDeployment{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: name}, dep); err != nil {
+		return fmt.Errorf("get deployment: %v", err)
+	}
+	org := dep.DeepCopy()
+	if err := dep.EnsureDefaults(r.containerImage); err != nil {
+		// Reconcile reports this.
+		return nil
+	}
+	if dep.Spec.NodeUpgradeStrategy != api.NodeUpgradeOrchestrated {
+		return nil
+	}
+	switch dep.Status.Phase {
+	case api.DeploymentPhaseRunning, api.DeploymentPhaseUpgrading:
+	default:
+		// Reconcile has not deployed the driver yet or failed.
+		return nil
+	}
+	d := &pmemCSIDeployment{
+		PmemCSIDeployment: dep,
+		namespace:         r.namespace,
+		k8sVersion:        r.k8sVersion,
+	}
+	upgrading, err := d.upgradeNodes(ctx, r)
+	if err != nil {
+		return err
+	}
+	d.setUpgradePhase(upgrading)
+	// Spec defaults must not get stored.
+	org.Spec.DeepCopyInto(&dep.Spec)
+	return r.patchDeploymentStatus(dep, client.MergeFrom(org))
+}
+
+// setUpgradePhase sets the phase of a deployment whose driver was
+// deployed successfully.
+func (d *pmemCSIDeployment) setUpgradePhase(upgrading bool) {
+	if upgrading {
+		d.Status.Phase = api.DeploymentPhaseUpgrading
+		d.Status.Reason = "Node driver pods are getting replaced"
+		return
+	}
+	d.Status.Phase = api.DeploymentPhaseRunning
+	d.Status.Reason = "All driver components are deployed successfully"
+}
+
+// nodeDaemonSetNames returns the names of all node driver DaemonSets.
+func (d *pmemCSIDeployment) nodeDaemonSetNames() []string {
+	if !nodePoolsEnabled(d) {
+		return []string{d.NodeDriverName()}
+	}
+	var names []string
+	for _, pool := range d.Spec.NodePools {
+		names = append(names, d.NodePoolDriverName(pool.Name))
+	}
+	return names
+}
+
+// checkVersionSkew compares the image of the running node driver pods
+// against the image that is about to be deployed. The DaemonSet is
+// not enough because with the "Orchestrated" strategy, pods of older
+// revisions may still be running. Images without a release version
+// tag are not checked.
+func (d *pmemCSIDeployment) checkVersionSkew(ctx context.Context, r *ReconcileDeployment) error {
+	to, ok := version.ImageVersion(d.Spec.Image)
+	if !ok {
+		return nil
+	}
+	for _, name := range d.nodeDaemonSetNames() {
+		ds := &appsv1.DaemonSet{}
+		if err := r.client.Get(ctx, client.ObjectKey{Namespace: d.namespace, Name: name}, ds); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("get node driver %s: %v", name, err)
+		}
+		pods := &corev1.PodList{}
+		if err := r.client.List(ctx, pods,
+			client.InNamespace(d.namespace),
+			client.MatchingLabels(ds.Spec.Selector.MatchLabels)); err != nil {
+			return fmt.Errorf("list pods of node driver %s: %v", name, err)
+		}
+		for _, pod := range pods.Items {
+			for _, container := range pod.Spec.Containers {
+				if container.Name != "pmem-driver" {
+					continue
+				}
+				from, ok := version.ImageVersion(container.Image)
+				if !ok {
+					continue
+				}
+				if err := version.CheckUpgrade(from, to); err != nil {
+					return fmt.Errorf("node driver %s: image %s of pod %s cannot be replaced with %s: %v", name, container.Image, pod.Name, d.Spec.Image, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeNodes replaces outdated node driver pods in batches when the
+// "Orchestrated" upgrade strategy is used. It returns true while pods
+// still need to be replaced. Progress gets recorded in the
+// NodeDriverUpgraded condition.
+//
+// Nodes with published volumes are not skipped: there are no
+// VolumeAttachments for PMEM-CSI volumes and the operator cannot
+// list pods and PVCs outside of its namespace. Published volumes
+// remain usable while the driver restarts.
+func (d *pmemCSIDeployment) upgradeNodes(ctx context.Context, r *ReconcileDeployment) (bool, error) {
+	// Pods which are not ready only block when they were replaced
+	// by an upgrade that is still in progress.
+	upgrading := false
+	for _, condition := range d.Status.Conditions {
+		if condition.Type == api.NodeDriverUpgraded {
+			upgrading = condition.Status == corev1.ConditionFalse
+		}
+	}
+	var progress []string
+	for _, name := range d.nodeDaemonSetNames() {
+		message, err := d.upgradeNodeDaemonSet(ctx, r, name, upgrading)
+		if err != nil {
+			return false, fmt.Errorf("upgrade node driver %s: %v", name, err)
+		}
+		if message != "" {
+			progress = append(progress, message)
+		}
+	}
+	if len(progress) == 0 {
+		d.SetCondition(api.NodeDriverUpgraded, corev1.ConditionTrue, "All node driver pods are up-to-date.")
+		return false, nil
+	}
+	d.SetCondition(api.NodeDriverUpgraded, corev1.ConditionFalse, strings.Join(progress, " "))
+	return true, nil
+}
+
+// upgradeNodeDaemonSet advances the upgrade of one DaemonSet by at
+// most one batch. It returns a description of the current state or an
+// empty string when all pods are up-to-date.
+func (d *pmemCSIDeployment) upgradeNodeDaemonSet(ctx context.Context, r *ReconcileDeployment, name string, upgrading bool) (string, error) {
+	l := klog.FromContext(ctx).WithName("upgradeNodes").WithValues("daemonset", name)
+
+	ds := &appsv1.DaemonSet{}
+	if err := r.client.Get(ctx, client.ObjectKey{Namespace: d.namespace, Name: name}, ds); err != nil {
+		if errors.IsNotFound(err) {
+			// Nothing to upgrade yet.
+			return "", nil
+		}
+		return "", err
+	}
+	if ds.Status.ObservedGeneration > 0 && ds.Status.ObservedGeneration < ds.Generation {
+		// The spec was changed and the DaemonSet controller has
+		// not created the new revision yet.
+		return fmt.Sprintf("%s: waiting for DaemonSet controller.", name), nil
+	}
+	hash, err := d.currentRevisionHash(ctx, r, ds)
+	if err != nil {
+		return "", err
+	}
+	if hash == "" {
+		// A new DaemonSet, no pods to replace.
+		return "", nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels(ds.Spec.Selector.MatchLabels)); err != nil {
+		return "", fmt.Errorf("list pods: %v", err)
+	}
+	var outdated, pending []*corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		switch {
+		case pod.Spec.NodeName == "":
+			// Not scheduled yet, handled by the DaemonSet controller.
+		case pod.DeletionTimestamp != nil:
+			pending = append(pending, pod)
+		case pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] != hash:
+			outdated = append(outdated, pod)
+		default:
+			registered, err := d.driverRegistered(ctx, r, pod.Spec.NodeName)
+			if err != nil {
+				return "", err
+			}
+			if !podIsReady(pod) || !registered {
+				pending = append(pending, pod)
+			}
+		}
+	}
+
+	if len(outdated) == 0 && !upgrading {
+		return "", nil
+	}
+	if len(pending) > 0 {
+		// Wait for the current batch, pause if it takes too long.
+		for _, pod := range pending {
+			if pod.DeletionTimestamp == nil && time.Since(pod.CreationTimestamp.Time) > nodeUpgradeTimeout {
+				reason := "driver not registered"
+				if !podIsReady(pod) {
+					reason = podNotReadyReason(pod)
+				}
+				return fmt.Sprintf("%s: paused, node driver on node %s not ready after %s: %s.",
+					name, pod.Spec.NodeName, nodeUpgradeTimeout, reason), nil
+			}
+		}
+		return fmt.Sprintf("%s: waiting for %d node driver pod(s), %d outdated.", name, len(pending), len(outdated)), nil
+	}
+	if missing := int(ds.Status.DesiredNumberScheduled) - len(pods.Items); missing > 0 {
+		// Replaced pods have not been recreated yet.
+		return fmt.Sprintf("%s: waiting for %d node driver pod(s), %d outdated.", name, missing, len(outdated)), nil
+	}
+	if len(outdated) == 0 {
+		return "", nil
+	}
+
+	// Nodes with fewer volumes go first.
+	volumes := map[string]int64{}
+	for _, node := range d.Status.Nodes {
+		if node.Capacity != nil {
+			volumes[node.NodeName] = node.Capacity.Volumes
+		}
+	}
+	sort.Slice(outdated, func(i, j int) bool {
+		a, b := outdated[i].Spec.NodeName, outdated[j].Spec.NodeName
+		if volumes[a] != volumes[b] {
+			return volumes[a] < volumes[b]
+		}
+		return a < b
+	})
+	batch := d.upgradeBatchSize(int(ds.Status.DesiredNumberScheduled))
+	if batch > len(outdated) {
+		batch = len(outdated)
+	}
+	var nodes []string
+	for _, pod := range outdated[:batch] {
+		l.V(2).Info("replacing node driver pod", "pod", klog.KObj(pod), "node", pod.Spec.NodeName)
+		if err := r.client.Delete(ctx, pod); err != nil && !errors.IsNotFound(err) {
+			return "", fmt.Errorf("delete pod %s: %v", pod.Name, err)
+		}
+		nodes = append(nodes, pod.Spec.NodeName)
+	}
+	return fmt.Sprintf("%s: replacing node driver on node(s) %s, %d outdated.",
+		name, strings.Join(nodes, ", "), len(outdated)-batch), nil
+}
+
+// currentRevisionHash returns the hash of the most recent
+// ControllerRevision of the DaemonSet, empty if there is none yet.
+func (d *pmemCSIDeployment) currentRevisionHash(ctx context.Context, r *ReconcileDeployment, ds *appsv1.DaemonSet) (string, error) {
+	revisions := &appsv1.ControllerRevisionList{}
+	if err := r.client.List(ctx, revisions,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels(ds.Spec.Selector.MatchLabels)); err != nil {
+		return "", fmt.Errorf("list controller revisions: %v", err)
+	}
+	var latest *appsv1.ControllerRevision
+	for i := range revisions.Items {
+		revision := &revisions.Items[i]
+		if !metav1.IsControlledBy(revision, ds) {
+			continue
+		}
+		if latest == nil || revision.Revision > latest.Revision {
+			latest = revision
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return latest.Labels[appsv1.DefaultDaemonSetUniqueLabelKey], nil
+}
+
+// driverRegistered checks whether kubelet on the node has registered
+// the driver in the CSINode object.
+func (d *pmemCSIDeployment) driverRegistered(ctx context.Context, r *ReconcileDeployment, nodeName string) (bool, error) {
+	csiNode := &storagev1.CSINode{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: nodeName}, csiNode); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("get CSINode %s: %v", nodeName, err)
+	}
+	for _, driver := range csiNode.Spec.Drivers {
+		if driver.Name == d.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// upgradeBatchSize determines how many pods may get replaced at once,
+// based on MaxUnavailable.
+func (d *pmemCSIDeployment) upgradeBatchSize(desired int) int {
+	maxUnavailable := intstr.FromInt(1)
+	if d.Spec.MaxUnavailable != nil {
+		maxUnavailable = *d.Spec.MaxUnavailable
+	}
+	batch, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, desired, true)
+	if err != nil || batch < 1 {
+		return 1
+	}
+	return batch
+}
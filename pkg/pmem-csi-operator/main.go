@@ -8,8 +8,11 @@ package pmemoperator
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
 
 	"github.com/intel/pmem-csi/pkg/apis"
@@ -19,8 +22,10 @@ import (
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
 
+	apiclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
@@ -40,8 +45,11 @@ var (
 	driverImage    = flag.String("image", "", "docker container image used for deploying the operator.")
 	leaderElection = flag.Bool("leader-election", false, "Enable leader election for controller manager. "+
 		"Enabling this will ensure there is only one active controller manager.")
-	metricsAddr = flag.String("metrics-addr", metrics.DefaultBindAddress, "The address the metric endpoint binds to. Use \"0\" to disable metrics.")
-	logFormat   = logger.NewFlag()
+	metricsAddr    = flag.String("metrics-addr", metrics.DefaultBindAddress, "The address the metric endpoint binds to. Use \"0\" to disable metrics.")
+	webhookCertDir = flag.String("webhook-cert-dir", "", "Directory with tls.crt and tls.key for the conversion webhook. The webhook is disabled if empty or if the files are missing.")
+	webhookPort    = flag.Int("webhook-port", 9443, "The port that the conversion webhook listens on.")
+	webhookService = flag.String("webhook-service", "", "The service for the conversion webhook in the operator namespace. If set, the operator generates the certificate for it, stores it in -webhook-cert-dir and injects the CA bundle into the CRD.")
+	logFormat      = logger.NewFlag()
 )
 
 func init() {
@@ -72,6 +80,8 @@ func Main() int {
 		LeaderElectionNamespace: namespace,
 		LeaderElectionID:        "pmem-csi-operator-lock",
 		MetricsBindAddress:      *metricsAddr,
+		Port:                    *webhookPort,
+		CertDir:                 *webhookCertDir,
 	})
 	if err != nil {
 		pmemcommon.ExitError("Failed to create controller manager: ", err)
@@ -98,6 +108,44 @@ func Main() int {
 		pmemcommon.ExitError("failed to get in-cluster client: %v", err)
 		return 1
 	}
+
+	if *webhookService != "" {
+		if *webhookCertDir == "" {
+			pmemcommon.ExitError("Invalid flags", errors.New("-webhook-service requires -webhook-cert-dir"))
+			return 1
+		}
+		crdClient, err := apiclient.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			pmemcommon.ExitError("failed to get CRD client: %v", err)
+			return 1
+		}
+		cert := &webhookCert{
+			client:    cs,
+			crdClient: crdClient,
+			namespace: namespace,
+			service:   *webhookService,
+			certDir:   *webhookCertDir,
+		}
+		renewal, err := cert.update(ctx)
+		if err != nil {
+			pmemcommon.ExitError("Failed to create conversion webhook certificate: ", err)
+			return 1
+		}
+		go cert.run(ctx, renewal)
+	}
+
+	// The conversion webhook serves the v1 API. It can only run
+	// when certificates were provided or generated.
+	if *webhookCertDir != "" && fileExists(filepath.Join(*webhookCertDir, "tls.crt")) {
+		if err := builder.WebhookManagedBy(mgr).For(&api.PmemCSIDeployment{}).Complete(); err != nil {
+			pmemcommon.ExitError("Failed to set up conversion webhook: ", err)
+			return 1
+		}
+		klog.Info("Conversion webhook enabled.")
+	} else {
+		klog.Info("No webhook certificates, conversion webhook disabled.")
+	}
+
 	// Setup all Controllers
 	if err := controller.AddToManager(ctx, mgr, controller.ControllerOptions{
 		Config:       mgr.GetConfig(),
@@ -138,3 +186,8 @@ func Main() int {
 
 	return 0
 }
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
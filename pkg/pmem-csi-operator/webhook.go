@@ -0,0 +1,168 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemoperator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
+
+	corev1 "k8s.io/api/core/v1"
+	apiclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// crdName is the CRD which gets the CA bundle of the conversion webhook.
+const crdName = "pmemcsideployments.pmem-csi.intel.com"
+
+// webhookCert generates the certificate for the conversion webhook.
+// It gets stored in a secret, so all replicas of the operator and
+// restarts use the same one, and written into the directory that
+// the webhook server reads from. The CA bundle gets injected into
+// the CRD.
+type webhookCert struct {
+	client    kubernetes.Interface
+	crdClient apiclient.Interface
+	namespace string
+	service   string
+	certDir   string
+}
+
+// secretName returns the name of the secret with the certificates.
+func (w *webhookCert) secretName() string {
+	return w.service + "-cert"
+}
+
+// update ensures that the certificate is valid and returns the time
+// when it needs to be renewed.
+func (w *webhookCert) update(ctx context.Context) (time.Time, error) {
+	var secret *corev1.Secret
+	var renewal time.Time
+	hosts := []string{
+		w.service,
+		w.service + "." + w.namespace,
+		w.service + "." + w.namespace + ".svc",
+	}
+	// Another replica might be doing the same thing, in which
+	// case we retry with the secret created by it.
+	if err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		secret, err = w.client.CoreV1().Secrets(w.namespace).Get(ctx, w.secretName(), metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		switch {
+		case create:
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      w.secretName(),
+					Namespace: w.namespace,
+				},
+			}
+		case err != nil:
+			return fmt.Errorf("get secret %s: %v", w.secretName(), err)
+		}
+		oldData := secret.Data
+		renewal, err = deployment.GetWebhookTLSSecret(secret, hosts, time.Now())
+		if err != nil {
+			return err
+		}
+		switch {
+		case create:
+			secret, err = w.client.CoreV1().Secrets(w.namespace).Create(ctx, secret, metav1.CreateOptions{})
+		case !sameData(oldData, secret.Data):
+			secret, err = w.client.CoreV1().Secrets(w.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		}
+		return err
+	}); err != nil {
+		return time.Time{}, fmt.Errorf("update secret %s: %v", w.secretName(), err)
+	}
+
+	for _, file := range []string{api.TLSSecretCert, api.TLSSecretKey} {
+		if err := writeFile(filepath.Join(w.certDir, file), secret.Data[file]); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"conversion": map[string]interface{}{
+				"webhook": map[string]interface{}{
+					"clientConfig": map[string]interface{}{
+						"caBundle": secret.Data[api.TLSSecretCA],
+						"service": map[string]interface{}{
+							"namespace": w.namespace,
+							"name":      w.service,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := w.crdClient.ApiextensionsV1().CustomResourceDefinitions().Patch(ctx, crdName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return time.Time{}, fmt.Errorf("inject CA bundle into CRD %s: %v", crdName, err)
+	}
+	return renewal, nil
+}
+
+// run renews the certificate until the context is done.
+func (w *webhookCert) run(ctx context.Context, renewal time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(renewal)):
+		}
+		next, err := w.update(ctx)
+		if err != nil {
+			klog.Errorf("Renewing the conversion webhook certificate failed: %v", err)
+			next = time.Now().Add(time.Minute)
+		} else {
+			klog.Infof("Renewed the conversion webhook certificate, next renewal at %s.", next)
+		}
+		renewal = next
+	}
+}
+
+func sameData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if string(b[key]) != string(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFile replaces the file atomically, so the webhook server
+// never reads a partially written file.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemoperator
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWebhookCert(t *testing.T) {
+	ctx := context.Background()
+	crd := &apiextensions.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: crdName,
+		},
+		Spec: apiextensions.CustomResourceDefinitionSpec{
+			Conversion: &apiextensions.CustomResourceConversion{
+				Strategy: apiextensions.WebhookConverter,
+				Webhook: &apiextensions.WebhookConversion{
+					ClientConfig: &apiextensions.WebhookClientConfig{
+						Service: &apiextensions.ServiceReference{
+							Namespace: "pmem-csi",
+							Name:      "pmem-csi-operator-webhook",
+						},
+					},
+					ConversionReviewVersions: []string{"v1"},
+				},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset()
+	crdClient := crdfake.NewSimpleClientset(crd)
+	certDir := t.TempDir()
+	w := &webhookCert{
+		client:    client,
+		crdClient: crdClient,
+		namespace: "operator-namespace",
+		service:   "pmem-csi-operator-webhook",
+		certDir:   certDir,
+	}
+
+	check := func() map[string][]byte {
+		renewal, err := w.update(ctx)
+		require.NoError(t, err, "update")
+		assert.True(t, renewal.After(time.Now()), "renewal in the future")
+
+		secret, err := client.CoreV1().Secrets(w.namespace).Get(ctx, w.secretName(), metav1.GetOptions{})
+		require.NoError(t, err, "get secret")
+		for _, file := range []string{api.TLSSecretCert, api.TLSSecretKey} {
+			data, err := os.ReadFile(filepath.Join(certDir, file))
+			require.NoError(t, err, "read %s", file)
+			assert.Equal(t, string(secret.Data[file]), string(data), "content of %s", file)
+		}
+
+		crd, err := crdClient.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, crdName, metav1.GetOptions{})
+		require.NoError(t, err, "get CRD")
+		clientConfig := crd.Spec.Conversion.Webhook.ClientConfig
+		assert.Equal(t, string(secret.Data[api.TLSSecretCA]), string(clientConfig.CABundle), "CA bundle")
+		assert.Equal(t, w.namespace, clientConfig.Service.Namespace, "service namespace")
+		assert.Equal(t, w.service, clientConfig.Service.Name, "service name")
+
+		block, _ := pem.Decode(secret.Data[api.TLSSecretCert])
+		require.NotNil(t, block, "PEM certificate")
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err, "parse certificate")
+		pool := x509.NewCertPool()
+		require.True(t, pool.AppendCertsFromPEM(clientConfig.CABundle), "parse CA bundle")
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName: "pmem-csi-operator-webhook.operator-namespace.svc",
+			Roots:   pool,
+		})
+		assert.NoError(t, err, "verify certificate")
+		return secret.Data
+	}
+
+	first := check()
+	// A restart must not replace the certificate.
+	second := check()
+	assert.Equal(t, first, second, "secret after second update")
+}
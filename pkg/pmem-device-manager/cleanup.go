@@ -0,0 +1,198 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// Cleanup removes all volumes of the driver on the node together
+// with the driver state and then records that in the
+// "<driver name>/cleanup" annotation of the node, using the token as
+// value. It is used when a driver gets uninstalled although volumes
+// still exist.
+func Cleanup(ctx context.Context, client kubernetes.Interface, driverName, nodeName string, mode api.DeviceMode, instance, statePath, token string) error {
+	ctx, _ = pmemlog.WithName(ctx, "Cleanup")
+
+	// Zero percentage ensures that no new namespaces get created
+	// while initializing LVM mode.
+	dm, err := New(ctx, mode, 0, instance)
+	if err != nil {
+		return fmt.Errorf("initialize device manager: %v", err)
+	}
+	if err := cleanup(ctx, dm, mount.New(""), statePath); err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				driverName + "/" + api.CleanupKey: token,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}, ""); err != nil {
+		return fmt.Errorf("annotate node %s: %v", nodeName, err)
+	}
+	return nil
+}
+
+// cleanup unmounts everything below the state directory, then deletes
+// the devices of the driver instance and the content of the state
+// directory.
+func cleanup(ctx context.Context, dm PmemDeviceManager, mounter mount.Interface, statePath string) error {
+	logger := klog.FromContext(ctx)
+
+	// Volumes may still be mounted in the state directory. Those
+	// mounts must be gone before deleting the devices and the
+	// directories.
+	if statePath != "" {
+		statePath = filepath.Clean(statePath)
+		if err := unmountBelow(ctx, mounter, statePath); err != nil {
+			return err
+		}
+	}
+
+	devices, err := dm.ListDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("list volumes: %v", err)
+	}
+	if dm.GetMode() != api.DeviceModeLVM {
+		// The volume groups in LVM mode belong to the driver
+		// instance, but in direct mode ListDevices returns all
+		// namespaces, including those of other driver instances
+		// and of other users.
+		devices, err = ownedDevices(dm.GetMode(), statePath, devices)
+		if err != nil {
+			return err
+		}
+	}
+	for _, device := range devices {
+		logger.Info("Deleting volume", "volume", device.VolumeId, "size", pmemlog.CapacityRef(int64(device.Size)))
+		// Erase the data, as DeleteVolume does by default.
+		if err := dm.DeleteDevice(ctx, device.VolumeId, true); err != nil {
+			return fmt.Errorf("delete volume %s: %v", device.VolumeId, err)
+		}
+	}
+
+	if statePath == "" {
+		return nil
+	}
+	// The directory itself is a host path volume, only its content
+	// can be removed.
+	entries, err := os.ReadDir(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read state directory: %v", err)
+	}
+	// RemoveAll would also delete files inside a mount point.
+	// Check once more that nothing got mounted in the meantime.
+	mounts, err := mountsBelow(mounter, statePath)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("not removing driver state, still mounted: %s", strings.Join(mounts, ", "))
+	}
+	for _, entry := range entries {
+		path := filepath.Join(statePath, entry.Name())
+		logger.V(3).Info("Removing driver state", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("remove driver state: %v", err)
+		}
+	}
+	logger.Info("Removed all volumes", "count", len(devices))
+	return nil
+}
+
+// ownedDevices returns those devices which are recorded in the state
+// directory of the driver instance.
+func ownedDevices(mode api.DeviceMode, statePath string, devices []*PmemDeviceInfo) ([]*PmemDeviceInfo, error) {
+	if statePath == "" {
+		return nil, fmt.Errorf("cannot identify volumes of the driver instance in %s mode without state directory", mode)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("check state directory: %v", err)
+	}
+	sm, err := pmemstate.NewFileState(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("load state: %v", err)
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("load state: %v", err)
+	}
+	owned := map[string]bool{}
+	for _, id := range ids {
+		owned[id] = true
+	}
+	var result []*PmemDeviceInfo
+	for _, device := range devices {
+		if owned[device.VolumeId] {
+			result = append(result, device)
+		}
+	}
+	return result, nil
+}
+
+// unmountBelow unmounts everything below the directory, but not the
+// directory itself. Nested mounts get unmounted first.
+func unmountBelow(ctx context.Context, mounter mount.Interface, dir string) error {
+	logger := klog.FromContext(ctx)
+	mounts, err := mountsBelow(mounter, dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range mounts {
+		logger.Info("Unmounting", "path", path)
+		if err := mounter.Unmount(path); err != nil {
+			return fmt.Errorf("unmount %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// mountsBelow returns all mount points below the directory, with
+// nested mount points before their parents.
+func mountsBelow(mounter mount.Interface, dir string) ([]string, error) {
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return nil, fmt.Errorf("list mounts: %v", err)
+	}
+	var mounts []string
+	for _, mp := range mountPoints {
+		if strings.HasPrefix(mp.Path, dir+"/") {
+			mounts = append(mounts, mp.Path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(mounts)))
+	return mounts, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/mount"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestCleanup(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := newFake(100)
+	require.NoError(t, err, "create fake device manager")
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		_, err := dm.CreateDevice(ctx, name, 1024*1024, parameters.UsageAppDirect)
+		require.NoError(t, err, "create device %s", name)
+	}
+
+	statePath := t.TempDir()
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		require.NoError(t, os.WriteFile(filepath.Join(statePath, name+".json"), []byte("{}"), 0600), "write state file %s", name)
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(statePath, "mount", "pvc-1"), 0700), "create mount directory")
+
+	require.NoError(t, cleanup(ctx, dm, &mount.FakeMounter{}, statePath), "cleanup")
+
+	devices, err := dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Empty(t, devices, "devices")
+	entries, err := os.ReadDir(statePath)
+	require.NoError(t, err, "state directory must still exist")
+	assert.Empty(t, entries, "state directory content")
+
+	// Idempotent, also without state directory.
+	require.NoError(t, cleanup(ctx, dm, &mount.FakeMounter{}, filepath.Join(statePath, "no-such-dir")), "second cleanup")
+}
+
+func TestCleanupForeign(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := newFake(100)
+	require.NoError(t, err, "create fake device manager")
+	// "foreign" stands for a namespace that was created by some
+	// other driver instance or manually.
+	for _, name := range []string{"pvc-1", "foreign"} {
+		_, err := dm.CreateDevice(ctx, name, 1024*1024, parameters.UsageAppDirect)
+		require.NoError(t, err, "create device %s", name)
+	}
+	statePath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(statePath, "pvc-1.json"), []byte("{}"), 0600), "write state file")
+
+	require.NoError(t, cleanup(ctx, dm, &mount.FakeMounter{}, statePath), "cleanup")
+	devices, err := dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	require.Len(t, devices, 1, "devices")
+	assert.Equal(t, "foreign", devices[0].VolumeId, "remaining device")
+
+	// Without state, nothing belongs to the driver instance.
+	require.NoError(t, cleanup(ctx, dm, &mount.FakeMounter{}, filepath.Join(statePath, "no-such-dir")), "cleanup without state")
+	devices, err = dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Len(t, devices, 1, "devices after cleanup without state")
+
+	// The state is needed to identify volumes.
+	err = cleanup(ctx, dm, &mount.FakeMounter{}, "")
+	require.Error(t, err, "cleanup without state directory")
+	devices, err = dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Len(t, devices, 1, "devices after failed cleanup")
+}
+
+func TestCleanupMounted(t *testing.T) {
+	setup := func(t *testing.T) (PmemDeviceManager, string, *mount.FakeMounter) {
+		dm, err := newFake(100)
+		require.NoError(t, err, "create fake device manager")
+		_, ctx := ktesting.NewTestContext(t)
+		_, err = dm.CreateDevice(ctx, "pvc-1", 1024*1024, parameters.UsageAppDirect)
+		require.NoError(t, err, "create device")
+
+		// The fake mounter resolves symlinks.
+		statePath, err := filepath.EvalSymlinks(t.TempDir())
+		require.NoError(t, err, "resolve state path")
+		require.NoError(t, os.WriteFile(filepath.Join(statePath, "pvc-1.json"), []byte("{}"), 0600), "write state file")
+		for _, dir := range []string{"mount/pvc-1/data", "shared/pvc-2"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(statePath, dir), 0700), "create %s", dir)
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(statePath, "mount/pvc-1/data/file"), []byte("hello"), 0600), "write file")
+		mounter := &mount.FakeMounter{
+			MountPoints: []mount.MountPoint{
+				// The state directory itself is a host path volume.
+				{Path: statePath},
+				{Path: filepath.Join(statePath, "mount/pvc-1")},
+				{Path: filepath.Join(statePath, "mount/pvc-1/data")},
+				{Path: filepath.Join(statePath, "shared/pvc-2")},
+				{Path: statePath + "-other"},
+			},
+		}
+		return dm, statePath, mounter
+	}
+
+	t.Run("unmount", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, statePath, mounter := setup(t)
+		var unmounted []string
+		mounter.UnmountFunc = func(path string) error {
+			unmounted = append(unmounted, path)
+			return nil
+		}
+
+		require.NoError(t, cleanup(ctx, dm, mounter, statePath), "cleanup")
+		assert.Equal(t, []string{
+			filepath.Join(statePath, "shared/pvc-2"),
+			filepath.Join(statePath, "mount/pvc-1/data"),
+			filepath.Join(statePath, "mount/pvc-1"),
+		}, unmounted, "unmounted, nested mounts first")
+		mounts, err := mounter.List()
+		require.NoError(t, err, "list mounts")
+		assert.Equal(t, []mount.MountPoint{{Path: statePath}, {Path: statePath + "-other"}}, mounts, "remaining mounts")
+		devices, err := dm.ListDevices(ctx)
+		require.NoError(t, err, "list devices")
+		assert.Empty(t, devices, "devices")
+		entries, err := os.ReadDir(statePath)
+		require.NoError(t, err, "state directory must still exist")
+		assert.Empty(t, entries, "state directory content")
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, statePath, mounter := setup(t)
+		mounter.UnmountFunc = func(path string) error {
+			return errors.New("device is busy")
+		}
+
+		err := cleanup(ctx, dm, mounter, statePath)
+		require.Error(t, err, "cleanup")
+		assert.Contains(t, err.Error(), "device is busy", "error")
+		// Nothing got deleted.
+		devices, err := dm.ListDevices(ctx)
+		require.NoError(t, err, "list devices")
+		assert.Len(t, devices, 1, "devices")
+		_, err = os.Stat(filepath.Join(statePath, "mount/pvc-1/data/file"))
+		assert.NoError(t, err, "file in mounted directory")
+	})
+}
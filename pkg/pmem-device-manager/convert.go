@@ -32,7 +32,7 @@ const (
 // force-converts them to fsdax + LVM volume group, then modifies the
 // node labels such that the normal driver runs instead of this
 // special one-time operation.
-func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface, driverName string, nodeSelector types.NodeSelector, nodeName string) (finalErr error) {
+func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface, driverName, instance string, nodeSelector types.NodeSelector, nodeName string) (finalErr error) {
 	ctx, _ = pmemlog.WithName(ctx, "ForceConvertRawNamespaces")
 	defer func() {
 		if finalErr == nil {
@@ -52,11 +52,11 @@ func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface,
 		return fmt.Errorf("ndctl: %v", err)
 	}
 
-	if _, err := convert(ctx, ndctx); err != nil {
+	if _, err := convert(ctx, ndctx, instance); err != nil {
 		return err
 	}
 
-	if err := havePMEM(ctx, ndctx); err != nil {
+	if err := havePMEM(ctx, ndctx, instance); err != nil {
 		return err
 	}
 
@@ -66,7 +66,7 @@ func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface,
 	return nil
 }
 
-func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalErr error) {
+func convert(ctx context.Context, ndctx ndctl.Context, instance string) (numConverted int, finalErr error) {
 	ctx, logger := pmemlog.WithName(ctx, "convert")
 	defer func() {
 		if finalErr != nil {
@@ -85,7 +85,7 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 				logger.V(3).Info("skipped because read-only")
 				continue
 			}
-			vgName := pmemcommon.VgName(bus, region)
+			vgName := pmemcommon.VgName(instance, bus, region)
 			for _, namespace := range region.AllNamespaces() {
 				logger.V(3).Info("checking", "namespace", namespace)
 				size := namespace.Size()
@@ -119,7 +119,7 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 					// preparing a node as required by PMEM-CSI and then forcing
 					// conversion skips the unnecessary conversion and handles such
 					// a node normally.
-					if namespace.Name() == pmemCSINamespaceName {
+					if namespace.Name() == pmemcommon.NamespaceName(instance) {
 						continue
 					}
 					// Otherwise we must have the right volume group for it.
@@ -142,7 +142,7 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 	return
 }
 
-func havePMEM(ctx context.Context, ndctx ndctl.Context) error {
+func havePMEM(ctx context.Context, ndctx ndctl.Context, instance string) error {
 	ctx, logger := pmemlog.WithName(ctx, "havePMEM")
 
 	haveFsdaxWithName := 0
@@ -155,13 +155,13 @@ func havePMEM(ctx context.Context, ndctx ndctl.Context) error {
 				logger.V(3).Info("Skipped because read-only")
 				continue
 			}
-			vgName := pmemcommon.VgName(bus, region)
+			vgName := pmemcommon.VgName(instance, bus, region)
 			for _, namespace := range region.AllNamespaces() {
 				logger.V(5).Info("Checking namespace", "namespace", namespace)
 				size := namespace.Size()
 				if size > 0 &&
 					namespace.Mode() == ndctl.FsdaxMode &&
-					namespace.Name() == pmemCSINamespaceName {
+					namespace.Name() == pmemcommon.NamespaceName(instance) {
 					logger.V(3).Info("Namespace will be used by PMEM-CSI in LVM mode because of name", "namespace", namespace)
 					haveFsdaxWithName++
 				}
@@ -90,6 +90,18 @@ case "$*" in
        exit 1
        ;;
 esac
+`
+
+	vgCreateInstance := `#!/bin/sh
+case "$*" in
+    --force\ second-bus0region0fsdax\ /dev/pmem0)
+       exit 0
+       ;;
+    *)
+       echo >&2 "unexpected invocation: $*"
+       exit 1
+       ;;
+esac
 `
 
 	vgExtendOkay := `#!/bin/sh
@@ -117,6 +129,7 @@ esac
 `
 	testcases := map[string]struct {
 		hardware    ndctl.Context
+		instance    string
 		scripts     map[string]string
 		expectError bool
 		expectNum   int
@@ -160,6 +173,22 @@ esac
 				return hardware
 			}(),
 		},
+		"fsdax-namespace-of-other-instance": {
+			hardware: func() ndctl.Context {
+				hardware := makeRawNamespace()
+				region := hardware.Buses[0].(*ndctlfake.Bus).Regions_[0].(*ndctlfake.Region)
+				ns := region.Namespaces_[0].(*ndctlfake.Namespace)
+				ns.Mode_ = ndctl.FsdaxMode
+				ns.Name_ = "pmem-csi"
+				return hardware
+			}(),
+			instance: "second",
+			scripts: map[string]string{
+				"pvs":      pvsNone,
+				"vgcreate": vgCreateInstance,
+			},
+			expectNum: 1,
+		},
 		"deleted-namespace": {
 			hardware: func() ndctl.Context {
 				hardware := makeRawNamespace()
@@ -300,7 +329,7 @@ esac
 
 			_, ctx := ktesting.NewTestContext(t)
 
-			numConverted, err := convert(ctx, tc.hardware)
+			numConverted, err := convert(ctx, tc.hardware, tc.instance)
 			if tc.expectError {
 				assert.Error(t, err)
 			} else {
@@ -35,6 +35,11 @@ var (
 		"Total amount of PMEM on the host.",
 		nil, nil,
 	)
+	pmemVolumesDesc = prometheus.NewDesc(
+		"pmem_volumes",
+		"Number of PMEM volumes on the host.",
+		nil, nil,
+	)
 )
 
 // NodeLabel is a label used for Prometheus which identifies the
@@ -42,11 +47,17 @@ var (
 const NodeLabel = "node"
 
 // CapacityCollector is a wrapper around a PMEM device manager which
-// takes GetCapacity values and turns them into metrics data.
+// takes GetCapacity values and turns them into metrics data. If the
+// device manager can also list devices, the number of volumes is
+// reported, too.
 type CapacityCollector struct {
 	PmemDeviceCapacity
 }
 
+type pmemDeviceLister interface {
+	ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error)
+}
+
 // MustRegister adds the collector to the registry, using labels to tag each sample with node and driver name.
 func (cc CapacityCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
 	labels := prometheus.Labels{
@@ -91,6 +102,18 @@ func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(capacity.Total),
 	)
+
+	if lister, ok := cc.PmemDeviceCapacity.(pmemDeviceLister); ok {
+		devices, err := lister.ListDevices(ctx)
+		if err != nil {
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(
+			pmemVolumesDesc,
+			prometheus.GaugeValue,
+			float64(len(devices)),
+		)
+	}
 }
 
 var _ prometheus.Collector = CapacityCollector{}
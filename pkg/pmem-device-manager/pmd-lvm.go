@@ -22,9 +22,6 @@ import (
 const (
 	// 4 MB alignment is used by LVM
 	lvmAlign uint64 = 4 * 1024 * 1024
-
-	// special alt name that a namespace must have to be managed by PMEM-CSI.
-	pmemCSINamespaceName = "pmem-csi"
 )
 
 type pmemLvm struct {
@@ -44,7 +41,7 @@ var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_f
 var lvmMutex = &sync.Mutex{}
 
 // NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
-func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
+func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint, instance string) (PmemDeviceManager, error) {
 	ctx, logger := pmemlog.WithName(ctx, "LVM-New")
 
 	if pmemPercentage > 100 {
@@ -62,16 +59,16 @@ func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDevi
 	volumeGroups := []string{}
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
-			vgName := pmemcommon.VgName(bus, r)
+			vgName := pmemcommon.VgName(instance, bus, r)
 			if r.Type() != ndctl.PmemRegion {
 				logger.Info("Region is not suitable for fsdax, skipping it", "id", r.ID(), "device", r.DeviceName())
 				continue
 			}
 
-			if err := setupNS(ctx, r, pmemPercentage); err != nil {
+			if _, err := setupNS(ctx, r, pmemPercentage, instance); err != nil {
 				return nil, err
 			}
-			if err := setupVG(ctx, r, vgName); err != nil {
+			if err := setupVG(ctx, r, vgName, instance); err != nil {
 				return nil, err
 			}
 			if _, err := pmemexec.RunCommand(ctx, "vgs", vgName); err != nil {
@@ -325,8 +322,37 @@ func getVolumeGroups(ctx context.Context, groups []string) ([]vgInfo, error) {
 }
 
 // setupNS checks if a namespace needs to be created in the region and if so, does that.
-func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
+// It returns true if a namespace was created.
+func setupNS(ctx context.Context, r ndctl.Region, percentage uint, instance string) (bool, error) {
 	ctx, logger := pmemlog.WithName(ctx, "setupNS")
+	canUse := namespaceSize(ctx, r, percentage, instance)
+	if canUse > 0 {
+		logger.V(3).Info("Create fsdax namespace", "size", pmemlog.CapacityRef(int64(canUse)))
+		ns, err := r.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
+			Name: pmemcommon.NamespaceName(instance),
+			Mode: "fsdax",
+			Size: canUse,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to create PMEM namespace with size '%d' in region '%s': %v", canUse, r.DeviceName(), err)
+		}
+		// Wipe out any old filesystem or LVM signatures. Without this we might get
+		// duplicate volume groups when accidentally restoring a namespace that existed
+		// before and was used in a volume group. This is not idempotent, but hopefully
+		// it'll never fail or if it does, can be skipped when the driver tries again.
+		if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", "/dev/"+ns.BlockDeviceName()); err != nil {
+			return true, fmt.Errorf("failed to wipe new namespace: %v", err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// namespaceSize determines the size of the namespace that setupNS
+// needs to create in the region, zero if none.
+func namespaceSize(ctx context.Context, r ndctl.Region, percentage uint, instance string) uint64 {
+	logger := klog.FromContext(ctx)
 	canUse := uint64(percentage) * r.Size() / 100
 	logger.V(3).Info("Checking region for fsdax namespaces",
 		"region", r.DeviceName(),
@@ -335,7 +361,7 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 		"available", pmemlog.CapacityRef(int64(r.AvailableSize())),
 		"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())),
 		"may-use", pmemlog.CapacityRef(int64(canUse)))
-	// Subtract sizes of existing active namespaces with currently handled mode and owned by pmem-csi
+	// Subtract sizes of existing active namespaces with currently handled mode and owned by the driver instance
 	for _, ns := range r.ActiveNamespaces() {
 		logger.V(3).Info("Existing namespace",
 			"usable-size", pmemlog.CapacityRef(int64(ns.Size())),
@@ -343,7 +369,7 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 			"mode", ns.Mode(),
 			"device", ns.DeviceName(),
 			"name", ns.Name())
-		if ns.Name() != pmemCSINamespaceName {
+		if ns.Name() != pmemcommon.NamespaceName(instance) {
 			continue
 		}
 		used := ns.RawSize()
@@ -366,31 +392,12 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 			"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())))
 		canUse = r.MaxAvailableExtent()
 	}
-	if canUse > 0 {
-		logger.V(3).Info("Create fsdax namespace", "size", pmemlog.CapacityRef(int64(canUse)))
-		ns, err := r.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
-			Name: "pmem-csi",
-			Mode: "fsdax",
-			Size: canUse,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to create PMEM namespace with size '%d' in region '%s': %v", canUse, r.DeviceName(), err)
-		}
-		// Wipe out any old filesystem or LVM signatures. Without this we might get
-		// duplicate volume groups when accidentally restoring a namespace that existed
-		// before and was used in a volume group. This is not idempotent, but hopefully
-		// it'll never fail or if it does, can be skipped when the driver tries again.
-		if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", "/dev/"+ns.BlockDeviceName()); err != nil {
-			return fmt.Errorf("failed to wipe new namespace: %v", err)
-		}
-	}
-
-	return nil
+	return canUse
 }
 
-// setupVG ensures that all namespaces with name "pmem-csi" in the region
+// setupVG ensures that all namespaces of the driver instance in the region
 // are part of the volume group.
-func setupVG(ctx context.Context, r ndctl.Region, vgName string) error {
+func setupVG(ctx context.Context, r ndctl.Region, vgName, instance string) error {
 	ctx, logger := pmemlog.WithName(ctx, "setupVG")
 	nsArray := r.ActiveNamespaces()
 	if len(nsArray) == 0 {
@@ -400,7 +407,7 @@ func setupVG(ctx context.Context, r ndctl.Region, vgName string) error {
 	var devNames []string
 	for _, ns := range nsArray {
 		// consider only namespaces having name given by this driver, to exclude foreign ones
-		if ns.Name() == pmemCSINamespaceName {
+		if ns.Name() == pmemcommon.NamespaceName(instance) {
 			devName := "/dev/" + ns.BlockDeviceName()
 			devNames = append(devNames, devName)
 		}
@@ -97,12 +97,14 @@ type PmemDeviceManager interface {
 }
 
 // New creates a new device manager for the given mode and percentage.
-func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint) (PmemDeviceManager, error) {
+// The instance name determines which namespaces and volume groups
+// are used in LVM mode, see pmemcommon.NamespaceName.
+func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint, instance string) (PmemDeviceManager, error) {
 	switch mode {
 	case api.DeviceModeFake:
 		return newFake(pmemPercentage)
 	case api.DeviceModeLVM:
-		return newPmemDeviceManagerLVM(ctx, pmemPercentage)
+		return newPmemDeviceManagerLVM(ctx, pmemPercentage, instance)
 	case api.DeviceModeDirect:
 		return newPmemDeviceManagerNdctl(ctx, pmemPercentage)
 	default:
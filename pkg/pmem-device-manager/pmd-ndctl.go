@@ -13,6 +13,7 @@ import (
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/ndctl"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 
 	"k8s.io/utils/mount"
@@ -249,6 +250,11 @@ func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, erro
 
 	devices := []*PmemDeviceInfo{}
 	for _, ns := range ndctl.GetAllNamespaces(ndctx) {
+		// Namespaces for LVM mode are not volumes and may belong
+		// to some other driver instance.
+		if pmemcommon.IsNamespaceName(ns.Name()) {
+			continue
+		}
 		devices = append(devices, namespaceToPmemInfo(ns))
 	}
 	return devices, nil
@@ -0,0 +1,231 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+	"github.com/intel/pmem-csi/pkg/types"
+)
+
+// SetupOptions determines what PmemSetup does.
+type SetupOptions struct {
+	// ConvertRawNamespaces converts all raw namespaces into fsdax
+	// namespaces for LVM.
+	ConvertRawNamespaces bool
+	// CreateNamespaces creates fsdax namespaces for LVM in the
+	// free space of each region.
+	CreateNamespaces bool
+	// ReservePercentage of each region is not used by CreateNamespaces.
+	ReservePercentage uint
+	// DryRun only determines what would be done.
+	DryRun bool
+	// Instance is the name of the driver instance which owns the
+	// namespaces and volume groups.
+	Instance string
+}
+
+// PmemSetup prepares PMEM on the node for LVM mode, stores the result
+// in the "<driver name>/pmem-setup" annotation of the node and then,
+// unless it was a dry run, modifies the node labels such that the
+// node driver runs instead of the setup pod.
+func PmemSetup(ctx context.Context, client kubernetes.Interface, driverName string, nodeSelector types.NodeSelector, nodeName string, opts SetupOptions) error {
+	ctx, logger := pmemlog.WithName(ctx, "PmemSetup")
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	status, setupErr := setup(ctx, ndctx, opts)
+	if err := annotate(ctx, client, driverName, nodeName, status); err != nil {
+		if setupErr != nil {
+			return fmt.Errorf("%v; annotate node %s: %v", setupErr, nodeName, err)
+		}
+		return fmt.Errorf("annotate node %s: %v", nodeName, err)
+	}
+	if setupErr != nil {
+		return setupErr
+	}
+	if opts.DryRun {
+		logger.Info("Dry run done, node not modified", "actions", status.Actions)
+		return nil
+	}
+
+	labels := types.NodeSelector{
+		driverName + "/" + api.PmemSetupKey: api.PmemSetupDone,
+	}
+	for key, value := range nodeSelector {
+		labels[key] = value
+	}
+	if err := relabel(ctx, client, driverName, labels, nodeName); err != nil {
+		return fmt.Errorf("relabel node %s: %v", nodeName, err)
+	}
+	return nil
+}
+
+// setupAction is one modification of the PMEM configuration.
+type setupAction struct {
+	description string
+	condition   api.NodeSetupConditionType
+}
+
+// setup determines which modifications are needed and, unless in a
+// dry run, executes them. The status is filled in also when an error
+// is returned.
+func setup(ctx context.Context, ndctx ndctl.Context, opts SetupOptions) (*api.NodeSetupStatus, error) {
+	ctx, logger := pmemlog.WithName(ctx, "setup")
+	status := &api.NodeSetupStatus{
+		DryRun: opts.DryRun,
+	}
+
+	// Everything gets planned before touching anything.
+	actions := planSetup(ctx, ndctx, opts)
+	counts := map[api.NodeSetupConditionType]int{}
+	for _, action := range actions {
+		status.Actions = append(status.Actions, action.description)
+		counts[action.condition]++
+	}
+	logger.V(2).Info("Planned", "actions", status.Actions)
+
+	if opts.DryRun {
+		if opts.ConvertRawNamespaces {
+			setSetupCondition(status, api.RawNamespacesConverted, corev1.ConditionUnknown,
+				fmt.Sprintf("Dry run: %d raw namespace(s) would be converted.", counts[api.RawNamespacesConverted]))
+		}
+		if opts.CreateNamespaces {
+			setSetupCondition(status, api.NamespacesCreated, corev1.ConditionUnknown,
+				fmt.Sprintf("Dry run: %d namespace(s) would be created.", counts[api.NamespacesCreated]))
+		}
+		return status, nil
+	}
+
+	if opts.ConvertRawNamespaces {
+		numConverted, err := convert(ctx, ndctx, opts.Instance)
+		if err != nil {
+			setSetupCondition(status, api.RawNamespacesConverted, corev1.ConditionFalse, err.Error())
+			return status, err
+		}
+		setSetupCondition(status, api.RawNamespacesConverted, corev1.ConditionTrue,
+			fmt.Sprintf("%d namespace(s) converted.", numConverted))
+	}
+	if opts.CreateNamespaces {
+		numCreated, err := createNamespaces(ctx, ndctx, opts.ReservePercentage, opts.Instance)
+		if err != nil {
+			setSetupCondition(status, api.NamespacesCreated, corev1.ConditionFalse,
+				fmt.Sprintf("%d namespace(s) created, then failed: %v", numCreated, err))
+			return status, err
+		}
+		setSetupCondition(status, api.NamespacesCreated, corev1.ConditionTrue,
+			fmt.Sprintf("%d namespace(s) created.", numCreated))
+	}
+
+	if err := havePMEM(ctx, ndctx, opts.Instance); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// planSetup returns the modifications that setup would make.
+func planSetup(ctx context.Context, ndctx ndctl.Context, opts SetupOptions) []setupAction {
+	var actions []setupAction
+	for _, bus := range ndctx.GetBuses() {
+		for _, region := range bus.ActiveRegions() {
+			if region.Readonly() {
+				continue
+			}
+			if opts.ConvertRawNamespaces {
+				for _, namespace := range region.AllNamespaces() {
+					if namespace.Size() <= 0 || namespace.Mode() != ndctl.RawMode {
+						continue
+					}
+					actions = append(actions, setupAction{
+						description: fmt.Sprintf("convert raw namespace %s of size %s in region %s to fsdax, DESTROYS ITS DATA",
+							namespace.DeviceName(), pmemlog.CapacityRef(int64(namespace.Size())), region.DeviceName()),
+						condition: api.RawNamespacesConverted,
+					})
+				}
+			}
+			if opts.CreateNamespaces && region.Type() == ndctl.PmemRegion {
+				if size := namespaceSize(ctx, region, 100-opts.ReservePercentage, opts.Instance); size > 0 {
+					actions = append(actions, setupAction{
+						description: fmt.Sprintf("create fsdax namespace of size %s in region %s",
+							pmemlog.CapacityRef(int64(size)), region.DeviceName()),
+						condition: api.NamespacesCreated,
+					})
+				}
+			}
+		}
+	}
+	return actions
+}
+
+// createNamespaces creates namespaces and volume groups for LVM mode
+// in all suitable regions. It returns the number of namespaces that
+// were created, also when failing.
+func createNamespaces(ctx context.Context, ndctx ndctl.Context, reservePercentage uint, instance string) (numCreated int, err error) {
+	for _, bus := range ndctx.GetBuses() {
+		for _, region := range bus.ActiveRegions() {
+			if region.Readonly() || region.Type() != ndctl.PmemRegion {
+				continue
+			}
+			created, err := setupNS(ctx, region, 100-reservePercentage, instance)
+			if created {
+				numCreated++
+			}
+			if err != nil {
+				return numCreated, err
+			}
+			if err := setupVG(ctx, region, pmemcommon.VgName(instance, bus, region), instance); err != nil {
+				return numCreated, err
+			}
+		}
+	}
+	return numCreated, nil
+}
+
+func setSetupCondition(status *api.NodeSetupStatus, t api.NodeSetupConditionType, state corev1.ConditionStatus, reason string) {
+	status.Conditions = append(status.Conditions, api.NodeSetupCondition{
+		Type:           t,
+		Status:         state,
+		Reason:         reason,
+		LastUpdateTime: metav1.Now(),
+	})
+}
+
+func annotate(ctx context.Context, client kubernetes.Interface, driverName, nodeName string, status *api.NodeSetupStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("encode status: %v", err)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				driverName + "/" + api.PmemSetupKey: string(value),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}, ""); err != nil {
+		return fmt.Errorf("failed to patch node: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestSetupDryRun(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+
+	// makeFreeSpace adds a second region with free space.
+	makeFreeSpace := func() *ndctlfake.Context {
+		hardware := makeRawNamespace()
+		bus := hardware.Buses[0].(*ndctlfake.Bus)
+		bus.Regions_ = append(bus.Regions_,
+			&ndctlfake.Region{
+				Type_:               ndctl.PmemRegion,
+				DeviceName_:         "region1",
+				Enabled_:            true,
+				Size_:               10 * gib,
+				AvailableSize_:      10 * gib,
+				MaxAvailableExtent_: 10 * gib,
+			})
+		return hardware
+	}
+
+	testcases := map[string]struct {
+		hardware         ndctl.Context
+		opts             SetupOptions
+		expectActions    int
+		expectConditions map[api.NodeSetupConditionType]string
+	}{
+		"nop": {
+			hardware: makeFreeSpace(),
+		},
+		"convert": {
+			hardware: makeFreeSpace(),
+			opts: SetupOptions{
+				ConvertRawNamespaces: true,
+			},
+			expectActions: 1,
+			expectConditions: map[api.NodeSetupConditionType]string{
+				api.RawNamespacesConverted: "Dry run: 1 raw namespace(s) would be converted.",
+			},
+		},
+		"create": {
+			hardware: makeFreeSpace(),
+			opts: SetupOptions{
+				CreateNamespaces: true,
+			},
+			expectActions: 1,
+			expectConditions: map[api.NodeSetupConditionType]string{
+				api.NamespacesCreated: "Dry run: 1 namespace(s) would be created.",
+			},
+		},
+		"reserve-all": {
+			hardware: makeFreeSpace(),
+			opts: SetupOptions{
+				CreateNamespaces:  true,
+				ReservePercentage: 100,
+			},
+			expectConditions: map[api.NodeSetupConditionType]string{
+				api.NamespacesCreated: "Dry run: 0 namespace(s) would be created.",
+			},
+		},
+		"readonly-region": {
+			hardware: func() ndctl.Context {
+				hardware := makeRawNamespace()
+				hardware.Buses[0].(*ndctlfake.Bus).Regions_[0].(*ndctlfake.Region).Readonly_ = true
+				return hardware
+			}(),
+			opts: SetupOptions{
+				ConvertRawNamespaces: true,
+				CreateNamespaces:     true,
+			},
+			expectConditions: map[api.NodeSetupConditionType]string{
+				api.RawNamespacesConverted: "Dry run: 0 raw namespace(s) would be converted.",
+				api.NamespacesCreated:      "Dry run: 0 namespace(s) would be created.",
+			},
+		},
+		"both": {
+			hardware: makeFreeSpace(),
+			opts: SetupOptions{
+				ConvertRawNamespaces: true,
+				CreateNamespaces:     true,
+			},
+			expectActions: 2,
+			expectConditions: map[api.NodeSetupConditionType]string{
+				api.RawNamespacesConverted: "Dry run: 1 raw namespace(s) would be converted.",
+				api.NamespacesCreated:      "Dry run: 1 namespace(s) would be created.",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+
+			// No fake commands: a dry run must not invoke any.
+			t.Setenv("PATH", t.TempDir())
+			opts := tc.opts
+			opts.DryRun = true
+			status, err := setup(ctx, tc.hardware, opts)
+			require.NoError(t, err)
+			assert.True(t, status.DryRun, "dry run")
+			assert.Len(t, status.Actions, tc.expectActions, "actions")
+			conditions := map[api.NodeSetupConditionType]string{}
+			for _, condition := range status.Conditions {
+				assert.Equal(t, corev1.ConditionUnknown, condition.Status, "condition status")
+				conditions[condition.Type] = condition.Reason
+			}
+			if tc.expectConditions == nil {
+				tc.expectConditions = map[api.NodeSetupConditionType]string{}
+			}
+			assert.Equal(t, tc.expectConditions, conditions, "conditions")
+		})
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client := fake.NewSimpleClientset(makeNode("worker", nil))
+	status := &api.NodeSetupStatus{
+		DryRun:  true,
+		Actions: []string{"something"},
+	}
+	require.NoError(t, annotate(ctx, client, "pmem-csi", "worker", status))
+
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	value, ok := node.Annotations["pmem-csi/"+api.PmemSetupKey]
+	require.True(t, ok, "annotation")
+	var actual api.NodeSetupStatus
+	require.NoError(t, json.Unmarshal([]byte(value), &actual), "decode annotation")
+	assert.Equal(t, *status, actual)
+
+	assert.Error(t, annotate(ctx, client, "pmem-csi", "no-such-node", status), "missing node")
+}
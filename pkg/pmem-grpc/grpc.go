@@ -1,7 +1,9 @@
 package pmemgrpc
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -10,6 +12,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -134,27 +137,47 @@ func ServerTLS(ctx context.Context, caCert, cert, key []byte, peerName string) (
 		return nil, err
 	}
 
-	return serverConfig(ctx, certPool, &certificate, peerName), nil
+	certs := func() (*x509.CertPool, *tls.Certificate) {
+		return certPool, &certificate
+	}
+	return serverConfig(ctx, certs, peerName), nil
 }
 
 // LoadServerTLS prepares the TLS configuration needed for a server with the given certificate files.
 // peerName is either the name that the client is expected to have a certificate for or empty,
-// in which case any client is allowed to connect.
+// in which case any client is allowed to connect. Client certificates are then still verified
+// against the CA if one is given.
+//
+// The files are read again when they change, so certificates can be
+// replaced without restarting the server. If reading them fails, the
+// previous certificates remain in use.
 func LoadServerTLS(ctx context.Context, caFile, certFile, keyFile, peerName string) (*tls.Config, error) {
-	certPool, peerCert, err := loadCertificate(caFile, certFile, keyFile)
-	if err != nil {
+	loader := &certLoader{
+		logger:   klog.FromContext(ctx).WithName("certLoader"),
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := loader.load(); err != nil {
 		return nil, err
 	}
-	return serverConfig(ctx, certPool, peerCert, peerName), nil
+	return serverConfig(ctx, loader.get, peerName), nil
 }
 
-func serverConfig(ctx context.Context, certPool *x509.CertPool, peerCert *tls.Certificate, peerName string) *tls.Config {
+func serverConfig(ctx context.Context, certs func() (*x509.CertPool, *tls.Certificate), peerName string) *tls.Config {
 	logger := klog.FromContext(ctx).WithName("serverConfig").WithValues("peername", peerName)
 	return &tls.Config{
+		// Only used to satisfy http.Server.ServeTLS, the actual
+		// configuration comes from GetConfigForClient.
+		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			_, peerCert := certs()
+			return peerCert, nil
+		},
 		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
 			if info == nil {
 				return nil, errors.New("nil client info passed")
 			}
+			certPool, peerCert := certs()
 			ciphers := []uint16{}
 			for _, c := range info.CipherSuites {
 				// filter out all insecure ciphers from client offered list
@@ -210,8 +233,13 @@ func serverConfig(ctx context.Context, certPool *x509.CertPool, peerCert *tls.Ce
 					return fmt.Errorf("certificate is not signed for %q hostname", peerName)
 				},
 			}
-			if peerName != "" {
+			switch {
+			case peerName != "":
 				config.ClientAuth = tls.RequireAndVerifyClientCert
+			case certPool != nil:
+				// Clients may authenticate themselves, which
+				// then gets checked by the request handler.
+				config.ClientAuth = tls.VerifyClientCertIfGiven
 			}
 			return config, nil
 		},
@@ -260,20 +288,44 @@ func clientConfig(certPool *x509.CertPool, peerCert *tls.Certificate, peerName s
 }
 
 func loadCertificate(caFile, certFile, keyFile string) (certPool *x509.CertPool, peerCert *tls.Certificate, err error) {
-	if certFile != "" || keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return nil, nil, err
+	ca, cert, key, err := readCertificateFiles(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseCertificate(caFile, ca, cert, key)
+}
+
+// readCertificateFiles returns the content of the files. Files with
+// empty names are skipped.
+func readCertificateFiles(caFile, certFile, keyFile string) (ca, cert, key []byte, err error) {
+	for _, f := range []struct {
+		name string
+		data *[]byte
+	}{
+		{caFile, &ca},
+		{certFile, &cert},
+		{keyFile, &key},
+	} {
+		if f.name == "" {
+			continue
+		}
+		if *f.data, err = ioutil.ReadFile(f.name); err != nil {
+			return nil, nil, nil, err
 		}
-		peerCert = &cert
 	}
+	return
+}
 
-	if caFile != "" {
-		caCert, err := ioutil.ReadFile(caFile)
+func parseCertificate(caFile string, caCert, cert, key []byte) (certPool *x509.CertPool, peerCert *tls.Certificate, err error) {
+	if cert != nil || key != nil {
+		cert, err := tls.X509KeyPair(cert, key)
 		if err != nil {
 			return nil, nil, err
 		}
+		peerCert = &cert
+	}
 
+	if caCert != nil {
 		certPool = x509.NewCertPool()
 		if ok := certPool.AppendCertsFromPEM(caCert); !ok {
 			return nil, nil, fmt.Errorf("failed to append certs from %s", caFile)
@@ -283,6 +335,61 @@ func loadCertificate(caFile, certFile, keyFile string) (certPool *x509.CertPool,
 	return
 }
 
+// certLoader reads certificate files and parses them again when their
+// content changes. Comparing a hash of the content instead of the
+// modification time also detects updates which happen within the
+// granularity of the file system timestamps. Kubernetes updates the
+// files of a secret volume by replacing a symlink, which gets detected
+// because reading follows symlinks.
+type certLoader struct {
+	logger                    klog.Logger
+	caFile, certFile, keyFile string
+
+	mutex    sync.Mutex
+	hash     []byte
+	certPool *x509.CertPool
+	peerCert *tls.Certificate
+}
+
+// load reads the files and parses them if they have changed since the
+// last call.
+func (l *certLoader) load() error {
+	ca, cert, key, err := readCertificateFiles(l.caFile, l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	for _, data := range [][]byte{ca, cert, key} {
+		// The length prefix keeps the content of different files apart.
+		fmt.Fprintf(h, "%d:", len(data))
+		h.Write(data)
+	}
+	hash := h.Sum(nil)
+	if bytes.Equal(hash, l.hash) {
+		return nil
+	}
+	certPool, peerCert, err := parseCertificate(l.caFile, ca, cert, key)
+	if err != nil {
+		return err
+	}
+	if l.hash != nil {
+		l.logger.Info("Reloaded certificates", "certFile", l.certFile)
+	}
+	l.hash, l.certPool, l.peerCert = hash, certPool, peerCert
+	return nil
+}
+
+// get returns the most recent certificates.
+func (l *certLoader) get() (*x509.CertPool, *tls.Certificate) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		// Might be a partial update, try again next time.
+		l.logger.Error(err, "Reloading certificates failed, continuing with the previous ones")
+	}
+	return l.certPool, l.peerCert
+}
+
 func parseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
 		s := strings.SplitN(ep, "://", 2)
@@ -0,0 +1,220 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemgrpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+// keyPair contains PEM encoded CA, certificate and key.
+type keyPair struct {
+	ca, cert, key []byte
+}
+
+// newKeyPair creates a new CA and a certificate signed by it.
+func newKeyPair(t *testing.T, commonName string) keyPair {
+	newCert := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err, "generate key")
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		require.NoError(t, err, "create certificate")
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err, "parse certificate")
+		return cert, key
+	}
+	now := time.Now()
+	ca, caKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	cert, key := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err, "encode key")
+	return keyPair{
+		ca:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeKeyPair stores the files in a new directory and points the
+// "..data" symlink in dir at it, like kubelet does for secret volumes.
+func writeKeyPair(t *testing.T, dir string, pair keyPair) {
+	dataDir, err := os.MkdirTemp(dir, "..data-")
+	require.NoError(t, err, "create data directory")
+	for name, data := range map[string][]byte{
+		"ca.crt":  pair.ca,
+		"tls.crt": pair.cert,
+		"tls.key": pair.key,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, name), data, 0600), "write %s", name)
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			require.NoError(t, os.Symlink(filepath.Join("..data", name), link), "symlink %s", name)
+		}
+	}
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	require.NoError(t, os.Symlink(filepath.Base(dataDir), tmpLink), "symlink data")
+	require.NoError(t, os.Rename(tmpLink, filepath.Join(dir, "..data")), "replace data")
+}
+
+// tlsPipe returns both ends of a TLS connection over loopback TCP.
+// net.Pipe would block in Close because it has no buffering.
+func tlsPipe(t *testing.T, clientConfig, serverConfig *tls.Config) (*tls.Conn, *tls.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "listen")
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dial")
+	server, err := listener.Accept()
+	require.NoError(t, err, "accept")
+	return tls.Client(client, clientConfig), tls.Server(server, serverConfig)
+}
+
+// serverCert returns the certificate that a new connection gets.
+func serverCert(t *testing.T, config *tls.Config) *x509.Certificate {
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err, "GetConfigForClient")
+	require.Len(t, clientConfig.Certificates, 1, "certificates")
+	cert, err := x509.ParseCertificate(clientConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err, "parse server certificate")
+	return cert
+}
+
+func TestLoadServerTLS(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	_, err := LoadServerTLS(ctx, caFile, certFile, keyFile, "")
+	assert.Error(t, err, "missing files")
+
+	writeKeyPair(t, dir, newKeyPair(t, "first"))
+	config, err := LoadServerTLS(ctx, caFile, certFile, keyFile, "")
+	require.NoError(t, err, "LoadServerTLS")
+	assert.Equal(t, "first", serverCert(t, config).Subject.CommonName, "initial certificate")
+	assert.Equal(t, "first", serverCert(t, config).Subject.CommonName, "unchanged certificate")
+
+	// Replacing the secret content gets detected.
+	second := newKeyPair(t, "second")
+	writeKeyPair(t, dir, second)
+	assert.Equal(t, "second", serverCert(t, config).Subject.CommonName, "reloaded certificate")
+
+	// Broken files are ignored.
+	writeKeyPair(t, dir, keyPair{ca: second.ca, cert: []byte("broken"), key: second.key})
+	assert.Equal(t, "second", serverCert(t, config).Subject.CommonName, "certificate after broken update")
+
+	// Modifying the files in place also gets detected.
+	third := newKeyPair(t, "third")
+	for file, data := range map[string][]byte{
+		caFile:   third.ca,
+		certFile: third.cert,
+		keyFile:  third.key,
+	} {
+		require.NoError(t, os.WriteFile(file, data, 0600), "rewrite %s", file)
+	}
+	assert.Equal(t, "third", serverCert(t, config).Subject.CommonName, "certificate after modification")
+
+	// The CA also gets updated.
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err, "GetConfigForClient")
+	expected := x509.NewCertPool()
+	require.True(t, expected.AppendCertsFromPEM(third.ca), "parse CA")
+	assert.True(t, expected.Equal(clientConfig.ClientCAs), "client CAs")
+
+	// Rewriting the files with content of the same size and
+	// keeping the modification time also gets detected.
+	var fifth keyPair
+	for i := 0; ; i++ {
+		require.Less(t, i, 1000, "generate key pair with the same size")
+		fifth = newKeyPair(t, "fifth")
+		if len(fifth.ca) == len(third.ca) && len(fifth.cert) == len(third.cert) && len(fifth.key) == len(third.key) {
+			break
+		}
+	}
+	for file, data := range map[string][]byte{
+		caFile:   fifth.ca,
+		certFile: fifth.cert,
+		keyFile:  fifth.key,
+	} {
+		info, err := os.Stat(file)
+		require.NoError(t, err, "stat %s", file)
+		require.NoError(t, os.WriteFile(file, data, 0600), "rewrite %s", file)
+		require.NoError(t, os.Chtimes(file, info.ModTime(), info.ModTime()), "restore modification time of %s", file)
+	}
+	assert.Equal(t, "fifth", serverCert(t, config).Subject.CommonName, "certificate after same-size modification")
+}
+
+func TestLoadServerTLSHandshake(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dir := t.TempDir()
+	first := newKeyPair(t, "pmem-controller")
+	writeKeyPair(t, dir, first)
+	serverConfig, err := LoadServerTLS(ctx, filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "pmem-controller")
+	require.NoError(t, err, "LoadServerTLS")
+
+	handshake := func(pair keyPair) error {
+		clientConfig, err := ClientTLS(pair.ca, pair.cert, pair.key, "pmem-controller")
+		require.NoError(t, err, "ClientTLS")
+		client, server := tlsPipe(t, clientConfig, serverConfig)
+		defer client.Close()
+		defer server.Close()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.Handshake()
+		}()
+		clientErr := client.Handshake()
+		serverErr := <-errs
+		if clientErr != nil {
+			return clientErr
+		}
+		return serverErr
+	}
+
+	require.NoError(t, handshake(first), "handshake with first certificate")
+
+	// After rotating the certificates, clients with the new CA
+	// and certificate get accepted and old ones get rejected.
+	second := newKeyPair(t, "pmem-controller")
+	writeKeyPair(t, dir, second)
+	assert.NoError(t, handshake(second), "handshake with second certificate")
+	assert.Error(t, handshake(first), "handshake with first certificate after rotation")
+}
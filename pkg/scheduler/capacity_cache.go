@@ -0,0 +1,204 @@
+/*
+Copyright 2022 Intel Corp.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CapacityReporterName is the common name in the client certificate
+// that node drivers must present when sending capacity reports.
+const CapacityReporterName = "pmem-csi-node"
+
+// CapacityReport is the information that a node driver pushes to the
+// controller via HTTP POST whenever its capacity changes and
+// periodically as heartbeat.
+type CapacityReport struct {
+	// DriverName must match the name of the driver instance that
+	// the controller is responsible for.
+	DriverName string `json:"driverName"`
+	// NodeName identifies the node.
+	NodeName string `json:"nodeName"`
+	// MaxVolumeSize is the size of the largest volume that can be
+	// created on the node.
+	MaxVolumeSize int64 `json:"maxVolumeSize"`
+	// Available is the sum of all PMEM that could be used for volumes.
+	Available int64 `json:"available"`
+	// Managed is all PMEM that is managed by the driver.
+	Managed int64 `json:"managed"`
+	// Total is all PMEM found by the driver.
+	Total int64 `json:"total"`
+}
+
+// CapacityCacheEntry is a report together with the time when it was received.
+type CapacityCacheEntry struct {
+	CapacityReport
+	Received time.Time
+}
+
+// CapacityCache is an in-memory cache of the most recent capacity
+// reports sent by node drivers. It implements the Capacity interface
+// and serves as HTTP handler for incoming reports.
+type CapacityCache struct {
+	driverName string
+	maxAge     time.Duration
+	fallback   Capacity
+	now        func() time.Time
+
+	// publish is set by ShareViaLeases and makes a new report
+	// available to other controller replicas.
+	publish func(ctx context.Context, entry CapacityCacheEntry) error
+
+	mutex sync.Mutex
+	nodes map[string]CapacityCacheEntry
+}
+
+var _ Capacity = &CapacityCache{}
+var _ http.Handler = &CapacityCache{}
+
+// NewCapacityCache creates an empty cache. Reports older than maxAge
+// are ignored (zero disables expiration). When there is no current
+// report for a node, the optional fallback is used instead, for
+// example node drivers which predate capacity reporting.
+func NewCapacityCache(driverName string, maxAge time.Duration, fallback Capacity) *CapacityCache {
+	return &CapacityCache{
+		driverName: driverName,
+		maxAge:     maxAge,
+		fallback:   fallback,
+		now:        time.Now,
+		nodes:      map[string]CapacityCacheEntry{},
+	}
+}
+
+// NodeCapacity implements the Capacity interface.
+func (c *CapacityCache) NodeCapacity(nodeName string) (int64, error) {
+	if entry, ok := c.get(nodeName); ok {
+		return entry.MaxVolumeSize, nil
+	}
+	if c.fallback != nil {
+		return c.fallback.NodeCapacity(nodeName)
+	}
+	// Node not known or report is stale.
+	return 0, nil
+}
+
+// Update stores a new report. It must be for the driver instance
+// that the cache was created for.
+func (c *CapacityCache) Update(report CapacityReport) error {
+	_, err := c.update(report)
+	return err
+}
+
+func (c *CapacityCache) update(report CapacityReport) (CapacityCacheEntry, error) {
+	if report.DriverName != c.driverName {
+		return CapacityCacheEntry{}, fmt.Errorf("report for driver %q, expected %q", report.DriverName, c.driverName)
+	}
+	if report.NodeName == "" {
+		return CapacityCacheEntry{}, errors.New("node name missing in report")
+	}
+
+	entry := CapacityCacheEntry{
+		CapacityReport: report,
+		Received:       c.now(),
+	}
+	c.set(entry)
+	return entry, nil
+}
+
+// set stores the entry unless the cache already has a more recent
+// one for the node.
+func (c *CapacityCache) set(entry CapacityCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if existing, ok := c.nodes[entry.NodeName]; ok && existing.Received.After(entry.Received) {
+		return
+	}
+	c.nodes[entry.NodeName] = entry
+}
+
+// Entries returns all reports which have not expired yet, sorted by node name.
+func (c *CapacityCache) Entries() []CapacityCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var entries []CapacityCacheEntry
+	for _, entry := range c.nodes {
+		if c.isFresh(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NodeName < entries[j].NodeName
+	})
+	return entries
+}
+
+func (c *CapacityCache) get(nodeName string) (CapacityCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.nodes[nodeName]
+	if !ok || !c.isFresh(entry) {
+		return CapacityCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *CapacityCache) isFresh(entry CapacityCacheEntry) bool {
+	return c.maxAge == 0 || c.now().Sub(entry.Received) <= c.maxAge
+}
+
+// ServeHTTP accepts a JSON-encoded CapacityReport via POST. The
+// request must come from a client with a verified certificate for
+// CapacityReporterName.
+func (c *CapacityCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isCapacityReporter(r) {
+		http.Error(w, "client certificate for "+CapacityReporterName+" required", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, r.Method+" not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var report CapacityReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, fmt.Sprintf("decode capacity report: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry, err := c.update(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.publish != nil {
+		if err := c.publish(r.Context(), entry); err != nil {
+			// The node driver tries again with its next report.
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isCapacityReporter checks the client certificate. It must have been
+// verified by the TLS server, which is only the case when the server
+// was configured with a CA for client certificates.
+func isCapacityReporter(r *http.Request) bool {
+	if r.TLS == nil ||
+		len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName == CapacityReporterName
+}
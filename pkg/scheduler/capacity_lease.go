@@ -0,0 +1,147 @@
+/*
+Copyright 2022 Intel Corp.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// capacityLeaseLabel marks the Lease objects with capacity
+	// reports. The value is the driver name.
+	capacityLeaseLabel = "pmem-csi.intel.com/capacity-report"
+	// capacityLeaseAnnotation contains the JSON-encoded report.
+	capacityLeaseAnnotation = "pmem-csi.intel.com/capacity-report"
+)
+
+// ShareViaLeases makes reports visible in all controller replicas.
+// Node drivers send their reports through a Service, so each report
+// reaches only one replica. That replica stores the report in a Lease
+// object for the node in the namespace and all replicas watch those
+// objects. It must be called before the cache receives reports and
+// returns once the existing reports are known.
+func (c *CapacityCache) ShareViaLeases(ctx context.Context, client kubernetes.Interface, namespace string) error {
+	logger := klog.FromContext(ctx).WithName("CapacityCache")
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.Set{capacityLeaseLabel: c.driverName}.String()
+		}),
+	)
+	leases := factory.Coordination().V1().Leases()
+	leases.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.storeLease(logger, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.storeLease(logger, newObj)
+		},
+	})
+	lister := leases.Lister().Leases(namespace)
+	leaseClient := client.CoordinationV1().Leases(namespace)
+
+	c.publish = func(ctx context.Context, entry CapacityCacheEntry) error {
+		data, err := json.Marshal(entry.CapacityReport)
+		if err != nil {
+			return fmt.Errorf("encode report: %v", err)
+		}
+		name := capacityLeaseName(c.driverName, entry.NodeName)
+		lease, err := lister.Get(name)
+		exists := err == nil
+		switch {
+		case apierrors.IsNotFound(err):
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+					Labels:    map[string]string{capacityLeaseLabel: c.driverName},
+				},
+			}
+		case err != nil:
+			return fmt.Errorf("get lease %s: %v", name, err)
+		default:
+			lease = lease.DeepCopy()
+		}
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[capacityLeaseAnnotation] = string(data)
+		lease.Spec.HolderIdentity = &entry.NodeName
+		lease.Spec.RenewTime = &metav1.MicroTime{Time: entry.Received}
+		if c.maxAge > 0 {
+			seconds := int32(c.maxAge / time.Second)
+			lease.Spec.LeaseDurationSeconds = &seconds
+		}
+		if !exists {
+			_, err = leaseClient.Create(ctx, lease, metav1.CreateOptions{})
+		} else {
+			_, err = leaseClient.Update(ctx, lease, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("store report in lease %s: %v", name, err)
+		}
+		return nil
+	}
+
+	factory.Start(ctx.Done())
+	for t, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync informer for type %v", t)
+		}
+	}
+	logger.V(3).Info("Sharing capacity reports", "namespace", namespace)
+	return nil
+}
+
+// storeLease adds the report from a Lease to the cache.
+func (c *CapacityCache) storeLease(logger klog.Logger, obj interface{}) {
+	lease, ok := obj.(*coordinationv1.Lease)
+	if !ok || lease.Spec.RenewTime == nil {
+		return
+	}
+	var report CapacityReport
+	if err := json.Unmarshal([]byte(lease.Annotations[capacityLeaseAnnotation]), &report); err != nil {
+		logger.Error(err, "Invalid capacity report", "lease", klog.KObj(lease))
+		return
+	}
+	if report.DriverName != c.driverName || report.NodeName == "" {
+		logger.Error(nil, "Unexpected capacity report", "lease", klog.KObj(lease), "report", report)
+		return
+	}
+	c.set(CapacityCacheEntry{
+		CapacityReport: report,
+		Received:       lease.Spec.RenewTime.Time,
+	})
+}
+
+// capacityLeaseName returns the name of the Lease object for the node.
+func capacityLeaseName(driverName, nodeName string) string {
+	prefix := strings.ReplaceAll(driverName, ".", "-") + "-capacity-"
+	if len(prefix+nodeName) <= validation.DNS1123SubdomainMaxLength {
+		return prefix + nodeName
+	}
+	// Node names can be as long as the maximum length of the
+	// object name.
+	hash := sha256.Sum256([]byte(nodeName))
+	return prefix + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Intel Corp.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// NodeCapacity returns the current capacity of the node. Only the
+// capacity fields of the report need to be filled in.
+type NodeCapacity func(ctx context.Context) (CapacityReport, error)
+
+// CapacityReporter runs on the node and pushes the current capacity
+// to the CapacityCache of the controller.
+type CapacityReporter struct {
+	url        string
+	tlsConfig  func() (*tls.Config, error)
+	interval   time.Duration
+	driverName string
+	nodeName   string
+	capacity   NodeCapacity
+	trigger    chan struct{}
+}
+
+// NewCapacityReporter creates a reporter which sends to the given URL
+// (usually https://<scheduler service>/capacity) whenever Trigger is
+// called and at least once per interval. tlsConfig gets called for
+// each report, so updated certificates are used without restarting
+// the reporter. Without it, the report is sent without a client
+// certificate and the controller will reject it.
+func NewCapacityReporter(url string, tlsConfig func() (*tls.Config, error), interval time.Duration, driverName, nodeName string, capacity NodeCapacity) *CapacityReporter {
+	return &CapacityReporter{
+		url:        url,
+		tlsConfig:  tlsConfig,
+		interval:   interval,
+		driverName: driverName,
+		nodeName:   nodeName,
+		capacity:   capacity,
+		trigger:    make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests a new report. It never blocks.
+func (r *CapacityReporter) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// A report is already pending.
+	}
+}
+
+// Run sends reports until the context is done. Failures are logged
+// and retried with the next report.
+func (r *CapacityReporter) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("CapacityReporter").WithValues("url", r.url)
+	ctx = klog.NewContext(ctx, logger)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.report(ctx); err != nil {
+			logger.Error(err, "Capacity report failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
+
+func (r *CapacityReporter) report(ctx context.Context) error {
+	report, err := r.capacity(ctx)
+	if err != nil {
+		return fmt.Errorf("get capacity: %v", err)
+	}
+	report.DriverName = r.driverName
+	report.NodeName = r.nodeName
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("encode report: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	if r.tlsConfig != nil {
+		config, err := r.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("load TLS configuration: %v", err)
+		}
+		transport.TLSClientConfig = config
+	}
+	client := http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad HTTP response status: %s", resp.Status)
+	}
+	klog.FromContext(ctx).V(5).Info("Reported capacity", "report", report)
+	return nil
+}
@@ -7,16 +7,29 @@ SPDX-License-Identifier: Apache-2.0
 package scheduler
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclient "k8s.io/client-go/kubernetes/fake"
 	corelistersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 
@@ -207,3 +220,266 @@ func TestCapacityFromMetrics(t *testing.T) {
 		})
 	}
 }
+
+type fallbackCapacity int64
+
+func (f fallbackCapacity) NodeCapacity(nodeName string) (int64, error) {
+	return int64(f), nil
+}
+
+func TestCapacityCache(t *testing.T) {
+	now := time.Now()
+	c := NewCapacityCache("pmem-csi.intel.com", time.Minute, nil)
+	c.now = func() time.Time { return now }
+
+	actual, err := c.NodeCapacity("foobar")
+	require.NoError(t, err, "unknown node")
+	require.Equal(t, int64(0), actual, "unknown node")
+
+	require.Error(t, c.Update(CapacityReport{DriverName: "other-driver", NodeName: "foobar"}), "wrong driver")
+	require.Error(t, c.Update(CapacityReport{DriverName: "pmem-csi.intel.com"}), "no node name")
+
+	require.NoError(t, c.Update(CapacityReport{DriverName: "pmem-csi.intel.com", NodeName: "foobar", MaxVolumeSize: 1000}), "update")
+	actual, err = c.NodeCapacity("foobar")
+	require.NoError(t, err, "known node")
+	require.Equal(t, int64(1000), actual, "known node")
+	require.Len(t, c.Entries(), 1, "entries")
+
+	now = now.Add(2 * time.Minute)
+	actual, err = c.NodeCapacity("foobar")
+	require.NoError(t, err, "stale report")
+	require.Equal(t, int64(0), actual, "stale report")
+	require.Empty(t, c.Entries(), "entries")
+
+	c.fallback = fallbackCapacity(42)
+	actual, err = c.NodeCapacity("foobar")
+	require.NoError(t, err, "fallback")
+	require.Equal(t, int64(42), actual, "fallback")
+}
+
+func TestCapacityReporter(t *testing.T) {
+	certs := newTestCerts(t)
+	testcases := map[string]struct {
+		clientName  string
+		noTLS       bool
+		expectError bool
+	}{
+		"authorized": {
+			clientName: CapacityReporterName,
+		},
+		"wrong client": {
+			clientName:  "pmem-controller",
+			expectError: true,
+		},
+		"no client certificate": {
+			expectError: true,
+		},
+		"no TLS": {
+			noTLS:       true,
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			report := CapacityReport{
+				MaxVolumeSize: 1000,
+				Available:     2000,
+				Managed:       3000,
+				Total:         4000,
+			}
+			capacity := func(ctx context.Context) (CapacityReport, error) {
+				return report, nil
+			}
+			c := NewCapacityCache("pmem-csi.intel.com", 0, nil)
+			var server *httptest.Server
+			var tlsConfig func() (*tls.Config, error)
+			if tc.noTLS {
+				server = httptest.NewServer(c)
+			} else {
+				server = httptest.NewUnstartedServer(c)
+				server.TLS = &tls.Config{
+					Certificates: []tls.Certificate{certs.server},
+					ClientCAs:    certs.pool,
+					ClientAuth:   tls.VerifyClientCertIfGiven,
+				}
+				server.StartTLS()
+				tlsConfig = func() (*tls.Config, error) {
+					config := &tls.Config{
+						RootCAs: certs.pool,
+					}
+					if tc.clientName != "" {
+						config.Certificates = []tls.Certificate{certs.client(t, tc.clientName)}
+					}
+					return config, nil
+				}
+			}
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := NewCapacityReporter(server.URL+"/capacity", tlsConfig, time.Hour, "pmem-csi.intel.com", "foobar", capacity)
+			err := r.report(ctx)
+			if tc.expectError {
+				t.Logf("got error %v", err)
+				require.Error(t, err, "report should have been rejected")
+				require.Empty(t, c.Entries(), "entries")
+				return
+			}
+			require.NoError(t, err, "report")
+			actual, err := c.NodeCapacity("foobar")
+			require.NoError(t, err, "NodeCapacity")
+			require.Equal(t, int64(1000), actual, "capacity reported")
+			entries := c.Entries()
+			require.Len(t, entries, 1, "entries")
+			require.Equal(t, int64(4000), entries[0].Total, "total")
+
+			// Run also sends reports, first immediately and
+			// then after each trigger.
+			report.MaxVolumeSize = 500
+			go r.Run(ctx)
+			require.Eventually(t, func() bool {
+				actual, _ := c.NodeCapacity("foobar")
+				return actual == 500
+			}, 10*time.Second, 10*time.Millisecond, "capacity reported")
+		})
+	}
+}
+
+func TestCapacityCacheReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	certs := newTestCerts(t)
+	client := fakeclient.NewSimpleClientset()
+	const driverName = "pmem-csi.intel.com"
+	const namespace = "pmem-csi"
+
+	// Each replica has its own cache and HTTPS server.
+	var caches []*CapacityCache
+	var urls []string
+	for i := 0; i < 2; i++ {
+		c := NewCapacityCache(driverName, time.Hour, nil)
+		require.NoError(t, c.ShareViaLeases(ctx, client, namespace), "share reports of replica #%d", i)
+		server := httptest.NewUnstartedServer(c)
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{certs.server},
+			ClientCAs:    certs.pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}
+		server.StartTLS()
+		defer server.Close()
+		caches = append(caches, c)
+		urls = append(urls, server.URL+"/capacity")
+	}
+	tlsConfig := func() (*tls.Config, error) {
+		return &tls.Config{
+			RootCAs:      certs.pool,
+			Certificates: []tls.Certificate{certs.client(t, CapacityReporterName)},
+		}, nil
+	}
+	capacity := func(ctx context.Context) (CapacityReport, error) {
+		return CapacityReport{MaxVolumeSize: 1000}, nil
+	}
+	hasCapacity := func(c *CapacityCache, expected int64) func() bool {
+		return func() bool {
+			actual, err := c.NodeCapacity("foobar")
+			return err == nil && actual == expected
+		}
+	}
+
+	// A report sent to the first replica becomes visible in the second one.
+	r := NewCapacityReporter(urls[0], tlsConfig, time.Hour, driverName, "foobar", capacity)
+	require.NoError(t, r.report(ctx), "report to first replica")
+	require.True(t, hasCapacity(caches[0], 1000)(), "capacity in first replica")
+	require.Eventually(t, hasCapacity(caches[1], 1000), 10*time.Second, 10*time.Millisecond, "capacity in second replica")
+
+	lease, err := client.CoordinationV1().Leases(namespace).Get(ctx, "pmem-csi-intel-com-capacity-foobar", metav1.GetOptions{})
+	require.NoError(t, err, "get lease")
+	require.Equal(t, driverName, lease.Labels[capacityLeaseLabel], "lease label")
+	require.Equal(t, "foobar", *lease.Spec.HolderIdentity, "lease holder")
+
+	// A newer report sent to the second replica updates the first one.
+	capacity = func(ctx context.Context) (CapacityReport, error) {
+		return CapacityReport{MaxVolumeSize: 500}, nil
+	}
+	r = NewCapacityReporter(urls[1], tlsConfig, time.Hour, driverName, "foobar", capacity)
+	require.NoError(t, r.report(ctx), "report to second replica")
+	require.True(t, hasCapacity(caches[1], 500)(), "capacity in second replica")
+	require.Eventually(t, hasCapacity(caches[0], 500), 10*time.Second, 10*time.Millisecond, "capacity in first replica")
+
+	// A replica which starts later gets the existing reports.
+	c := NewCapacityCache(driverName, time.Hour, nil)
+	require.NoError(t, c.ShareViaLeases(ctx, client, namespace), "share reports of new replica")
+	require.True(t, hasCapacity(c, 500)(), "capacity in new replica")
+
+	// Older reports do not replace newer ones.
+	now := time.Now()
+	c.set(CapacityCacheEntry{CapacityReport: CapacityReport{NodeName: "foobar", MaxVolumeSize: 200}, Received: now.Add(-time.Minute)})
+	require.True(t, hasCapacity(c, 500)(), "capacity after older report")
+}
+
+func TestCapacityLeaseName(t *testing.T) {
+	require.Equal(t, "pmem-csi-intel-com-capacity-foobar", capacityLeaseName("pmem-csi.intel.com", "foobar"), "short node name")
+	long := capacityLeaseName("pmem-csi.intel.com", strings.Repeat("a", 253))
+	require.LessOrEqual(t, len(long), 253, "length for long node name")
+	require.NotEqual(t, long, capacityLeaseName("pmem-csi.intel.com", strings.Repeat("b", 253)), "unique names for long node names")
+}
+
+// testCerts contains a CA and a serving certificate for 127.0.0.1
+// which is signed by it. Client certificates get created on demand.
+type testCerts struct {
+	pool   *x509.CertPool
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	server tls.Certificate
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "generate CA key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	require.NoError(t, err, "create CA")
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "parse CA")
+	certs := &testCerts{
+		pool:  x509.NewCertPool(),
+		ca:    ca,
+		caKey: caKey,
+	}
+	certs.pool.AddCert(ca)
+	certs.server = certs.newCertificate(t, "pmem-controller", x509.ExtKeyUsageServerAuth)
+	return certs
+}
+
+func (c *testCerts) client(t *testing.T, commonName string) tls.Certificate {
+	return c.newCertificate(t, commonName, x509.ExtKeyUsageClientAuth)
+}
+
+func (c *testCerts) newCertificate(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, key.Public(), c.caKey)
+	require.NoError(t, err, "create certificate")
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
@@ -32,6 +32,13 @@ const (
 	// resourceSuffix is the part which gets added to the CSI driver name to
 	// create the extended resource name that will trigger the scheduler extender.
 	resourceSuffix = "/scheduler"
+
+	// OptOutAnnotation can be set to OptOutValue in a pod to
+	// prevent pod mutation. This has the same effect as the label
+	// with the same name and value, which is checked by the
+	// object selector of the webhook configuration.
+	OptOutAnnotation = "pmem-csi.intel.com/webhook"
+	OptOutValue      = "ignore"
 )
 
 // Handle implements admission.Handler interface.
@@ -53,6 +60,11 @@ func (s scheduler) Handle(ctx context.Context, req admission.Request) admission.
 		return admission.Allowed("no volumes")
 	}
 
+	if pod.Annotations[OptOutAnnotation] == OptOutValue {
+		logger.V(5).Info("Pod opted out of mutation.")
+		return admission.Allowed("opted out via annotation")
+	}
+
 	// Pods instantiated from templates may have empty name/namespace.
 	// To lookup PVC in the same namespace, we set namespace obtained from req.
 	if pod.Namespace == "" {
@@ -74,9 +86,17 @@ func (s scheduler) Handle(ctx context.Context, req admission.Request) admission.
 		return admission.Allowed("no relevant PMEM volumes")
 	}
 
-	ctnr := &pod.Spec.Containers[0]
+	ctnr := s.targetContainer(pod)
+	if ctnr == nil {
+		response := admission.Allowed("target container not found")
+		response.Warnings = []string{
+			fmt.Sprintf("%s: pod uses PMEM, but container %q for the %s resource was not found, pod may get scheduled onto a node with insufficient PMEM",
+				s.driverName, s.mutation.ContainerName, s.mutation.ResourceName),
+		}
+		return response
+	}
 	quantity := resource.NewQuantity(1, resource.DecimalSI)
-	resource := corev1.ResourceName(s.driverName + resourceSuffix)
+	resource := corev1.ResourceName(s.mutation.ResourceName)
 	if ctnr.Resources.Requests == nil {
 		ctnr.Resources.Requests = corev1.ResourceList{}
 	}
@@ -91,8 +111,31 @@ func (s scheduler) Handle(ctx context.Context, req admission.Request) admission.
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
 
-	logger.V(5).Info("Pod uses PMEM.")
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	logger.V(5).Info("Pod uses PMEM.", "container", ctnr.Name, "resource", resource)
+	response := admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	response.Warnings = []string{
+		fmt.Sprintf("%s: added extended resource %s to container %q because the pod uses PMEM volumes which still need to be created, the PMEM-CSI scheduler extender will check capacity",
+			s.driverName, resource, ctnr.Name),
+	}
+	return response
+}
+
+// targetContainer returns the container which is supposed to get the
+// extended resource or nil if not found.
+func (s scheduler) targetContainer(pod *corev1.Pod) *corev1.Container {
+	containers := pod.Spec.Containers
+	if s.mutation.InitContainer && len(pod.Spec.InitContainers) > 0 {
+		containers = pod.Spec.InitContainers
+	}
+	if s.mutation.ContainerName == "" {
+		return &containers[0]
+	}
+	for i := range containers {
+		if containers[i].Name == s.mutation.ContainerName {
+			return &containers[i]
+		}
+	}
+	return nil
 }
 
 func (s scheduler) targetStorageClasses(ctx context.Context) (map[string]bool, error) {
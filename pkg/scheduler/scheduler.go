@@ -87,16 +87,32 @@ func wrapHTTPHandler(handlerName string, handler http.HandlerFunc) http.HandlerF
 	)
 }
 
+// PodMutation configures how the mutating pod webhook marks pods which
+// need the scheduler extender.
+type PodMutation struct {
+	// ResourceName is the extended resource that gets added to
+	// the pod. The default is "<driver name>/scheduler".
+	ResourceName string
+	// ContainerName selects the container which gets the extended
+	// resource. The default is the first container.
+	ContainerName string
+	// InitContainer selects among the init containers instead of
+	// the normal containers. Pods without init containers fall
+	// back to the normal containers.
+	InitContainer bool
+}
+
 type scheduler struct {
 	driverName string
 	capacity   Capacity
 	clientSet  kubernetes.Interface
 	pvcLister  corelisters.PersistentVolumeClaimLister
 	scLister   storagelisters.StorageClassLister
+	mutation   PodMutation
 	decoder    *admission.Decoder
 	log        logr.Logger
 
-	instrumentedFilter, instrumentedStatus, instrumentedMutate http.HandlerFunc
+	instrumentedFilter, instrumentedStatus, instrumentedMutate, instrumentedValidate http.HandlerFunc
 }
 
 func NewScheduler(
@@ -105,13 +121,18 @@ func NewScheduler(
 	clientSet kubernetes.Interface,
 	pvcLister corelisters.PersistentVolumeClaimLister,
 	scLister storagelisters.StorageClassLister,
+	mutation PodMutation,
 ) (http.Handler, error) {
+	if mutation.ResourceName == "" {
+		mutation.ResourceName = driverName + resourceSuffix
+	}
 	s := &scheduler{
 		driverName: driverName,
 		capacity:   capacity,
 		clientSet:  clientSet,
 		pvcLister:  pvcLister,
 		scLister:   scLister,
+		mutation:   mutation,
 		log:        klogr.New().WithName("scheduler"),
 	}
 	scheme := runtime.NewScheme()
@@ -123,6 +144,11 @@ func NewScheduler(
 		return nil, fmt.Errorf("initialize admission decoder: %v", err)
 	}
 	s.decoder = decoder
+	validatingWebhook := webhook.Admission{Handler: validator{scheduler: s}}
+	if err := validatingWebhook.InjectLogger(s.log.WithName("validating-webhook")); err != nil {
+		return nil, fmt.Errorf("inject logger: %v", err)
+	}
+
 	webhook := webhook.Admission{Handler: s}
 	if err := webhook.InjectLogger(s.log.WithName("webhook")); err != nil {
 		return nil, fmt.Errorf("inject logger: %v", err)
@@ -131,6 +157,7 @@ func NewScheduler(
 	s.instrumentedFilter = wrapHTTPHandler("filter", s.filter)
 	s.instrumentedStatus = wrapHTTPHandler("status", s.status)
 	s.instrumentedMutate = wrapHTTPHandler("mutate", webhook.ServeHTTP)
+	s.instrumentedValidate = wrapHTTPHandler("validate", validatingWebhook.ServeHTTP)
 
 	return s, nil
 }
@@ -154,6 +181,8 @@ func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.instrumentedStatus(w, r)
 	case "/pod/mutate":
 		s.instrumentedMutate(w, r)
+	case "/validate":
+		s.instrumentedValidate(w, r)
 	default:
 		http.Error(w, "not found", http.StatusNotFound)
 	}
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,6 +26,7 @@ import (
 	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -33,6 +35,7 @@ import (
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	schedulerapi "k8s.io/kube-scheduler/extender/v1"
 	"k8s.io/kubernetes/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -54,6 +57,7 @@ var (
 	waitClassNoProvisioner    = "waitClassNoProvisioner"
 	waitClassOtherProvisioner = "waitClassOtherProvisioner"
 	unknownClass              = "unknownClass"
+	kataClass                 = "kataClass"
 )
 
 const (
@@ -94,7 +98,7 @@ type testEnv struct {
 	pvcInformer coreinformers.PersistentVolumeClaimInformer
 }
 
-func newTestEnv(t *testing.T, capacity Capacity, stopCh <-chan struct{}) *testEnv {
+func newTestEnv(t *testing.T, capacity Capacity, mutation PodMutation, stopCh <-chan struct{}) *testEnv {
 	client := &fake.Clientset{}
 	informerFactory := informers.NewSharedInformerFactory(client, controller.NoResyncPeriodFunc())
 
@@ -140,6 +144,16 @@ func newTestEnv(t *testing.T, capacity Capacity, stopCh <-chan struct{}) *testEn
 			VolumeBindingMode: &waitMode,
 			Provisioner:       driverName + ".example",
 		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: kataClass,
+			},
+			VolumeBindingMode: &waitMode,
+			Provisioner:       driverName,
+			Parameters: map[string]string{
+				"kataContainers": "true",
+			},
+		},
 	}
 	for _, class := range classes {
 		if err := classInformer.Informer().GetIndexer().Add(class); err != nil {
@@ -152,6 +166,7 @@ func newTestEnv(t *testing.T, capacity Capacity, stopCh <-chan struct{}) *testEn
 		client,
 		pvcInformer.Lister(),
 		classInformer.Lister(),
+		mutation,
 	)
 	if err != nil {
 		t.Fatalf("Failed to create scheduler: %v", err)
@@ -494,7 +509,7 @@ func TestScheduler(t *testing.T) {
 		defer cancel()
 
 		// Setup
-		testEnv := newTestEnv(t, scenario.capacity, ctx.Done())
+		testEnv := newTestEnv(t, scenario.capacity, PodMutation{}, ctx.Done())
 		testEnv.initClaims(scenario.pvcs)
 
 		// Generate input. We keep it very simple. Kubernetes actually sends
@@ -559,17 +574,29 @@ func TestMutatePod(t *testing.T) {
 	// denied := admission.Denied("pod has no containers")
 	noFiltering := admission.Allowed("no relevant PMEM volumes")
 	noVolumes := admission.Allowed("no volumes")
+	optedOut := admission.Allowed("opted out via annotation")
+
+	withAnnotation := makePod([]*v1.PersistentVolumeClaim{unboundPVC}, nil)
+	withAnnotation.Annotations = map[string]string{OptOutAnnotation: OptOutValue}
+	withContainers := makePod([]*v1.PersistentVolumeClaim{unboundPVC}, nil)
+	withContainers.Spec.Containers = []v1.Container{{Name: "first"}, {Name: "second"}}
+	withContainers.Spec.InitContainers = []v1.Container{{Name: "init"}}
 
 	type scenarioType struct {
 		// Inputs
-		pvcs   []*v1.PersistentVolumeClaim
-		inline []inlineVolume
+		pvcs     []*v1.PersistentVolumeClaim
+		inline   []inlineVolume
+		mutation PodMutation
 		// If nil, makePod with podPVCs
 		pod *v1.Pod
 
 		// If a result is specified, that is what should be returned.
 		// If not, then the pod is expected to get filtered.
 		expectedResult *admission.Response
+		// If set, one of the patches must have a path with this prefix.
+		expectedPatchPath string
+		// If true, the pod must not get filtered and a warning is expected.
+		expectedWarning bool
 	}
 	scenarios := map[string]scenarioType{
 		"no volumes": {
@@ -625,6 +652,44 @@ func TestMutatePod(t *testing.T) {
 			},
 			expectedResult: &noFiltering,
 		},
+		"opt-out annotation": {
+			pvcs: []*v1.PersistentVolumeClaim{
+				unboundPVC,
+			},
+			pod:            withAnnotation,
+			expectedResult: &optedOut,
+		},
+		"named container": {
+			pvcs: []*v1.PersistentVolumeClaim{
+				unboundPVC,
+			},
+			pod:               withContainers,
+			mutation:          PodMutation{ContainerName: "second"},
+			expectedPatchPath: "/spec/containers/1/resources",
+		},
+		"init container": {
+			pvcs: []*v1.PersistentVolumeClaim{
+				unboundPVC,
+			},
+			pod:               withContainers,
+			mutation:          PodMutation{InitContainer: true},
+			expectedPatchPath: "/spec/initContainers/0/resources",
+		},
+		"custom resource": {
+			pvcs: []*v1.PersistentVolumeClaim{
+				unboundPVC,
+			},
+			mutation:          PodMutation{ResourceName: "example.com/pmem"},
+			expectedPatchPath: "/spec/containers/0/resources",
+		},
+		"missing container": {
+			pvcs: []*v1.PersistentVolumeClaim{
+				unboundPVC,
+			},
+			pod:             withContainers,
+			mutation:        PodMutation{ContainerName: "no-such-container"},
+			expectedWarning: true,
+		},
 	}
 
 	run := func(t *testing.T, scenario scenarioType) {
@@ -632,7 +697,7 @@ func TestMutatePod(t *testing.T) {
 		defer cancel()
 
 		// Setup
-		testEnv := newTestEnv(t, nil, ctx.Done())
+		testEnv := newTestEnv(t, nil, scenario.mutation, ctx.Done())
 		testEnv.initClaims(scenario.pvcs)
 
 		// Generate input. We keep it very simple. Kubernetes actually sends
@@ -656,13 +721,179 @@ func TestMutatePod(t *testing.T) {
 		response := testEnv.scheduler.Handle(context.Background(), req)
 
 		// Check response.
-		if scenario.expectedResult != nil {
+		switch {
+		case scenario.expectedResult != nil:
 			assert.Equal(t, *scenario.expectedResult, response, "webhook result")
-		} else {
+		case scenario.expectedWarning:
+			assert.True(t, response.Allowed, "allowed")
+			assert.Empty(t, response.Patches, "JSON patch")
+			assert.NotEmpty(t, response.Warnings, "warnings")
+		default:
 			assert.True(t, response.Allowed, "allowed")
 			// That the patches do indeed add the extended
 			// resource is covered by the E2E test.
 			assert.NotEmpty(t, response.Patches, "JSON patch")
+			assert.NotEmpty(t, response.Warnings, "warnings")
+			if scenario.expectedPatchPath != "" {
+				found := false
+				for _, patch := range response.Patches {
+					if strings.HasPrefix(patch.Path, scenario.expectedPatchPath) {
+						found = true
+					}
+				}
+				assert.True(t, found, "patch for %s in %v", scenario.expectedPatchPath, response.Patches)
+			}
+		}
+	}
+
+	for name, scenario := range scenarios {
+		scenario := scenario
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			run(t, scenario)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	block := v1.PersistentVolumeBlock
+	blockPVC := makeTestPVC("block-pvc", "1Gi", "", pvcUnbound, "", "1", &kataClass)
+	blockPVC.Spec.VolumeMode = &block
+	unknownBlockPVC := makeTestPVC("block-pvc", "1Gi", "", pvcUnbound, "", "1", &unknownClass)
+	unknownBlockPVC.Spec.VolumeMode = &block
+	inlinePod := func(attributes map[string]string) *v1.Pod {
+		pod := makePod(nil, nil)
+		pod.Spec.Volumes = []v1.Volume{
+			{
+				Name: "vol",
+				VolumeSource: v1.VolumeSource{
+					CSI: &v1.CSIVolumeSource{
+						Driver:           driverName,
+						VolumeAttributes: attributes,
+					},
+				},
+			},
+		}
+		return pod
+	}
+	storageClass := func(provisioner string, params map[string]string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "sc",
+			},
+			Provisioner: provisioner,
+			Parameters:  params,
+		}
+	}
+
+	type scenarioType struct {
+		kind          string
+		object        interface{}
+		apiError      error
+		expectAllowed bool
+		expectCode    int32
+		expectMessage string
+	}
+	scenarios := map[string]scenarioType{
+		"valid storage class": {
+			kind: "StorageClass",
+			object: storageClass(driverName, map[string]string{
+				"usage":                     "FileIO",
+				"csi.storage.k8s.io/fstype": "xfs",
+			}),
+			expectAllowed: true,
+		},
+		"misspelled usage": {
+			kind: "StorageClass",
+			object: storageClass(driverName, map[string]string{
+				"usage": "FileIo",
+			}),
+			expectMessage: `storage class sc: parameter "usage": unknown value: FileIo`,
+		},
+		"unknown key": {
+			kind: "StorageClass",
+			object: storageClass(driverName, map[string]string{
+				"foo": "bar",
+			}),
+			expectMessage: `storage class sc: parameter "foo" invalid in this context`,
+		},
+		"other provisioner": {
+			kind: "StorageClass",
+			object: storageClass(driverName+".example", map[string]string{
+				"foo": "bar",
+			}),
+			expectAllowed: true,
+		},
+		"kata with block volume": {
+			kind:          "PersistentVolumeClaim",
+			object:        blockPVC,
+			expectMessage: "PVC block-pvc: raw block volumes are incompatible with Kata Containers, which are enabled in storage class kataClass",
+		},
+		"unknown storage class": {
+			kind:          "PersistentVolumeClaim",
+			object:        unknownBlockPVC,
+			apiError:      apierrors.NewNotFound(storagev1.Resource("storageclasses"), unknownClass),
+			expectAllowed: true,
+		},
+		"storage class lookup failure": {
+			kind:       "PersistentVolumeClaim",
+			object:     unknownBlockPVC,
+			apiError:   apierrors.NewServiceUnavailable("fake error"),
+			expectCode: http.StatusInternalServerError,
+		},
+		"filesystem volume": {
+			kind:          "PersistentVolumeClaim",
+			object:        unboundPVC,
+			expectAllowed: true,
+		},
+		"valid inline volume": {
+			kind: "Pod",
+			object: inlinePod(map[string]string{
+				"size": "1Gi",
+			}),
+			expectAllowed: true,
+		},
+		"inline volume without size": {
+			kind:          "Pod",
+			object:        inlinePod(map[string]string{}),
+			expectMessage: `inline volume vol: required parameter "size" not specified`,
+		},
+	}
+
+	run := func(t *testing.T, scenario scenarioType) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		testEnv := newTestEnv(t, nil, PodMutation{}, ctx.Done())
+		if scenario.apiError != nil {
+			testEnv.client.(*fake.Clientset).PrependReactor("get", "storageclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, scenario.apiError
+			})
+		}
+		obj, err := json.Marshal(scenario.object)
+		require.NoError(t, err, "encode object")
+		req := admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Kind: metav1.GroupVersionKind{
+					Kind: scenario.kind,
+				},
+				Namespace: "default",
+				Object: runtime.RawExtension{
+					Raw: obj,
+				},
+			},
+		}
+
+		response := validator{scheduler: testEnv.scheduler}.Handle(context.Background(), req)
+		assert.Equal(t, scenario.expectAllowed, response.Allowed, "allowed")
+		if scenario.expectCode != 0 {
+			require.NotNil(t, response.Result, "result")
+			assert.Equal(t, scenario.expectCode, response.Result.Code, "code")
+		}
+		if scenario.expectMessage != "" {
+			require.NotNil(t, response.Result, "result")
+			assert.Equal(t, scenario.expectMessage, string(response.Result.Reason), "reason")
 		}
 	}
 
@@ -720,7 +951,7 @@ func TestInputValidation(t *testing.T) {
 		defer cancel()
 
 		// Setup
-		testEnv := newTestEnv(t, clusterCapacity{}, ctx.Done())
+		testEnv := newTestEnv(t, clusterCapacity{}, PodMutation{}, ctx.Done())
 
 		// Prepare request.
 		requestBody := []byte(scenario.body)
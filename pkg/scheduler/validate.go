@@ -0,0 +1,152 @@
+/*
+Copyright 2022 Intel Corp.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// provisionerPrefix is used by the external-provisioner for storage
+// class parameters that it handles itself and removes before calling
+// CreateVolume.
+const provisionerPrefix = "csi.storage.k8s.io/"
+
+// validator implements the validating admission webhook. It rejects
+// storage classes, PVCs and pods with invalid PMEM-CSI parameters
+// before they get stored, instead of failing later during volume
+// creation or NodePublishVolume.
+type validator struct {
+	*scheduler
+}
+
+// Handle implements admission.Handler interface.
+func (v validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := klog.FromContext(ctx).WithName("validating-webhook").WithValues("kind", req.Kind.Kind)
+	ctx = klog.NewContext(ctx, logger)
+
+	switch req.Kind.Kind {
+	case "StorageClass":
+		sc := &storagev1.StorageClass{}
+		if err := v.decoder.Decode(req, sc); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if sc.Provisioner != v.driverName {
+			return admission.Allowed("not a PMEM-CSI storage class")
+		}
+		if _, err := ParseStorageClassParameters(sc.Parameters); err != nil {
+			logger.V(3).Info("Rejecting storage class", "storage-class", sc.Name, "err", err)
+			return admission.Denied(fmt.Sprintf("storage class %s: %v", sc.Name, err))
+		}
+		return admission.Allowed("valid PMEM-CSI parameters")
+	case "PersistentVolumeClaim":
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := v.decoder.Decode(req, pvc); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if err := v.validatePVC(ctx, pvc); err != nil {
+			var lookupErr lookupError
+			if errors.As(err, &lookupErr) {
+				// Not the fault of the PVC, the API server may retry.
+				logger.Error(err, "Checking PVC failed", "pvc", pmemlog.KObj(pvc))
+				return admission.Errored(http.StatusInternalServerError, fmt.Errorf("PVC %s: %v", pvc.Name, err))
+			}
+			logger.V(3).Info("Rejecting PVC", "pvc", pmemlog.KObj(pvc), "err", err)
+			return admission.Denied(fmt.Sprintf("PVC %s: %v", pvc.Name, err))
+		}
+		return admission.Allowed("valid PVC")
+	case "Pod":
+		pod := &corev1.Pod{}
+		if err := v.decoder.Decode(req, pod); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.CSI == nil || volume.CSI.Driver != v.driverName {
+				continue
+			}
+			if _, err := parameters.Parse(parameters.EphemeralVolumeOrigin, volume.CSI.VolumeAttributes); err != nil {
+				logger.V(3).Info("Rejecting pod", "pod", pmemlog.KObj(pod), "volume", volume.Name, "err", err)
+				return admission.Denied(fmt.Sprintf("inline volume %s: %v", volume.Name, err))
+			}
+		}
+		return admission.Allowed("valid inline PMEM-CSI volumes")
+	default:
+		return admission.Allowed("not checked")
+	}
+}
+
+// lookupError wraps errors which prevent checking an object, like a
+// failed API call. They must not cause a rejection of the object.
+type lookupError struct {
+	error
+}
+
+func (err lookupError) Unwrap() error {
+	return err.error
+}
+
+// validatePVC rejects raw block volumes for storage classes with Kata
+// Containers support. Unknown storage classes are not an error because
+// the PVC might get created before its storage class. Failures while
+// looking up the storage class are returned as lookupError.
+func (v validator) validatePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	if pvc.Spec.VolumeMode == nil ||
+		*pvc.Spec.VolumeMode != corev1.PersistentVolumeBlock ||
+		pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+	scName := *pvc.Spec.StorageClassName
+	sc, err := v.scLister.Get(scName)
+	if err != nil && apierrs.IsNotFound(err) {
+		sc, err = v.clientSet.StorageV1().StorageClasses().Get(ctx, scName, metav1.GetOptions{})
+	}
+	if err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		return lookupError{fmt.Errorf("check storage class %s: %v", scName, err)}
+	}
+	if sc.Provisioner != v.driverName {
+		return nil
+	}
+	p, err := ParseStorageClassParameters(sc.Parameters)
+	if err != nil {
+		return fmt.Errorf("storage class %s: %v", scName, err)
+	}
+	if p.GetKataContainers() {
+		return fmt.Errorf("raw block volumes are incompatible with Kata Containers, which are enabled in storage class %s", scName)
+	}
+	return nil
+}
+
+// ParseStorageClassParameters checks the parameters of a PMEM-CSI
+// storage class the same way as CreateVolume will check them after
+// the external-provisioner has removed the parameters that it handles
+// itself.
+func ParseStorageClassParameters(params map[string]string) (parameters.Volume, error) {
+	filtered := map[string]string{}
+	for key, value := range params {
+		if strings.HasPrefix(key, provisionerPrefix) {
+			continue
+		}
+		filtered[key] = value
+	}
+	return parameters.Parse(parameters.CreateVolumeOrigin, filtered)
+}
@@ -77,3 +77,44 @@ func (v Version) Compare(major, minor uint) int {
 func (v Version) CompareVersion(other Version) int {
 	return v.Compare(other.major, other.minor)
 }
+
+// ImageVersion extracts the version from the tag of a container image
+// like "intel/pmem-csi-driver:v1.0.2". It returns false if the image
+// has no tag or the tag is not a release version, for example
+// "canary" or a digest.
+func ImageVersion(image string) (Version, bool) {
+	if strings.Contains(image, "@") {
+		return Version{}, false
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		// No tag, the colon was part of the registry address.
+		return Version{}, false
+	}
+	tag := strings.TrimPrefix(image[i+1:], "v")
+	// Ignore pre-release and build suffixes.
+	if i := strings.IndexAny(tag, "-+"); i >= 0 {
+		tag = tag[:i]
+	}
+	v, err := Parse(tag)
+	if err != nil {
+		return Version{}, false
+	}
+	return v, true
+}
+
+// CheckUpgrade returns an error if switching from one version to
+// the other is not supported. Only changes within the same major
+// version which do not skip a minor version are supported.
+func CheckUpgrade(from, to Version) error {
+	if from.major != to.major {
+		return fmt.Errorf("changing the major version from %s to %s is not supported", from, to)
+	}
+	if to.minor > from.minor+1 {
+		return fmt.Errorf("upgrading from %s to %s skips at least one minor version", from, to)
+	}
+	if from.minor > to.minor+1 {
+		return fmt.Errorf("downgrading from %s to %s skips at least one minor version", from, to)
+	}
+	return nil
+}
@@ -72,3 +72,57 @@ func TestVersion(t *testing.T) {
 		}
 	})
 }
+
+func TestImageVersion(t *testing.T) {
+	valid := map[string]version.Version{
+		"intel/pmem-csi-driver:v1.0.2":                  version.NewVersion(1, 0),
+		"intel/pmem-csi-driver:1.1":                     version.NewVersion(1, 1),
+		"localhost:5000/intel/pmem-csi-driver:v1.2.0":   version.NewVersion(1, 2),
+		"intel/pmem-csi-driver:v1.3.0-rc1":              version.NewVersion(1, 3),
+		"registry.example.com/pmem-csi-driver:v2.0+abc": version.NewVersion(2, 0),
+	}
+	invalid := []string{
+		"intel/pmem-csi-driver",
+		"intel/pmem-csi-driver:canary",
+		"localhost:5000/intel/pmem-csi-driver",
+		"intel/pmem-csi-driver@sha256:0123456789abcdef",
+	}
+	for image, expected := range valid {
+		t.Run(image, func(t *testing.T) {
+			actual, ok := version.ImageVersion(image)
+			if assert.True(t, ok) {
+				assert.Equal(t, expected, actual)
+			}
+		})
+	}
+	for _, image := range invalid {
+		t.Run(image, func(t *testing.T) {
+			_, ok := version.ImageVersion(image)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	testcases := []struct {
+		from, to version.Version
+		ok       bool
+	}{
+		{version.NewVersion(1, 0), version.NewVersion(1, 0), true},
+		{version.NewVersion(1, 0), version.NewVersion(1, 1), true},
+		{version.NewVersion(1, 1), version.NewVersion(1, 0), true},
+		{version.NewVersion(1, 0), version.NewVersion(1, 2), false},
+		{version.NewVersion(1, 2), version.NewVersion(1, 0), false},
+		{version.NewVersion(1, 3), version.NewVersion(2, 0), false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.from.String()+"->"+tc.to.String(), func(t *testing.T) {
+			err := version.CheckUpgrade(tc.from, tc.to)
+			if tc.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
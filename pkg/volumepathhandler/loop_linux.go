@@ -0,0 +1,240 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package volumepathhandler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LoopOptions configure a new loop device.
+type LoopOptions struct {
+	// Offset is the start of the data in the backing file.
+	Offset int64
+	// SizeLimit is the maximum size of the device. Zero means
+	// that the device extends to the end of the backing file.
+	SizeLimit int64
+	// DirectIO avoids double caching by bypassing the page cache
+	// of the backing file. The kernel silently disables it if
+	// the backing file does not support it.
+	DirectIO bool
+}
+
+var (
+	// Variables instead of constants for testing.
+	loopControlPath = "/dev/loop-control"
+	sysBlockPath    = "/sys/block"
+
+	// getFreeLoopDevice returns the index of a free loop device.
+	getFreeLoopDevice = func(control *os.File) (int, error) {
+		return unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+	}
+)
+
+const (
+	// LOOP_CONFIGURE from linux/loop.h, available since Linux 5.8.
+	loopConfigure = 0x4C0A
+
+	// How often attaching is retried when another process
+	// grabs the same free loop device.
+	maxLoopAttempts = 10
+)
+
+// loopConfig is struct loop_config from linux/loop.h.
+type loopConfig struct {
+	fd        uint32
+	blockSize uint32
+	info      unix.LoopInfo64
+	reserved  [8]uint64
+}
+
+// errLoopUnsupported is returned when loop devices cannot be managed
+// with ioctls, for example because /dev/loop-control is missing.
+// losetup is used instead.
+var errLoopUnsupported = errors.New("loop device ioctls not supported")
+
+// attachLoopDevice binds a file to a free loop device and returns
+// the path of that device.
+func attachLoopDevice(path string, options LoopOptions) (string, error) {
+	control, err := os.OpenFile(loopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: %v", errLoopUnsupported, err)
+		}
+		return "", err
+	}
+	defer control.Close()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Another process may configure the free device before we
+	// do. Then configuring fails with EBUSY and we try again with
+	// the next free device.
+	for i := 0; i < maxLoopAttempts; i++ {
+		index, err := getFreeLoopDevice(control)
+		if err != nil {
+			return "", fmt.Errorf("%s: get free loop device: %w", loopControlPath, err)
+		}
+		device := fmt.Sprintf("/dev/loop%d", index)
+		err = configureLoopDevice(device, file, options)
+		if errors.Is(err, unix.EBUSY) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", device, err)
+		}
+		return device, nil
+	}
+	return "", fmt.Errorf("no free loop device found after %d attempts", maxLoopAttempts)
+}
+
+func configureLoopDevice(device string, file *os.File, options LoopOptions) error {
+	loop, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	config := loopConfig{
+		fd: uint32(file.Fd()),
+		info: unix.LoopInfo64{
+			Offset:    uint64(options.Offset),
+			Sizelimit: uint64(options.SizeLimit),
+		},
+	}
+	copy(config.info.File_name[:len(config.info.File_name)-1], file.Name())
+	if options.DirectIO {
+		config.info.Flags |= unix.LO_FLAGS_DIRECT_IO
+	}
+	err = ioctlPointer(loop, loopConfigure, unsafe.Pointer(&config))
+	if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOTTY) {
+		return err
+	}
+
+	// Older kernels: set file and status separately. This is
+	// racy, but EBUSY still tells us when someone else got the
+	// device first.
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(file.Fd())); err != nil {
+		return err
+	}
+	config.info.Flags &^= unix.LO_FLAGS_DIRECT_IO
+	if err := ioctlPointer(loop, unix.LOOP_SET_STATUS64, unsafe.Pointer(&config.info)); err != nil {
+		_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("set status: %w", err)
+	}
+	if options.DirectIO {
+		// Failures are okay, the flag is just a hint.
+		_ = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_DIRECT_IO, 1)
+	}
+	return nil
+}
+
+// detachLoopDevice unbinds the file from the loop device. If the
+// device is still in use, then the kernel detaches it once it is
+// no longer used.
+func detachLoopDevice(device string) error {
+	loop, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer loop.Close()
+	err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+	if errors.Is(err, unix.ENXIO) {
+		// Not bound (anymore).
+		return nil
+	}
+	return err
+}
+
+// findLoopDevice returns the first loop device which is bound to
+// the given file, regardless of the offset. Files are compared by
+// device and inode, like losetup does.
+func findLoopDevice(path string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	// Only bound loop devices have a "loop" directory.
+	bound, err := filepath.Glob(filepath.Join(sysBlockPath, "loop*", "loop"))
+	if err != nil {
+		return "", err
+	}
+	if len(bound) == 0 {
+		if _, err := os.Stat(sysBlockPath); err != nil {
+			return "", fmt.Errorf("%w: %v", errLoopUnsupported, err)
+		}
+	}
+	for _, dir := range bound {
+		device := "/dev/" + filepath.Base(filepath.Dir(dir))
+		info, err := getLoopStatus(device)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) || os.IsNotExist(err) {
+				// Detached in the meantime.
+				continue
+			}
+			return "", fmt.Errorf("%s: %w", device, err)
+		}
+		if info.Device == uint64(stat.Dev) && info.Inode == stat.Ino {
+			return device, nil
+		}
+	}
+	return "", errors.New(ErrDeviceNotFound)
+}
+
+func getLoopStatus(device string) (*unix.LoopInfo64, error) {
+	loop, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer loop.Close()
+	var info unix.LoopInfo64
+	if err := ioctlPointer(loop, unix.LOOP_GET_STATUS64, unsafe.Pointer(&info)); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// setLoopAutoClear sets the LO_FLAGS_AUTOCLEAR flag.
+func setLoopAutoClear(device string) error {
+	loop, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+	var info unix.LoopInfo64
+	if err := ioctlPointer(loop, unix.LOOP_GET_STATUS64, unsafe.Pointer(&info)); err != nil {
+		return fmt.Errorf("get status: %w", err)
+	}
+	info.Flags |= unix.LO_FLAGS_AUTOCLEAR
+	if err := ioctlPointer(loop, unix.LOOP_SET_STATUS64, unsafe.Pointer(&info)); err != nil {
+		return fmt.Errorf("set status: %w", err)
+	}
+	return nil
+}
+
+func ioctlPointer(file *os.File, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package volumepathhandler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2/ktesting"
+)
+
+const (
+	testFileSize = 1024 * 1024
+	testOffset   = 64 * 1024
+)
+
+// skipUnlessLoop skips tests which need to create loop devices.
+func skipUnlessLoop(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating loop devices needs root privileges")
+	}
+	if _, err := os.Stat(loopControlPath); err != nil {
+		t.Skipf("loop devices not available: %v", err)
+	}
+}
+
+// createBackingFile creates a file with a marker at testOffset.
+func createBackingFile(t *testing.T, marker string) string {
+	path := filepath.Join(t.TempDir(), "backing.img")
+	data := make([]byte, testFileSize)
+	copy(data[testOffset:], marker)
+	require.NoError(t, os.WriteFile(path, data, 0600), "create backing file")
+	return path
+}
+
+// readDevice returns the beginning of the loop device content.
+func readDevice(t *testing.T, device string, size int) []byte {
+	file, err := os.Open(device)
+	require.NoError(t, err, "open loop device")
+	defer file.Close()
+	data := make([]byte, size)
+	_, err = file.ReadAt(data, 0)
+	require.NoError(t, err, "read loop device")
+	return data
+}
+
+// attach attaches the file and ensures that the device gets detached
+// again at the end of the test.
+func attach(ctx context.Context, t *testing.T, path string, options LoopOptions) string {
+	v := VolumePathHandler{}
+	device, err := v.AttachFileDeviceWithOptions(ctx, path, options)
+	require.NoError(t, err, "attach %s", path)
+	t.Cleanup(func() {
+		_ = removeLoopDevice(ctx, device)
+	})
+	return device
+}
+
+func TestLoopDevice(t *testing.T) {
+	skipUnlessLoop(t)
+	_, ctx := ktesting.NewTestContext(t)
+	v := VolumePathHandler{}
+	marker := "hello world"
+	path := createBackingFile(t, marker)
+
+	_, err := v.GetLoopDevice(ctx, path)
+	require.Error(t, err, "GetLoopDevice before attaching")
+	assert.Equal(t, ErrDeviceNotFound, err.Error(), "GetLoopDevice before attaching")
+
+	device := attach(ctx, t, path, LoopOptions{Offset: testOffset, SizeLimit: testFileSize / 2})
+	info, err := getLoopStatus(device)
+	require.NoError(t, err, "get status")
+	assert.Equal(t, uint64(testOffset), info.Offset, "offset")
+	assert.Equal(t, uint64(testFileSize/2), info.Sizelimit, "size limit")
+	assert.Equal(t, marker, string(readDevice(t, device, len(marker))), "content")
+
+	found, err := v.GetLoopDevice(ctx, path)
+	require.NoError(t, err, "GetLoopDevice")
+	assert.Equal(t, device, found, "GetLoopDevice")
+
+	again, err := v.AttachFileDeviceWithOptions(ctx, path, LoopOptions{Offset: testOffset})
+	require.NoError(t, err, "attach again")
+	assert.Equal(t, device, again, "existing device reused")
+
+	require.NoError(t, v.DetachFileDevice(ctx, path), "detach")
+	_, err = v.GetLoopDevice(ctx, path)
+	require.Error(t, err, "GetLoopDevice after detaching")
+	assert.Equal(t, ErrDeviceNotFound, err.Error(), "GetLoopDevice after detaching")
+	require.NoError(t, v.DetachFileDevice(ctx, path), "detach again")
+	require.NoError(t, detachLoopDevice(device), "detach unbound device")
+}
+
+func TestLoopDeviceAutoClear(t *testing.T) {
+	skipUnlessLoop(t)
+	_, ctx := ktesting.NewTestContext(t)
+	v := VolumePathHandler{}
+	path := createBackingFile(t, "")
+
+	device := attach(ctx, t, path, LoopOptions{DirectIO: true})
+	// Keep the device open while setting the flag, otherwise
+	// the kernel detaches it immediately.
+	file, err := os.Open(device)
+	require.NoError(t, err, "open loop device")
+	require.NoError(t, v.SetAutoClear(ctx, device), "SetAutoClear")
+	info, err := getLoopStatus(device)
+	require.NoError(t, err, "get status")
+	assert.NotZero(t, info.Flags&unix.LO_FLAGS_AUTOCLEAR, "autoclear flag")
+	require.NoError(t, file.Close(), "close loop device")
+
+	_, err = v.GetLoopDevice(ctx, path)
+	require.Error(t, err, "GetLoopDevice after closing")
+	assert.Equal(t, ErrDeviceNotFound, err.Error(), "GetLoopDevice after closing")
+}
+
+func TestLoopDeviceBusy(t *testing.T) {
+	skipUnlessLoop(t)
+	_, ctx := ktesting.NewTestContext(t)
+
+	// Simulate a race with some other process by returning
+	// a device which is in use.
+	busyDevice := attach(ctx, t, createBackingFile(t, "busy"), LoopOptions{})
+	busyIndex, err := loopIndex(busyDevice)
+	require.NoError(t, err, "parse busy device")
+	getFree := getFreeLoopDevice
+	defer func() {
+		getFreeLoopDevice = getFree
+	}()
+
+	calls := 0
+	getFreeLoopDevice = func(control *os.File) (int, error) {
+		calls++
+		if calls == 1 {
+			return busyIndex, nil
+		}
+		return getFree(control)
+	}
+	path := createBackingFile(t, "free")
+	device := attach(ctx, t, path, LoopOptions{Offset: testOffset})
+	assert.Equal(t, 2, calls, "attempts")
+	assert.NotEqual(t, busyDevice, device, "busy device not used")
+	assert.Equal(t, "free", string(readDevice(t, device, len("free"))), "content")
+
+	// All attempts fail.
+	calls = 0
+	getFreeLoopDevice = func(control *os.File) (int, error) {
+		calls++
+		return busyIndex, nil
+	}
+	_, err = attachLoopDevice(createBackingFile(t, ""), LoopOptions{})
+	require.Error(t, err, "attach with busy devices")
+	assert.Contains(t, err.Error(), "no free loop device", "attach with busy devices")
+	assert.Equal(t, maxLoopAttempts, calls, "attempts")
+
+	// Other errors are not retried.
+	calls = 0
+	getFreeLoopDevice = func(control *os.File) (int, error) {
+		calls++
+		return 0, unix.ENOSPC
+	}
+	_, err = attachLoopDevice(createBackingFile(t, ""), LoopOptions{})
+	require.Error(t, err, "attach without free devices")
+	assert.True(t, errors.Is(err, unix.ENOSPC), "attach without free devices: %v", err)
+	assert.Equal(t, 1, calls, "attempts")
+}
+
+func TestLoopDeviceLosetup(t *testing.T) {
+	skipUnlessLoop(t)
+	if _, err := exec.LookPath(losetupPath); err != nil {
+		t.Skipf("losetup not available: %v", err)
+	}
+	_, ctx := ktesting.NewTestContext(t)
+	v := VolumePathHandler{}
+
+	// Without /dev/loop-control and /sys/block, the code
+	// falls back to losetup.
+	controlPath, blockPath := loopControlPath, sysBlockPath
+	defer func() {
+		loopControlPath, sysBlockPath = controlPath, blockPath
+	}()
+	loopControlPath = filepath.Join(t.TempDir(), "no-such-loop-control")
+	sysBlockPath = filepath.Join(t.TempDir(), "no-such-block")
+	_, err := attachLoopDevice("/dev/null", LoopOptions{})
+	assert.True(t, errors.Is(err, errLoopUnsupported), "attach without loop-control: %v", err)
+	_, err = findLoopDevice("/dev/null")
+	assert.True(t, errors.Is(err, errLoopUnsupported), "find without /sys/block: %v", err)
+
+	marker := "losetup"
+	path := createBackingFile(t, marker)
+	device := attach(ctx, t, path, LoopOptions{Offset: testOffset, SizeLimit: testFileSize / 2})
+	assert.True(t, strings.HasPrefix(device, "/dev/loop"), "device %q", device)
+	info, err := getLoopStatus(device)
+	require.NoError(t, err, "get status")
+	assert.Equal(t, uint64(testOffset), info.Offset, "offset")
+	assert.Equal(t, uint64(testFileSize/2), info.Sizelimit, "size limit")
+	assert.Equal(t, marker, string(readDevice(t, device, len(marker))), "content")
+
+	found, err := v.GetLoopDevice(ctx, path)
+	require.NoError(t, err, "GetLoopDevice")
+	assert.Equal(t, device, found, "GetLoopDevice")
+
+	require.NoError(t, v.DetachFileDevice(ctx, path), "detach")
+	_, err = v.GetLoopDevice(ctx, path)
+	require.Error(t, err, "GetLoopDevice after detaching")
+	assert.Equal(t, ErrDeviceNotFound, err.Error(), "GetLoopDevice after detaching")
+}
+
+// loopIndex returns the index of a loop device, which is its minor number.
+func loopIndex(device string) (int, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		return 0, err
+	}
+	return int(unix.Minor(uint64(stat.Rdev))), nil
+}
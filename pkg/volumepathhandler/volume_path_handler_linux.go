@@ -48,6 +48,13 @@ func (v VolumePathHandler) AttachFileDevice(ctx context.Context, path string) (s
 // AttachFileDevice takes a path to a regular file and makes its content starting
 // at the given offset available as an attached block device.
 func (v VolumePathHandler) AttachFileDeviceWithOffset(ctx context.Context, path string, offset int64) (string, error) {
+	return v.AttachFileDeviceWithOptions(ctx, path, LoopOptions{Offset: offset})
+}
+
+// AttachFileDeviceWithOptions takes a path to a regular file and makes its content
+// available as an attached block device, configured according to the options.
+// An existing loop device for the file is returned as it is.
+func (v VolumePathHandler) AttachFileDeviceWithOptions(ctx context.Context, path string, options LoopOptions) (string, error) {
 	ctx, logger := pmemlog.WithName(ctx, "AttachFileDevice")
 	blockDevicePath, err := v.GetLoopDevice(ctx, path)
 	if err != nil && err.Error() != ErrDeviceNotFound {
@@ -57,7 +64,7 @@ func (v VolumePathHandler) AttachFileDeviceWithOffset(ctx context.Context, path
 	// If no existing loop device for the path, create one
 	if blockDevicePath == "" {
 		logger.V(4).Info("Creating device", "path", path)
-		blockDevicePath, err = makeLoopDevice(ctx, path, offset)
+		blockDevicePath, err = makeLoopDevice(ctx, path, options)
 		if err != nil {
 			return "", fmt.Errorf("makeLoopDevice failed for path %s: %v", path, err)
 		}
@@ -99,6 +106,12 @@ func (v VolumePathHandler) GetLoopDevice(ctx context.Context, path string) (stri
 		return "", fmt.Errorf("not attachable: %v", err)
 	}
 
+	device, err := findLoopDevice(path)
+	if !errors.Is(err, errLoopUnsupported) {
+		return device, err
+	}
+	logger.V(5).Info("Falling back to losetup", "reason", err)
+
 	args := []string{"-j", path}
 	cmd := exec.Command(losetupPath, args...)
 	out, err := cmd.CombinedOutput()
@@ -110,11 +123,35 @@ func (v VolumePathHandler) GetLoopDevice(ctx context.Context, path string) (stri
 	return parseLosetupOutputForDevice(out, path)
 }
 
-func makeLoopDevice(ctx context.Context, path string, offset int64) (string, error) {
+// SetAutoClear lets the kernel detach the loop device once it is no longer in use.
+// It must be called while the device is in use, for example after mounting it,
+// because otherwise the device gets detached immediately.
+func (v VolumePathHandler) SetAutoClear(ctx context.Context, device string) error {
+	_, logger := pmemlog.WithName(ctx, "SetAutoClear")
+	if err := setLoopAutoClear(device); err != nil {
+		return fmt.Errorf("%s: %v", device, err)
+	}
+	logger.V(5).Info("Set autoclear flag", "device", device)
+	return nil
+}
+
+func makeLoopDevice(ctx context.Context, path string, options LoopOptions) (string, error) {
 	ctx, logger := pmemlog.WithName(ctx, "makeLoopDevice")
+	device, err := attachLoopDevice(path, options)
+	if !errors.Is(err, errLoopUnsupported) {
+		return device, err
+	}
+	logger.V(5).Info("Falling back to losetup", "reason", err)
+
 	args := []string{"-f", "--show"}
-	if offset != 0 {
-		args = append(args, "-o", fmt.Sprintf("%d", offset))
+	if options.Offset != 0 {
+		args = append(args, "-o", fmt.Sprintf("%d", options.Offset))
+	}
+	if options.SizeLimit != 0 {
+		args = append(args, "--sizelimit", fmt.Sprintf("%d", options.SizeLimit))
+	}
+	if options.DirectIO {
+		args = append(args, "--direct-io=on")
 	}
 	args = append(args, path)
 	cmd := exec.Command(losetupPath, args...)
@@ -136,6 +173,10 @@ func makeLoopDevice(ctx context.Context, path string, offset int64) (string, err
 // removeLoopDevice removes specified loopback device
 func removeLoopDevice(ctx context.Context, device string) error {
 	ctx, logger := pmemlog.WithName(ctx, "removeLoopDevice")
+	if _, err := os.Stat(loopControlPath); err == nil {
+		return detachLoopDevice(device)
+	}
+
 	args := []string{"-d", device}
 	cmd := exec.Command(losetupPath, args...)
 	out, err := cmd.CombinedOutput()
@@ -149,7 +190,7 @@ func removeLoopDevice(ctx context.Context, device string) error {
 	return nil
 }
 
-var offsetSuffix = regexp.MustCompile(`, offset \d+$`)
+var offsetSuffix = regexp.MustCompile(`(, (offset|sizelimit) \d+)+$`)
 
 func parseLosetupOutputForDevice(output []byte, path string) (string, error) {
 	if len(output) == 0 {
@@ -164,14 +205,15 @@ func parseLosetupOutputForDevice(output []byte, path string) (string, error) {
 	// major/minor number, by resolving symlink and matching major/minor number.
 	// Therefore, there will be other path than {path} in output, as shown in above output.
 	//
-	// Optionally the lines have ", offset {offset}" at the end. We strip those
+	// Optionally the lines have ", offset {offset}" and/or
+	// ", sizelimit {size}" at the end. We strip those
 	// and return all loop devices that refer to the same file.
 	s := string(output)
 	// Find the line that exact matches to the path, or "({path})"
 	var matched string
 	scanner := bufio.NewScanner(strings.NewReader(s))
 	for scanner.Scan() {
-		// Remove the ", offset ..." suffix?
+		// Remove the ", offset ..., sizelimit ..." suffix?
 		line := scanner.Text()
 		index := offsetSuffix.FindStringSubmatchIndex(line)
 		if index != nil {
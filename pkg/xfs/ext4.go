@@ -0,0 +1,46 @@
+/*
+Copyright 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package xfs
+
+// #include <linux/fs.h>
+// #include <sys/ioctl.h>
+// #include <errno.h>
+// #include <string.h>
+//
+// // From fs/ext4/ext4.h, same value as FS_DAX_FL in newer headers.
+// #define EXT4_DAX_FL 0x02000000
+//
+// char *setext4dax(int fd) {
+//     int flags;
+//     if (ioctl(fd, FS_IOC_GETFLAGS, &flags) != 0) {
+//         return strerror(errno);
+//     }
+//     flags |= EXT4_DAX_FL;
+//     return ioctl(fd, FS_IOC_SETFLAGS, &flags) == 0 ? 0 : strerror(errno);
+// }
+import "C"
+
+import (
+	"fmt"
+	"os"
+)
+
+// SetExt4DAX is the ext4 equivalent of setting FS_XFLAG_DAX with
+// ConfigureDirectory: it sets EXT4_DAX_FL, which new files and
+// sub-directories inherit. ext4 has no extent size hints.
+func SetExt4DAX(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %q: %v", path, err)
+	}
+	defer file.Close()
+
+	if errnostr := C.setext4dax(C.int(file.Fd())); errnostr != nil {
+		return fmt.Errorf("set EXT4_DAX_FL for %q: %v", path, C.GoString(errnostr))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 Intel Corporation
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package xfs
+
+// #include <stdlib.h>
+// #include <sys/types.h>
+// #include <sys/quota.h>
+// #include <linux/dqblk_xfs.h>
+// #include <errno.h>
+// #include <string.h>
+//
+// char *setprojquota(const char *device, __u32 id, __u64 blocks) {
+//     struct fs_disk_quota quota;
+//     memset(&quota, 0, sizeof(quota));
+//     quota.d_version = FS_DQUOT_VERSION;
+//     quota.d_flags = FS_PROJ_QUOTA;
+//     quota.d_id = id;
+//     quota.d_fieldmask = FS_DQ_BSOFT | FS_DQ_BHARD;
+//     quota.d_blk_softlimit = blocks;
+//     quota.d_blk_hardlimit = blocks;
+//     return quotactl(QCMD(Q_XSETQLIM, PRJQUOTA), device, id, (caddr_t)&quota) == 0 ? 0 : strerror(errno);
+// }
+//
+// char *getprojquota(const char *device, __u32 id, struct fs_disk_quota *quota) {
+//     return quotactl(QCMD(Q_XGETQUOTA, PRJQUOTA), device, id, (caddr_t)quota) == 0 ? 0 : strerror(errno);
+// }
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// quotaBlockSize is the unit of the block limits and counters in
+// struct fs_disk_quota.
+const quotaBlockSize = 512
+
+// SetProjectQuota limits the disk space of a project to the given
+// number of bytes, rounded up to full 512 byte blocks. The device is
+// the block device of a mounted XFS filesystem. Zero removes the
+// limit.
+func SetProjectQuota(device string, projectID uint32, limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid project quota limit %d", limit)
+	}
+	blocks := (limit + quotaBlockSize - 1) / quotaBlockSize
+	cdevice := C.CString(device)
+	defer C.free(unsafe.Pointer(cdevice))
+	if errnostr := C.setprojquota(cdevice, C.__u32(projectID), C.__u64(blocks)); errnostr != nil {
+		return fmt.Errorf("Q_XSETQLIM for project %d on %q: %v", projectID, device, C.GoString(errnostr))
+	}
+	return nil
+}
+
+// GetProjectQuota returns the limit and the current usage of a
+// project in bytes. A zero limit means that there is none.
+func GetProjectQuota(device string, projectID uint32) (limit, used int64, err error) {
+	cdevice := C.CString(device)
+	defer C.free(unsafe.Pointer(cdevice))
+	var quota C.struct_fs_disk_quota
+	if errnostr := C.getprojquota(cdevice, C.__u32(projectID), &quota); errnostr != nil {
+		return 0, 0, fmt.Errorf("Q_XGETQUOTA for project %d on %q: %v", projectID, device, C.GoString(errnostr))
+	}
+	return int64(quota.d_blk_hardlimit) * quotaBlockSize, int64(quota.d_bcount) * quotaBlockSize, nil
+}
@@ -7,6 +7,12 @@ SPDX-License-Identifier: Apache-2.0
 package xfs
 
 import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -19,3 +25,133 @@ func Test_ConfigureFS(t *testing.T) {
 	}
 	t.Logf("got expected error: %v", err)
 }
+
+func Test_SetProjectQuota(t *testing.T) {
+	testcases := map[string]struct {
+		device string
+		limit  int64
+		err    string
+	}{
+		"negative-limit": {
+			device: "/dev/null",
+			limit:  -1,
+			err:    "invalid project quota limit -1",
+		},
+		"no-such-device": {
+			device: "/dev/no-such-device",
+			limit:  1024 * 1024,
+			err:    `Q_XSETQLIM for project 1 on "/dev/no-such-device": `,
+		},
+		"directory": {
+			// Not a block device with an XFS filesystem.
+			device: t.TempDir(),
+			limit:  1024 * 1024,
+			err:    "Q_XSETQLIM for project 1 on ",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := SetProjectQuota(tc.device, 1, tc.limit)
+			if err == nil {
+				t.Fatal("did not get expected error")
+			}
+			if !strings.HasPrefix(err.Error(), tc.err) {
+				t.Fatalf("expected error starting with %q, got: %v", tc.err, err)
+			}
+			t.Logf("got expected error: %v", err)
+		})
+	}
+
+	t.Run("xfs", func(t *testing.T) {
+		device, mountPoint := mountXFS(t)
+		dir := filepath.Join(mountPoint, "project")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		const projectID = 42
+		if err := SetProjectID(dir, projectID); err != nil {
+			t.Fatalf("SetProjectID: %v", err)
+		}
+		if id, err := GetProjectID(dir); err != nil || id != projectID {
+			t.Fatalf("GetProjectID: expected %d, got %d, %v", projectID, id, err)
+		}
+
+		// Limits get rounded up to full blocks.
+		const limit = 1024*1024 + 1
+		if err := SetProjectQuota(device, projectID, limit); err != nil {
+			t.Fatalf("SetProjectQuota: %v", err)
+		}
+		actual, _, err := GetProjectQuota(device, projectID)
+		if err != nil {
+			t.Fatalf("GetProjectQuota: %v", err)
+		}
+		if expected := int64(1024*1024 + quotaBlockSize); actual != expected {
+			t.Fatalf("expected limit %d, got %d", expected, actual)
+		}
+
+		// Files inside the directory are accounted for and
+		// cannot grow beyond the limit.
+		file := filepath.Join(dir, "file")
+		if err := os.WriteFile(file, make([]byte, 512*1024), 0644); err != nil {
+			t.Fatalf("write file within limit: %v", err)
+		}
+		syscall.Sync()
+		if _, used, err := GetProjectQuota(device, projectID); err != nil || used < 512*1024 {
+			t.Fatalf("GetProjectQuota: expected at least %d bytes used, got %d, %v", 512*1024, used, err)
+		}
+		err = os.WriteFile(file, make([]byte, 2*1024*1024), 0644)
+		if !errors.Is(err, syscall.EDQUOT) {
+			t.Fatalf("write file beyond limit: expected EDQUOT, got %v", err)
+		}
+
+		// Zero removes the limit.
+		if err := SetProjectQuota(device, projectID, 0); err != nil {
+			t.Fatalf("SetProjectQuota: %v", err)
+		}
+		if actual, _, err := GetProjectQuota(device, projectID); err != nil || actual != 0 {
+			t.Fatalf("GetProjectQuota: expected no limit, got %d, %v", actual, err)
+		}
+		if err := os.WriteFile(file, make([]byte, 2*1024*1024), 0644); err != nil {
+			t.Fatalf("write file without limit: %v", err)
+		}
+	})
+}
+
+// mountXFS creates an XFS filesystem in a loop device and mounts it
+// with project quotas enabled. It needs root privileges and
+// mkfs.xfs.
+func mountXFS(t *testing.T) (device, mountPoint string) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root privileges")
+	}
+	if _, err := exec.LookPath("mkfs.xfs"); err != nil {
+		t.Skipf("mkfs.xfs not found: %v", err)
+	}
+	tmp := t.TempDir()
+	image := filepath.Join(tmp, "xfs.img")
+	// Recent mkfs.xfs refuses to create filesystems smaller than 300MiB.
+	if err := os.WriteFile(image, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 300*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	run := func(cmd string, args ...string) string {
+		out, err := exec.Command(cmd, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("mkfs.xfs", "-q", image)
+	device = run("losetup", "--find", "--show", image)
+	t.Cleanup(func() { run("losetup", "--detach", device) })
+	mountPoint = filepath.Join(tmp, "mnt")
+	if err := os.Mkdir(mountPoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+	run("mount", "-o", "prjquota", device, mountPoint)
+	t.Cleanup(func() { run("umount", mountPoint) })
+	return device, mountPoint
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2022 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// pmem-imagefile creates image files for Kata Containers or QEMU
+// nvdimm devices offline, either with a new filesystem or with a
+// copy of an existing filesystem image. It can also inspect and
+// verify existing image files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/pmem-csi/pkg/imagefile"
+)
+
+func main() {
+	size := flag.String("size", "0", "total size of the image file, zero means as large as possible")
+	fs := flag.String("fs", string(imagefile.Ext4), "filesystem inside the image file: ext4, ext2, xfs or raw")
+	from := flag.String("from", "", "filesystem image which gets copied into the partition instead of creating a new filesystem, -size and -fs are ignored")
+	inspect := flag.Bool("inspect", false, "print the content of an existing image file and verify it instead of creating one")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "need exactly one file name as parameter\n")
+		os.Exit(2)
+	}
+
+	if *inspect {
+		if err := runInspect(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(flag.Arg(0), *size, imagefile.FsType(*fs), *from); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(filename, size string, fs imagefile.FsType, from string) error {
+	if from != "" {
+		return imagefile.CreateFromImage(filename, from)
+	}
+
+	switch fs {
+	case imagefile.Ext4, imagefile.Ext2, imagefile.Xfs, imagefile.Raw:
+	default:
+		return fmt.Errorf("unsupported filesystem %q", fs)
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return fmt.Errorf("size: %v", err)
+	}
+	return imagefile.Create(filename, imagefile.Bytes(quantity.Value()), fs)
+}
+
+func runInspect(filename string) error {
+	d, err := imagefile.Inspect(filename)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(d)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return d.Verify()
+}
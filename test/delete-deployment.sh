@@ -20,6 +20,7 @@ kinds="
       crd
       csidrivers
       mutatingwebhookconfigurations
+      validatingwebhookconfigurations
       pods
       rolebindings
       roles
@@ -627,6 +627,14 @@ func RemoveObjects(c *Cluster, deployment *Deployment) error {
 			}
 		}
 
+		if list, err := c.cs.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(context.Background(), filter); !failure(err) {
+			for _, object := range list.Items {
+				del(object.ObjectMeta, object, func() error {
+					return c.cs.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(context.Background(), object.Name, metav1.DeleteOptions{})
+				})
+			}
+		}
+
 		if list, err := c.cs.AppsV1().DaemonSets("").List(context.Background(), filter); !failure(err) {
 			for _, object := range list.Items {
 				del(object.ObjectMeta, object, func() error {
@@ -109,6 +109,7 @@ var _ = deploy.Describe("direct-testing", "direct-testing-metrics", "", func(d *
 									expect(ContainSubstring("pmem_amount_managed "), name)
 									expect(ContainSubstring("pmem_amount_max_volume_size "), name)
 									expect(ContainSubstring("pmem_amount_total "), name)
+									expect(ContainSubstring("pmem_volumes "), name)
 								}
 							} else {
 								Expect(data).To(ContainSubstring("csi_sidecar_operations_seconds "), name)
@@ -400,6 +400,8 @@ var _ = deploy.DescribeForSome("API", func(d *deploy.Deployment) bool {
 		It("shall allow multiple deployments", func() {
 			deployment1 := getDeployment("test-deployment-1")
 			deployment2 := getDeployment("test-deployment-2")
+			// Must not share PMEM with the first deployment.
+			deployment2.Spec.InstanceName = "second"
 
 			deployment1 = deploy.CreateDeploymentCR(f, deployment1)
 			defer deploy.DeleteDeploymentCR(f, deployment1.Name)
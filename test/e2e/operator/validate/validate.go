@@ -236,7 +236,7 @@ func DriverDeployment(ctx context.Context, c client.Client, k8sver version.Versi
 		}
 		objKey := client.ObjectKey{
 			Namespace: namespace,
-			Name:      deployment.Spec.ControllerTLSSecret,
+			Name:      deployment.ControllerTLSSecretName(),
 		}
 		if err := c.Get(ctx, objKey, secret); err != nil {
 			if !apierrs.IsNotFound(err) {
@@ -249,6 +249,21 @@ func DriverDeployment(ctx context.Context, c client.Client, k8sver version.Versi
 		}
 	}
 
+	// Generated secrets have random content. They get checked
+	// indirectly through the CA bundle of the webhooks.
+	if deployment.Spec.ControllerTLSSecret == api.ControllerTLSSecretGenerated {
+		var filtered []unstructured.Unstructured
+		for _, obj := range objects {
+			if obj.GetKind() == "Secret" &&
+				(obj.GetName() == deployment.ControllerTLSSecretName() ||
+					obj.GetName() == deployment.NodeTLSSecretGeneratedName()) {
+				continue
+			}
+			filtered = append(filtered, obj)
+		}
+		objects = filtered
+	}
+
 	expectedObjects, err := deployments.LoadAndCustomizeObjects(k8sver, deployment.Spec.DeviceMode, namespace, deployment, controllerCABundle)
 	if err != nil {
 		return fmt.Errorf("customize expected objects: %v", err)
@@ -407,6 +422,19 @@ MutatingWebhookConfiguration:
       scope: "*"
     sideEffects: Unknown
     timeoutSeconds: 10 # default timeout in v1
+ValidatingWebhookConfiguration:
+  webhooks:
+    clientConfig:
+      caBundle: ignore # Can change, in particular when generated by OpenShift.
+      service:
+        port: 443
+    admissionReviewVersions:
+    - v1beta1
+    matchPolicy: Equivalent # default policy in v1
+    rules:
+      scope: "*"
+    sideEffects: Unknown
+    timeoutSeconds: 10 # default timeout in v1
 `
 
 	err := yaml.UnmarshalStrict([]byte(defaultsYAML), &defaults)
@@ -572,7 +600,7 @@ func listAllDeployedObjects(ctx context.Context, c client.Client, deployment api
 		// Test client does not support differentiating cluster-scoped objects
 		// and the query fails when fetch those object by setting the namespace-
 		switch list.GetKind() {
-		case "CSIDriverList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList":
+		case "CSIDriverList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList", "ValidatingWebhookConfigurationList":
 			opts = &client.ListOptions{}
 		}
 		// Filtering by owner doesn't work, so we have to use brute-force and look at all
@@ -728,6 +728,48 @@ fi
 			Expect(s.Code()).Should(BeEquivalentTo(codes.NotFound), "Expected volume not found")
 		})
 
+		It("NodeStageVolume does not format read-only volumes", func() {
+			v.namePrefix = "read-only"
+
+			name, vol := v.create(22*1024*1024, nodeID)
+			defer v.remove(vol, name)
+
+			stageReadOnly := func() error {
+				_, err := v.nc.NodeStageVolume(v.ctx, &csi.NodeStageVolumeRequest{
+					VolumeId: vol.GetVolumeId(),
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+						},
+					},
+					StagingTargetPath: v.getStagingPath(),
+					VolumeContext:     vol.GetVolumeContext(),
+				})
+				return err
+			}
+			err := stageReadOnly()
+			Expect(err).ShouldNot(BeNil(), "NodeStageVolume should have failed for a volume without filesystem")
+			s, ok := status.FromError(err)
+			if !ok {
+				framework.Failf("Expected a status error, got %T: %v", err, err)
+			}
+			Expect(s.Code()).Should(BeEquivalentTo(codes.FailedPrecondition), "Expected missing filesystem error")
+
+			// Staging with a writable access mode creates the filesystem.
+			nodeID := v.publish(name, vol)
+			v.unpublish(vol, nodeID)
+
+			framework.ExpectNoError(stageReadOnly(), "stage formatted volume read-only")
+			_, err = v.nc.NodeUnstageVolume(v.ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          vol.GetVolumeId(),
+				StagingTargetPath: v.getStagingPath(),
+			})
+			framework.ExpectNoError(err, "unstage read-only volume")
+		})
+
 		It("stress test", func() {
 			// The load here consists of n workers which
 			// create and test volumes in parallel until